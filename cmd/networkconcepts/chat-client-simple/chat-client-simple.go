@@ -1,68 +1,69 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
 	"flag"
-	"fmt"
 	"net"
+	"os"
 	"strconv"
 	"time"
 
 	"github.com/vinh0604/go-network-concepts/internal/chatmodels"
+	"github.com/vinh0604/go-network-concepts/internal/chatutils"
+	"github.com/vinh0604/go-network-concepts/internal/cliconfig"
+	"github.com/vinh0604/go-network-concepts/internal/logging"
 )
 
 func main() {
 	var err error
 
-	args := flag.Args()
-	host := "localhost"
-	port := 8080
-	if len(args) > 2 {
+	cfg := cliconfig.New("CHAT_CLIENT_SIMPLE", "[host [port]]", "Joins the chat room and sends a single message. Positional host and port override -host and -port.")
+
+	var host string
+	var port int
+	var nick string
+	var msg string
+	var delay time.Duration
+	flag.StringVar(&host, "host", "localhost", "Server host")
+	flag.IntVar(&port, "port", 8080, "Server port")
+	flag.StringVar(&nick, "nick", "vinh", "Nickname to join with")
+	flag.StringVar(&msg, "message", "Hello, everyone!", "Message to send")
+	flag.DurationVar(&delay, "delay", 2*time.Second, "How long to wait after joining before sending the message")
+	logOpts := logging.RegisterFlags()
+	cfg.Parse()
+	logger := logOpts.Setup(os.Stderr)
+
+	args := cfg.Args(0, 2)
+	if len(args) > 0 {
 		host = args[0]
-		port, err = strconv.Atoi(args[1])
-		if err != nil {
-			panic(err)
-		}
 	}
-
-	sock, err := net.Dial("tcp", fmt.Sprintf("%s:%d", host, port))
-	if err != nil {
-		panic(err)
+	if len(args) > 1 {
+		port, err = cliconfig.ParsePort(args[1])
+		cfg.Validate(err)
 	}
-	defer sock.Close()
-
-	nick := "vinh"
-	payload := chatmodels.Payload{
-		MsgType: chatmodels.MsgTypeHello,
-		Nick:    &nick,
+	cfg.Validate(cliconfig.ValidateHost(host), cliconfig.ValidatePort(port))
+	if nick == "" || msg == "" {
+		cfg.Fail(errors.New("nick and message cannot be empty"))
 	}
 
-	out, err := json.Marshal(payload)
+	sock, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
 	if err != nil {
-		panic(err)
+		logging.Fatal(logger, "failed to connect", "host", host, "port", port, "error", err)
 	}
-	outLen := len(out)
-	outLenBytes := []byte{
-		byte(outLen >> 8),
-		byte(outLen & 0xFF),
-	}
-
-	sock.Write(append(outLenBytes, out...))
-	time.Sleep(2 * time.Second)
+	defer sock.Close()
+	logger = logging.WithConn(logger, sock)
+	logger.Info("connected to server")
 
-	msg := "Hello, everyone!"
-	payload = chatmodels.Payload{
-		MsgType: chatmodels.MsgTypeChat,
-		Msg:     &msg,
+	hello := chatmodels.Payload{MsgType: chatmodels.MsgTypeHello, Nick: &nick}
+	if err := chatutils.WriteMessage(sock, hello); err != nil {
+		logging.Fatal(logger, "failed to send hello message", "error", err)
 	}
-	out, err = json.Marshal(payload)
-	if err != nil {
-		panic(err)
-	}
-	outLen = len(out)
-	outLenBytes = []byte{
-		byte(outLen >> 8),
-		byte(outLen & 0xFF),
+	logger.Info("sent hello message", "nick", nick)
+	time.Sleep(delay)
+
+	chat := chatmodels.Payload{MsgType: chatmodels.MsgTypeChat, Msg: &msg}
+	if err := chatutils.WriteMessage(sock, chat); err != nil {
+		logging.Fatal(logger, "failed to send chat message", "error", err)
 	}
-	sock.Write(append(outLenBytes, out...))
+	logger.Info("sent chat message", "nick", nick)
 }
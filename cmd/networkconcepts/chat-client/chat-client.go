@@ -2,10 +2,14 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net"
+	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -14,147 +18,413 @@ import (
 	"github.com/charmbracelet/bubbles/viewport"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
+	"github.com/vinh0604/go-network-concepts/internal/chatactivity"
+	"github.com/vinh0604/go-network-concepts/internal/chatcmd"
+	"github.com/vinh0604/go-network-concepts/internal/chatcrypto"
+	"github.com/vinh0604/go-network-concepts/internal/chatfile"
+	"github.com/vinh0604/go-network-concepts/internal/chatheadless"
 	"github.com/vinh0604/go-network-concepts/internal/chatmodels"
+	"github.com/vinh0604/go-network-concepts/internal/chatrender"
+	"github.com/vinh0604/go-network-concepts/internal/chattranscript"
 	"github.com/vinh0604/go-network-concepts/internal/chatutils"
+	"github.com/vinh0604/go-network-concepts/internal/cliconfig"
+	"github.com/vinh0604/go-network-concepts/internal/logging"
 )
 
 type globalState struct {
-	nick string
-	host string
-	port int
-	sock *net.Conn
+	nick    string
+	host    string
+	port    int
+	token   string
+	sock    *net.Conn
+	program *tea.Program
+	// transcript is nil unless -transcript is given.
+	transcript     *chattranscript.Writer
+	transcriptPath string
+	downloadDir    string
+	// keys outlives reconnects so key changes are noticed.
+	identity *chatcrypto.Identity
+	keys     *chatcrypto.KeyRing
+}
+
+var commands = newCommandRegistry()
+
+func newCommandRegistry() *chatcmd.Registry {
+	registry := chatcmd.NewRegistry()
+	registry.Register(chatcmd.Spec{Name: "nick", Usage: "<nick>", Description: "Change your nickname", MinArgs: 1, MaxArgs: 1})
+	registry.Register(chatcmd.Spec{Name: "msg", Usage: "<nick> <message>", Description: "Send a direct message", MinArgs: 2, MaxArgs: 2})
+	registry.Register(chatcmd.Spec{Name: "join", Description: "Reconnect and rejoin the room", MaxArgs: 0})
+	registry.Register(chatcmd.Spec{Name: "send", Usage: "<nick|*> <path>", Description: "Offer a file to a user, or to the room with *", MinArgs: 2, MaxArgs: 2})
+	registry.Register(chatcmd.Spec{Name: "fingerprint", Usage: "[nick]", Description: "Show your key fingerprint or a user's", MaxArgs: 1})
+	registry.Register(chatcmd.Spec{Name: "trust", Usage: "<nick>", Description: "Accept a user's changed key after verifying it", MinArgs: 1, MaxArgs: 1})
+	registry.Register(chatcmd.Spec{Name: "plain", Usage: "<nick>", Description: "Send DMs held for a user whose key is gone without encryption", MinArgs: 1, MaxArgs: 1})
+	registry.Register(chatcmd.Spec{Name: "who", Description: "List users in the room", MaxArgs: 0})
+	registry.Register(chatcmd.Spec{Name: "quit", Description: "Leave the chat", MaxArgs: 0})
+	registry.Register(chatcmd.Spec{Name: "clear", Description: "Clear the message history", MaxArgs: 0})
+	registry.Register(chatcmd.Spec{Name: "search", Usage: "[text]", Description: "Find messages; repeat without text for older matches", MaxArgs: 1})
+	registry.Register(chatcmd.Spec{Name: "export", Usage: "<text|html> [path]", Description: "Write the transcript to a file", MinArgs: 1, MaxArgs: 2})
+	registry.Register(chatcmd.Spec{Name: "help", Description: "Show this help", MaxArgs: 0})
+
+	registry.Register(chatcmd.Spec{Name: "kick", Usage: "<nick> [reason]", Description: "Disconnect a user (admin)", MinArgs: 1, MaxArgs: 2, Server: true})
+	registry.Register(chatcmd.Spec{Name: "ban", Usage: "<nick|ip|cidr> [reason]", Description: "Ban a user or address (admin)", MinArgs: 1, MaxArgs: 2, Server: true})
+	registry.Register(chatcmd.Spec{Name: "unban", Usage: "<nick|ip|cidr>", Description: "Lift a ban (admin)", MinArgs: 1, MaxArgs: 1, Server: true})
+	registry.Register(chatcmd.Spec{Name: "mute", Usage: "<nick> [reason]", Description: "Silence a user (admin)", MinArgs: 1, MaxArgs: 2, Server: true})
+	registry.Register(chatcmd.Spec{Name: "unmute", Usage: "<nick>", Description: "Let a muted user talk again (admin)", MinArgs: 1, MaxArgs: 1, Server: true})
+	registry.Register(chatcmd.Spec{Name: "topic", Usage: "[topic]", Description: "Set the room topic (admin)", MaxArgs: 1, Server: true})
+	return registry
 }
 
 func main() {
-	var err error
+	cfg := cliconfig.New("CHAT_CLIENT", "[host [port]]", "Terminal client for chat-server. Positional host and port override -host and -port.")
 
-	args := flag.Args()
-	host := "localhost"
-	port := 8080
-	if len(args) > 2 {
+	var token string
+	var logFile string
+	var nick string
+	var host string
+	var port int
+	var transcriptPath string
+	var downloadDir string
+	var keyFile string
+	var headless bool
+	var headlessOpts chatheadless.Options
+	flag.StringVar(&token, "token", "", "Admin token sent with the hello message")
+	flag.StringVar(&logFile, "log-file", "", "File to write logs to; the terminal is used by the UI (discarded when empty, stderr in headless mode)")
+	flag.StringVar(&nick, "nick", "", "Nickname; prefills the prompt, required in headless mode")
+	flag.StringVar(&host, "host", "localhost", "Server host")
+	flag.IntVar(&port, "port", 8080, "Server port")
+	flag.StringVar(&transcriptPath, "transcript", "", "Append every message to this file as JSON lines (disabled when empty)")
+	flag.StringVar(&downloadDir, "download-dir", ".", "Directory where accepted files are saved")
+	flag.StringVar(&keyFile, "key-file", "", "File holding the key that encrypts DMs, created if missing (a new key every session when empty)")
+	flag.BoolVar(&headless, "headless", false, "Run without the TUI: send lines from stdin and print received messages to stdout")
+	flag.StringVar(&headlessOpts.Format, "format", chatheadless.FormatPlain, "Headless output format: plain or json (one payload per line)")
+	flag.DurationVar(&headlessOpts.Linger, "linger", time.Second, "Headless: keep printing received messages this long after stdin ends")
+	logOpts := logging.RegisterFlags()
+	cfg.Parse()
+
+	args := cfg.Args(0, 2)
+	if len(args) > 0 {
 		host = args[0]
-		port, err = strconv.Atoi(args[1])
+	}
+	if len(args) > 1 {
+		var err error
+		port, err = cliconfig.ParsePort(args[1])
+		cfg.Validate(err)
+	}
+	cfg.Validate(cliconfig.ValidateHost(host), cliconfig.ValidatePort(port))
+	if host == "" {
+		cfg.Fail(errors.New("host cannot be empty"))
+	}
+	if headless {
+		headlessOpts.Nick = nick
+		headlessOpts.Token = token
+		cfg.Validate(headlessOpts.Validate())
+	}
+
+	var logOutput io.Writer = io.Discard
+	if headless {
+		logOutput = os.Stderr
+	}
+	if logFile != "" {
+		f, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
 		if err != nil {
-			panic(err)
+			fmt.Fprintln(os.Stderr, "Error opening log file:", err)
+			os.Exit(1)
 		}
+		defer f.Close()
+		logOutput = f
 	}
+	logger := logOpts.Setup(logOutput)
 
-	state := globalState{
-		nick: "",
-		host: host,
-		port: port,
+	if headless {
+		runHeadless(logger, host, port, headlessOpts)
+		return
 	}
-	p := tea.NewProgram(initNickInputModel(&state))
-
-	go func() {
-		for {
-			if state.sock == nil {
-				time.Sleep(100 * time.Millisecond)
-				continue
-			}
 
-			readBuf := chatutils.ReadBuffer{}
-			for {
-				payload, err := chatutils.ReadNextMessage(*state.sock, &readBuf)
-				if err != nil {
-					p.Send(errMsg{err: fmt.Errorf("error reading message from server: %s", err.Error())})
-					break
-				}
-
-				switch payload.MsgType {
-				case chatmodels.MsgTypeChat:
-					p.Send(recvMsg{msg: fmt.Sprint(*payload.Nick, ": ", *payload.Msg), isSys: false})
-				case chatmodels.MsgTypeJoin:
-					p.Send(recvMsg{msg: fmt.Sprint("[", *payload.Nick, " joined the chat]"), isSys: true})
-				default:
-					p.Send(errMsg{err: fmt.Errorf("unknown message type: %s", payload.MsgType)})
-				}
-			}
+	state := globalState{
+		nick:           nick,
+		host:           host,
+		port:           port,
+		token:          token,
+		transcriptPath: transcriptPath,
+		downloadDir:    downloadDir,
+		keys:           chatcrypto.NewKeyRing(),
+	}
+	var err error
+	if keyFile != "" {
+		state.identity, err = chatcrypto.LoadOrCreateIdentity(keyFile)
+	} else {
+		state.identity, err = chatcrypto.NewIdentity()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error loading key:", err)
+		os.Exit(1)
+	}
+	if transcriptPath != "" {
+		transcript, err := chattranscript.Create(transcriptPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error opening transcript:", err)
+			os.Exit(1)
 		}
-	}()
+		defer transcript.Close()
+		state.transcript = transcript
+	}
+	p := tea.NewProgram(initNickInputModel(&state), tea.WithAltScreen())
+	state.program = p
 
 	if _, err := p.Run(); err != nil {
-		log.Fatal(err)
+		fmt.Fprintln(os.Stderr, "Error running program:", err)
+		logging.Fatal(logger, "program exited with an error", "error", err)
 	}
 }
 
-func initNickInputModel(state *globalState) tea.Model {
-	return nickInputModel{
-		state: state,
-		nick:  "",
+func runHeadless(logger *slog.Logger, host string, port int, opts chatheadless.Options) {
+	sock, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		logging.Fatal(logger, "failed to connect to server", "host", host, "port", port, "error", err)
+	}
+	defer sock.Close()
+	logging.WithConn(logger, sock).Info("connected to server", "nick", opts.Nick)
+
+	opts.Commands = newCommandRegistry()
+	opts.Errors = os.Stderr
+	if err := chatheadless.Run(sock, opts, os.Stdin, os.Stdout); err != nil {
+		logging.Fatal(logger, "headless session failed", "error", err)
 	}
 }
 
-func initialChatViewModel(state *globalState) chatViewModel {
-	var err error
-	sock, err := net.Dial("tcp", fmt.Sprintf("%s:%d", state.host, state.port))
+// connect dials the server, says hello and asks for the who-list.
+func connect(state *globalState) error {
+	sock, err := net.Dial("tcp", net.JoinHostPort(state.host, strconv.Itoa(state.port)))
 	if err != nil {
-		panic(fmt.Sprint("Error connecting to server: ", err))
+		slog.Error("failed to connect to server", "host", state.host, "port", state.port, "error", err)
+		return fmt.Errorf("error connecting to server: %s", err)
 	}
-	state.sock = &sock
+	logging.WithConn(slog.Default(), sock).Info("connected to server", "nick", state.nick)
 
 	helloPayload := chatmodels.Payload{
-		MsgType: chatmodels.MsgTypeHello,
-		Nick:    &state.nick,
+		MsgType:   chatmodels.MsgTypeHello,
+		Nick:      &state.nick,
+		PublicKey: state.identity.PublicKey(),
+	}
+	if state.token != "" {
+		helloPayload.Token = &state.token
 	}
 	err = sendChat(&sock, helloPayload)
+	if err == nil {
+		err = sendChat(&sock, chatmodels.Payload{MsgType: chatmodels.MsgTypeWho})
+	}
 	if err != nil {
-		panic(fmt.Sprint("Error sending hello message to server: ", err))
+		sock.Close()
+		slog.Error("failed to send hello message", "error", err)
+		return fmt.Errorf("error sending hello message to server: %s", err)
+	}
+	state.sock = &sock
+
+	go readMessages(state.program, sock)
+	return nil
+}
+
+func readMessages(p *tea.Program, sock net.Conn) {
+	readBuf := chatutils.ReadBuffer{}
+	for {
+		payload, err := chatutils.ReadNextMessage(sock, &readBuf)
+		if err != nil {
+			slog.Error("failed to read message from server", "error", err)
+			p.Send(disconnectedMsg{err: err})
+			return
+		}
+		slog.Debug("received payload", "msg_type", payload.MsgType)
+		p.Send(payloadMsg{payload: payload})
+	}
+}
+
+func initNickInputModel(state *globalState) tea.Model {
+	return nickInputModel{
+		state: state,
+		nick:  state.nick,
+	}
+}
+
+func initialChatViewModel(state *globalState, width int, height int) (chatViewModel, error) {
+	if err := connect(state); err != nil {
+		return chatViewModel{}, err
 	}
 
 	ta := textarea.New()
-	ta.Placeholder = "Send a message..."
+	ta.Placeholder = "Send a message or /help..."
 	ta.Focus()
 
 	ta.Prompt = "| "
 	ta.CharLimit = 280
 
-	ta.SetWidth(30)
-	ta.SetHeight(3)
+	ta.SetHeight(textareaHeight)
 
 	ta.FocusedStyle.CursorLine = lipgloss.NewStyle()
 	ta.ShowLineNumbers = false
 
-	vp := viewport.New(30, 5)
-	vp.SetContent(`Welcome to the chat room!
-Type a message and press Enter to send.`)
+	vp := viewport.New(0, 0)
 
 	ta.KeyMap.InsertNewline.SetEnabled(false)
 
-	return chatViewModel{
+	m := chatViewModel{
 		state:         state,
 		textarea:      ta,
-		messages:      []string{},
+		messages:      []chatLine{},
 		viewport:      vp,
-		senderStyle:   lipgloss.NewStyle().Foreground(lipgloss.Color("5")),
-		receiverStyle: lipgloss.NewStyle().Foreground(lipgloss.Color("3")),
+		nicks:         map[string]bool{state.nick: true},
+		outgoing:      map[string]*chatfile.Outgoing{},
+		incoming:      map[string]*chatfile.Incoming{},
+		pendingDMs:    map[string][]string{},
+		heldDMs:       map[string][]chatmodels.Payload{},
+		receipts:      chatactivity.NewReceipts(),
+		typing:        chatactivity.NewTyping(),
+		refLines:      map[string]int{},
+		idLines:       map[string]int{},
+		connected:     true,
 		announceStyle: lipgloss.NewStyle().Foreground(lipgloss.Color("9")),
+		dmStyle:       lipgloss.NewStyle().Foreground(lipgloss.Color("6")),
+		hintStyle:     lipgloss.NewStyle().Foreground(lipgloss.Color("8")),
+		helpStyle:     lipgloss.NewStyle().Border(lipgloss.RoundedBorder()).Padding(0, 1),
+		sidebarStyle:  lipgloss.NewStyle().Border(lipgloss.NormalBorder(), false, false, false, true).PaddingLeft(1),
+		statusStyle:   lipgloss.NewStyle().Reverse(true),
 		err:           nil,
 	}
+	m.resize(width, height)
+	m.appendMessage(m.hintStyle.Render("Welcome to the chat room!"))
+	m.appendMessage(m.hintStyle.Render("Type a message and press Enter to send."))
+	m.appendMessage(m.hintStyle.Render("Your key fingerprint: " + state.identity.Fingerprint()))
+	return m, nil
 }
 
+const (
+	textareaHeight = 3
+	sidebarWidth   = 20
+	// Below this width the sidebar is hidden to leave room for messages.
+	minWidthForSidebar = 60
+	pingInterval       = 5 * time.Second
+)
+
 type errMsg struct {
 	err error
 }
 
-type recvMsg struct {
-	msg   string
-	isSys bool
+type payloadMsg struct {
+	payload *chatmodels.Payload
+}
+
+type disconnectedMsg struct {
+	err error
+}
+
+type pingTickMsg struct{}
+
+type typingExpiredMsg struct{}
+
+// chatLine keeps the head apart from the body so lines can be re-wrapped
+// with a hanging indent.
+type chatLine struct {
+	at     time.Time
+	head   string
+	body   string
+	id     string
+	direct bool
+	status string
+}
+
+var (
+	// spanStyles is in priority order: where styles overlap, the earlier
+	// one decides the colours.
+	spanStyles = []struct {
+		flag  chatrender.Style
+		style lipgloss.Style
+	}{
+		{chatrender.Mention, lipgloss.NewStyle().Bold(true).Foreground(lipgloss.Color("0")).Background(lipgloss.Color("11"))},
+		{chatrender.URL, lipgloss.NewStyle().Foreground(lipgloss.Color("12")).Underline(true)},
+		{chatrender.Code, lipgloss.NewStyle().Foreground(lipgloss.Color("7")).Background(lipgloss.Color("236"))},
+		{chatrender.Bold, lipgloss.NewStyle().Bold(true)},
+		{chatrender.Italic, lipgloss.NewStyle().Italic(true)},
+	}
+	mentionMarkerStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("11")).Bold(true)
+	searchMarkerStyle  = lipgloss.NewStyle().Foreground(lipgloss.Color("0")).Background(lipgloss.Color("14"))
+)
+
+func renderText(text string, nick string) string {
+	var sb strings.Builder
+	for _, span := range chatrender.Parse(text, nick) {
+		style := lipgloss.NewStyle()
+		for _, spanStyle := range spanStyles {
+			if span.Style&spanStyle.flag != 0 {
+				style = style.Inherit(spanStyle.style)
+			}
+		}
+		sb.WriteString(style.Render(span.Text))
+	}
+	return sb.String()
+}
+
+func nickStyle(nick string) lipgloss.Style {
+	return lipgloss.NewStyle().Foreground(chatrender.NickColor(nick)).Bold(true)
+}
+
+// bell writes straight to the terminal since a bell is not part of any view.
+func bell() tea.Msg {
+	fmt.Fprint(os.Stdout, "\a")
+	return nil
+}
+
+func pingTick() tea.Cmd {
+	return tea.Tick(pingInterval, func(time.Time) tea.Msg {
+		return pingTickMsg{}
+	})
 }
 
 type chatViewModel struct {
 	state         *globalState
 	viewport      viewport.Model
-	messages      []string
+	messages      []chatLine
 	textarea      textarea.Model
-	senderStyle   lipgloss.Style
-	receiverStyle lipgloss.Style
+	nicks         map[string]bool
+	connected     bool
+	showHelp      bool
+	showWho       bool
+	hint          string
+	width         int
+	height        int
+	latency       time.Duration
+	entries       []chattranscript.Entry
+	entryLines    []int
+	lineOffsets   []int
+	searchQuery   string
+	searchMatches []int
+	searchPos     int
+	outgoing      map[string]*chatfile.Outgoing
+	incoming      map[string]*chatfile.Incoming
+	// offers waits for the user to accept or reject, oldest first.
+	offers []*chatfile.Incoming
+	// pendingDMs waits for recipients' keys, heldDMs for keys to be
+	// trusted; both are keyed by lower-case nick.
+	pendingDMs map[string][]string
+	heldDMs    map[string][]chatmodels.Payload
+	receipts   *chatactivity.Receipts
+	typing     *chatactivity.Typing
+	lastTyping time.Time
+	lastRef    int
+	// refLines and idLines find our own messages when receipts arrive.
+	refLines map[string]int
+	idLines  map[string]int
+	// unread holds the IDs awaiting a read receipt.
+	unread        []string
 	announceStyle lipgloss.Style
+	dmStyle       lipgloss.Style
+	hintStyle     lipgloss.Style
+	helpStyle     lipgloss.Style
+	sidebarStyle  lipgloss.Style
+	statusStyle   lipgloss.Style
 	err           error
 }
 
 func (m chatViewModel) Init() tea.Cmd {
-	return textarea.Blink
+	return tea.Batch(textarea.Blink, m.ping())
 }
 
 func (m chatViewModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
@@ -163,46 +433,92 @@ func (m chatViewModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		vpCmd tea.Cmd
 	)
 
+	if _, ok := msg.(tea.KeyMsg); ok && m.showHelp {
+		m.showHelp = false
+		return m, nil
+	}
+
+	if msg, ok := msg.(tea.KeyMsg); ok && len(m.offers) > 0 && msg.Type != tea.KeyCtrlC {
+		switch {
+		case msg.Type == tea.KeyRunes && strings.EqualFold(string(msg.Runes), "y"):
+			m.answerOffer(true)
+		case msg.Type == tea.KeyEsc || msg.Type == tea.KeyRunes && strings.EqualFold(string(msg.Runes), "n"):
+			m.answerOffer(false)
+		}
+		return m, nil
+	}
+
 	m.textarea, tiCmd = m.textarea.Update(msg)
 	m.viewport, vpCmd = m.viewport.Update(msg)
 
 	switch msg := msg.(type) {
 	case tea.KeyMsg:
+		m.markRead()
+		if msg.Type == tea.KeyRunes || msg.Type == tea.KeySpace {
+			m.sendTyping()
+		}
 		switch msg.Type {
 		case tea.KeyCtrlC, tea.KeyEsc:
 			if m.state != nil && m.state.sock != nil {
 				(*m.state.sock).Close()
 			}
 			return m, tea.Quit
+		case tea.KeyTab:
+			completed, candidates := commands.Complete(m.textarea.Value(), m.onlineNicks())
+			m.textarea.SetValue(completed)
+			m.textarea.CursorEnd()
+			m.hint = ""
+			if len(candidates) > 1 {
+				m.hint = strings.Join(candidates, "  ")
+			}
+			return m, nil
 		case tea.KeyEnter:
 			if m.textarea.Value() == "" {
 				return m, nil
 			}
 
+			m.hint = ""
 			msg := m.textarea.Value()
+			if chatcmd.IsCommand(msg) {
+				invocation, err := commands.Parse(msg)
+				if err != nil {
+					m.err = err
+					return m, nil
+				}
+				m.err = nil
+				m.textarea.Reset()
+				return m.runCommand(invocation, msg)
+			}
+
 			chatPayload := chatmodels.Payload{
 				MsgType: chatmodels.MsgTypeChat,
 				Msg:     &msg,
+				Ref:     m.nextRef(),
 			}
-			err := sendChat(m.state.sock, chatPayload)
-			if err != nil {
-				m.err = fmt.Errorf("error sending chat message: %s", err.Error())
+			if err := m.send(chatPayload); err != nil {
+				m.err = err
 				return m, nil
 			}
+			m.err = nil
 
-			m.messages = append(m.messages, m.senderStyle.Render(fmt.Sprint(m.state.nick, ": ", m.textarea.Value())))
-			m.viewport.SetContent(strings.Join(m.messages, "\n"))
+			chatPayload.Nick = &m.state.nick
+			m.record(chattranscript.Sent, chatPayload, len(m.messages))
+			m.appendChat(nickStyle(m.state.nick).Render(m.state.nick)+": ", msg)
+			m.refLines[chatPayload.Ref] = len(m.messages) - 1
 			m.textarea.Reset()
-			m.viewport.GotoBottom()
 		}
-	case recvMsg:
-		if msg.isSys {
-			m.messages = append(m.messages, m.announceStyle.Render(msg.msg))
-		} else {
-			m.messages = append(m.messages, m.receiverStyle.Render(msg.msg))
-		}
-		m.viewport.SetContent(strings.Join(m.messages, "\n"))
-		m.viewport.GotoBottom()
+	case tea.WindowSizeMsg:
+		m.resize(msg.Width, msg.Height)
+		return m, nil
+	case pingTickMsg:
+		return m, m.ping()
+	case typingExpiredMsg:
+		return m, nil
+	case payloadMsg:
+		return m, m.handlePayload(msg.payload)
+	case disconnectedMsg:
+		m.connected = false
+		m.appendMessage(m.announceStyle.Render(fmt.Sprintf("[Disconnected: %s. Type /join to reconnect]", msg.err)))
 		return m, nil
 	case errMsg:
 		m.err = msg.err
@@ -212,14 +528,749 @@ func (m chatViewModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	return m, tea.Batch(tiCmd, vpCmd)
 }
 
+func (m chatViewModel) runCommand(invocation *chatcmd.Invocation, line string) (tea.Model, tea.Cmd) {
+	if invocation.Spec.Server {
+		if err := m.send(chatmodels.Payload{MsgType: chatmodels.MsgTypeCommand, Msg: &line}); err != nil {
+			m.err = err
+			return m, nil
+		}
+		m.appendMessage(m.announceStyle.Render(line))
+		return m, nil
+	}
+
+	var err error
+	switch invocation.Spec.Name {
+	case "quit":
+		if m.state.sock != nil {
+			(*m.state.sock).Close()
+		}
+		return m, tea.Quit
+	case "help":
+		m.showHelp = true
+	case "clear":
+		m.messages = []chatLine{}
+		clear(m.refLines)
+		clear(m.idLines)
+		for i := range m.entryLines {
+			m.entryLines[i] = -1
+		}
+		m.searchMatches = nil
+		m.renderMessages()
+	case "search":
+		err = m.search(invocation.Args)
+	case "export":
+		err = m.export(invocation.Args)
+	case "join":
+		if m.connected {
+			err = fmt.Errorf("already in the room")
+		} else if err = connect(m.state); err == nil {
+			m.connected = true
+			m.appendMessage(m.announceStyle.Render("[Rejoined the chat]"))
+		}
+	case "nick":
+		err = m.send(chatmodels.Payload{MsgType: chatmodels.MsgTypeNick, Nick: &invocation.Args[0]})
+	case "msg":
+		err = m.sendDM(invocation.Args[0], invocation.Args[1])
+	case "fingerprint":
+		if len(invocation.Args) == 0 {
+			m.appendMessage(m.hintStyle.Render("[Your key fingerprint: " + m.state.identity.Fingerprint() + "]"))
+		} else if key, ok := m.state.keys.Get(invocation.Args[0]); ok {
+			m.appendMessage(m.hintStyle.Render(fmt.Sprintf("[%s's key fingerprint: %s]", invocation.Args[0], chatcrypto.Fingerprint(key))))
+		} else {
+			err = fmt.Errorf("no key known for %s yet, send them a DM first", invocation.Args[0])
+		}
+	case "trust":
+		if !m.state.keys.Trust(invocation.Args[0]) {
+			err = fmt.Errorf("no key known for %s", invocation.Args[0])
+		} else {
+			m.appendMessage(m.hintStyle.Render(fmt.Sprintf("[Trusting %s's current key]", invocation.Args[0])))
+			m.releaseDMs(invocation.Args[0])
+			err = m.flushDMs(invocation.Args[0], false)
+		}
+	case "plain":
+		err = m.flushDMs(invocation.Args[0], true)
+	case "send":
+		err = m.sendFile(invocation.Args[0], invocation.Args[1])
+	case "who":
+		m.showWho = true
+		err = m.send(chatmodels.Payload{MsgType: chatmodels.MsgTypeWho})
+	}
+	m.err = err
+	return m, nil
+}
+
+func (m *chatViewModel) handlePayload(payload *chatmodels.Payload) tea.Cmd {
+	switch payload.MsgType {
+	case chatmodels.MsgTypePong, chatmodels.MsgTypeKey, chatmodels.MsgTypeTyping, chatmodels.MsgTypeReceipt,
+		chatmodels.MsgTypeFileChunk, chatmodels.MsgTypeFileAck:
+	default:
+		// Notices such as a new key fingerprint come before the payload.
+		before := len(m.messages)
+		defer func() {
+			line := len(m.messages) - 1
+			if line < before {
+				line = -1
+			}
+			m.record(chattranscript.Received, *payload, line)
+		}()
+	}
+
+	switch payload.MsgType {
+	case chatmodels.MsgTypeChat, chatmodels.MsgTypeDM:
+		head := nickStyle(*payload.Nick).Render(*payload.Nick) + ": "
+		if payload.MsgType == chatmodels.MsgTypeDM {
+			label := "[DM from "
+			if payload.Ciphertext != nil {
+				if !m.decryptDM(payload) {
+					return nil
+				}
+				label = "[secure DM from "
+			}
+			head = m.dmStyle.Render(label) + nickStyle(*payload.Nick).Render(*payload.Nick) + m.dmStyle.Render("] ")
+		}
+		mentioned := chatrender.Mentions(*payload.Msg, m.state.nick)
+		if mentioned {
+			head = mentionMarkerStyle.Render("» ") + head
+		}
+		m.appendChat(head, *payload.Msg)
+		m.typing.Stop(*payload.Nick)
+		if payload.Time != nil {
+			m.messages[len(m.messages)-1].at = *payload.Time
+		}
+		if payload.ID != "" {
+			m.acknowledge(payload.ID)
+		}
+		if mentioned {
+			return bell
+		}
+	case chatmodels.MsgTypeTyping:
+		if payload.Nick == nil || *payload.Nick == m.state.nick {
+			return nil
+		}
+		m.typing.Saw(*payload.Nick, time.Now())
+		return tea.Tick(chatactivity.TypingTimeout, func(time.Time) tea.Msg {
+			return typingExpiredMsg{}
+		})
+	case chatmodels.MsgTypeReceipt:
+		m.handleReceipt(payload)
+	case chatmodels.MsgTypeJoin:
+		m.nicks[*payload.Nick] = true
+		m.appendMessage(m.announceStyle.Render(fmt.Sprint("[", *payload.Nick, " joined the chat]")))
+	case chatmodels.MsgTypeLeave:
+		delete(m.nicks, *payload.Nick)
+		m.state.keys.Forget(*payload.Nick)
+		m.appendMessage(m.announceStyle.Render(fmt.Sprint("[", *payload.Nick, " left the chat]")))
+	case chatmodels.MsgTypeNick:
+		delete(m.nicks, *payload.Msg)
+		if m.state.keys.Rename(*payload.Msg, *payload.Nick) {
+			m.appendMessage(m.announceStyle.Render(fmt.Sprintf("[WARNING: %s now uses a different key than %s had before. Verify it, then /trust %s]", *payload.Msg, *payload.Nick, *payload.Nick)))
+		}
+		m.nicks[*payload.Nick] = true
+		if *payload.Msg == m.state.nick {
+			m.state.nick = *payload.Nick
+			m.appendMessage(m.announceStyle.Render(fmt.Sprint("[You are now known as ", *payload.Nick, "]")))
+		} else {
+			m.appendMessage(m.announceStyle.Render(fmt.Sprint("[", *payload.Msg, " is now known as ", *payload.Nick, "]")))
+		}
+	case chatmodels.MsgTypeWho:
+		clear(m.nicks)
+		for _, nick := range payload.Nicks {
+			m.nicks[nick] = true
+		}
+		if m.showWho {
+			m.showWho = false
+			m.appendMessage(m.announceStyle.Render(fmt.Sprintf("[Online (%d): %s]", len(payload.Nicks), strings.Join(payload.Nicks, ", "))))
+		}
+	case chatmodels.MsgTypePong:
+		if payload.Msg == nil {
+			return nil
+		}
+		sentAt, err := strconv.ParseInt(*payload.Msg, 10, 64)
+		if err == nil {
+			m.latency = time.Since(time.Unix(0, sentAt))
+		}
+	case chatmodels.MsgTypeAnn:
+		m.appendMessage(m.announceStyle.Render(*payload.Msg))
+	case chatmodels.MsgTypeTopic:
+		m.appendMessage(m.announceStyle.Render(fmt.Sprint("[Topic set by ", *payload.Nick, ": ", *payload.Msg, "]")))
+	case chatmodels.MsgTypeKey:
+		if payload.Nick == nil {
+			return nil
+		}
+		if payload.PublicKey != nil {
+			m.observeKey(*payload.Nick, payload.PublicKey)
+		}
+		if err := m.flushDMs(*payload.Nick, false); err != nil {
+			m.err = err
+		}
+	case chatmodels.MsgTypeFileOffer, chatmodels.MsgTypeFileAnswer, chatmodels.MsgTypeFileChunk, chatmodels.MsgTypeFileAck:
+		return m.handleFile(payload)
+	default:
+		slog.Warn("unknown message type", "msg_type", payload.MsgType)
+		m.err = fmt.Errorf("unknown message type: %s", payload.MsgType)
+	}
+	return nil
+}
+
+func (m *chatViewModel) send(payload chatmodels.Payload) error {
+	if !m.connected {
+		return fmt.Errorf("not connected, type /join to reconnect")
+	}
+	if err := sendChat(m.state.sock, payload); err != nil {
+		return fmt.Errorf("error sending %s message: %s", payload.MsgType, err.Error())
+	}
+	return nil
+}
+
+// record adds a payload to the transcript. line is the index of the message
+// line showing it, or -1.
+func (m *chatViewModel) record(direction string, payload chatmodels.Payload, line int) {
+	entry := chattranscript.Entry{Time: time.Now(), Direction: direction, Payload: payload}
+	m.entries = append(m.entries, entry)
+	m.entryLines = append(m.entryLines, line)
+	if m.state.transcript != nil {
+		if err := m.state.transcript.Write(entry); err != nil {
+			slog.Error("failed to write transcript", "path", m.state.transcriptPath, "error", err)
+		}
+	}
+}
+
+// search scrolls to the next older match, starting over when given text.
+func (m *chatViewModel) search(args []string) error {
+	if len(args) > 0 {
+		m.searchQuery = args[0]
+		m.searchMatches = []int{}
+		for _, i := range chattranscript.Search(m.entries, m.searchQuery) {
+			if m.entryLines[i] >= 0 {
+				m.searchMatches = append(m.searchMatches, m.entryLines[i])
+			}
+		}
+		m.searchPos = len(m.searchMatches)
+	} else if m.searchQuery == "" {
+		return fmt.Errorf("usage: /search <text>")
+	}
+	if len(m.searchMatches) == 0 {
+		return fmt.Errorf("no messages match %q", m.searchQuery)
+	}
+
+	m.searchPos--
+	if m.searchPos < 0 {
+		m.searchPos = len(m.searchMatches) - 1
+	}
+	m.renderMessages()
+	m.viewport.SetYOffset(m.lineOffsets[m.searchMatches[m.searchPos]])
+	m.hint = fmt.Sprintf("Match %d of %d for %q, /search for the next older one", m.searchPos+1, len(m.searchMatches), m.searchQuery)
+	return nil
+}
+
+func (m *chatViewModel) export(args []string) error {
+	format := strings.ToLower(args[0])
+	if format != "text" && format != "html" {
+		return fmt.Errorf("usage: /export <text|html> [path]")
+	}
+	path := fmt.Sprintf("chat-transcript-%s.%s", time.Now().Format("20060102-150405"), map[string]string{"text": "txt", "html": "html"}[format])
+	if len(args) > 1 {
+		path = args[1]
+	}
+
+	entries := m.entries
+	if m.state.transcriptPath != "" {
+		var err error
+		if entries, err = chattranscript.Load(m.state.transcriptPath); err != nil {
+			return fmt.Errorf("error reading transcript: %s", err)
+		}
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("error creating export: %s", err)
+	}
+	defer f.Close()
+	if format == "html" {
+		title := fmt.Sprintf("Chat on %s", net.JoinHostPort(m.state.host, strconv.Itoa(m.state.port)))
+		err = chattranscript.ExportHTML(f, entries, title)
+	} else {
+		err = chattranscript.ExportText(f, entries)
+	}
+	if err != nil {
+		return fmt.Errorf("error writing export: %s", err)
+	}
+	m.appendMessage(m.hintStyle.Render(fmt.Sprintf("[Exported %d messages to %s]", len(entries), path)))
+	return nil
+}
+
+// sendDM queues a DM until the recipient's key is known.
+func (m *chatViewModel) sendDM(nick string, text string) error {
+	if _, ok := m.state.keys.Get(nick); ok {
+		pending := m.pendingDMs[strings.ToLower(nick)]
+		m.pendingDMs[strings.ToLower(nick)] = append(pending, text)
+		return m.flushDMs(nick, false)
+	}
+
+	pending, requested := m.pendingDMs[strings.ToLower(nick)]
+	m.pendingDMs[strings.ToLower(nick)] = append(pending, text)
+	if requested {
+		return nil
+	}
+	return m.send(chatmodels.Payload{MsgType: chatmodels.MsgTypeKey, Nick: &nick})
+}
+
+// flushDMs sends the DMs waiting for nick. They stay queued while a changed
+// key is untrusted, or a known key went missing and /plain wasn't given.
+func (m *chatViewModel) flushDMs(nick string, allowPlain bool) error {
+	pending := m.pendingDMs[strings.ToLower(nick)]
+	if len(pending) == 0 {
+		delete(m.pendingDMs, strings.ToLower(nick))
+		return nil
+	}
+	key, hasKey := m.state.keys.Get(nick)
+	if hasKey {
+		if !m.state.keys.Trusted(nick) {
+			m.hint = fmt.Sprintf("%d DM(s) to %s held until you /trust %s", len(pending), nick, nick)
+			return nil
+		}
+	} else if m.state.keys.Pinned(nick) && !allowPlain {
+		m.appendMessage(m.announceStyle.Render(fmt.Sprintf("[WARNING: %s had an encryption key but sent none. %d DM(s) held; /plain %s sends them unencrypted]", nick, len(pending), nick)))
+		return nil
+	} else {
+		m.appendMessage(m.announceStyle.Render(fmt.Sprintf("[%s has no encryption key, sending unencrypted]", nick)))
+	}
+	delete(m.pendingDMs, strings.ToLower(nick))
+
+	for _, text := range pending {
+		text := text
+		payload := chatmodels.Payload{MsgType: chatmodels.MsgTypeDM, Nick: &nick, Ref: m.nextRef()}
+		label := "[DM to "
+		if hasKey {
+			ciphertext, nonce, err := m.state.identity.Seal(key, text)
+			if err != nil {
+				return fmt.Errorf("error encrypting message: %s", err)
+			}
+			payload.Ciphertext, payload.Nonce = ciphertext, nonce
+			label = "[secure DM to "
+		} else {
+			payload.Msg = &text
+		}
+		if err := m.send(payload); err != nil {
+			return err
+		}
+		m.record(chattranscript.Sent, chatmodels.Payload{MsgType: chatmodels.MsgTypeDM, Nick: &nick, Msg: &text}, len(m.messages))
+		m.appendChat(m.dmStyle.Render(label)+nickStyle(nick).Render(nick)+m.dmStyle.Render("] "), text)
+		m.messages[len(m.messages)-1].direct = true
+		m.refLines[payload.Ref] = len(m.messages) - 1
+	}
+	return nil
+}
+
+func (m *chatViewModel) nextRef() string {
+	m.lastRef++
+	return strconv.Itoa(m.lastRef)
+}
+
+func (m *chatViewModel) acknowledge(id string) {
+	status := chatactivity.StatusDelivered
+	if err := m.send(chatmodels.Payload{MsgType: chatmodels.MsgTypeReceipt, ID: id, Msg: &status}); err != nil {
+		slog.Warn("failed to send receipt", "id", id, "error", err)
+	}
+	m.unread = append(m.unread, id)
+}
+
+// markRead runs on a key press, when we know the user is looking.
+func (m *chatViewModel) markRead() {
+	if !m.connected {
+		return
+	}
+	status := chatactivity.StatusRead
+	for _, id := range m.unread {
+		if err := m.send(chatmodels.Payload{MsgType: chatmodels.MsgTypeReceipt, ID: id, Msg: &status}); err != nil {
+			slog.Warn("failed to send receipt", "id", id, "error", err)
+			return
+		}
+	}
+	m.unread = nil
+}
+
+// sendTyping tells the room we are typing, at most once per interval.
+func (m *chatViewModel) sendTyping() {
+	if !m.connected || chatcmd.IsCommand(m.textarea.Value()) || time.Since(m.lastTyping) < chatactivity.TypingInterval {
+		return
+	}
+	m.lastTyping = time.Now()
+	if err := m.send(chatmodels.Payload{MsgType: chatmodels.MsgTypeTyping}); err != nil {
+		slog.Warn("failed to send typing event", "error", err)
+	}
+}
+
+func (m *chatViewModel) handleReceipt(payload *chatmodels.Payload) {
+	if payload.Msg == nil {
+		return
+	}
+	if *payload.Msg == chatactivity.StatusSent {
+		line, ok := m.refLines[payload.Ref]
+		if !ok {
+			return
+		}
+		delete(m.refLines, payload.Ref)
+		m.idLines[payload.ID] = line
+		m.messages[line].id = payload.ID
+		if payload.Time != nil {
+			m.messages[line].at = *payload.Time
+		}
+	} else if payload.Nick != nil {
+		m.receipts.Record(payload.ID, *payload.Nick, *payload.Msg)
+	}
+
+	line, ok := m.idLines[payload.ID]
+	if !ok {
+		return
+	}
+	m.messages[line].status = m.receipts.Summary(payload.ID, m.messages[line].direct)
+	m.renderMessages()
+}
+
+// decryptDM replaces the ciphertext of a received DM with its text. DMs
+// under a changed key are held until /trust.
+func (m *chatViewModel) decryptDM(payload *chatmodels.Payload) bool {
+	if payload.PublicKey == nil {
+		m.appendMessage(m.announceStyle.Render(fmt.Sprintf("[Could not decrypt a DM from %s: no key]", *payload.Nick)))
+		return false
+	}
+	m.observeKey(*payload.Nick, payload.PublicKey)
+	if !m.state.keys.Trusted(*payload.Nick) {
+		nick := strings.ToLower(*payload.Nick)
+		m.heldDMs[nick] = append(m.heldDMs[nick], *payload)
+		m.appendMessage(m.announceStyle.Render(fmt.Sprintf("[DM from %s held: their key changed. Verify it, then /trust %s to read it]", *payload.Nick, *payload.Nick)))
+		return false
+	}
+	text, err := m.state.identity.Open(payload.PublicKey, payload.Ciphertext, payload.Nonce)
+	if err != nil {
+		slog.Warn("failed to decrypt direct message", "from", *payload.Nick, "error", err)
+		m.appendMessage(m.announceStyle.Render(fmt.Sprintf("[Could not decrypt a DM from %s]", *payload.Nick)))
+		return false
+	}
+	payload.Msg = &text
+	payload.Ciphertext, payload.Nonce, payload.PublicKey = nil, nil, nil
+	return true
+}
+
+func (m *chatViewModel) releaseDMs(nick string) {
+	held := m.heldDMs[strings.ToLower(nick)]
+	delete(m.heldDMs, strings.ToLower(nick))
+	for _, payload := range held {
+		m.handlePayload(&payload)
+	}
+}
+
+// observeKey records a user's key and warns when it changed.
+func (m *chatViewModel) observeKey(nick string, key []byte) {
+	first, changed := m.state.keys.Observe(nick, key)
+	if first {
+		m.appendMessage(m.hintStyle.Render(fmt.Sprintf("[%s's key fingerprint: %s]", nick, chatcrypto.Fingerprint(key))))
+	} else if changed {
+		m.appendMessage(m.announceStyle.Render(fmt.Sprintf("[WARNING: %s's key changed, fingerprint now %s. Verify it, then /trust %s]", nick, chatcrypto.Fingerprint(key), nick)))
+	}
+}
+
+func (m *chatViewModel) sendFile(target string, path string) error {
+	out, err := chatfile.NewOutgoing(target, path)
+	if err != nil {
+		return fmt.Errorf("cannot send %s: %s", path, err)
+	}
+	if err := m.send(out.Offer()); err != nil {
+		return err
+	}
+	m.outgoing[out.ID] = out
+	m.appendMessage(m.hintStyle.Render(fmt.Sprintf("[Offered %s (%s) to %s, waiting for an answer]", out.Name, formatSize(out.Size()), target)))
+	return nil
+}
+
+func (m *chatViewModel) answerOffer(accept bool) {
+	offer := m.offers[0]
+	m.offers = m.offers[1:]
+	if err := m.send(offer.Answer(accept)); err != nil {
+		m.err = err
+		return
+	}
+	if accept {
+		m.incoming[offer.ID] = offer
+		m.appendMessage(m.hintStyle.Render(fmt.Sprintf("[Receiving %s from %s]", offer.Name, offer.From)))
+	} else {
+		m.appendMessage(m.hintStyle.Render(fmt.Sprintf("[Declined %s from %s]", offer.Name, offer.From)))
+	}
+}
+
+func (m *chatViewModel) handleFile(payload *chatmodels.Payload) tea.Cmd {
+	file := payload.File
+	if file == nil {
+		return nil
+	}
+	from := ""
+	if payload.Nick != nil {
+		from = *payload.Nick
+	}
+	status := ""
+	if payload.Msg != nil {
+		status = *payload.Msg
+	}
+
+	switch payload.MsgType {
+	case chatmodels.MsgTypeFileOffer:
+		offer, err := chatfile.NewIncoming(payload)
+		if err != nil {
+			slog.Warn("invalid file offer", "from", from, "error", err)
+			return nil
+		}
+		m.offers = append(m.offers, offer)
+		m.appendMessage(m.announceStyle.Render(fmt.Sprintf("[%s offers %s (%s)]", from, offer.Name, formatSize(offer.Size))))
+		return bell
+	case chatmodels.MsgTypeFileAnswer:
+		out, ok := m.outgoing[file.TransferID]
+		if !ok {
+			return nil
+		}
+		if status != chatfile.AnswerAccept {
+			m.appendMessage(m.hintStyle.Render(fmt.Sprintf("[%s declined %s]", from, out.Name)))
+			if out.Target != chatfile.Everyone {
+				delete(m.outgoing, out.ID)
+			}
+			return nil
+		}
+		m.appendMessage(m.hintStyle.Render(fmt.Sprintf("[%s accepted %s, sending]", from, out.Name)))
+		m.sendChunks(out)
+	case chatmodels.MsgTypeFileChunk:
+		in, ok := m.incoming[file.TransferID]
+		if !ok {
+			return nil
+		}
+		ack, err := in.Write(file)
+		if err != nil {
+			slog.Warn("invalid file chunk", "transfer_id", file.TransferID, "error", err)
+			return nil
+		}
+		if err := m.send(ack); err != nil {
+			m.err = err
+			return nil
+		}
+		if ack.Msg == nil {
+			return nil
+		}
+		delete(m.incoming, in.ID)
+		if path, err := in.Save(m.state.downloadDir); err != nil {
+			m.appendMessage(m.announceStyle.Render(fmt.Sprintf("[Could not save %s from %s: %s]", in.Name, in.From, err)))
+		} else {
+			m.appendMessage(m.hintStyle.Render(fmt.Sprintf("[Saved %s from %s to %s]", in.Name, in.From, path)))
+		}
+	case chatmodels.MsgTypeFileAck:
+		if status == chatfile.StatusCancelled {
+			m.cancelTransfer(file.TransferID)
+			return nil
+		}
+		out, ok := m.outgoing[file.TransferID]
+		if !ok {
+			return nil
+		}
+		out.Ack(file.Offset)
+		if status != "" {
+			m.appendMessage(m.hintStyle.Render(fmt.Sprintf("[%s received %s: %s]", from, out.Name, status)))
+		}
+		if out.Done() {
+			delete(m.outgoing, out.ID)
+			return nil
+		}
+		m.sendChunks(out)
+	}
+	return nil
+}
+
+// sendChunks sends as many chunks as the window allows.
+func (m *chatViewModel) sendChunks(out *chatfile.Outgoing) {
+	for _, chunk := range out.NextChunks() {
+		if err := m.send(chunk); err != nil {
+			m.err = err
+			return
+		}
+	}
+}
+
+func (m *chatViewModel) cancelTransfer(id string) {
+	name := ""
+	if out, ok := m.outgoing[id]; ok {
+		name = out.Name
+		delete(m.outgoing, id)
+	}
+	if in, ok := m.incoming[id]; ok {
+		name = in.Name
+		delete(m.incoming, id)
+	}
+	m.offers = slices.DeleteFunc(m.offers, func(offer *chatfile.Incoming) bool {
+		if offer.ID == id {
+			name = offer.Name
+			return true
+		}
+		return false
+	})
+	if name != "" {
+		m.appendMessage(m.announceStyle.Render(fmt.Sprintf("[Transfer of %s was cancelled]", name)))
+	}
+}
+
+func formatSize(size int64) string {
+	switch {
+	case size >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(size)/(1<<20))
+	case size >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(size)/(1<<10))
+	}
+	return fmt.Sprintf("%d bytes", size)
+}
+
+// ping sends a ping stamped with the time, which the pong echoes back.
+func (m *chatViewModel) ping() tea.Cmd {
+	if m.connected {
+		sentAt := strconv.FormatInt(time.Now().UnixNano(), 10)
+		if err := m.send(chatmodels.Payload{MsgType: chatmodels.MsgTypePing, Msg: &sentAt}); err != nil {
+			slog.Warn("failed to send ping", "error", err)
+		}
+	}
+	return pingTick()
+}
+
+func (m *chatViewModel) resize(width int, height int) {
+	m.width = width
+	m.height = height
+
+	messagesWidth := width
+	if m.showSidebar() {
+		messagesWidth -= sidebarWidth
+	}
+	// Leave room for the blank separator, the hint/error line and the
+	// status bar.
+	m.viewport.Width = max(messagesWidth, 1)
+	m.viewport.Height = max(height-textareaHeight-3, 1)
+	m.textarea.SetWidth(max(width, 1))
+	m.renderMessages()
+}
+
+func (m chatViewModel) showSidebar() bool {
+	return m.width >= minWidthForSidebar
+}
+
+func (m *chatViewModel) appendMessage(line string) {
+	m.messages = append(m.messages, chatLine{at: time.Now(), body: line})
+	m.renderMessages()
+}
+
+func (m *chatViewModel) appendChat(head string, text string) {
+	m.messages = append(m.messages, chatLine{at: time.Now(), head: head, body: renderText(text, m.state.nick)})
+	m.renderMessages()
+}
+
+func (m *chatViewModel) renderMessages() {
+	current := -1
+	if len(m.searchMatches) > 0 {
+		current = m.searchMatches[m.searchPos]
+	}
+
+	lines := make([]string, 0, len(m.messages))
+	m.lineOffsets = make([]int, 0, len(m.messages))
+	offset := 0
+	for i, line := range m.messages {
+		head := m.hintStyle.Render(line.at.Local().Format("15:04")) + " " + line.head
+		if i == current {
+			head = searchMarkerStyle.Render(">") + head
+		}
+		body := line.body
+		if line.status != "" {
+			body += " " + m.hintStyle.Render("("+line.status+")")
+		}
+		rendered := chatrender.Wrap(head, body, m.viewport.Width)
+		lines = append(lines, rendered)
+		m.lineOffsets = append(m.lineOffsets, offset)
+		offset += strings.Count(rendered, "\n") + 1
+	}
+	m.viewport.SetContent(strings.Join(lines, "\n"))
+	m.viewport.GotoBottom()
+}
+
+func (m chatViewModel) onlineNicks() []string {
+	nicks := make([]string, 0, len(m.nicks))
+	for nick := range m.nicks {
+		nicks = append(nicks, nick)
+	}
+	slices.Sort(nicks)
+	return nicks
+}
+
 func (m chatViewModel) View() string {
-	return fmt.Sprintf("%s\n\n%s", m.viewport.View(), m.textarea.View()) + "\n\n"
+	if m.showHelp {
+		help := append([]string{"Commands (Tab completes commands and nicks):", ""}, commands.Help()...)
+		help = append(help, "", "Press any key to close.")
+		return m.helpStyle.Render(strings.Join(help, "\n")) + "\n"
+	}
+
+	messages := m.viewport.View()
+	if m.showSidebar() {
+		messages = lipgloss.JoinHorizontal(lipgloss.Top, messages, m.sidebarView())
+	}
+
+	notice := ""
+	if m.err != nil {
+		notice = m.announceStyle.Render(dipslayError(m.err))
+	} else if m.hint != "" {
+		notice = m.hintStyle.Render(m.hint)
+	}
+	input := m.textarea.View()
+	if len(m.offers) > 0 {
+		offer := m.offers[0]
+		prompt := fmt.Sprintf("%s wants to send you %s (%s). Accept? [y/n]", offer.From, offer.Name, formatSize(offer.Size))
+		if len(m.offers) > 1 {
+			prompt += fmt.Sprintf(" (%d more waiting)", len(m.offers)-1)
+		}
+		input = m.helpStyle.Width(max(m.width-2, 1)).MaxHeight(textareaHeight).Render(prompt)
+	}
+	return strings.Join([]string{messages, notice, input, m.statusView()}, "\n")
+}
+
+func (m chatViewModel) sidebarView() string {
+	lines := []string{fmt.Sprintf("Online (%d)", len(m.nicks)), ""}
+	for _, nick := range m.onlineNicks() {
+		label := nick
+		if nick == m.state.nick {
+			label += " (you)"
+		}
+		lines = append(lines, nickStyle(nick).Render(label))
+	}
+	if len(lines) > m.viewport.Height {
+		lines = append(lines[:m.viewport.Height-1], "...")
+	}
+	return m.sidebarStyle.
+		Width(sidebarWidth - 1).
+		MaxWidth(sidebarWidth).
+		Height(m.viewport.Height).
+		Render(strings.Join(lines, "\n"))
+}
+
+func (m chatViewModel) statusView() string {
+	latency := "-"
+	if !m.connected {
+		latency = "disconnected"
+	} else if m.latency > 0 {
+		latency = m.latency.Round(time.Millisecond).String()
+	}
+	status := fmt.Sprintf(" %s | %s | latency: %s",
+		net.JoinHostPort(m.state.host, strconv.Itoa(m.state.port)), m.state.nick, latency)
+	if typing := chatactivity.Describe(m.typing.Active(time.Now())); typing != "" {
+		status += " | " + typing
+	}
+	return m.statusStyle.Width(max(m.width, 1)).MaxWidth(max(m.width, 1)).Render(status)
 }
 
 type nickInputModel struct {
-	state *globalState
-	nick  string
-	err   error
+	state  *globalState
+	nick   string
+	width  int
+	height int
+	err    error
 }
 
 func (m nickInputModel) Init() tea.Cmd {
@@ -228,6 +1279,10 @@ func (m nickInputModel) Init() tea.Cmd {
 
 func (m nickInputModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		// The chat view only exists after the first size message.
+		m.width = msg.Width
+		m.height = msg.Height
 	case tea.KeyMsg:
 		switch msg.Type {
 		case tea.KeyCtrlC, tea.KeyEsc:
@@ -237,7 +1292,12 @@ func (m nickInputModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				m.err = fmt.Errorf("nick cannot be empty")
 			} else {
 				m.state.nick = m.nick
-				return initialChatViewModel(m.state), nil
+				chatModel, err := initialChatViewModel(m.state, m.width, m.height)
+				if err != nil {
+					m.err = err
+					return m, nil
+				}
+				return chatModel, chatModel.Init()
 			}
 		case tea.KeyRunes:
 			m.nick += string(msg.Runes)
@@ -2,14 +2,33 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
+	"net/http"
+	"os"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/vinh0604/go-network-concepts/internal/chatactivity"
+	"github.com/vinh0604/go-network-concepts/internal/chatadmin"
+	"github.com/vinh0604/go-network-concepts/internal/chatcrypto"
+	"github.com/vinh0604/go-network-concepts/internal/chatfed"
+	"github.com/vinh0604/go-network-concepts/internal/chatfile"
+	"github.com/vinh0604/go-network-concepts/internal/chatmetrics"
 	"github.com/vinh0604/go-network-concepts/internal/chatmodels"
 	"github.com/vinh0604/go-network-concepts/internal/chatutils"
+	"github.com/vinh0604/go-network-concepts/internal/cliconfig"
+	"github.com/vinh0604/go-network-concepts/internal/irc"
+	"github.com/vinh0604/go-network-concepts/internal/logging"
+	"github.com/vinh0604/go-network-concepts/internal/netfunc"
+	"github.com/vinh0604/go-network-concepts/internal/websocket"
 )
 
 type clientInfo struct {
@@ -18,104 +37,1187 @@ type clientInfo struct {
 	disconnected bool
 }
 
+// roomState holds the moderation state shared by every connection handler.
+type roomState struct {
+	mu     sync.Mutex
+	topic  *chatmodels.Payload
+	admins map[net.Conn]bool
+	muted  map[string]bool
+}
+
+// keyState holds the public keys clients announced in their hello.
+type keyState struct {
+	mu     sync.Mutex
+	byConn map[net.Conn][]byte
+}
+
+func (k *keyState) get(conn net.Conn) []byte {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.byConn[conn]
+}
+
+func (k *keyState) set(conn net.Conn, key []byte) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if key == nil {
+		delete(k.byConn, conn)
+	} else {
+		k.byConn[conn] = key
+	}
+}
+
+// fileState tracks the file transfers relayed between connections.
+type fileState struct {
+	mu      sync.Mutex
+	tracker *chatfile.Tracker[net.Conn]
+}
+
+type serverMetrics struct {
+	registry        *chatmetrics.Registry
+	messagesIn      *chatmetrics.Counter
+	messagesOut     *chatmetrics.Counter
+	bytesIn         *chatmetrics.Counter
+	bytesOut        *chatmetrics.Counter
+	droppedMessages *chatmetrics.Counter
+	errors          *chatmetrics.CounterVec
+	relayLatency    *chatmetrics.Histogram
+}
+
+// handshakeTimeout bounds a gateway connection's protocol handshake.
+const handshakeTimeout = 10 * time.Second
+
+const (
+	// typingLimit is a little below chatactivity.TypingInterval so
+	// well-behaved clients are not dropped because of jitter.
+	typingLimit = 2 * time.Second
+	// messageLogSize is how many recent messages can still get receipts.
+	messageLogSize = 4096
+	// seenSize is how many relayed message IDs are remembered to break
+	// loops between linked servers.
+	seenSize = 16384
+	// linkRetry is how long to wait before redialing a lost link.
+	linkRetry = 5 * time.Second
+)
+
+var metrics = newServerMetrics()
+
+func newServerMetrics() *serverMetrics {
+	registry := chatmetrics.NewRegistry()
+	return &serverMetrics{
+		registry:        registry,
+		messagesIn:      registry.NewCounter("chat_messages_received_total", "Payloads received from clients."),
+		messagesOut:     registry.NewCounter("chat_messages_sent_total", "Payloads written to clients."),
+		bytesIn:         registry.NewCounter("chat_bytes_received_total", "Bytes read from client sockets."),
+		bytesOut:        registry.NewCounter("chat_bytes_sent_total", "Bytes written to client sockets."),
+		droppedMessages: registry.NewCounter("chat_messages_dropped_total", "Payloads that were not delivered."),
+		errors:          registry.NewCounterVec("chat_errors_total", "Errors by type.", "type"),
+		relayLatency:    registry.NewHistogram("chat_relay_duration_seconds", "Time spent relaying a payload to all recipients.", []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1}),
+	}
+}
+
+// countingConn records the bytes moving through a client socket.
+type countingConn struct {
+	net.Conn
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	metrics.bytesIn.Add(n)
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	metrics.bytesOut.Add(n)
+	return n, err
+}
+
+// NetConn lets logging reach the socket's fd, as with *tls.Conn.
+func (c *countingConn) NetConn() net.Conn {
+	return c.Conn
+}
+
 func main() {
 	var err error
 
-	args := flag.Args()
-	port := 8080
-	if len(args) > 1 {
-		port, err = strconv.Atoi(args[0])
+	cfg := cliconfig.New("CHAT_SERVER", "[port]", "Runs the chat room server. A positional port overrides -port.")
+
+	var listenHost string
+	var port int
+	var adminConfigPath string
+	var adminToken string
+	var banFilePath string
+	var adminAddr string
+	var wsAddr string
+	var ircAddr string
+	var ircChannel string
+	var serverName string
+	var linkAddr string
+	var links string
+	var linkToken string
+	flag.StringVar(&listenHost, "listen", "", "Address to bind to (all interfaces when empty)")
+	flag.IntVar(&port, "port", 8080, "Port for chat clients")
+	flag.StringVar(&adminConfigPath, "admin-config", "", "JSON file listing admin tokens")
+	flag.StringVar(&adminToken, "admin-token", "", "Token that grants the admin role")
+	flag.StringVar(&banFilePath, "ban-file", "chat-bans.json", "File where bans are persisted")
+	flag.StringVar(&adminAddr, "admin-addr", "", "Address for the metrics and /clients HTTP endpoint, e.g. :9090 (disabled when empty); /clients needs an admin token as a Bearer token, or a loopback client when no tokens are configured")
+	flag.StringVar(&wsAddr, "ws-addr", "", "Address for the WebSocket gateway, e.g. :8081 (disabled when empty)")
+	flag.StringVar(&ircAddr, "irc-addr", "", "Address for the IRC bridge, e.g. :6667 (disabled when empty)")
+	flag.StringVar(&ircChannel, "irc-channel", "#chat", "IRC channel name that maps to the chat room")
+	flag.StringVar(&serverName, "server-name", "", "Name of this server on links to other servers (host name and port when empty)")
+	flag.StringVar(&linkAddr, "link-addr", "", "Address where other servers link to this one, e.g. :9000 (disabled when empty)")
+	flag.StringVar(&links, "link", "", "Comma-separated addresses of servers to link to, e.g. lab-b:9000")
+	flag.StringVar(&linkToken, "link-token", "", "Shared secret that linked servers must present")
+	logOpts := logging.RegisterFlags()
+	cfg.Parse()
+	logger := logOpts.Setup(os.Stderr)
+
+	if args := cfg.Args(0, 1); len(args) == 1 {
+		port, err = cliconfig.ParsePort(args[0])
+		cfg.Validate(err)
+	}
+	cfg.Validate(
+		cliconfig.ValidateHost(listenHost),
+		cliconfig.ValidatePort(port),
+		cliconfig.ValidateAddr(adminAddr),
+		cliconfig.ValidateAddr(wsAddr),
+		cliconfig.ValidateAddr(ircAddr),
+		cliconfig.ValidateAddr(linkAddr),
+	)
+	linkPeers := []string{}
+	for _, peer := range strings.Split(links, ",") {
+		if peer = strings.TrimSpace(peer); peer != "" {
+			cfg.Validate(cliconfig.ValidateAddr(peer))
+			linkPeers = append(linkPeers, peer)
+		}
+	}
+	if serverName == "" {
+		hostname, _ := os.Hostname()
+		serverName = fmt.Sprintf("%s:%d", hostname, port)
+	}
+	if !strings.HasPrefix(ircChannel, "#") {
+		cfg.Fail(fmt.Errorf("invalid IRC channel %q: must start with #", ircChannel))
+	}
+
+	adminConfig := &chatadmin.Config{}
+	if adminConfigPath != "" {
+		adminConfig, err = chatadmin.LoadConfig(adminConfigPath)
 		if err != nil {
-			panic(err)
+			logging.Fatal(logger, "failed to load admin config", "path", adminConfigPath, "error", err)
 		}
 	}
+	if adminToken != "" {
+		adminConfig.AdminTokens = append(adminConfig.AdminTokens, adminToken)
+	}
+
+	banList, err := chatadmin.LoadBanList(banFilePath)
+	if err != nil {
+		logging.Fatal(logger, "failed to load ban list", "path", banFilePath, "error", err)
+	}
 
-	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	ln, err := net.Listen("tcp", net.JoinHostPort(listenHost, strconv.Itoa(port)))
 	if err != nil {
-		panic(err)
+		logging.Fatal(logger, "failed to listen", "host", listenHost, "port", port, "error", err)
 	}
 	defer ln.Close()
+	logger.Info("chat server listening", "addr", ln.Addr().String())
 
 	cm := chatutils.NewConnectionManager()
 	go cm.Run()
 
+	metrics.registry.NewGaugeFunc("chat_connected_clients", "Clients that completed the hello handshake.", func() float64 {
+		return float64(len(cm.List()))
+	})
+	if adminAddr != "" {
+		go serveAdmin(adminAddr, cm, adminConfig)
+	}
+
+	server := &chatServer{
+		cm:          cm,
+		adminConfig: adminConfig,
+		banList:     banList,
+		room: &roomState{
+			admins: make(map[net.Conn]bool),
+			muted:  make(map[string]bool),
+		},
+		files:    &fileState{tracker: chatfile.NewTracker[net.Conn]()},
+		keys:     &keyState{byConn: make(map[net.Conn][]byte)},
+		messages: chatactivity.NewLog[net.Conn](messageLogSize),
+		typing:   chatactivity.NewLimiter[net.Conn](typingLimit),
+		ids:      chatfed.NewIDs(serverName),
+		fed: &federation{
+			name:    serverName,
+			token:   linkToken,
+			seen:    chatfed.NewSeen(seenSize),
+			members: chatfed.NewMembers[net.Conn](),
+			links:   make(map[net.Conn]string),
+		},
+	}
+	if wsAddr != "" {
+		go server.listenGateway("WebSocket", wsAddr, func(conn net.Conn) (net.Conn, error) {
+			ws, err := websocket.Accept(conn)
+			if err != nil {
+				return nil, err
+			}
+			return chatutils.NewWebSocketConn(ws), nil
+		})
+	}
+	if linkAddr != "" {
+		go server.listenLinks(linkAddr)
+	}
+	for _, peer := range linkPeers {
+		go server.dialLink(peer)
+	}
+	if ircAddr != "" {
+		go server.listenGateway("IRC", ircAddr, func(conn net.Conn) (net.Conn, error) {
+			return irc.NewBridgeConn(conn, "chat-server", ircChannel), nil
+		})
+	}
+
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			panic(err)
+			logger.Error("failed to accept connection", "error", err)
+			continue
 		}
 
-		clientCh := make(chan clientInfo)
-		go handleConn(conn, clientCh)
+		if !server.admit(conn) {
+			continue
+		}
+		server.serve(&countingConn{Conn: conn})
+	}
+}
+
+type chatServer struct {
+	cm          *chatutils.ConnectionManager
+	adminConfig *chatadmin.Config
+	banList     *chatadmin.BanList
+	room        *roomState
+	files       *fileState
+	keys        *keyState
+	messages    *chatactivity.Log[net.Conn]
+	typing      *chatactivity.Limiter[net.Conn]
+	ids         *chatfed.IDs
+	fed         *federation
+}
+
+// federation links this server to others. Messages keep the Origin and ID
+// they were first given, and IDs already seen are dropped to break loops.
+type federation struct {
+	name    string
+	token   string
+	seen    *chatfed.Seen
+	members *chatfed.Members[net.Conn]
 
+	mu    sync.Mutex
+	links map[net.Conn]string
+}
+
+// admit closes connections from banned addresses before any bytes are read.
+func (s *chatServer) admit(conn net.Conn) bool {
+	if s.banList.IsIpBanned(remoteIp(conn)) {
+		logging.WithConn(slog.Default(), conn).Warn("rejected banned client")
+		conn.Close()
+		return false
+	}
+	return true
+}
+
+func (s *chatServer) serve(conn net.Conn) {
+	clientCh := make(chan clientInfo)
+	go handleConn(conn, clientCh)
+	go s.dispatch(conn, clientCh)
+}
+
+// listenGateway accepts clients that speak another protocol; wrap returns
+// a net.Conn carrying the length-prefixed chatmodels stream.
+func (s *chatServer) listenGateway(name string, addr string, wrap func(net.Conn) (net.Conn, error)) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		slog.Error("gateway failed to listen", "gateway", name, "addr", addr, "error", err)
+		return
+	}
+	defer ln.Close()
+	slog.Info("gateway listening", "gateway", name, "addr", addr)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			slog.Error("failed to accept connection", "gateway", name, "error", err)
+			continue
+		}
+
+		if !s.admit(conn) {
+			continue
+		}
 		go func() {
-			for {
-				client := <-clientCh
-				if client.disconnected {
-					disconnectedNick := cm.Remove(conn)
-					if disconnectedNick != nil {
-						fmt.Printf("Client %s (nick=%s) left.\n", (*client.conn).RemoteAddr().String(), *disconnectedNick)
-					}
+			conn.SetDeadline(time.Now().Add(handshakeTimeout))
+			gatewayConn, err := wrap(&countingConn{Conn: conn})
+			if err != nil {
+				logging.WithConn(slog.Default(), conn).Warn("gateway handshake failed", "gateway", name, "error", err)
+				metrics.errors.Inc("handshake")
+				conn.Close()
+				return
+			}
+			conn.SetDeadline(time.Time{})
+
+			logging.WithConn(slog.Default(), conn).Info("gateway client connected", "gateway", name)
+			s.serve(gatewayConn)
+		}()
+	}
+}
+
+func (s *chatServer) dispatch(conn net.Conn, clientCh chan clientInfo) {
+	connLogger := logging.WithConn(slog.Default(), conn)
+	logger := connLogger
+	for {
+		client := <-clientCh
+		if client.disconnected {
+			s.room.mu.Lock()
+			delete(s.room.admins, conn)
+			s.room.mu.Unlock()
+			s.dropTransfers(conn)
+			s.keys.set(conn, nil)
+			s.messages.Forget(conn)
+			s.typing.Forget(conn)
+			disconnectedNick := s.cm.Remove(conn)
+			if disconnectedNick != nil {
+				logger.Info("client left")
+				announceLeave(*disconnectedNick, s.cm.List())
+				s.federate(chatmodels.Payload{MsgType: chatmodels.MsgTypeLeave, Nick: disconnectedNick}, nil)
+			}
+			return
+		}
+
+		if client.chatPayload != nil {
+			if client.chatPayload.MsgType == chatmodels.MsgTypeHello {
+				if s.cm.GetNick(*client.conn) != nil {
+					logger.Warn("client sent a second hello", "requested_nick", *client.chatPayload.Nick)
+					metrics.errors.Inc("protocol")
+					sendAnnouncement(*client.conn, "You are already in the chat; use /nick to change your nick.")
+					continue
+				}
+				if s.banList.IsNickBanned(*client.chatPayload.Nick) {
+					logger.Warn("rejected banned nick", "nick", *client.chatPayload.Nick)
+					sendAnnouncement(*client.conn, "You are banned from this server.")
+					(*client.conn).Close()
+					continue
+				}
+				if taken := findNick(s.cm.List(), *client.chatPayload.Nick); len(taken) > 0 {
+					sendAnnouncement(*client.conn, fmt.Sprintf("Nick %s is already in use.", *client.chatPayload.Nick))
+					(*client.conn).Close()
+					continue
+				}
+				if member, ok := s.fed.members.Lookup(*client.chatPayload.Nick); ok {
+					sendAnnouncement(*client.conn, fmt.Sprintf("Nick %s is already in use on %s.", member.Nick, member.Origin))
+					(*client.conn).Close()
 					continue
 				}
 
-				if client.chatPayload != nil {
-					if client.chatPayload.MsgType == chatmodels.MsgTypeHello {
-						cm.Add(conn, *client.chatPayload.Nick)
-						fmt.Printf("Client %s (nick=%s) joined.\n", (*client.conn).RemoteAddr().String(), *client.chatPayload.Nick)
-						announce := chatmodels.Payload{
-							MsgType: chatmodels.MsgTypeJoin,
-							Nick:    client.chatPayload.Nick,
-						}
-						conns := cm.List()
-						go relay(*client.chatPayload.Nick, *client.conn, conns, announce)
-					} else if client.chatPayload.MsgType == chatmodels.MsgTypeChat {
-						nick := cm.GetNick(*client.conn)
-						if nick == nil {
-							fmt.Printf("Client %s not registered\n", (*client.conn).RemoteAddr().String())
-							continue
-						}
-
-						fmt.Printf("Client %s (nick=%s) sent a message.\n", (*client.conn).RemoteAddr().String(), *nick)
-						chat := chatmodels.Payload{
-							MsgType: chatmodels.MsgTypeChat,
-							Nick:    nick,
-							Msg:     client.chatPayload.Msg,
-						}
-						conns := cm.List()
-						go relay(*nick, *client.conn, conns, chat)
+				s.cm.Add(conn, *client.chatPayload.Nick)
+				logger = connLogger.With("nick", *client.chatPayload.Nick)
+				if key := client.chatPayload.PublicKey; key != nil {
+					if err := chatcrypto.ValidatePublicKey(key); err != nil {
+						logger.Warn("ignoring invalid public key", "error", err)
+						sendAnnouncement(*client.conn, "Your public key is invalid; direct messages to you will not be encrypted.")
 					} else {
-						fmt.Printf("Client %s sent an unknown message type: %s\n", (*client.conn).RemoteAddr().String(), client.chatPayload.MsgType)
+						s.keys.set(conn, key)
 					}
 				}
+				s.room.mu.Lock()
+				if client.chatPayload.Token != nil && s.adminConfig.IsAdminToken(*client.chatPayload.Token) {
+					s.room.admins[conn] = true
+					logger.Info("client authenticated as admin")
+				}
+				topic := s.room.topic
+				s.room.mu.Unlock()
+
+				logger.Info("client joined")
+				if topic != nil {
+					send(*client.conn, *topic)
+				}
+				announce := chatmodels.Payload{
+					MsgType: chatmodels.MsgTypeJoin,
+					Nick:    client.chatPayload.Nick,
+				}
+				conns := s.cm.List()
+				go relay(*client.chatPayload.Nick, *client.conn, conns, announce)
+				announce.PublicKey = s.keys.get(conn)
+				s.federate(announce, nil)
+			} else if client.chatPayload.MsgType == chatmodels.MsgTypeChat {
+				nick := s.cm.GetNick(*client.conn)
+				if nick == nil {
+					logger.Warn("client not registered", "msg_type", client.chatPayload.MsgType)
+					metrics.errors.Inc("protocol")
+					metrics.droppedMessages.Inc()
+					continue
+				}
+
+				if s.isMuted(*nick) {
+					logger.Info("dropping message from muted client")
+					metrics.droppedMessages.Inc()
+					sendAnnouncement(*client.conn, "You are muted.")
+					continue
+				}
+
+				logger.Debug("client sent a message")
+				chat := chatmodels.Payload{
+					MsgType: chatmodels.MsgTypeChat,
+					Nick:    nick,
+					Msg:     client.chatPayload.Msg,
+				}
+				conns := s.cm.List()
+				s.stamp(conn, &chat, client.chatPayload.Ref, conns)
+				go relay(*nick, *client.conn, conns, chat)
+				s.federate(chat, nil)
+			} else if client.chatPayload.MsgType == chatmodels.MsgTypeLeave {
+				s.room.mu.Lock()
+				delete(s.room.admins, conn)
+				s.room.mu.Unlock()
+				s.dropTransfers(conn)
+				s.keys.set(conn, nil)
+				s.messages.Forget(conn)
+				s.typing.Forget(conn)
+				leftNick := s.cm.Remove(conn)
+				if leftNick != nil {
+					logger.Info("client left the room")
+					announceLeave(*leftNick, s.cm.List())
+					s.federate(chatmodels.Payload{MsgType: chatmodels.MsgTypeLeave, Nick: leftNick}, nil)
+				}
+			} else if client.chatPayload.MsgType == chatmodels.MsgTypeDM {
+				nick := s.cm.GetNick(*client.conn)
+				if nick == nil {
+					logger.Warn("client not registered", "msg_type", client.chatPayload.MsgType)
+					metrics.errors.Inc("protocol")
+					metrics.droppedMessages.Inc()
+					continue
+				}
+				if s.isMuted(*nick) {
+					logger.Info("dropping message from muted client")
+					metrics.droppedMessages.Inc()
+					sendAnnouncement(*client.conn, "You are muted.")
+					continue
+				}
+
+				recipients := findNick(s.cm.List(), *client.chatPayload.Nick)
+				member, remote := s.fed.members.Lookup(*client.chatPayload.Nick)
+				if len(recipients) == 0 && !remote {
+					metrics.droppedMessages.Inc()
+					sendAnnouncement(*client.conn, fmt.Sprintf("No such nick: %s", *client.chatPayload.Nick))
+					continue
+				}
+				dm := chatmodels.Payload{
+					MsgType: chatmodels.MsgTypeDM,
+					Nick:    nick,
+					Msg:     client.chatPayload.Msg,
+				}
+				if client.chatPayload.Ciphertext != nil {
+					senderKey := s.keys.get(conn)
+					if senderKey == nil {
+						metrics.droppedMessages.Inc()
+						sendAnnouncement(*client.conn, "Encrypted messages need a public key in your hello.")
+						continue
+					}
+					dm.Msg = nil
+					dm.Ciphertext = client.chatPayload.Ciphertext
+					dm.Nonce = client.chatPayload.Nonce
+					dm.PublicKey = senderKey
+				}
+				s.stamp(conn, &dm, client.chatPayload.Ref, recipients)
+				logger.Debug("client sent a direct message", "to", *client.chatPayload.Nick, "encrypted", dm.Ciphertext != nil)
+				if len(recipients) == 0 {
+					// Only the link towards the recipient carries it.
+					dm.Origin = s.fed.name
+					dm.To = member.Nick
+					s.fed.seen.Mark(dm.ID)
+					send(member.Link, dm)
+					continue
+				}
+				go relay(*nick, *client.conn, recipients, dm)
+			} else if client.chatPayload.MsgType == chatmodels.MsgTypeTyping {
+				nick := s.cm.GetNick(*client.conn)
+				if nick == nil {
+					continue
+				}
+				if !s.typing.Allow(conn, time.Now()) {
+					metrics.droppedMessages.Inc()
+					continue
+				}
+				go relay(*nick, *client.conn, s.cm.List(), chatmodels.Payload{
+					MsgType: chatmodels.MsgTypeTyping,
+					Nick:    nick,
+				})
+			} else if client.chatPayload.MsgType == chatmodels.MsgTypeReceipt {
+				nick := s.cm.GetNick(*client.conn)
+				if nick == nil {
+					logger.Warn("client not registered", "msg_type", client.chatPayload.MsgType)
+					metrics.errors.Inc("protocol")
+					continue
+				}
+				// Only a message's recipients may send receipts for it.
+				sender, ok := s.messages.Sender(client.chatPayload.ID, conn)
+				if !ok || sender == conn {
+					metrics.droppedMessages.Inc()
+					continue
+				}
+				send(sender, chatmodels.Payload{
+					MsgType: chatmodels.MsgTypeReceipt,
+					ID:      client.chatPayload.ID,
+					Nick:    nick,
+					Msg:     client.chatPayload.Msg,
+				})
+			} else if client.chatPayload.MsgType == chatmodels.MsgTypeKey {
+				// A reply without a key lets the client fall back to a plain DM.
+				reply := chatmodels.Payload{
+					MsgType: chatmodels.MsgTypeKey,
+					Nick:    client.chatPayload.Nick,
+				}
+				if recipients := findNick(s.cm.List(), *client.chatPayload.Nick); len(recipients) > 0 {
+					reply.PublicKey = s.keys.get(recipients[0].Conn)
+				} else if member, ok := s.fed.members.Lookup(*client.chatPayload.Nick); ok {
+					reply.PublicKey = member.PublicKey
+				}
+				send(*client.conn, reply)
+			} else if client.chatPayload.MsgType == chatmodels.MsgTypeNick {
+				oldNick := s.cm.GetNick(*client.conn)
+				if oldNick == nil {
+					logger.Warn("client not registered", "msg_type", client.chatPayload.MsgType)
+					metrics.errors.Inc("protocol")
+					continue
+				}
+
+				// Mutes follow the nick, so a muted user keeps theirs.
+				if s.isMuted(*oldNick) {
+					metrics.droppedMessages.Inc()
+					sendAnnouncement(*client.conn, "You cannot change your nick while muted.")
+					continue
+				}
+				newNick := *client.chatPayload.Nick
+				if s.banList.IsNickBanned(newNick) {
+					sendAnnouncement(*client.conn, fmt.Sprintf("Nick %s is banned.", newNick))
+					continue
+				}
+				if taken := findNick(s.cm.List(), newNick); len(taken) > 0 && taken[0].Conn != conn {
+					sendAnnouncement(*client.conn, fmt.Sprintf("Nick %s is already in use.", newNick))
+					continue
+				}
+				if member, ok := s.fed.members.Lookup(newNick); ok {
+					sendAnnouncement(*client.conn, fmt.Sprintf("Nick %s is already in use on %s.", member.Nick, member.Origin))
+					continue
+				}
+
+				s.cm.Add(conn, newNick)
+				logger = connLogger.With("nick", newNick)
+				logger.Info("client changed nick", "old_nick", *oldNick)
+				rename := chatmodels.Payload{
+					MsgType: chatmodels.MsgTypeNick,
+					Nick:    &newNick,
+					Msg:     oldNick,
+				}
+				go relay(newNick, nil, s.cm.List(), rename)
+				s.federate(rename, nil)
+			} else if client.chatPayload.MsgType == chatmodels.MsgTypeWho {
+				nicks := []string{}
+				for _, connInfo := range s.cm.List() {
+					nicks = append(nicks, connInfo.Nick)
+				}
+				nicks = append(nicks, s.fed.members.Nicks()...)
+				slices.Sort(nicks)
+				send(*client.conn, chatmodels.Payload{
+					MsgType: chatmodels.MsgTypeWho,
+					Nicks:   nicks,
+				})
+			} else if client.chatPayload.MsgType == chatmodels.MsgTypePing {
+				// Answered here so the latency includes server queueing.
+				send(*client.conn, chatmodels.Payload{
+					MsgType: chatmodels.MsgTypePong,
+					Msg:     client.chatPayload.Msg,
+				})
+			} else if client.chatPayload.MsgType == chatmodels.MsgTypeCommand {
+				nick := s.cm.GetNick(*client.conn)
+				if nick == nil {
+					logger.Warn("client not registered", "msg_type", client.chatPayload.MsgType)
+					metrics.errors.Inc("protocol")
+					metrics.droppedMessages.Inc()
+					continue
+				}
+
+				s.room.mu.Lock()
+				isAdmin := s.room.admins[conn]
+				s.room.mu.Unlock()
+				if !isAdmin {
+					logger.Warn("admin command without permission")
+					metrics.errors.Inc("permission")
+					sendAnnouncement(*client.conn, "Permission denied: admin role required.")
+					continue
+				}
+
+				cmd, err := chatadmin.ParseCommand(*client.chatPayload.Msg)
+				if err != nil {
+					sendAnnouncement(*client.conn, err.Error())
+					continue
+				}
+				logger.Info("admin command", "command", cmd.Name, "target", cmd.Target)
+				s.runCommand(*nick, *client.conn, cmd)
+			} else if isFileMessage(client.chatPayload.MsgType) {
+				nick := s.cm.GetNick(*client.conn)
+				if nick == nil {
+					logger.Warn("client not registered", "msg_type", client.chatPayload.MsgType)
+					metrics.errors.Inc("protocol")
+					metrics.droppedMessages.Inc()
+					continue
+				}
+				s.relayFile(*nick, *client.conn, client.chatPayload)
+			} else {
+				logger.Warn("unknown message type", "msg_type", client.chatPayload.MsgType)
+				metrics.errors.Inc("protocol")
 			}
-		}()
+		}
 	}
 }
 
-func relay(nick string, clientConn net.Conn, clients []chatutils.ConnectionInfo, payload chatmodels.Payload) {
-	jsonStr, err := json.Marshal(payload)
+// stamp assigns a message its ID and time, logs it for receipts and sends
+// the sender a "sent" receipt.
+func (s *chatServer) stamp(conn net.Conn, payload *chatmodels.Payload, ref string, recipients []chatutils.ConnectionInfo) {
+	now := time.Now().UTC()
+	payload.ID = s.ids.Next()
+	payload.Time = &now
+	conns := []net.Conn{}
+	for _, connInfo := range recipients {
+		conns = append(conns, connInfo.Conn)
+	}
+	s.messages.Add(payload.ID, conn, conns)
+
+	status := chatactivity.StatusSent
+	send(conn, chatmodels.Payload{
+		MsgType: chatmodels.MsgTypeReceipt,
+		ID:      payload.ID,
+		Time:    &now,
+		Ref:     ref,
+		Msg:     &status,
+	})
+}
+
+// federate sends payload to every linked server except the one it came
+// from.
+func (s *chatServer) federate(payload chatmodels.Payload, from net.Conn) {
+	if payload.Origin == "" {
+		payload.Origin = s.fed.name
+	}
+	if payload.ID == "" {
+		payload.ID = s.ids.Next()
+	}
+	s.fed.seen.Mark(payload.ID)
+	payload.Ref = ""
+
+	s.fed.mu.Lock()
+	links := make([]net.Conn, 0, len(s.fed.links))
+	for link := range s.fed.links {
+		if link != from {
+			links = append(links, link)
+		}
+	}
+	s.fed.mu.Unlock()
+
+	for _, link := range links {
+		send(link, payload)
+	}
+}
+
+func (s *chatServer) listenLinks(addr string) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		slog.Error("link listener failed", "addr", addr, "error", err)
+		return
+	}
+	defer ln.Close()
+	slog.Info("accepting server links", "addr", addr, "server", s.fed.name)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			slog.Error("failed to accept link", "error", err)
+			continue
+		}
+		go s.runLink(conn)
+	}
+}
+
+// dialLink keeps a link to addr up, redialing after it drops.
+func (s *chatServer) dialLink(addr string) {
+	for {
+		conn, err := net.DialTimeout("tcp", addr, chatfed.HandshakeTimeout)
+		if err != nil {
+			slog.Warn("failed to link", "addr", addr, "error", err)
+		} else {
+			s.runLink(conn)
+		}
+		time.Sleep(linkRetry)
+	}
+}
+
+// runLink serves one server link until it drops, starting with a join for
+// every user each side knows about.
+func (s *chatServer) runLink(conn net.Conn) {
+	defer conn.Close()
+	logger := logging.WithConn(slog.Default(), conn)
+
+	readBuf := chatutils.ReadBuffer{}
+	peer, err := chatfed.Handshake(conn, &readBuf, s.fed.name, s.fed.token)
 	if err != nil {
-		fmt.Printf("Failed to relay %s message from %s: %s\n", payload.MsgType, nick, err)
+		logger.Warn("link handshake failed", "error", err)
+		metrics.errors.Inc("handshake")
+		return
+	}
+	logger = logger.With("peer", peer)
+
+	s.fed.mu.Lock()
+	for _, name := range s.fed.links {
+		if name == peer {
+			s.fed.mu.Unlock()
+			logger.Warn("already linked to server")
+			return
+		}
+	}
+	s.fed.links[conn] = peer
+	s.fed.mu.Unlock()
+	logger.Info("server linked")
+	broadcastAnnouncement(s.cm.List(), fmt.Sprintf("[Linked to %s]", peer))
+
+	for _, connInfo := range s.cm.List() {
+		nick := connInfo.Nick
+		send(conn, chatmodels.Payload{
+			MsgType:   chatmodels.MsgTypeJoin,
+			Nick:      &nick,
+			Origin:    s.fed.name,
+			ID:        s.ids.Next(),
+			PublicKey: s.keys.get(connInfo.Conn),
+		})
+	}
+	for _, nick := range s.fed.members.Nicks() {
+		member, ok := s.fed.members.Lookup(nick)
+		if !ok || member.Link == conn {
+			continue
+		}
+		send(conn, chatmodels.Payload{
+			MsgType:   chatmodels.MsgTypeJoin,
+			Nick:      &member.Nick,
+			Origin:    member.Origin,
+			ID:        s.ids.Next(),
+			PublicKey: member.PublicKey,
+		})
+	}
+
+	for {
+		payload, err := chatutils.ReadNextMessage(conn, &readBuf)
+		if err != nil {
+			logger.Warn("link lost", "error", err)
+			break
+		}
+		metrics.messagesIn.Inc()
+		s.fromLink(conn, *payload)
+	}
+
+	s.fed.mu.Lock()
+	delete(s.fed.links, conn)
+	s.fed.mu.Unlock()
+
+	lost := s.fed.members.DropLink(conn)
+	nicks := make([]string, 0, len(lost))
+	for _, member := range lost {
+		nick := member.Nick
+		nicks = append(nicks, nick)
+		announceLeave(nick, s.cm.List())
+		s.federate(chatmodels.Payload{MsgType: chatmodels.MsgTypeLeave, Nick: &nick, Origin: member.Origin}, conn)
+	}
+	broadcastAnnouncement(s.cm.List(), chatfed.SplitMessage(peer, nicks))
+}
+
+func (s *chatServer) linkName(link net.Conn) string {
+	s.fed.mu.Lock()
+	defer s.fed.mu.Unlock()
+	return s.fed.links[link]
+}
+
+func (s *chatServer) fromLink(link net.Conn, payload chatmodels.Payload) {
+	if payload.Origin == "" || payload.Origin == s.fed.name || payload.ID == "" || !s.fed.seen.Mark(payload.ID) {
 		return
 	}
+	if payload.Nick == nil || *payload.Nick == "" {
+		metrics.errors.Inc("protocol")
+		return
+	}
+	nick := *payload.Nick
 
-	payloadLen := len(jsonStr)
-	outBytes := []byte{
-		byte(payloadLen >> 8),
-		byte(payloadLen & 0xFF),
+	switch payload.MsgType {
+	case chatmodels.MsgTypeJoin:
+		if len(findNick(s.cm.List(), nick)) > 0 {
+			slog.Warn("remote nick collides with a local user", "nick", nick, "origin", payload.Origin)
+			return
+		}
+		member, known := s.fed.members.Lookup(nick)
+		if !known {
+			go relay(nick, nil, s.cm.List(), chatmodels.Payload{MsgType: chatmodels.MsgTypeJoin, Nick: &nick})
+		}
+		// With redundant links, a direct link to the user's server wins.
+		if !known || member.Link == link || s.linkName(link) == payload.Origin || s.linkName(member.Link) != member.Origin {
+			s.fed.members.Add(chatfed.Member[net.Conn]{Nick: nick, Origin: payload.Origin, Link: link, PublicKey: payload.PublicKey})
+		}
+	case chatmodels.MsgTypeLeave:
+		if _, ok := s.fed.members.Remove(nick); !ok {
+			return
+		}
+		announceLeave(nick, s.cm.List())
+	case chatmodels.MsgTypeNick:
+		if payload.Msg == nil || !s.fed.members.Rename(*payload.Msg, nick) {
+			return
+		}
+		go relay(nick, nil, s.cm.List(), chatmodels.Payload{MsgType: chatmodels.MsgTypeNick, Nick: &nick, Msg: payload.Msg})
+	case chatmodels.MsgTypeChat:
+		if payload.Msg == nil {
+			return
+		}
+		go relay(nick, nil, s.cm.List(), payload)
+	case chatmodels.MsgTypeDM:
+		if recipients := findNick(s.cm.List(), payload.To); len(recipients) > 0 {
+			dm := payload
+			dm.Origin = ""
+			dm.To = ""
+			go relay(nick, nil, recipients, dm)
+		} else if member, ok := s.fed.members.Lookup(payload.To); ok && member.Link != link {
+			send(member.Link, payload)
+		}
+		return
+	default:
+		return
 	}
-	outBytes = append(outBytes, jsonStr...)
+	s.federate(payload, link)
+}
+
+func (s *chatServer) isMuted(nick string) bool {
+	s.room.mu.Lock()
+	defer s.room.mu.Unlock()
+	return s.room.muted[strings.ToLower(nick)]
+}
+
+func (s *chatServer) runCommand(adminNick string, adminConn net.Conn, cmd *chatadmin.Command) {
+	reason := ""
+	if cmd.Args != "" {
+		reason = ": " + cmd.Args
+	}
+
+	switch cmd.Name {
+	case chatadmin.CmdKick:
+		targets := findTargets(s.cm.List(), cmd.Target)
+		if len(targets) == 0 {
+			sendAnnouncement(adminConn, fmt.Sprintf("No such nick: %s", cmd.Target))
+			return
+		}
+		disconnect(targets, fmt.Sprintf("You were kicked by %s%s", adminNick, reason))
+		broadcastAnnouncement(s.cm.List(), fmt.Sprintf("[%s was kicked by %s%s]", cmd.Target, adminNick, reason))
+	case chatadmin.CmdBan:
+		err := s.banList.Add(chatadmin.Ban{Target: cmd.Target, Reason: cmd.Args, By: adminNick, At: time.Now()})
+		if err != nil {
+			slog.Error("failed to persist ban", "target", cmd.Target, "error", err)
+			sendAnnouncement(adminConn, fmt.Sprintf("Failed to ban %s: %s", cmd.Target, err))
+			return
+		}
+		targets := slices.DeleteFunc(findTargets(s.cm.List(), cmd.Target), func(conn net.Conn) bool { return conn == adminConn })
+		disconnect(targets, fmt.Sprintf("You were banned by %s%s", adminNick, reason))
+		broadcastAnnouncement(s.cm.List(), fmt.Sprintf("[%s was banned by %s%s]", cmd.Target, adminNick, reason))
+	case chatadmin.CmdUnban:
+		removed, err := s.banList.Remove(cmd.Target)
+		if err != nil {
+			sendAnnouncement(adminConn, fmt.Sprintf("Failed to unban %s: %s", cmd.Target, err))
+		} else if !removed {
+			sendAnnouncement(adminConn, fmt.Sprintf("%s is not banned", cmd.Target))
+		} else {
+			sendAnnouncement(adminConn, fmt.Sprintf("%s was unbanned", cmd.Target))
+		}
+	case chatadmin.CmdMute, chatadmin.CmdUnmute:
+		s.room.mu.Lock()
+		if cmd.Name == chatadmin.CmdMute {
+			s.room.muted[strings.ToLower(cmd.Target)] = true
+		} else {
+			delete(s.room.muted, strings.ToLower(cmd.Target))
+		}
+		s.room.mu.Unlock()
+		broadcastAnnouncement(s.cm.List(), fmt.Sprintf("[%s was %sd by %s%s]", cmd.Target, cmd.Name, adminNick, reason))
+	case chatadmin.CmdTopic:
+		topic := chatmodels.Payload{
+			MsgType: chatmodels.MsgTypeTopic,
+			Nick:    &adminNick,
+			Msg:     &cmd.Args,
+		}
+		s.room.mu.Lock()
+		s.room.topic = &topic
+		s.room.mu.Unlock()
+		go relay(adminNick, nil, s.cm.List(), topic)
+	}
+}
+
+func isFileMessage(msgType string) bool {
+	switch msgType {
+	case chatmodels.MsgTypeFileOffer, chatmodels.MsgTypeFileAnswer, chatmodels.MsgTypeFileChunk, chatmodels.MsgTypeFileAck:
+		return true
+	}
+	return false
+}
+
+// relayFile forwards file transfer messages between the sender and the
+// recipients. Chunks are written before the sender's next payload is read,
+// so a sender cannot outrun its slowest recipient.
+func (s *chatServer) relayFile(nick string, conn net.Conn, payload *chatmodels.Payload) {
+	logger := logging.WithConn(slog.Default(), conn)
+	file := payload.File
+	if file == nil {
+		logger.Warn("file message without a file", "msg_type", payload.MsgType)
+		metrics.errors.Inc("protocol")
+		metrics.droppedMessages.Inc()
+		return
+	}
+	fail := func(err error) {
+		logger.Warn("file transfer failed", "msg_type", payload.MsgType, "transfer_id", file.TransferID, "error", err)
+		metrics.errors.Inc("file")
+		metrics.droppedMessages.Inc()
+		sendAnnouncement(conn, fmt.Sprintf("File transfer failed: %s", err))
+	}
+
+	// The lock never covers a write to a client.
+	files := s.files
+	switch payload.MsgType {
+	case chatmodels.MsgTypeFileOffer:
+		if s.isMuted(nick) {
+			metrics.droppedMessages.Inc()
+			sendAnnouncement(conn, "You are muted.")
+			return
+		}
+		var recipients []chatutils.ConnectionInfo
+		if *payload.Nick == chatfile.Everyone {
+			recipients = slices.DeleteFunc(s.cm.List(), func(connInfo chatutils.ConnectionInfo) bool { return connInfo.Conn == conn })
+		} else {
+			recipients = findNick(s.cm.List(), *payload.Nick)
+		}
+		if len(recipients) == 0 {
+			metrics.droppedMessages.Inc()
+			sendAnnouncement(conn, fmt.Sprintf("No such nick: %s", *payload.Nick))
+			return
+		}
+		if err := chatfile.CheckOffer(file); err != nil {
+			fail(err)
+			return
+		}
+		conns := []net.Conn{}
+		for _, connInfo := range recipients {
+			conns = append(conns, connInfo.Conn)
+		}
+		files.mu.Lock()
+		err := files.tracker.Offer(file.TransferID, conn, conns, file.Size)
+		files.mu.Unlock()
+		if err != nil {
+			fail(err)
+			return
+		}
+		logger.Info("file offered", "nick", nick, "to", *payload.Nick, "transfer_id", file.TransferID, "size", file.Size)
+		relay(nick, conn, recipients, chatmodels.Payload{
+			MsgType: chatmodels.MsgTypeFileOffer,
+			Nick:    &nick,
+			File:    &chatmodels.File{TransferID: file.TransferID, Name: file.Name, Size: file.Size, Checksum: file.Checksum},
+		})
+	case chatmodels.MsgTypeFileAnswer:
+		accept := payload.Msg != nil && *payload.Msg == chatfile.AnswerAccept
+		files.mu.Lock()
+		sender, err := files.tracker.Answer(file.TransferID, conn, accept)
+		files.mu.Unlock()
+		if err != nil {
+			fail(err)
+			if errors.Is(err, chatfile.ErrAlreadyStarted) {
+				cancelTransfer(conn, file.TransferID)
+			}
+			return
+		}
+		answer := chatfile.AnswerReject
+		if accept {
+			answer = chatfile.AnswerAccept
+		}
+		send(sender, chatmodels.Payload{
+			MsgType: chatmodels.MsgTypeFileAnswer,
+			Nick:    &nick,
+			Msg:     &answer,
+			File:    &chatmodels.File{TransferID: file.TransferID},
+		})
+	case chatmodels.MsgTypeFileChunk:
+		if len(file.Data) > chatfile.ChunkSize {
+			fail(chatfile.ErrBadChunk)
+			return
+		}
+		files.mu.Lock()
+		targets, err := files.tracker.Chunk(file.TransferID, conn, file.Offset, len(file.Data))
+		files.mu.Unlock()
+		if err != nil {
+			fail(err)
+			return
+		}
+		chunk := chatmodels.Payload{
+			MsgType: chatmodels.MsgTypeFileChunk,
+			Nick:    &nick,
+			File:    &chatmodels.File{TransferID: file.TransferID, Offset: file.Offset, Data: file.Data},
+		}
+		outBytes, err := chatutils.EncodeMessage(chunk)
+		if err != nil {
+			fail(err)
+			return
+		}
+		for _, target := range targets {
+			write(target, outBytes)
+		}
+	case chatmodels.MsgTypeFileAck:
+		final := payload.Msg != nil
+		files.mu.Lock()
+		sender, progress, advanced, err := files.tracker.Ack(file.TransferID, conn, file.Offset, final)
+		files.mu.Unlock()
+		if err != nil {
+			fail(err)
+			return
+		}
+		// Acks carry the progress of the slowest recipient.
+		if final || advanced {
+			send(sender, chatmodels.Payload{
+				MsgType: chatmodels.MsgTypeFileAck,
+				Nick:    &nick,
+				Msg:     payload.Msg,
+				File:    &chatmodels.File{TransferID: file.TransferID, Offset: progress},
+			})
+		}
+		if final {
+			logger.Info("file received", "nick", nick, "transfer_id", file.TransferID, "status", *payload.Msg)
+		}
+	}
+}
+
+// dropTransfers cancels the file transfers that cannot finish without conn.
+func (s *chatServer) dropTransfers(conn net.Conn) {
+	s.files.mu.Lock()
+	cancelled := s.files.tracker.Drop(conn)
+	s.files.mu.Unlock()
+	for _, c := range cancelled {
+		for _, notify := range c.Notify {
+			cancelTransfer(notify, c.ID)
+		}
+	}
+}
+
+func cancelTransfer(conn net.Conn, transferID string) {
+	status := chatfile.StatusCancelled
+	send(conn, chatmodels.Payload{
+		MsgType: chatmodels.MsgTypeFileAck,
+		Msg:     &status,
+		File:    &chatmodels.File{TransferID: transferID},
+	})
+}
+
+// findTargets returns the connections matching a nick or an IP/CIDR target.
+func findTargets(clients []chatutils.ConnectionInfo, target string) []net.Conn {
+	isAddress := chatadmin.IsAddressTarget(target)
+	targets := []net.Conn{}
+	for _, connInfo := range clients {
+		if isAddress {
+			if matched, _ := netfunc.IpInCidr(remoteIp(connInfo.Conn), target); matched {
+				targets = append(targets, connInfo.Conn)
+			}
+		} else if strings.EqualFold(connInfo.Nick, target) {
+			targets = append(targets, connInfo.Conn)
+		}
+	}
+	return targets
+}
+
+func findNick(clients []chatutils.ConnectionInfo, nick string) []chatutils.ConnectionInfo {
+	return slices.DeleteFunc(clients, func(connInfo chatutils.ConnectionInfo) bool {
+		return !strings.EqualFold(connInfo.Nick, nick)
+	})
+}
+
+func announceLeave(nick string, clients []chatutils.ConnectionInfo) {
+	relay(nick, nil, clients, chatmodels.Payload{
+		MsgType: chatmodels.MsgTypeLeave,
+		Nick:    &nick,
+	})
+}
+
+func disconnect(conns []net.Conn, message string) {
+	for _, conn := range conns {
+		sendAnnouncement(conn, message)
+		conn.Close()
+	}
+}
+
+func remoteIp(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+func sendAnnouncement(conn net.Conn, message string) {
+	send(conn, chatmodels.Payload{
+		MsgType: chatmodels.MsgTypeAnn,
+		Msg:     &message,
+	})
+}
+
+func broadcastAnnouncement(clients []chatutils.ConnectionInfo, message string) {
+	relay("server", nil, clients, chatmodels.Payload{
+		MsgType: chatmodels.MsgTypeAnn,
+		Msg:     &message,
+	})
+}
+
+func send(conn net.Conn, payload chatmodels.Payload) {
+	outBytes, err := chatutils.EncodeMessage(payload)
+	if err != nil {
+		logging.WithConn(slog.Default(), conn).Error("failed to encode payload", "msg_type", payload.MsgType, "error", err)
+		metrics.errors.Inc("encode")
+		metrics.droppedMessages.Inc()
+		return
+	}
+	write(conn, outBytes)
+}
+
+func write(conn net.Conn, outBytes []byte) {
+	if _, err := conn.Write(outBytes); err != nil {
+		logging.WithConn(slog.Default(), conn).Warn("failed to write payload", "error", err)
+		metrics.errors.Inc("write")
+		metrics.droppedMessages.Inc()
+		return
+	}
+	metrics.messagesOut.Inc()
+}
+
+func relay(nick string, clientConn net.Conn, clients []chatutils.ConnectionInfo, payload chatmodels.Payload) {
+	start := time.Now()
+	outBytes, err := chatutils.EncodeMessage(payload)
+	if err != nil {
+		slog.Error("failed to encode payload for relay", "msg_type", payload.MsgType, "nick", nick, "error", err)
+		metrics.errors.Inc("encode")
+		metrics.droppedMessages.Inc()
+		return
+	}
+
 	for _, connInfo := range clients {
 		if connInfo.Conn != clientConn {
-			fmt.Printf("Relaying to %s\n", connInfo.Conn.RemoteAddr().String())
-			connInfo.Conn.Write(outBytes)
+			logging.WithConn(slog.Default(), connInfo.Conn).Debug("relaying payload", "msg_type", payload.MsgType, "from", nick)
+			write(connInfo.Conn, outBytes)
 		}
 	}
+	metrics.relayLatency.Observe(time.Since(start).Seconds())
 }
 
 func handleConn(conn net.Conn, clientCh chan clientInfo) {
 	defer conn.Close()
+	logger := logging.WithConn(slog.Default(), conn)
 
 	readBuf := chatutils.ReadBuffer{}
 	for {
@@ -123,17 +1225,18 @@ func handleConn(conn net.Conn, clientCh chan clientInfo) {
 
 		if err != nil {
 			if err != io.EOF {
-				fmt.Println("Error reading:", err.Error())
-			} else {
-				clientCh <- clientInfo{
-					conn:         &conn,
-					disconnected: true,
-				}
+				logger.Error("failed to read payload", "error", err)
+				metrics.errors.Inc(readErrorType(err))
+			}
+			clientCh <- clientInfo{
+				conn:         &conn,
+				disconnected: true,
 			}
 			break
 		}
 
-		if payload.MsgType == chatmodels.MsgTypeHello {
+		metrics.messagesIn.Inc()
+		if payload.MsgType == chatmodels.MsgTypeHello || payload.MsgType == chatmodels.MsgTypeNick {
 			if payload.Nick != nil {
 				clientCh <- clientInfo{
 					conn:         &conn,
@@ -141,9 +1244,16 @@ func handleConn(conn net.Conn, clientCh chan clientInfo) {
 					disconnected: false,
 				}
 			} else {
-				fmt.Printf("Client %s sent a hello message without a nickname\n", conn.RemoteAddr().String())
+				logger.Warn("payload without a nickname", "msg_type", payload.MsgType)
+				metrics.errors.Inc("protocol")
+			}
+		} else if payload.MsgType == chatmodels.MsgTypeLeave || payload.MsgType == chatmodels.MsgTypeWho || payload.MsgType == chatmodels.MsgTypePing {
+			clientCh <- clientInfo{
+				conn:         &conn,
+				chatPayload:  payload,
+				disconnected: false,
 			}
-		} else if payload.MsgType == chatmodels.MsgTypeChat {
+		} else if payload.MsgType == chatmodels.MsgTypeChat || payload.MsgType == chatmodels.MsgTypeCommand {
 			if payload.Msg != nil {
 				clientCh <- clientInfo{
 					conn:         &conn,
@@ -151,10 +1261,113 @@ func handleConn(conn net.Conn, clientCh chan clientInfo) {
 					disconnected: false,
 				}
 			} else {
-				fmt.Printf("Client %s sent a chat message without a message\n", conn.RemoteAddr().String())
+				logger.Warn("payload without a message", "msg_type", payload.MsgType)
+				metrics.errors.Inc("protocol")
+			}
+		} else if payload.MsgType == chatmodels.MsgTypeTyping {
+			clientCh <- clientInfo{
+				conn:         &conn,
+				chatPayload:  payload,
+				disconnected: false,
+			}
+		} else if payload.MsgType == chatmodels.MsgTypeReceipt {
+			if payload.ID != "" && payload.Msg != nil && chatactivity.IsReceiptStatus(*payload.Msg) {
+				clientCh <- clientInfo{
+					conn:         &conn,
+					chatPayload:  payload,
+					disconnected: false,
+				}
+			} else {
+				logger.Warn("invalid receipt", "id", payload.ID)
+				metrics.errors.Inc("protocol")
+			}
+		} else if payload.MsgType == chatmodels.MsgTypeKey {
+			if payload.Nick != nil {
+				clientCh <- clientInfo{
+					conn:         &conn,
+					chatPayload:  payload,
+					disconnected: false,
+				}
+			} else {
+				logger.Warn("key request without a nickname")
+				metrics.errors.Inc("protocol")
+			}
+		} else if payload.MsgType == chatmodels.MsgTypeDM {
+			encrypted := payload.Ciphertext != nil && payload.Nonce != nil
+			if payload.Nick != nil && (payload.Msg != nil || encrypted) {
+				clientCh <- clientInfo{
+					conn:         &conn,
+					chatPayload:  payload,
+					disconnected: false,
+				}
+			} else {
+				logger.Warn("direct message without a recipient or message")
+				metrics.errors.Inc("protocol")
+			}
+		} else if isFileMessage(payload.MsgType) {
+			if payload.File != nil && payload.File.TransferID != "" &&
+				(payload.MsgType != chatmodels.MsgTypeFileOffer || payload.Nick != nil) {
+				clientCh <- clientInfo{
+					conn:         &conn,
+					chatPayload:  payload,
+					disconnected: false,
+				}
+			} else {
+				logger.Warn("file message without a transfer", "msg_type", payload.MsgType)
+				metrics.errors.Inc("protocol")
 			}
 		} else {
-			fmt.Printf("Client %s sent an unknown message type: %s\n", conn.RemoteAddr().String(), payload.MsgType)
+			logger.Warn("unknown message type", "msg_type", payload.MsgType)
+			metrics.errors.Inc("protocol")
+		}
+	}
+}
+
+func readErrorType(err error) string {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+		return "decode"
+	}
+	return "read"
+}
+
+type clientView struct {
+	Nick           string    `json:"nick"`
+	Address        string    `json:"address"`
+	ConnectedSince time.Time `json:"connected_since"`
+}
+
+// serveAdmin serves /metrics to anyone and /clients to admins.
+func serveAdmin(addr string, cm *chatutils.ConnectionManager, adminConfig *chatadmin.Config) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.registry.Handler())
+	mux.HandleFunc("/clients", func(w http.ResponseWriter, r *http.Request) {
+		if !adminConfig.AuthorizeHTTP(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="chat-server"`)
+			http.Error(w, "admin token required", http.StatusUnauthorized)
+			return
+		}
+		details := cm.ListDetails()
+		slices.SortFunc(details, func(a, b chatutils.ClientDetails) int {
+			return a.ConnectedSince.Compare(b.ConnectedSince)
+		})
+
+		clients := make([]clientView, 0, len(details))
+		for _, client := range details {
+			clients = append(clients, clientView{
+				Nick:           client.Nick,
+				Address:        client.Conn.RemoteAddr().String(),
+				ConnectedSince: client.ConnectedSince,
+			})
 		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(clients)
+	})
+
+	slog.Info("admin endpoint listening", "addr", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		slog.Error("admin endpoint stopped", "error", err)
 	}
 }
@@ -2,11 +2,15 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"os"
 	"strconv"
 	"strings"
 
+	"github.com/vinh0604/go-network-concepts/internal/cliconfig"
+	"github.com/vinh0604/go-network-concepts/internal/logging"
 	"github.com/vinh0604/go-network-concepts/internal/netfunc"
 )
 
@@ -29,20 +33,35 @@ type NetworkInfo struct {
 }
 
 func main() {
-	networkInfoData, err := os.ReadFile("./data/dijkstra/example1.json")
+	cfg := cliconfig.New("DIJKSTRA_ROUTERS", "", "Prints the shortest router paths for each source and destination in the network file.")
+
+	var networkFile string
+	flag.StringVar(&networkFile, "network", "./data/dijkstra/example1.json", "JSON file describing routers and the source/destination pairs")
+	logOpts := logging.RegisterFlags()
+	cfg.Parse()
+	logger := logOpts.Setup(os.Stderr)
+
+	cfg.Args(0, 0)
+	if networkFile == "" {
+		cfg.Fail(errors.New("network file cannot be empty"))
+	}
+
+	networkInfoData, err := os.ReadFile(networkFile)
 	if err != nil {
-		panic(err)
+		logging.Fatal(logger, "failed to read network info", "path", networkFile, "error", err)
 	}
 
 	networkInfo := NetworkInfo{}
-	json.Unmarshal(networkInfoData, &networkInfo)
+	if err := json.Unmarshal(networkInfoData, &networkInfo); err != nil {
+		logging.Fatal(logger, "failed to parse network info", "error", err)
+	}
 
 	for i := range networkInfo.SrcDest {
 		fmt.Println("Src:", networkInfo.SrcDest[i][0], "Dest:", networkInfo.SrcDest[i][1])
 
 		shortestPath, err := dijkstrasShortestPath(networkInfo.Routers, networkInfo.SrcDest[i][0], networkInfo.SrcDest[i][1])
 		if err != nil {
-			fmt.Println("Error:", err)
+			logger.Error("no path found", "src", networkInfo.SrcDest[i][0], "dest", networkInfo.SrcDest[i][1], "error", err)
 		} else {
 			fmt.Println("Shortest path:", shortestPath)
 		}
@@ -2,11 +2,18 @@ package main
 
 import (
 	"bytes"
+	"flag"
 	"io"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"strconv"
 	"strings"
+
+	"github.com/vinh0604/go-network-concepts/internal/cliconfig"
+	"github.com/vinh0604/go-network-concepts/internal/logging"
 )
 
 func handleTsChunkProxy(targetURL string, w http.ResponseWriter) {
@@ -52,7 +59,8 @@ func handleTsChunkProxy(targetURL string, w http.ResponseWriter) {
 	}
 }
 
-func handleM3U8Proxy(targetURL string, w http.ResponseWriter) {
+// proxyHost is the Host the client used to reach us.
+func handleM3U8Proxy(targetURL string, proxyHost string, w http.ResponseWriter) {
 	if targetURL == "" {
 		http.Error(w, "Missing 'm3u8' parameter", http.StatusBadRequest)
 		return
@@ -78,7 +86,7 @@ func handleM3U8Proxy(targetURL string, w http.ResponseWriter) {
 	for _, line := range lines {
 		if strings.HasPrefix(line, "https://") {
 			// Replace the URL
-			newLine := "http://localhost:8686?url=" + url.QueryEscape(strings.TrimSpace(line))
+			newLine := "http://" + proxyHost + "/?url=" + url.QueryEscape(strings.TrimSpace(line))
 			modifiedContent.WriteString(newLine + "\n")
 		} else {
 			modifiedContent.WriteString(line + "\n")
@@ -91,9 +99,10 @@ func handleM3U8Proxy(targetURL string, w http.ResponseWriter) {
 }
 
 func proxyHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Info("proxy request", "remote_addr", r.RemoteAddr, "query", r.URL.RawQuery)
 	if r.URL.Query().Has("m3u8") {
 		var targetURL string = r.URL.Query().Get("m3u8")
-		handleM3U8Proxy(targetURL, w)
+		handleM3U8Proxy(targetURL, r.Host, w)
 	} else if r.URL.Query().Has("url") {
 		var targetURL string = r.URL.Query().Get("url")
 		handleTsChunkProxy(targetURL, w)
@@ -104,6 +113,22 @@ func proxyHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
+	cfg := cliconfig.New("M3U8_PROXY", "", "Proxies m3u8 playlists and their disguised media segments.")
+
+	var listenHost string
+	var port int
+	flag.StringVar(&listenHost, "listen", "", "Address to bind to (all interfaces when empty)")
+	flag.IntVar(&port, "port", 8686, "Port to listen on")
+	logOpts := logging.RegisterFlags()
+	cfg.Parse()
+	logger := logOpts.Setup(os.Stderr)
+
+	cfg.Args(0, 0)
+	cfg.Validate(cliconfig.ValidateHost(listenHost), cliconfig.ValidatePort(port))
+
+	addr := net.JoinHostPort(listenHost, strconv.Itoa(port))
 	http.HandleFunc("/", proxyHandler)
-	log.Fatal(http.ListenAndServe(":8686", nil)) // Start the proxy server
+	logger.Info("m3u8 proxy listening", "addr", addr)
+	err := http.ListenAndServe(addr, nil) // Start the proxy server
+	logging.Fatal(logger, "proxy server stopped", "error", err)
 }
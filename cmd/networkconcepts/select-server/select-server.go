@@ -2,39 +2,49 @@ package main
 
 import (
 	"flag"
-	"fmt"
 	"net"
+	"os"
 	"strconv"
 	"syscall"
+
+	"github.com/vinh0604/go-network-concepts/internal/cliconfig"
+	"github.com/vinh0604/go-network-concepts/internal/logging"
 )
 
 func main() {
 	var err error
 
-	args := flag.Args()
-	port := 8080
-	if len(args) > 1 {
-		port, err = strconv.Atoi(args[0])
-		if err != nil {
-			panic(err)
-		}
+	cfg := cliconfig.New("SELECT_SERVER", "[port]", "Echo server multiplexing connections with select(2). A positional port overrides -port.")
+
+	var listenHost string
+	var port int
+	flag.StringVar(&listenHost, "listen", "", "Address to bind to (all interfaces when empty)")
+	flag.IntVar(&port, "port", 8080, "Port to listen on")
+	logOpts := logging.RegisterFlags()
+	cfg.Parse()
+	logger := logOpts.Setup(os.Stderr)
+
+	if args := cfg.Args(0, 1); len(args) == 1 {
+		port, err = cliconfig.ParsePort(args[0])
+		cfg.Validate(err)
 	}
+	cfg.Validate(cliconfig.ValidateHost(listenHost), cliconfig.ValidatePort(port))
 
-	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	ln, err := net.Listen("tcp", net.JoinHostPort(listenHost, strconv.Itoa(port)))
 	if err != nil {
-		panic(err)
+		logging.Fatal(logger, "failed to listen", "host", listenHost, "port", port, "error", err)
 	}
 	defer ln.Close()
 
 	file, err := ln.(*net.TCPListener).File()
 	if err != nil {
-		panic(err)
+		logging.Fatal(logger, "failed to get listener file descriptor", "error", err)
 	}
 	fdLn := int(file.Fd())
 
 	var readfds syscall.FdSet
 	fdMax := fdLn
-	fmt.Printf("Server FD: %d\n", fdLn)
+	logger.Info("select server listening", "addr", ln.Addr().String(), "fd", fdLn)
 	connMap := make(map[int]net.Conn)
 	for {
 		// After each syscall.Select, readfds set only contains the file descriptors that are currently ready for reading
@@ -52,7 +62,7 @@ func main() {
 			if err == syscall.EINTR {
 				continue
 			} else {
-				panic(err)
+				logging.Fatal(logger, "select failed", "error", err)
 			}
 		}
 
@@ -65,13 +75,15 @@ func main() {
 				if fd == fdLn {
 					conn, err := ln.Accept()
 					if err != nil {
-						fmt.Println(err)
+						logger.Error("failed to accept connection", "error", err)
 						continue
 					}
 
+					// File dups the socket, so select watches a different
+					// descriptor from the fd WithConn logs.
 					connFile, err := conn.(*net.TCPConn).File()
 					if err != nil {
-						fmt.Println(err)
+						logging.WithConn(logger, conn).Error("failed to get connection file descriptor", "error", err)
 						conn.Close()
 						continue
 					}
@@ -82,23 +94,23 @@ func main() {
 						fdMax = fdConn
 					}
 
-					fmt.Printf("%s %s connected\n", conn.RemoteAddr().Network(), conn.RemoteAddr().String())
-					fmt.Printf("Connection FD: %d\n", fdConn)
+					logging.WithConn(logger, conn).Info("client connected", "select_fd", fdConn)
 				} else {
 					conn := connMap[fd]
 					buf := make([]byte, 1024)
 
 					n, err := conn.Read(buf)
+					connLogger := logging.WithConn(logger, conn).With("select_fd", fd)
 					if err != nil || n == 0 {
 						if err != nil {
-							fmt.Println(err)
+							connLogger.Debug("read ended", "error", err)
 						}
 						FDClr(fd, &readfds)
 						delete(connMap, fd)
 						conn.Close()
-						fmt.Printf("%s %s hung up\n", conn.RemoteAddr().Network(), conn.RemoteAddr().String())
+						connLogger.Info("client hung up")
 					} else {
-						fmt.Println(string(buf[:n]))
+						connLogger.Info("received data", "bytes", n, "data", string(buf[:n]))
 					}
 				}
 			}
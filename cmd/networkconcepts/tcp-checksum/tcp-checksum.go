@@ -2,17 +2,41 @@ package main
 
 import (
 	"encoding/binary"
+	"flag"
 	"fmt"
+	"log/slog"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+
+	"github.com/vinh0604/go-network-concepts/internal/cliconfig"
+	"github.com/vinh0604/go-network-concepts/internal/logging"
 )
 
 func main() {
-	for i := 0; i < 10; i++ {
-		result, err := tcpChecksum(i)
+	cfg := cliconfig.New("TCP_CHECKSUM", "", "Verifies the TCP checksums of the captured packets in the data directory.")
+
+	var dataDir string
+	var count int
+	flag.StringVar(&dataDir, "data-dir", "./data/tcp_data", "Directory with tcp_addrs_N.txt and tcp_data_N.dat files")
+	flag.IntVar(&count, "count", 10, "Number of packets to verify")
+	logOpts := logging.RegisterFlags()
+	cfg.Parse()
+	logger := logOpts.Setup(os.Stderr)
+
+	cfg.Args(0, 0)
+	if count < 1 {
+		cfg.Fail(fmt.Errorf("invalid count %d: must be at least 1", count))
+	}
+	if info, err := os.Stat(dataDir); err != nil || !info.IsDir() {
+		cfg.Fail(fmt.Errorf("data directory %s not found", dataDir))
+	}
+
+	for i := 0; i < count; i++ {
+		result, err := tcpChecksum(dataDir, i)
 		if err != nil {
-			fmt.Println("TCP Checksum 1: false, err:", err)
+			logger.Error("failed to verify TCP checksum", "packet", i, "error", err)
 			return
 		}
 
@@ -20,8 +44,8 @@ func main() {
 	}
 }
 
-func tcpChecksum(packetIdx int) (bool, error) {
-	addrsFile, err := os.ReadFile(fmt.Sprintf("./data/tcp_data/tcp_addrs_%d.txt", packetIdx))
+func tcpChecksum(dataDir string, packetIdx int) (bool, error) {
+	addrsFile, err := os.ReadFile(filepath.Join(dataDir, fmt.Sprintf("tcp_addrs_%d.txt", packetIdx)))
 	if err != nil {
 		return false, err
 	}
@@ -36,12 +60,12 @@ func tcpChecksum(packetIdx int) (bool, error) {
 		return false, err
 	}
 
-	tcpDataFile, err := os.ReadFile(fmt.Sprintf("./data/tcp_data/tcp_data_%d.dat", packetIdx))
+	tcpDataFile, err := os.ReadFile(filepath.Join(dataDir, fmt.Sprintf("tcp_data_%d.dat", packetIdx)))
 	if err != nil {
 		return false, err
 	}
 	checksum := binary.BigEndian.Uint16(tcpDataFile[16:18])
-	fmt.Println("Checksum:", fmt.Sprintf("0x%04x", checksum))
+	slog.Debug("read checksum", "packet", packetIdx, "checksum", fmt.Sprintf("0x%04x", checksum))
 
 	tcpLen := len(tcpDataFile)
 	tcpPseudoHeader := append(*sourceBytes, *dstBytes...)
@@ -71,7 +95,7 @@ func tcpChecksum(packetIdx int) (bool, error) {
 	total += (total >> 16)
 
 	calculatedChecksum := uint16(^total)
-	fmt.Println("Calculated Checksum:", fmt.Sprintf("0x%04x", calculatedChecksum))
+	slog.Debug("calculated checksum", "packet", packetIdx, "checksum", fmt.Sprintf("0x%04x", calculatedChecksum))
 
 	return calculatedChecksum == checksum, nil
 }
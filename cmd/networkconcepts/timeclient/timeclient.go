@@ -3,19 +3,43 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"net"
+	"os"
+	"strconv"
 	"time"
+
+	"github.com/vinh0604/go-network-concepts/internal/cliconfig"
+	"github.com/vinh0604/go-network-concepts/internal/logging"
 )
 
 func main() {
 	var err error
-	sock, err := net.Dial("tcp", "time.nist.gov:37")
+	cfg := cliconfig.New("TIME_CLIENT", "", "Compares the time from an RFC 868 time server with the system clock.")
+
+	var host string
+	var port int
+	flag.StringVar(&host, "host", "time.nist.gov", "Time server host")
+	flag.IntVar(&port, "port", 37, "Time server port")
+	logOpts := logging.RegisterFlags()
+	cfg.Parse()
+	logger := logOpts.Setup(os.Stderr)
+
+	cfg.Args(0, 0)
+	cfg.Validate(cliconfig.ValidateHost(host), cliconfig.ValidatePort(port))
+	if host == "" {
+		cfg.Fail(errors.New("host cannot be empty"))
+	}
 
+	sock, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
 	if err != nil {
-		panic(err)
+		logging.Fatal(logger, "failed to connect", "host", host, "port", port, "error", err)
 	}
+	defer sock.Close()
+	logger = logging.WithConn(logger, sock)
 
 	var bytesBuffer bytes.Buffer
 	buffer := make([]byte, 4096)
@@ -23,7 +47,7 @@ func main() {
 		mLen, err := sock.Read(buffer)
 		if err != nil {
 			if err != io.EOF {
-				fmt.Println("Error reading:", err.Error())
+				logger.Error("failed to read response", "error", err)
 			}
 			break
 		}
@@ -33,7 +57,7 @@ func main() {
 
 	bytesReceived := bytesBuffer.Bytes()
 	if len(bytesReceived) != 4 {
-		panic("Invalid response from server")
+		logging.Fatal(logger, "invalid response from server", "bytes", len(bytesReceived))
 	}
 
 	epochFrom1900 := binary.BigEndian.Uint32(bytesReceived)
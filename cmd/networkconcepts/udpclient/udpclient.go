@@ -1,33 +1,48 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"net"
 	"os"
 	"strconv"
+
+	"github.com/vinh0604/go-network-concepts/internal/cliconfig"
+	"github.com/vinh0604/go-network-concepts/internal/logging"
 )
 
 const MAX_PACKET_SIZE = 512
 
 func main() {
 	var err error
-	if len(os.Args) < 4 {
-		fmt.Println("usage: udpclient <host> <port> <data>")
-		return
-	}
+	cfg := cliconfig.New("UDP_CLIENT", "[<host> <port>] <data>", "Sends data to a UDP server in datagrams of at most 1024 bytes. A positional host and port override -host and -port.")
 
-	host := os.Args[1]
-	port, err := strconv.Atoi(os.Args[2])
-	if err != nil {
-		panic(err)
+	var host string
+	var port int
+	flag.StringVar(&host, "host", "localhost", "Server host")
+	flag.IntVar(&port, "port", 0, "Server port (required)")
+	logOpts := logging.RegisterFlags()
+	cfg.Parse()
+	logger := logOpts.Setup(os.Stderr)
+
+	args := cfg.Args(1, 3)
+	if len(args) == 2 {
+		cfg.Fail(fmt.Errorf("expected <data> or <host> <port> <data>, got %d arguments", len(args)))
+	}
+	if len(args) == 3 {
+		host = args[0]
+		port, err = cliconfig.ParsePort(args[1])
+		cfg.Validate(err)
 	}
-	data := os.Args[3]
+	data := args[len(args)-1]
+	cfg.Validate(cliconfig.ValidateHost(host), cliconfig.ValidatePort(port))
 
-	conn, err := net.Dial("udp", fmt.Sprintf("%s:%d", host, port))
+	conn, err := net.Dial("udp", net.JoinHostPort(host, strconv.Itoa(port)))
 	if err != nil {
-		panic(err)
+		logging.Fatal(logger, "failed to dial", "host", host, "port", port, "error", err)
 	}
 	defer conn.Close()
+	logger = logging.WithConn(logger, conn)
 
 	dataBytes := []byte(data)
 
@@ -36,6 +51,10 @@ func main() {
 		if end > len(dataBytes) {
 			end = len(dataBytes)
 		}
-		conn.Write(dataBytes[start:end])
+		if _, err := conn.Write(dataBytes[start:end]); err != nil {
+			logger.Error("failed to send datagram", "offset", start, "error", err)
+			continue
+		}
+		logger.Debug("sent datagram", "offset", start, "bytes", end-start)
 	}
 }
@@ -1,43 +1,56 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"net"
 	"os"
 	"strconv"
+
+	"github.com/vinh0604/go-network-concepts/internal/cliconfig"
+	"github.com/vinh0604/go-network-concepts/internal/logging"
 )
 
 func main() {
 	var err error
-	if len(os.Args) < 2 {
-		fmt.Println("usage: udpserver <port>")
-		return
-	}
+	cfg := cliconfig.New("UDP_SERVER", "[port]", "Prints received datagrams and answers each with ACK. The port is required, either positionally or with -port.")
 
-	port, err := strconv.Atoi(os.Args[1])
-	if err != nil {
-		panic(err)
+	var listenHost string
+	var port int
+	flag.StringVar(&listenHost, "listen", "", "Address to bind to (all interfaces when empty)")
+	flag.IntVar(&port, "port", 0, "Port to listen on")
+	logOpts := logging.RegisterFlags()
+	cfg.Parse()
+	logger := logOpts.Setup(os.Stderr)
+
+	if args := cfg.Args(0, 1); len(args) == 1 {
+		port, err = cliconfig.ParsePort(args[0])
+		cfg.Validate(err)
 	}
+	cfg.Validate(cliconfig.ValidateHost(listenHost), cliconfig.ValidatePort(port))
 
-	conn, err := net.ListenPacket("udp", fmt.Sprintf(":%d", port))
+	conn, err := net.ListenPacket("udp", net.JoinHostPort(listenHost, strconv.Itoa(port)))
 	if err != nil {
-		panic(err)
+		logging.Fatal(logger, "failed to listen", "host", listenHost, "port", port, "error", err)
 	}
 	defer conn.Close()
+	logger.Info("udp server listening", "addr", conn.LocalAddr().String())
 
 	for {
 		buffer := make([]byte, 4096)
 		size, remoteAddr, err := conn.ReadFrom(buffer)
 		if err != nil {
-			panic(err)
+			logger.Error("failed to read datagram", "error", err)
+			continue
 		}
 
-		fmt.Printf("Remote Address: %s %s\n", remoteAddr.Network(), remoteAddr.String())
+		packetLogger := logger.With("network", remoteAddr.Network(), "remote_addr", remoteAddr.String())
+		packetLogger.Info("received datagram", "bytes", size)
 		fmt.Println("Received:", string(buffer[:size]))
 
 		_, err = conn.WriteTo([]byte("ACK"), remoteAddr)
 		if err != nil {
-			panic(err)
+			packetLogger.Error("failed to send ACK", "error", err)
 		}
 	}
 }
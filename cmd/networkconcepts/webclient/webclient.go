@@ -5,38 +5,48 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"os"
 	"slices"
+	"strconv"
 	"strings"
+
+	"github.com/vinh0604/go-network-concepts/internal/cliconfig"
+	"github.com/vinh0604/go-network-concepts/internal/logging"
 )
 
 func main() {
 	ALLOWED_METHODS := []string{"GET", "POST", "PUT", "DELETE", "PATCH", "OPTIONS", "HEAD"}
 	METHODS_WITH_PAYLOAD := []string{"POST", "PUT", "PATCH", "DELETE"}
+	cfg := cliconfig.New("WEB_CLIENT", "<host>", "Sends a single HTTP/1.1 request to host and prints the raw response.")
+
 	var port int
 	flag.IntVar(&port, "p", 80, "Port to connect to")
+	flag.IntVar(&port, "port", 80, "Port to connect to (same as -p)")
 	var method string = "GET"
 	flag.StringVar(&method, "X", "GET", "HTTP Method")
-	method = strings.ToUpper(method)
+	flag.StringVar(&method, "method", "GET", "HTTP Method (same as -X)")
 	var payload string
 	flag.StringVar(&payload, "d", "", "Payload")
-	flag.Parse()
-
-	args := flag.Args()
-	if len(args) == 0 {
-		panic("Not enough arguments")
-	}
-	host := args[0]
+	flag.StringVar(&payload, "data", "", "Payload (same as -d)")
+	logOpts := logging.RegisterFlags()
+	cfg.Parse()
+	logger := logOpts.Setup(os.Stderr)
 
+	host := cfg.Args(1, 1)[0]
+	method = strings.ToUpper(method)
+	cfg.Validate(cliconfig.ValidateHost(host), cliconfig.ValidatePort(port))
 	if !slices.Contains(ALLOWED_METHODS, method) {
-		panic(fmt.Sprintf("Method %s not allowed", method))
+		cfg.Fail(fmt.Errorf("method %s not allowed: must be one of %s", method, strings.Join(ALLOWED_METHODS, ", ")))
 	}
 
 	var err error
-	sock, err := net.Dial("tcp", fmt.Sprintf("%s:%d", host, port))
+	sock, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
 	if err != nil {
-		panic(err)
+		logging.Fatal(logger, "failed to connect", "host", host, "port", port, "error", err)
 	}
 	defer sock.Close()
+	logger = logging.WithConn(logger, sock)
+	logger.Debug("sending request", "method", method)
 
 	if slices.Contains(METHODS_WITH_PAYLOAD, method) && payload != "" {
 		sock.Write([]byte(
@@ -52,7 +62,7 @@ func main() {
 		mLen, err := sock.Read(buffer)
 		if err != nil {
 			if err != io.EOF {
-				fmt.Println("Error reading:", err.Error())
+				logger.Error("failed to read response", "error", err)
 			}
 			break
 		}
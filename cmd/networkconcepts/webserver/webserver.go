@@ -2,185 +2,605 @@ package main
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
+	"log/slog"
+	"math/big"
 	"net"
 	"net/url"
 	"os"
-	"path/filepath"
+	"path"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/vinh0604/go-network-concepts/internal/cliconfig"
+	"github.com/vinh0604/go-network-concepts/internal/http1"
+	"github.com/vinh0604/go-network-concepts/internal/http2"
+	"github.com/vinh0604/go-network-concepts/internal/httpfile"
+	"github.com/vinh0604/go-network-concepts/internal/httpproxy"
+	"github.com/vinh0604/go-network-concepts/internal/logging"
+	"github.com/vinh0604/go-network-concepts/internal/vhost"
 )
 
 func main() {
 	var err error
 	currDir, err := os.Getwd()
 	if err != nil {
-		panic(err)
+		currDir = "."
 	}
 
+	cfg := cliconfig.New("WEBSERVER", "[port]", "Serves static files over HTTP/1.1, or HTTPS with HTTP/2 when -tls is set. A positional port overrides -port.")
+
 	var rootDir string
+	var listenHost string
+	var port int
+	var idleTimeout time.Duration
+	var maxRequests int
+	var cachePolicy string
+	var hashETags bool
+	var mimeTypesPath string
+	var compress bool
+	var precompressed bool
+	var symlinks string
+	var hideDotfiles bool
+	var index bool
+	var vhostsPath string
+	var proxyUpstreams string
+	var balance string
+	var useTLS bool
+	var certFile string
+	var keyFile string
+	var enableHTTP2 bool
 	flag.StringVar(&rootDir, "d", currDir, "Serving directory")
-	flag.Parse()
-	fmt.Printf("Serving directory: %s\n", rootDir)
-	if rootInfo, err := os.Stat(rootDir); os.IsNotExist(err) {
-		panic(err)
-	} else if !rootInfo.IsDir() {
-		panic("Root path is not a directory")
-	}
-	rootDir, err = filepath.Abs(rootDir)
-	if err != nil {
-		panic(err)
+	flag.StringVar(&listenHost, "listen", "", "Address to bind to (all interfaces when empty)")
+	flag.IntVar(&port, "port", 8080, "Port to listen on")
+	flag.DurationVar(&idleTimeout, "idle-timeout", http1.DefaultIdleTimeout, "How long a kept-alive connection may wait for its next request")
+	flag.IntVar(&maxRequests, "max-requests", http1.DefaultMaxRequests, "Requests served on one connection before it is closed (1 disables keep-alive)")
+	flag.StringVar(&cachePolicy, "cache-policy", "*=no-cache", "Cache-Control per extension, e.g. '.html=no-cache; .css,.js=public, max-age=86400; *=max-age=300'")
+	flag.BoolVar(&hashETags, "etag-hash", false, "Derive ETags from a hash of the file content instead of its size and modification time")
+	flag.StringVar(&mimeTypesPath, "mime-types", "", "mime.types file with extra or overriding extension mappings, e.g. /etc/mime.types")
+	flag.BoolVar(&compress, "compress", true, "Compress text responses with gzip or deflate when the client accepts it")
+	flag.BoolVar(&precompressed, "precompressed", false, "Serve a fresh file.gz sibling, when present, to clients that accept gzip")
+	flag.StringVar(&symlinks, "symlinks", "inside", "Symbolic links to follow: inside (only those pointing under the root), follow or deny")
+	flag.BoolVar(&hideDotfiles, "hide-dotfiles", true, "Answer 404 for names starting with '.' and leave them out of listings")
+	flag.BoolVar(&index, "index", false, "Serve a directory's index.html instead of its listing")
+	flag.StringVar(&vhostsPath, "vhosts", "", "YAML or JSON file mapping Host names to roots, redirects and proxy upstreams; replaces -d")
+	flag.StringVar(&proxyUpstreams, "proxy", "", "Comma-separated host:port upstreams to forward every request to; replaces -d")
+	flag.StringVar(&balance, "balance", "round-robin", "How -proxy spreads requests: round-robin or least-conn")
+	flag.BoolVar(&useTLS, "tls", false, "Serve HTTPS, with a self-signed certificate unless -tls-cert and -tls-key are given")
+	flag.StringVar(&certFile, "tls-cert", "", "PEM certificate chain for HTTPS; implies -tls")
+	flag.StringVar(&keyFile, "tls-key", "", "PEM private key for -tls-cert")
+	flag.BoolVar(&enableHTTP2, "http2", true, "Offer HTTP/2 to HTTPS clients through ALPN")
+	logOpts := logging.RegisterFlags()
+	cfg.Parse()
+	logger := logOpts.Setup(os.Stderr)
+
+	if args := cfg.Args(0, 1); len(args) == 1 {
+		port, err = cliconfig.ParsePort(args[0])
+		cfg.Validate(err)
+	}
+	cfg.Validate(cliconfig.ValidateHost(listenHost), cliconfig.ValidatePort(port))
+	if idleTimeout <= 0 || maxRequests <= 0 {
+		cfg.Fail(fmt.Errorf("-idle-timeout and -max-requests must be positive"))
+	}
+	policy, err := httpfile.ParseCachePolicy(cachePolicy)
+	cfg.Validate(err)
+	symlinkPolicy, err := httpfile.ParseSymlinkPolicy(symlinks)
+	cfg.Validate(err)
+	types := httpfile.NewMIMETypes()
+	if mimeTypesPath != "" {
+		cfg.Validate(types.LoadFile(mimeTypesPath))
+	}
+
+	var tlsConfig *tls.Config
+	if (certFile == "") != (keyFile == "") {
+		cfg.Fail(fmt.Errorf("-tls-cert and -tls-key must be given together"))
+	}
+	if useTLS || certFile != "" {
+		var cert tls.Certificate
+		if certFile != "" {
+			cert, err = tls.LoadX509KeyPair(certFile, keyFile)
+			cfg.Validate(err)
+		} else {
+			cert, err = selfSignedCertificate(listenHost)
+			if err != nil {
+				logging.Fatal(logger, "cannot generate a certificate", "error", err)
+			}
+			fingerprint := sha256.Sum256(cert.Certificate[0])
+			logger.Warn("serving a self-signed certificate; clients must skip verification or pin it",
+				"sha256", hex.EncodeToString(fingerprint[:]))
+		}
+		tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+			NextProtos:   []string{"http/1.1"},
+		}
+		if enableHTTP2 {
+			tlsConfig.NextProtos = []string{http2.NextProto, "http/1.1"}
+		}
 	}
 
-	args := flag.Args()
-	port := 8080
-	if len(args) > 1 {
-		port, err = strconv.Atoi(args[0])
+	var hashes *httpfile.HashCache
+	if hashETags {
+		hashes = httpfile.NewHashCache()
+	}
+	newFileServer := func(root string, prefix string, pages errorPages) *fileServer {
+		if rootInfo, err := os.Stat(root); err != nil {
+			cfg.Fail(fmt.Errorf("cannot open root directory: %w", err))
+		} else if !rootInfo.IsDir() {
+			cfg.Fail(fmt.Errorf("root path %s is not a directory", root))
+		}
+		resolver, err := httpfile.NewResolver(root, symlinkPolicy, hideDotfiles)
 		if err != nil {
-			panic(err)
+			logging.Fatal(logger, "cannot resolve root directory", "root", root, "error", err)
+		}
+		logger.Info("serving directory", "root", resolver.Root(), "prefix", prefix)
+		return &fileServer{
+			resolver:      resolver,
+			prefix:        strings.TrimSuffix(prefix, "/"),
+			index:         index,
+			cachePolicy:   policy,
+			types:         types,
+			hashes:        hashes,
+			compress:      compress,
+			precompressed: precompressed,
+			errorPages:    pages,
 		}
 	}
 
-	sock, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	var vhosts *vhost.Config
+	switch {
+	case vhostsPath != "" && proxyUpstreams != "":
+		cfg.Fail(fmt.Errorf("-vhosts and -proxy can't be combined; add a proxy route to the config instead"))
+	case vhostsPath != "":
+		vhosts, err = vhost.LoadConfig(vhostsPath)
+		cfg.Validate(err)
+	case proxyUpstreams != "":
+		// Reverse proxy mode is a single catch-all proxy route.
+		route := &vhost.Route{Prefix: "/", Proxy: strings.Split(proxyUpstreams, ","), Balance: balance}
+		vhosts = &vhost.Config{Hosts: []*vhost.Host{{Names: []string{"*"}, Routes: []*vhost.Route{route}}}}
+		cfg.Validate(vhosts.Validate())
+	}
+
+	var handler http1.Handler
+	if vhosts != nil {
+		sites := &virtualHosts{
+			router:  vhost.NewRouter(vhosts),
+			pages:   map[*vhost.Host]errorPages{},
+			files:   map[*vhost.Route]*fileServer{},
+			proxies: map[*vhost.Route]*httpproxy.Proxy{},
+		}
+		for _, host := range vhosts.Hosts {
+			pages, err := loadErrorPages(host.ErrorPages, types)
+			cfg.Validate(err)
+			sites.pages[host] = pages
+			for _, route := range host.Routes {
+				switch {
+				case route.Root != "":
+					sites.files[route] = newFileServer(route.Root, route.Prefix, pages)
+				case len(route.Proxy) > 0:
+					proxy := httpproxy.New(route.Proxy...)
+					proxy.Balance, _ = httpproxy.ParseBalance(route.Balance)
+					proxy.PreserveHost = route.PreserveHost
+					if route.StripPrefix {
+						proxy.StripPrefix = route.Prefix
+					}
+					sites.proxies[route] = proxy
+				}
+			}
+			logger.Info("virtual host", "names", strings.Join(host.Names, ","), "routes", len(host.Routes))
+		}
+		handler = sites.serve
+	} else {
+		handler = newFileServer(rootDir, "/", nil).serve
+	}
+
+	sock, err := net.Listen("tcp", net.JoinHostPort(listenHost, strconv.Itoa(port)))
 	if err != nil {
-		panic(err)
+		logging.Fatal(logger, "failed to listen", "host", listenHost, "port", port, "error", err)
+	}
+	if tlsConfig != nil {
+		sock = tls.NewListener(sock, tlsConfig)
+	}
+	logger.Info("web server listening", "addr", sock.Addr().String(), "tls", tlsConfig != nil, "protocols", strings.Join(protocols(tlsConfig), ","))
+
+	server := &servers{
+		http1: &http1.Server{
+			IdleTimeout: idleTimeout,
+			MaxRequests: maxRequests,
+			Handler:     logRequests(handler),
+		},
+		http2: &http2.Server{
+			IdleTimeout: idleTimeout,
+			Handler:     logRequests(handler),
+		},
 	}
 
 	for {
 		conn, err := sock.Accept()
 		if err != nil {
-			fmt.Println(err)
+			logger.Error("failed to accept connection", "error", err)
 			continue
 		}
 
 		// Handle the connection in a new goroutine
-		go handleConnection(conn, rootDir)
+		go handleConnection(conn, server)
 	}
 }
 
-func handleConnection(conn net.Conn, rootDir string) {
-	defer conn.Close()
-	fmt.Printf("Remote Address: %s %s\n", conn.RemoteAddr().Network(), conn.RemoteAddr().String())
-	fmt.Printf("Local Address: %s %s\n", conn.LocalAddr().Network(), conn.LocalAddr().String())
+// servers serves both protocols with the same handler, picked by ALPN.
+type servers struct {
+	http1 *http1.Server
+	http2 *http2.Server
+}
 
-	buffer := make([]byte, 4096)
-	var sb strings.Builder
-	var last3Bytes []byte = []byte{}
-	for {
-		mLen, err := conn.Read(buffer)
-		if err != nil {
-			if err != io.EOF {
-				fmt.Println("Error reading:", err.Error())
-			}
-			break
+// handshakeTimeout bounds the TLS handshake.
+const handshakeTimeout = 10 * time.Second
+
+func handleConnection(conn net.Conn, server *servers) {
+	logger := logging.WithConn(slog.Default(), conn)
+	logger.Debug("connection accepted", "local_addr", conn.LocalAddr().String())
+
+	serve := server.http1.ServeConn
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			logger.Debug("TLS handshake failed", "error", err)
+			conn.Close()
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+		state := tlsConn.ConnectionState()
+		logger.Debug("TLS handshake complete", "version", tls.VersionName(state.Version), "protocol", state.NegotiatedProtocol, "server_name", state.ServerName)
+		if state.NegotiatedProtocol == http2.NextProto {
+			serve = server.http2.ServeConn
 		}
+	}
+
+	if err := serve(conn); err != nil {
+		logger.Warn("connection ended with an error", "status", http1.StatusOf(err), "error", err)
+		return
+	}
+	logger.Debug("connection closed")
+}
 
-		sb.Write(buffer[:mLen])
-		if bytes.Contains(append(last3Bytes, buffer[:mLen]...), []byte("\r\n\r\n")) {
-			break
+func protocols(config *tls.Config) []string {
+	if config == nil {
+		return []string{"http/1.1"}
+	}
+	return config.NextProtos
+}
+
+// selfSignedCertificate makes a throwaway certificate so -tls works out of
+// the box for local testing.
+func selfSignedCertificate(listenHost string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "localhost", Organization: []string{"networkconcepts webserver"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	names := []string{"localhost", "127.0.0.1", "::1", listenHost}
+	if hostname, err := os.Hostname(); err == nil {
+		names = append(names, hostname)
+	}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if name != "" && !slices.Contains(template.DNSNames, name) {
+			template.DNSNames = append(template.DNSNames, name)
 		}
+	}
 
-		if mLen >= 3 {
-			last3Bytes = buffer[mLen-3:]
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+func logRequests(next http1.Handler) http1.Handler {
+	return func(w *http1.Response, req *http1.Request) {
+		slog.Info("request", "remote_addr", req.RemoteAddr, "proto", req.Proto, "method", req.Method, "host", req.Host, "path", req.Target)
+		next(w, req)
+	}
+}
+
+// errorPage is a custom body for an error status.
+type errorPage struct {
+	contentType string
+	body        []byte
+}
+
+type errorPages map[int]errorPage
+
+// loadErrorPages reads the configured pages up front, so a missing file
+// is found at startup.
+func loadErrorPages(paths map[int]string, types *httpfile.MIMETypes) (errorPages, error) {
+	pages := errorPages{}
+	for status, path := range paths {
+		body, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error page for %d: %w", status, err)
 		}
+		contentType, err := types.TypeOf(path, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		pages[status] = errorPage{contentType: contentType, body: body}
+	}
+	return pages, nil
+}
+
+// write answers with the custom page for status, or with message.
+func (p errorPages) write(w *http1.Response, status int, message string) {
+	page, ok := p[status]
+	if !ok {
+		page = errorPage{contentType: "text/plain; charset=utf-8", body: []byte(message)}
 	}
-	requestHeaders := sb.String()
-	var firstHeaderLine = strings.Split(requestHeaders, "\r\n")[0]
-	requestMethod := firstHeaderLine[:strings.Index(firstHeaderLine, " ")+1]
-	fmt.Printf("Request method: %s\n", requestMethod)
+	w.Header.Set("Content-Type", page.contentType)
+	w.Header.Set("Content-Length", strconv.Itoa(len(page.body)))
+	w.WriteHeader(status)
+	w.Write(page.body)
+}
 
-	var requestPath = firstHeaderLine[strings.Index(firstHeaderLine, " ")+1 : strings.LastIndex(firstHeaderLine, " ")]
-	filePath, err := url.QueryUnescape(requestPath[1:])
+// virtualHosts picks the site by Host header and the route by path prefix.
+type virtualHosts struct {
+	router  *vhost.Router
+	pages   map[*vhost.Host]errorPages
+	files   map[*vhost.Route]*fileServer
+	proxies map[*vhost.Route]*httpproxy.Proxy
+}
 
-	if err != nil {
-		fmt.Printf("Error decoding URI: %v\n", err)
+func (v *virtualHosts) serve(w *http1.Response, req *http1.Request) {
+	logger := slog.Default().With("remote_addr", req.RemoteAddr, "host", req.Host)
+	host := v.router.Host(req.Host)
+	if host == nil {
+		logger.Warn("request failed", "status", http1.StatusNotFound, "error", "no site for host")
+		errorPages(nil).write(w, http1.StatusNotFound, fmt.Sprintf("No site for host %s", req.Host))
+		return
 	}
-	filePath = filepath.Join(rootDir, filePath)
-	fmt.Printf("File requested: %s\n", filePath)
+	pages := v.pages[host]
+
+	// Dot segments are resolved here, so a route is never picked for a
+	// path that ends up outside it.
+	if cleaned := vhost.CleanPath(req.Path); strings.HasPrefix(req.Path, "/") && cleaned != req.Path {
+		location := (&url.URL{Path: cleaned, RawQuery: req.RawQuery}).String()
+		w.Header.Set("Location", location)
+		pages.write(w, http1.StatusMovedPermanently, fmt.Sprintf("Moved to %s", location))
+		return
+	}
+	route := host.Route(req.Path)
+	switch {
+	case route == nil:
+		pages.write(w, http1.StatusNotFound, fmt.Sprintf("File not found: %s", req.Path))
+	case route.Redirect != "":
+		location := route.Location(req.Path, req.RawQuery)
+		w.Header.Set("Location", location)
+		pages.write(w, route.Status, fmt.Sprintf("Moved to %s", location))
+	case len(route.Proxy) > 0:
+		err := v.proxies[route].Serve(w, req)
+		if err == nil {
+			return
+		}
+		logger.Warn("proxy request failed", "path", req.Path, "status", http1.StatusOf(err), "error", err)
+		if w.Status() == 0 {
+			status := http1.StatusOf(err)
+			if status == 0 {
+				status = http1.StatusBadGateway
+			}
+			pages.write(w, status, http1.StatusText(status))
+		}
+	default:
+		v.files[route].serve(w, req)
+	}
+}
+
+// fileServer serves the files under its resolver's root.
+type fileServer struct {
+	resolver    *httpfile.Resolver
+	prefix      string
+	index       bool
+	cachePolicy httpfile.CachePolicy
+	types       *httpfile.MIMETypes
+	// hashes is set when ETags come from file content.
+	hashes        *httpfile.HashCache
+	compress      bool
+	precompressed bool
+	errorPages    errorPages
+}
+
+func (s *fileServer) serve(w *http1.Response, req *http1.Request) {
+	logger := slog.Default().With("remote_addr", req.RemoteAddr)
+	if !http1.AllowMethod(w, req, "GET", "HEAD") {
+		logger.Warn("request failed", "status", http1.StatusMethodNotAllowed, "method", req.Method)
+		s.errorPages.write(w, http1.StatusMethodNotAllowed, fmt.Sprintf("Method not allowed: %s", req.Method))
+		return
+	}
+	relPath := strings.TrimPrefix(req.Path, s.prefix)
 
 	var errorMessage string
-	var responseCode string
+	var responseCode int
 	var contentType string
 	var responseBody []byte
-	filePath, err = filepath.Abs(filePath)
-	if err != nil {
-		errorMessage = fmt.Sprintf("Internal Server Error: %s", err.Error())
-		responseCode = "500 Internal Server Error"
-	} else if !strings.HasPrefix(filePath, rootDir) {
-		errorMessage = fmt.Sprintf("Access denied: %s", filePath)
-		responseCode = "403 Forbidden"
-	} else if fileInfo, err := os.Stat(filePath); os.IsNotExist(err) {
-		errorMessage = fmt.Sprintf("File not found: %s", filePath)
-		responseCode = "404 Not Found"
+	filePath, err := s.resolver.Resolve(relPath)
+	if errors.Is(err, httpfile.ErrNotFound) {
+		errorMessage = fmt.Sprintf("File not found: %s", req.Path)
+		responseCode = http1.StatusNotFound
+	} else if errors.Is(err, httpfile.ErrForbidden) {
+		errorMessage = fmt.Sprintf("Access denied: %s", req.Path)
+		responseCode = http1.StatusForbidden
 	} else if err != nil {
 		errorMessage = fmt.Sprintf("Internal Server Error: %s", err.Error())
-		responseCode = "500 Internal Server Error"
-	} else {
-		if fileInfo.IsDir() {
-			renderDir(rootDir, filePath, &responseBody, &errorMessage, &responseCode, &contentType)
+		responseCode = http1.StatusInternalServerError
+	} else if fileInfo, err := os.Stat(filePath); err != nil {
+		errorMessage = fmt.Sprintf("Internal Server Error: %s", err.Error())
+		responseCode = http1.StatusInternalServerError
+	} else if fileInfo.IsDir() && !strings.HasSuffix(req.Path, "/") {
+		// Relative links only work with the trailing slash.
+		location := httpfile.DirLocation(req.Path, req.RawQuery)
+		w.Header.Set("Location", location)
+		errorMessage = fmt.Sprintf("Moved to %s", location)
+		responseCode = http1.StatusMovedPermanently
+	} else if fileInfo.IsDir() {
+		indexRelPath := path.Join(relPath, "index.html")
+		indexPath, err := s.resolver.Resolve(indexRelPath)
+		if indexInfo, statErr := os.Stat(indexPath); s.index && err == nil && statErr == nil && indexInfo.Mode().IsRegular() {
+			s.renderFile(w, req, indexRelPath, indexPath, &errorMessage, &responseCode)
+			if errorMessage == "" {
+				return
+			}
 		} else {
-			renderFile(filePath, &responseBody, &errorMessage, &responseCode, &contentType)
+			s.renderDir(req, relPath, filePath, &responseBody, &errorMessage, &responseCode, &contentType)
+		}
+	} else {
+		s.renderFile(w, req, relPath, filePath, &errorMessage, &responseCode)
+		if errorMessage == "" {
+			return
 		}
-
 	}
 
 	if errorMessage != "" {
-		conn.Write([]byte(fmt.Sprintf("HTTP/1.1 %s\r\nContent-Type: text/plain\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", responseCode, len(errorMessage), errorMessage)))
-	} else {
-		conn.Write([]byte(fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Type: %s\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", contentType, len(responseBody), responseBody)))
+		logger.Warn("request failed", "status", responseCode, "error", errorMessage)
+		s.errorPages.write(w, responseCode, errorMessage)
+		return
 	}
-}
 
-func renderDir(rootDir string, dirPath string, responseBody *[]byte, errorMessage *string, responseCode *string, contentType *string) {
-	relPath, err := filepath.Rel(rootDir, dirPath)
-	if err != nil {
-		*errorMessage = fmt.Sprintf("Internal Server Error: %s", err.Error())
-		*responseCode = "500 Internal Server Error"
-		return
+	if httpfile.Compressible(contentType) && s.compress {
+		w.Header.Add("Vary", "Accept-Encoding")
+		if coding := httpfile.Negotiate(req.Header.Get("Accept-Encoding"), "gzip", "deflate"); coding != "" && len(responseBody) >= httpfile.MinCompressSize {
+			if compressed, err := httpfile.Compress(responseBody, coding); err == nil {
+				w.Header.Set("Content-Encoding", coding)
+				responseBody = compressed
+			}
+		}
 	}
+	w.Header.Set("Content-Type", contentType)
+	w.Header.Set("Content-Length", strconv.Itoa(len(responseBody)))
+	w.WriteHeader(http1.StatusOK)
+	w.Write(responseBody)
+}
+
+// renderDir lists the directory, leaving out entries the resolver refuses.
+func (s *fileServer) renderDir(req *http1.Request, relPath string, dirPath string, responseBody *[]byte, errorMessage *string, responseCode *int, contentType *string) {
 	files, err := os.ReadDir(dirPath)
 	if err != nil {
 		*errorMessage = fmt.Sprintf("Internal Server Error: %s", err.Error())
-		*responseCode = "500 Internal Server Error"
+		*responseCode = http1.StatusInternalServerError
+		return
 	}
 
-	var sb strings.Builder
-	sb.WriteString("<html><head><title>Directory Listing</title></head><body><h1>Directory Listing</h1><ul>")
+	var entries []httpfile.Entry
 	for _, file := range files {
-		sb.WriteString(fmt.Sprintf("<li><a href=\"/%s/%s\">%s</a></li>", relPath, file.Name(), file.Name()))
+		if s.resolver.Hidden(file.Name()) {
+			continue
+		}
+		target, err := s.resolver.Resolve(relPath + "/" + file.Name())
+		if err != nil {
+			continue
+		}
+		info, err := os.Stat(target)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, httpfile.Entry{Name: file.Name(), IsDir: info.IsDir(), Size: info.Size(), ModTime: info.ModTime()})
 	}
 
-	sb.WriteString("</ul></body></html>")
+	query, _ := url.ParseQuery(req.RawQuery)
 	*contentType = "text/html; charset=utf-8"
-	*responseBody = []byte(sb.String())
+	*responseBody = httpfile.Listing(req.Path, entries, query.Get("sort"), query.Get("order") == "desc")
 }
 
-func renderFile(filePath string, responseBody *[]byte, errorMessage *string, responseCode *string, contentType *string) {
-	var content, err = os.ReadFile(filePath)
+// renderFile streams the file at relPath, leaving errors found before
+// anything is sent in errorMessage.
+func (s *fileServer) renderFile(w *http1.Response, req *http1.Request, relPath string, filePath string, errorMessage *string, responseCode *int) {
+	file, err := os.Open(filePath)
 	if err != nil {
 		*errorMessage = fmt.Sprintf("Internal Server Error: %s", err.Error())
-		*responseCode = "500 Internal Server Error"
-	} else {
-		if strings.HasSuffix(filePath, ".html") || strings.HasSuffix(filePath, ".htm") {
-			*contentType = "text/html; charset=utf-8"
-			*responseBody = content
-		} else if strings.HasSuffix(filePath, ".txt") || strings.HasSuffix(filePath, ".log") || strings.HasSuffix(filePath, ".csv") || strings.HasSuffix(filePath, ".md") {
-			*contentType = "text/plain; charset=utf-8"
-			*responseBody = content
-		} else if strings.HasSuffix(filePath, ".jpg") {
-			*contentType = "image/jpeg"
-			*responseBody = content
-		} else if strings.HasSuffix(filePath, ".png") {
-			*contentType = "image/png"
-			*responseBody = content
-		} else if strings.HasSuffix(filePath, ".pdf") {
-			*contentType = "application/pdf"
-			*responseBody = content
-		} else {
-			*errorMessage = fmt.Sprintf("File content is not supported: %s", filePath)
-			*responseCode = "400 Bad Request"
+		*responseCode = http1.StatusInternalServerError
+		return
+	}
+	defer file.Close()
+	fileInfo, err := file.Stat()
+	if err != nil {
+		*errorMessage = fmt.Sprintf("Internal Server Error: %s", err.Error())
+		*responseCode = http1.StatusInternalServerError
+		return
+	}
+	contentType, err := s.types.TypeOf(filePath, file)
+	if err != nil {
+		*errorMessage = fmt.Sprintf("Internal Server Error: %s", err.Error())
+		*responseCode = http1.StatusInternalServerError
+		return
+	}
+
+	etag, err := s.etag(filePath, fileInfo)
+	if err != nil {
+		*errorMessage = fmt.Sprintf("Internal Server Error: %s", err.Error())
+		*responseCode = http1.StatusInternalServerError
+		return
+	}
+	if cacheControl := s.cachePolicy.For(filePath); cacheControl != "" {
+		w.Header.Set("Cache-Control", cacheControl)
+	}
+
+	coding := ""
+	if httpfile.Compressible(contentType) && (s.compress || s.precompressed) {
+		w.Header.Add("Vary", "Accept-Encoding")
+		acceptEncoding := req.Header.Get("Accept-Encoding")
+		if s.precompressed && httpfile.Negotiate(acceptEncoding, "gzip") == "gzip" {
+			if gz, gzPath, gzInfo, ok := s.resolver.OpenPrecompressed(relPath, fileInfo); ok {
+				defer gz.Close()
+				if gzETag, err := s.etag(gzPath, gzInfo); err == nil {
+					// The sibling is served as-is, so it keeps Range
+					// support; ranges count bytes of the gzip stream.
+					w.Header.Set("Content-Encoding", "gzip")
+					file, fileInfo, etag = gz, gzInfo, httpfile.EncodedETag(gzETag, "gzip")
+				}
+			}
+		}
+		if s.compress && w.Header.Get("Content-Encoding") == "" && fileInfo.Size() >= httpfile.MinCompressSize {
+			coding = httpfile.Negotiate(acceptEncoding, "gzip", "deflate")
 		}
 	}
+
+	if coding != "" {
+		httpfile.SetValidators(w, fileInfo.ModTime(), httpfile.EncodedETag(etag, coding))
+		err = httpfile.ServeEncoded(w, req, file, contentType, coding)
+	} else {
+		httpfile.SetValidators(w, fileInfo.ModTime(), etag)
+		err = httpfile.ServeContent(w, req, file, fileInfo.Size(), contentType)
+	}
+	if err != nil {
+		slog.Warn("failed to send file", "remote_addr", req.RemoteAddr, "file", filePath, "status", w.Status(), "error", err)
+	}
+}
+
+func (s *fileServer) etag(path string, info os.FileInfo) (string, error) {
+	if s.hashes != nil {
+		return s.hashes.ETag(path, info)
+	}
+	return httpfile.ETag(info), nil
 }
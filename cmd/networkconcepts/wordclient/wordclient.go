@@ -3,41 +3,54 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"flag"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"strconv"
+
+	"github.com/vinh0604/go-network-concepts/internal/cliconfig"
+	"github.com/vinh0604/go-network-concepts/internal/logging"
 )
 
 const WORD_LENGTH_SIZE = 2
 
 func main() {
 	var err error
-	if len(os.Args) < 2 {
-		fmt.Println("usage: wordclient <port>")
-		return
-	}
+	cfg := cliconfig.New("WORD_CLIENT", "[port]", "Prints the words sent by scripts/wordserver.py. The port is required, either positionally or with -port.")
 
-	port, err := strconv.Atoi(os.Args[1])
-	if err != nil {
-		panic(err)
+	var host string
+	var port int
+	flag.StringVar(&host, "host", "localhost", "Server host")
+	flag.IntVar(&port, "port", 0, "Server port")
+	logOpts := logging.RegisterFlags()
+	cfg.Parse()
+	logger := logOpts.Setup(os.Stderr)
+
+	if args := cfg.Args(0, 1); len(args) == 1 {
+		port, err = cliconfig.ParsePort(args[0])
+		cfg.Validate(err)
 	}
+	cfg.Validate(cliconfig.ValidateHost(host), cliconfig.ValidatePort(port))
 
-	sock, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+	sock, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
 	if err != nil {
-		panic(err)
+		logging.Fatal(logger, "failed to connect", "host", host, "port", port, "error", err)
 	}
+	defer sock.Close()
+	logger = logging.WithConn(logger, sock)
 
 	var buffer bytes.Buffer
 	for {
 		packet, err := getNextWordPacket(&buffer, sock)
 		if err != nil {
 			if err != io.EOF {
-				panic(err)
+				logger.Error("failed to read word packet", "error", err)
+				break
 			}
 
-			fmt.Println("Connection closed")
+			logger.Info("connection closed")
 			break
 		}
 
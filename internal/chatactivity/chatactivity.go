@@ -0,0 +1,212 @@
+package chatactivity
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Receipt statuses, in the order a message goes through them.
+const (
+	StatusSent      = "sent"
+	StatusDelivered = "delivered"
+	StatusRead      = "read"
+)
+
+const (
+	// TypingInterval is how often a client repeats a typing event while
+	// the user keeps typing.
+	TypingInterval = 3 * time.Second
+	// TypingTimeout outlasts the interval so a steady typist does not flicker.
+	TypingTimeout = 5 * time.Second
+)
+
+// IsReceiptStatus reports whether a client may send status in a receipt.
+// "sent" receipts only come from the server.
+func IsReceiptStatus(status string) bool {
+	return status == StatusDelivered || status == StatusRead
+}
+
+// Log remembers who sent the most recent messages and who they went to.
+// It is safe for concurrent use.
+type Log[K comparable] struct {
+	mu       sync.Mutex
+	capacity int
+	order    []string
+	entries  map[string]logEntry[K]
+}
+
+type logEntry[K comparable] struct {
+	sender     K
+	recipients []K
+}
+
+func NewLog[K comparable](capacity int) *Log[K] {
+	return &Log[K]{capacity: capacity, entries: map[string]logEntry[K]{}}
+}
+
+func (l *Log[K]) Add(id string, sender K, recipients []K) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.entries[id]; !ok {
+		l.order = append(l.order, id)
+	}
+	l.entries[id] = logEntry[K]{sender: sender, recipients: recipients}
+	for len(l.order) > l.capacity {
+		delete(l.entries, l.order[0])
+		l.order = l.order[1:]
+	}
+}
+
+// Sender returns who sent message id, provided recipient was one of those
+// it went to.
+func (l *Log[K]) Sender(id string, recipient K) (K, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry, ok := l.entries[id]
+	if !ok || !slices.Contains(entry.recipients, recipient) {
+		var zero K
+		return zero, false
+	}
+	return entry.sender, true
+}
+
+// Forget drops the messages of a sender that disconnected.
+func (l *Log[K]) Forget(sender K) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.order = slices.DeleteFunc(l.order, func(id string) bool {
+		if l.entries[id].sender == sender {
+			delete(l.entries, id)
+			return true
+		}
+		return false
+	})
+}
+
+// Limiter allows one event per key per interval. It is safe for concurrent
+// use.
+type Limiter[K comparable] struct {
+	mu       sync.Mutex
+	interval time.Duration
+	last     map[K]time.Time
+}
+
+func NewLimiter[K comparable](interval time.Duration) *Limiter[K] {
+	return &Limiter[K]{interval: interval, last: map[K]time.Time{}}
+}
+
+func (l *Limiter[K]) Allow(key K, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if last, ok := l.last[key]; ok && now.Sub(last) < l.interval {
+		return false
+	}
+	l.last[key] = now
+	return true
+}
+
+func (l *Limiter[K]) Forget(key K) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.last, key)
+}
+
+// Receipts collects the receipts for the messages a client sent.
+type Receipts struct {
+	delivered map[string][]string
+	read      map[string][]string
+}
+
+func NewReceipts() *Receipts {
+	return &Receipts{delivered: map[string][]string{}, read: map[string][]string{}}
+}
+
+// Record notes that nick has reached status for message id. A read message
+// was also delivered.
+func (r *Receipts) Record(id string, nick string, status string) {
+	add := func(m map[string][]string) {
+		if !slices.Contains(m[id], nick) {
+			m[id] = append(m[id], nick)
+		}
+	}
+	switch status {
+	case StatusRead:
+		add(r.read)
+		add(r.delivered)
+	case StatusDelivered:
+		add(r.delivered)
+	}
+}
+
+// Summary describes how far message id got.
+func (r *Receipts) Summary(id string, direct bool) string {
+	read, delivered := r.read[id], r.delivered[id]
+	if direct {
+		switch {
+		case len(read) > 0:
+			return StatusRead
+		case len(delivered) > 0:
+			return StatusDelivered
+		}
+		return StatusSent
+	}
+	switch {
+	case len(read) > 0 && len(read) <= 3:
+		names := slices.Clone(read)
+		slices.Sort(names)
+		return "read by " + strings.Join(names, ", ")
+	case len(read) > 3:
+		return fmt.Sprintf("read by %d", len(read))
+	case len(delivered) > 0:
+		return fmt.Sprintf("delivered to %d", len(delivered))
+	}
+	return StatusSent
+}
+
+// Typing tracks who is typing, forgetting them after TypingTimeout.
+type Typing struct {
+	seen map[string]time.Time
+}
+
+func NewTyping() *Typing {
+	return &Typing{seen: map[string]time.Time{}}
+}
+
+func (t *Typing) Saw(nick string, now time.Time) {
+	t.seen[nick] = now
+}
+
+// Stop forgets nick, e.g. once their message arrives.
+func (t *Typing) Stop(nick string) {
+	delete(t.seen, nick)
+}
+
+// Active returns the nicks typing at now, sorted.
+func (t *Typing) Active(now time.Time) []string {
+	nicks := []string{}
+	for nick, seen := range t.seen {
+		if now.Sub(seen) < TypingTimeout {
+			nicks = append(nicks, nick)
+		} else {
+			delete(t.seen, nick)
+		}
+	}
+	slices.Sort(nicks)
+	return nicks
+}
+
+// Describe renders the typing nicks for a status bar.
+func Describe(nicks []string) string {
+	switch len(nicks) {
+	case 0:
+		return ""
+	case 1:
+		return nicks[0] + " is typing..."
+	case 2:
+		return nicks[0] + " and " + nicks[1] + " are typing..."
+	}
+	return "several people are typing..."
+}
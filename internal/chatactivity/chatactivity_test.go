@@ -0,0 +1,93 @@
+package chatactivity
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogEvictsOldest(t *testing.T) {
+	assert := assert.New(t)
+	log := NewLog[string](2)
+	log.Add("1", "alice", []string{"bob"})
+	log.Add("2", "bob", []string{"alice"})
+	log.Add("3", "alice", []string{"bob"})
+
+	_, ok := log.Sender("1", "bob")
+	assert.False(ok, "Expected the oldest message to be evicted")
+	sender, ok := log.Sender("3", "bob")
+	assert.True(ok)
+	assert.Equal("alice", sender)
+
+	log.Forget("alice")
+	_, ok = log.Sender("3", "bob")
+	assert.False(ok)
+	_, ok = log.Sender("2", "alice")
+	assert.True(ok)
+}
+
+func TestLogSenderOnlyForRecipients(t *testing.T) {
+	assert := assert.New(t)
+	log := NewLog[string](2)
+	log.Add("1", "alice", []string{"bob", "carol"})
+
+	_, ok := log.Sender("1", "carol")
+	assert.True(ok)
+	_, ok = log.Sender("1", "mallory")
+	assert.False(ok, "Expected a receipt from someone the message never reached to be refused")
+}
+
+func TestLimiter(t *testing.T) {
+	limiter := NewLimiter[string](2 * time.Second)
+	start := time.Now()
+	assert.True(t, limiter.Allow("alice", start))
+	assert.False(t, limiter.Allow("alice", start.Add(time.Second)))
+	assert.True(t, limiter.Allow("bob", start.Add(time.Second)), "Expected keys to be limited separately")
+	assert.True(t, limiter.Allow("alice", start.Add(2*time.Second)))
+}
+
+func TestReceiptSummary(t *testing.T) {
+	assert := assert.New(t)
+	r := NewReceipts()
+	assert.Equal(StatusSent, r.Summary("1", true))
+
+	r.Record("1", "bob", StatusDelivered)
+	assert.Equal(StatusDelivered, r.Summary("1", true))
+	r.Record("1", "bob", StatusRead)
+	assert.Equal(StatusRead, r.Summary("1", true))
+
+	r.Record("2", "bob", StatusDelivered)
+	r.Record("2", "carol", StatusDelivered)
+	r.Record("2", "carol", StatusDelivered)
+	assert.Equal("delivered to 2", r.Summary("2", false), "Expected duplicate receipts to count once")
+	r.Record("2", "carol", StatusRead)
+	r.Record("2", "bob", StatusRead)
+	assert.Equal("read by bob, carol", r.Summary("2", false))
+
+	for i := 0; i < 4; i++ {
+		r.Record("3", fmt.Sprint("user", i), StatusRead)
+	}
+	assert.Equal("read by 4", r.Summary("3", false))
+}
+
+func TestReceiptStatuses(t *testing.T) {
+	assert.True(t, IsReceiptStatus(StatusRead))
+	assert.False(t, IsReceiptStatus(StatusSent), "Expected only the server to send sent receipts")
+}
+
+func TestTyping(t *testing.T) {
+	assert := assert.New(t)
+	typing := NewTyping()
+	now := time.Now()
+	typing.Saw("carol", now)
+	typing.Saw("bob", now.Add(-TypingTimeout))
+	assert.Equal([]string{"carol"}, typing.Active(now))
+
+	typing.Saw("alice", now)
+	assert.Equal("alice and carol are typing...", Describe(typing.Active(now)))
+	typing.Stop("alice")
+	assert.Equal("carol is typing...", Describe(typing.Active(now)))
+	assert.Equal("", Describe(nil))
+}
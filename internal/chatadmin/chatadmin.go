@@ -0,0 +1,200 @@
+package chatadmin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vinh0604/go-network-concepts/internal/netfunc"
+)
+
+const (
+	CmdKick   = "kick"
+	CmdBan    = "ban"
+	CmdUnban  = "unban"
+	CmdMute   = "mute"
+	CmdUnmute = "unmute"
+	CmdTopic  = "topic"
+)
+
+type Config struct {
+	AdminTokens []string `json:"admin_tokens"`
+}
+
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+func (c *Config) IsAdminToken(token string) bool {
+	return token != "" && slices.Contains(c.AdminTokens, token)
+}
+
+// AuthorizeHTTP reports whether an HTTP request carries an admin bearer
+// token, or comes from loopback when no tokens are configured.
+func (c *Config) AuthorizeHTTP(r *http.Request) bool {
+	if len(c.AdminTokens) > 0 {
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		return found && c.IsAdminToken(strings.TrimSpace(token))
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	addr, err := netip.ParseAddr(host)
+	return err == nil && addr.Unmap().IsLoopback()
+}
+
+type Command struct {
+	Name   string
+	Target string
+	Args   string
+}
+
+// ParseCommand parses an admin command line such as "/kick bob flooding".
+// The leading slash is optional.
+func ParseCommand(line string) (*Command, error) {
+	line = strings.TrimPrefix(strings.TrimSpace(line), "/")
+	name, rest, _ := strings.Cut(line, " ")
+	rest = strings.TrimSpace(rest)
+
+	switch name {
+	case CmdTopic:
+		return &Command{Name: name, Args: rest}, nil
+	case CmdKick, CmdBan, CmdUnban, CmdMute, CmdUnmute:
+		target, args, _ := strings.Cut(rest, " ")
+		if target == "" {
+			return nil, fmt.Errorf("usage: /%s <target> [reason]", name)
+		}
+		return &Command{Name: name, Target: target, Args: strings.TrimSpace(args)}, nil
+	case "":
+		return nil, errors.New("empty command")
+	default:
+		return nil, fmt.Errorf("unknown command: %s", name)
+	}
+}
+
+// IsAddressTarget reports whether a ban target is an IP address or CIDR
+// block rather than a nickname.
+func IsAddressTarget(target string) bool {
+	_, err := netfunc.ParseCidr(target)
+	return err == nil
+}
+
+type Ban struct {
+	Target string
+	Reason string
+	By     string
+	At     time.Time
+}
+
+// BanList holds nick and IP/CIDR bans, saved to its file on every change.
+type BanList struct {
+	mu   sync.Mutex
+	path string
+	bans []Ban
+}
+
+func LoadBanList(path string) (*BanList, error) {
+	banList := &BanList{path: path}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return banList, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &banList.bans); err != nil {
+		return nil, err
+	}
+	return banList, nil
+}
+
+// canonicalTarget returns the form a ban target is stored and compared in.
+func canonicalTarget(target string) string {
+	if prefix, err := netfunc.ParseCidr(target); err == nil {
+		return prefix.String()
+	}
+	return strings.ToLower(target)
+}
+
+func (bl *BanList) Add(ban Ban) error {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	if IsAddressTarget(ban.Target) {
+		ban.Target = canonicalTarget(ban.Target)
+	}
+	target := canonicalTarget(ban.Target)
+	bl.bans = slices.DeleteFunc(bl.bans, func(b Ban) bool { return canonicalTarget(b.Target) == target })
+	bl.bans = append(bl.bans, ban)
+	return bl.save()
+}
+
+func (bl *BanList) Remove(target string) (bool, error) {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	target = canonicalTarget(target)
+	count := len(bl.bans)
+	bl.bans = slices.DeleteFunc(bl.bans, func(b Ban) bool { return canonicalTarget(b.Target) == target })
+	if len(bl.bans) == count {
+		return false, nil
+	}
+	return true, bl.save()
+}
+
+func (bl *BanList) List() []Ban {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	return slices.Clone(bl.bans)
+}
+
+func (bl *BanList) IsIpBanned(ip string) bool {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	for _, ban := range bl.bans {
+		if matched, _ := netfunc.IpInCidr(ip, ban.Target); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (bl *BanList) IsNickBanned(nick string) bool {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	for _, ban := range bl.bans {
+		if !IsAddressTarget(ban.Target) && strings.EqualFold(ban.Target, nick) {
+			return true
+		}
+	}
+	return false
+}
+
+func (bl *BanList) save() error {
+	data, err := json.MarshalIndent(bl.bans, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(bl.path, data, 0o600)
+}
@@ -0,0 +1,136 @@
+package chatadmin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCommand(t *testing.T) {
+	assert := assert.New(t)
+
+	cmd, err := ParseCommand("/kick bob flooding the room")
+	assert.NoError(err, "Expected no error for a valid kick command")
+	assert.Equal(&Command{Name: CmdKick, Target: "bob", Args: "flooding the room"}, cmd)
+
+	cmd, err = ParseCommand("ban 10.0.0.0/8")
+	assert.NoError(err, "Expected the leading slash to be optional")
+	assert.Equal(&Command{Name: CmdBan, Target: "10.0.0.0/8"}, cmd)
+
+	cmd, err = ParseCommand("/topic Friday release party")
+	assert.NoError(err, "Expected no error for a valid topic command")
+	assert.Equal(&Command{Name: CmdTopic, Args: "Friday release party"}, cmd)
+
+	_, err = ParseCommand("/mute")
+	assert.Error(err, "Expected an error when the target is missing")
+
+	_, err = ParseCommand("/op bob")
+	assert.Error(err, "Expected an error for an unknown command")
+}
+
+func TestIsAddressTarget(t *testing.T) {
+	assert.True(t, IsAddressTarget("192.168.1.7"), "Expected a bare IP to be an address target")
+	assert.True(t, IsAddressTarget("192.168.1.0/24"), "Expected a CIDR to be an address target")
+	assert.True(t, IsAddressTarget("2001:db8::/32"), "Expected an IPv6 CIDR to be an address target")
+	assert.False(t, IsAddressTarget("bob"), "Expected a nick not to be an address target")
+	assert.False(t, IsAddressTarget("999.1.1.1/8"), "Expected an out-of-range address not to be an address target")
+}
+
+func TestConfigIsAdminToken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "admin.json")
+	err := os.WriteFile(path, []byte(`{"admin_tokens": ["s3cret"]}`), 0o600)
+	assert.NoError(t, err, "Failed to write config file")
+
+	config, err := LoadConfig(path)
+	assert.NoError(t, err, "Expected no error when loading a valid config")
+	assert.True(t, config.IsAdminToken("s3cret"), "Expected the configured token to be accepted")
+	assert.False(t, config.IsAdminToken("guess"), "Expected an unknown token to be rejected")
+	assert.False(t, config.IsAdminToken(""), "Expected an empty token to be rejected")
+}
+
+func TestBanList(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "bans.json")
+
+	banList, err := LoadBanList(path)
+	assert.NoError(err, "Expected a missing ban file to load as an empty list")
+	assert.Empty(banList.List())
+
+	assert.NoError(banList.Add(Ban{Target: "Mallory", By: "admin", At: time.Now()}))
+	assert.NoError(banList.Add(Ban{Target: "10.1.0.0/16", Reason: "spam", By: "admin", At: time.Now()}))
+
+	assert.True(banList.IsNickBanned("mallory"), "Expected nick bans to be case-insensitive")
+	assert.False(banList.IsNickBanned("alice"), "Expected alice not to be banned")
+	assert.True(banList.IsIpBanned("10.1.44.3"), "Expected an IP inside the CIDR to be banned")
+	assert.False(banList.IsIpBanned("10.2.44.3"), "Expected an IP outside the CIDR not to be banned")
+	assert.NoError(banList.Add(Ban{Target: "2001:db8::/32", By: "admin", At: time.Now()}))
+	assert.True(banList.IsIpBanned("2001:db8::7"), "Expected IPv6 clients to be bannable")
+	removed, err := banList.Remove("2001:db8::/32")
+	assert.True(removed)
+	assert.NoError(err)
+
+	reloaded, err := LoadBanList(path)
+	assert.NoError(err, "Expected the persisted ban file to load")
+	assert.Len(reloaded.List(), 2, "Expected bans to persist across reloads")
+	assert.True(reloaded.IsIpBanned("10.1.0.1"), "Expected the reloaded CIDR ban to match")
+
+	removed, err = reloaded.Remove("Mallory")
+	assert.NoError(err)
+	assert.True(removed, "Expected the nick ban to be removed")
+	removed, err = reloaded.Remove("Mallory")
+	assert.NoError(err)
+	assert.False(removed, "Expected removing a missing ban to report false")
+	assert.False(reloaded.IsNickBanned("mallory"), "Expected mallory to be unbanned")
+}
+
+func TestBanListCanonicalTargets(t *testing.T) {
+	assert := assert.New(t)
+	banList, err := LoadBanList(filepath.Join(t.TempDir(), "bans.json"))
+	assert.NoError(err)
+
+	assert.NoError(banList.Add(Ban{Target: "10.0.0.7/8", By: "admin", At: time.Now()}))
+	assert.NoError(banList.Add(Ban{Target: "10.0.0.0/8", By: "admin", At: time.Now()}))
+	assert.NoError(banList.Add(Ban{Target: "192.0.2.7", By: "admin", At: time.Now()}))
+	assert.NoError(banList.Add(Ban{Target: "Mallory", By: "admin", At: time.Now()}))
+	assert.NoError(banList.Add(Ban{Target: "mallory", By: "admin", At: time.Now()}))
+	targets := []string{}
+	for _, ban := range banList.List() {
+		targets = append(targets, ban.Target)
+	}
+	assert.ElementsMatch([]string{"10.0.0.0/8", "192.0.2.7/32", "mallory"}, targets, "Expected equivalent targets to be stored once")
+
+	removed, err := banList.Remove("192.0.2.7")
+	assert.NoError(err)
+	assert.True(removed, "Expected a bare address to unban its /32")
+	removed, err = banList.Remove("10.9.9.9/8")
+	assert.NoError(err)
+	assert.True(removed, "Expected any address in the block to name it")
+	assert.Len(banList.List(), 1)
+}
+
+func TestAuthorizeHTTP(t *testing.T) {
+	assert := assert.New(t)
+	request := func(remoteAddr string, authorization string) *http.Request {
+		r := httptest.NewRequest("GET", "/clients", nil)
+		r.RemoteAddr = remoteAddr
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		return r
+	}
+
+	open := &Config{}
+	assert.True(open.AuthorizeHTTP(request("127.0.0.1:5000", "")), "Expected loopback requests to be allowed without tokens")
+	assert.True(open.AuthorizeHTTP(request("[::1]:5000", "")), "Expected IPv6 loopback requests to be allowed without tokens")
+	assert.False(open.AuthorizeHTTP(request("192.0.2.7:5000", "")), "Expected remote requests to be refused without tokens")
+
+	guarded := &Config{AdminTokens: []string{"s3cret"}}
+	assert.True(guarded.AuthorizeHTTP(request("192.0.2.7:5000", "Bearer s3cret")), "Expected an admin token to be accepted")
+	assert.False(guarded.AuthorizeHTTP(request("192.0.2.7:5000", "Bearer wrong")), "Expected a wrong token to be refused")
+	assert.False(guarded.AuthorizeHTTP(request("127.0.0.1:5000", "")), "Expected loopback to need the token once tokens are configured")
+}
@@ -0,0 +1,151 @@
+package chatcmd
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+var ErrUnknownCommand = errors.New("unknown command")
+
+type Spec struct {
+	Name        string
+	Usage       string
+	Description string
+	MinArgs     int
+	// MaxArgs caps the number of arguments, the last one taking the rest
+	// of the line. A negative value means no limit.
+	MaxArgs int
+	// Server marks commands that are forwarded to the server verbatim rather
+	// than handled by the client.
+	Server bool
+}
+
+type Invocation struct {
+	Spec *Spec
+	Args []string
+}
+
+type Registry struct {
+	specs map[string]*Spec
+}
+
+func NewRegistry() *Registry {
+	return &Registry{specs: make(map[string]*Spec)}
+}
+
+func (r *Registry) Register(spec Spec) {
+	r.specs[spec.Name] = &spec
+}
+
+func (r *Registry) Lookup(name string) (*Spec, bool) {
+	spec, ok := r.specs[strings.ToLower(name)]
+	return spec, ok
+}
+
+// Names returns the registered command names in alphabetical order.
+func (r *Registry) Names() []string {
+	names := make([]string, 0, len(r.specs))
+	for name := range r.specs {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func IsCommand(line string) bool {
+	return strings.HasPrefix(line, "/")
+}
+
+// Parse splits a "/name args..." line and validates it against the
+// registry.
+func (r *Registry) Parse(line string) (*Invocation, error) {
+	line = strings.TrimSpace(line)
+	if !IsCommand(line) {
+		return nil, errors.New("not a command")
+	}
+
+	name, rest, _ := strings.Cut(line[1:], " ")
+	spec, ok := r.Lookup(name)
+	if !ok {
+		return nil, fmt.Errorf("%w: /%s (try /help)", ErrUnknownCommand, name)
+	}
+
+	args := []string{}
+	rest = strings.TrimSpace(rest)
+	for rest != "" {
+		if spec.MaxArgs > 0 && len(args) == spec.MaxArgs-1 {
+			args = append(args, rest)
+			break
+		}
+		var arg string
+		arg, rest, _ = strings.Cut(rest, " ")
+		args = append(args, arg)
+		rest = strings.TrimSpace(rest)
+	}
+
+	if len(args) < spec.MinArgs || (spec.MaxArgs >= 0 && len(args) > spec.MaxArgs) {
+		return nil, fmt.Errorf("usage: %s", strings.TrimSpace("/"+spec.Name+" "+spec.Usage))
+	}
+	return &Invocation{Spec: spec, Args: args}, nil
+}
+
+// Help returns one line per command, suitable for the help overlay.
+func (r *Registry) Help() []string {
+	lines := []string{}
+	for _, name := range r.Names() {
+		spec := r.specs[name]
+		usage := strings.TrimSpace("/" + spec.Name + " " + spec.Usage)
+		lines = append(lines, fmt.Sprintf("%-24s %s", usage, spec.Description))
+	}
+	return lines
+}
+
+// Complete completes the last word of input against command names or nicks,
+// and returns the new input and the candidates that matched.
+func (r *Registry) Complete(input string, nicks []string) (string, []string) {
+	wordStart := strings.LastIndex(input, " ") + 1
+	word := input[wordStart:]
+
+	var options []string
+	prefix := word
+	if wordStart == 0 && IsCommand(word) {
+		prefix = word[1:]
+		options = r.Names()
+	} else {
+		options = nicks
+	}
+
+	candidates := []string{}
+	for _, option := range options {
+		if strings.HasPrefix(strings.ToLower(option), strings.ToLower(prefix)) {
+			candidates = append(candidates, option)
+		}
+	}
+	if len(candidates) == 0 {
+		return input, candidates
+	}
+
+	completed := longestCommonPrefix(candidates)
+	if len(completed) < len(prefix) {
+		return input, candidates
+	}
+	if wordStart == 0 && IsCommand(word) {
+		completed = "/" + completed
+	}
+	if len(candidates) == 1 {
+		completed += " "
+	}
+	return input[:wordStart] + completed, candidates
+}
+
+func longestCommonPrefix(values []string) string {
+	prefix := values[0]
+	for _, value := range values[1:] {
+		for !strings.HasPrefix(strings.ToLower(value), strings.ToLower(prefix)) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix
+}
@@ -0,0 +1,80 @@
+package chatcmd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testRegistry() *Registry {
+	registry := NewRegistry()
+	registry.Register(Spec{Name: "msg", Usage: "<nick> <message>", Description: "Send a direct message", MinArgs: 2, MaxArgs: 2})
+	registry.Register(Spec{Name: "mute", Usage: "<nick> [reason]", Description: "Mute a user", MinArgs: 1, MaxArgs: 2, Server: true})
+	registry.Register(Spec{Name: "nick", Usage: "<nick>", Description: "Change your nickname", MinArgs: 1, MaxArgs: 1})
+	registry.Register(Spec{Name: "quit", Description: "Leave the chat", MaxArgs: 0})
+	return registry
+}
+
+func TestParse(t *testing.T) {
+	assert := assert.New(t)
+	registry := testRegistry()
+
+	invocation, err := registry.Parse("/msg bob  hi there, bob")
+	assert.NoError(err)
+	assert.Equal("msg", invocation.Spec.Name)
+	assert.Equal([]string{"bob", "hi there, bob"}, invocation.Args, "Expected the last argument to swallow the rest of the line")
+
+	invocation, err = registry.Parse("/QUIT")
+	assert.NoError(err, "Expected command names to be case-insensitive")
+	assert.Empty(invocation.Args)
+
+	_, err = registry.Parse("/quit now")
+	assert.EqualError(err, "usage: /quit")
+
+	_, err = registry.Parse("/msg bob")
+	assert.EqualError(err, "usage: /msg <nick> <message>")
+
+	_, err = registry.Parse("/dance")
+	assert.ErrorIs(err, ErrUnknownCommand)
+
+	_, err = registry.Parse("hello")
+	assert.Error(err, "Expected an error for a plain chat line")
+}
+
+func TestHelp(t *testing.T) {
+	help := testRegistry().Help()
+	assert.Len(t, help, 4)
+	assert.Equal(t, "/msg <nick> <message>    Send a direct message", help[0])
+	assert.Equal(t, "/quit                    Leave the chat", help[3])
+}
+
+func TestCompleteCommandNames(t *testing.T) {
+	registry := testRegistry()
+
+	completed, candidates := registry.Complete("/n", nil)
+	assert.Equal(t, "/nick ", completed, "Expected a unique match to be completed with a trailing space")
+	assert.Equal(t, []string{"nick"}, candidates)
+
+	completed, candidates = registry.Complete("/m", nil)
+	assert.Equal(t, "/m", completed, "Expected no change when candidates share no longer prefix")
+	assert.Equal(t, []string{"msg", "mute"}, candidates)
+
+	completed, candidates = registry.Complete("/x", nil)
+	assert.Equal(t, "/x", completed)
+	assert.Empty(t, candidates)
+}
+
+func TestCompleteNicks(t *testing.T) {
+	registry := testRegistry()
+	nicks := []string{"alice", "Albert", "bob"}
+
+	completed, _ := registry.Complete("/msg b", nicks)
+	assert.Equal(t, "/msg bob ", completed)
+
+	completed, candidates := registry.Complete("hey al", nicks)
+	assert.Equal(t, "hey al", completed)
+	assert.Equal(t, []string{"alice", "Albert"}, candidates)
+
+	completed, _ = registry.Complete("hey ALI", nicks)
+	assert.Equal(t, "hey alice ", completed, "Expected nick completion to be case-insensitive")
+}
@@ -0,0 +1,227 @@
+package chatcrypto
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// keyLabel separates the keys derived here from any other use of the same
+// shared secret.
+const keyLabel = "go-network-concepts chat DM v1"
+
+var ErrDecrypt = errors.New("message could not be decrypted")
+
+// Identity is a client's X25519 key pair. DMs are encrypted with AES-256-GCM
+// under a key derived from the shared secret.
+type Identity struct {
+	private *ecdh.PrivateKey
+}
+
+func NewIdentity() (*Identity, error) {
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{private: private}, nil
+}
+
+// LoadOrCreateIdentity reads the private key stored at path, creating it
+// on first use.
+func LoadOrCreateIdentity(path string) (*Identity, error) {
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		id, err := NewIdentity()
+		if err != nil {
+			return nil, err
+		}
+		encoded := hex.EncodeToString(id.private.Bytes()) + "\n"
+		if err := os.WriteFile(path, []byte(encoded), 0o600); err != nil {
+			return nil, err
+		}
+		return id, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(raw)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid key file %s: %w", path, err)
+	}
+	private, err := ecdh.X25519().NewPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key file %s: %w", path, err)
+	}
+	return &Identity{private: private}, nil
+}
+
+func (id *Identity) PublicKey() []byte {
+	return id.private.PublicKey().Bytes()
+}
+
+func (id *Identity) Fingerprint() string {
+	return Fingerprint(id.PublicKey())
+}
+
+// Seal encrypts a DM for the holder of peerKey.
+func (id *Identity) Seal(peerKey []byte, plaintext string) (ciphertext []byte, nonce []byte, err error) {
+	aead, err := id.aead(peerKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	ad := append(id.PublicKey(), peerKey...)
+	return aead.Seal(nil, nonce, []byte(plaintext), ad), nonce, nil
+}
+
+// Open decrypts a DM sent by the holder of peerKey.
+func (id *Identity) Open(peerKey []byte, ciphertext []byte, nonce []byte) (string, error) {
+	aead, err := id.aead(peerKey)
+	if err != nil {
+		return "", err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return "", ErrDecrypt
+	}
+	ad := append(bytes.Clone(peerKey), id.PublicKey()...)
+	plaintext, err := aead.Open(nil, nonce, ciphertext, ad)
+	if err != nil {
+		return "", ErrDecrypt
+	}
+	return string(plaintext), nil
+}
+
+// aead derives the AES-256-GCM key shared with peerKey. Both sides hash the
+// public keys in the same order, so they arrive at the same key.
+func (id *Identity) aead(peerKey []byte) (cipher.AEAD, error) {
+	peer, err := ecdh.X25519().NewPublicKey(peerKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	secret, err := id.private.ECDH(peer)
+	if err != nil {
+		return nil, err
+	}
+
+	own := id.PublicKey()
+	first, second := own, peerKey
+	if bytes.Compare(first, second) > 0 {
+		first, second = second, first
+	}
+	h := sha256.New()
+	h.Write([]byte(keyLabel))
+	h.Write(secret)
+	h.Write(first)
+	h.Write(second)
+
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// ValidatePublicKey checks that key is a usable X25519 public key.
+func ValidatePublicKey(key []byte) error {
+	_, err := ecdh.X25519().NewPublicKey(key)
+	return err
+}
+
+// Fingerprint formats the first 16 bytes of the SHA-256 of a public key in
+// groups of four hex digits, short enough to compare out loud.
+func Fingerprint(publicKey []byte) string {
+	sum := sha256.Sum256(publicKey)
+	digits := hex.EncodeToString(sum[:16])
+	groups := make([]string, 0, len(digits)/4)
+	for i := 0; i < len(digits); i += 4 {
+		groups = append(groups, digits[i:i+4])
+	}
+	return strings.Join(groups, " ")
+}
+
+// KeyRing remembers the public keys seen for each nick, pinning the first
+// so a change can be flagged.
+type KeyRing struct {
+	current map[string][]byte
+	pinned  map[string][]byte
+}
+
+func NewKeyRing() *KeyRing {
+	return &KeyRing{current: map[string][]byte{}, pinned: map[string][]byte{}}
+}
+
+// Observe records the key for nick. first is true the first time nick is
+// seen; changed is true when the key differs from the pinned one.
+func (k *KeyRing) Observe(nick string, key []byte) (first bool, changed bool) {
+	nick = strings.ToLower(nick)
+	k.current[nick] = bytes.Clone(key)
+	pinned, ok := k.pinned[nick]
+	if !ok {
+		k.pinned[nick] = bytes.Clone(key)
+		return true, false
+	}
+	return false, !bytes.Equal(pinned, key)
+}
+
+// Trust pins the current key for nick after a change was verified.
+func (k *KeyRing) Trust(nick string) bool {
+	nick = strings.ToLower(nick)
+	key, ok := k.current[nick]
+	if ok {
+		k.pinned[nick] = key
+	}
+	return ok
+}
+
+// Trusted reports whether the current key for nick is the pinned one.
+func (k *KeyRing) Trusted(nick string) bool {
+	nick = strings.ToLower(nick)
+	key, ok := k.current[nick]
+	return ok && bytes.Equal(key, k.pinned[nick])
+}
+
+// Pinned reports whether a key was ever seen for nick, so a missing one
+// may mean it was withheld rather than never set up.
+func (k *KeyRing) Pinned(nick string) bool {
+	_, ok := k.pinned[strings.ToLower(nick)]
+	return ok
+}
+
+func (k *KeyRing) Get(nick string) ([]byte, bool) {
+	key, ok := k.current[strings.ToLower(nick)]
+	return key, ok
+}
+
+func (k *KeyRing) Forget(nick string) {
+	delete(k.current, strings.ToLower(nick))
+}
+
+// Rename follows a nick change. A key pinned for the new nick is kept, so
+// taking a departed user's nick can't take over their identity.
+func (k *KeyRing) Rename(oldNick string, newNick string) (changed bool) {
+	oldNick, newNick = strings.ToLower(oldNick), strings.ToLower(newNick)
+	key, ok := k.current[oldNick]
+	delete(k.current, oldNick)
+	if !ok {
+		delete(k.current, newNick)
+		return false
+	}
+	k.current[newNick] = key
+	pinned, ok := k.pinned[newNick]
+	if !ok {
+		k.pinned[newNick] = key
+		return false
+	}
+	return !bytes.Equal(pinned, key)
+}
@@ -0,0 +1,132 @@
+package chatcrypto
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSealOpen(t *testing.T) {
+	assert := assert.New(t)
+	alice, _ := NewIdentity()
+	bob, _ := NewIdentity()
+
+	ciphertext, nonce, err := alice.Seal(bob.PublicKey(), "meet at noon")
+	assert.NoError(err)
+	assert.NotContains(string(ciphertext), "noon")
+
+	plaintext, err := bob.Open(alice.PublicKey(), ciphertext, nonce)
+	assert.NoError(err)
+	assert.Equal("meet at noon", plaintext)
+
+	eve, _ := NewIdentity()
+	_, err = eve.Open(alice.PublicKey(), ciphertext, nonce)
+	assert.ErrorIs(err, ErrDecrypt, "Expected a third party not to read the message")
+
+	ciphertext[0] ^= 1
+	_, err = bob.Open(alice.PublicKey(), ciphertext, nonce)
+	assert.ErrorIs(err, ErrDecrypt, "Expected tampering to be detected")
+}
+
+func TestMessagesAreBoundToTheirDirection(t *testing.T) {
+	alice, _ := NewIdentity()
+	bob, _ := NewIdentity()
+	ciphertext, nonce, _ := alice.Seal(bob.PublicKey(), "hi")
+
+	// Reflecting alice's message back at her must not pass as one from bob.
+	_, err := alice.Open(bob.PublicKey(), ciphertext, nonce)
+	assert.ErrorIs(t, err, ErrDecrypt)
+}
+
+func TestNoncesAreFresh(t *testing.T) {
+	alice, _ := NewIdentity()
+	bob, _ := NewIdentity()
+	first, nonce1, _ := alice.Seal(bob.PublicKey(), "same")
+	second, nonce2, _ := alice.Seal(bob.PublicKey(), "same")
+	assert.NotEqual(t, nonce1, nonce2)
+	assert.NotEqual(t, first, second)
+}
+
+func TestInvalidKeys(t *testing.T) {
+	alice, _ := NewIdentity()
+	_, _, err := alice.Seal([]byte("short"), "hi")
+	assert.Error(t, err)
+	assert.Error(t, ValidatePublicKey(nil))
+	assert.NoError(t, ValidatePublicKey(alice.PublicKey()))
+}
+
+func TestLoadOrCreateIdentity(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "chat.key")
+
+	created, err := LoadOrCreateIdentity(path)
+	assert.NoError(err)
+	info, _ := os.Stat(path)
+	assert.Equal(os.FileMode(0o600), info.Mode().Perm())
+
+	loaded, err := LoadOrCreateIdentity(path)
+	assert.NoError(err)
+	assert.Equal(created.Fingerprint(), loaded.Fingerprint())
+
+	os.WriteFile(path, []byte("not a key"), 0o600)
+	_, err = LoadOrCreateIdentity(path)
+	assert.Error(err)
+}
+
+func TestFingerprint(t *testing.T) {
+	alice, _ := NewIdentity()
+	assert.Regexp(t, regexp.MustCompile(`^([0-9a-f]{4} ){7}[0-9a-f]{4}$`), alice.Fingerprint())
+}
+
+func TestKeyRing(t *testing.T) {
+	assert := assert.New(t)
+	ring := NewKeyRing()
+	assert.False(ring.Pinned("bob"))
+	first, changed := ring.Observe("Bob", []byte("key1"))
+	assert.True(first)
+	assert.False(changed)
+	assert.True(ring.Trusted("bob"))
+
+	key, ok := ring.Get("bob")
+	assert.True(ok)
+	assert.Equal([]byte("key1"), key)
+
+	ring.Forget("bob")
+	_, ok = ring.Get("bob")
+	assert.False(ok)
+	assert.True(ring.Pinned("bob"), "Expected the pinned key to outlive Forget")
+	assert.False(ring.Trusted("bob"))
+
+	first, changed = ring.Observe("bob", []byte("key2"))
+	assert.False(first)
+	assert.True(changed, "Expected a new key for a known nick to be flagged")
+	assert.False(ring.Trusted("bob"), "Expected a changed key not to be trusted")
+	assert.True(ring.Trust("bob"))
+	assert.True(ring.Trusted("bob"))
+	_, changed = ring.Observe("bob", []byte("key2"))
+	assert.False(changed)
+
+	assert.False(ring.Rename("bob", "robert"))
+	key, ok = ring.Get("robert")
+	assert.True(ok)
+	assert.Equal([]byte("key2"), key)
+	assert.True(ring.Trusted("robert"))
+}
+
+func TestKeyRingRenameKeepsPinnedKey(t *testing.T) {
+	assert := assert.New(t)
+	ring := NewKeyRing()
+	ring.Observe("bob", []byte("bob-key"))
+	ring.Forget("bob")
+	ring.Observe("mallory", []byte("mallory-key"))
+
+	assert.True(ring.Rename("mallory", "bob"), "Expected taking a known nick with another key to be flagged")
+	assert.False(ring.Trusted("bob"))
+	_, changed := ring.Observe("bob", []byte("mallory-key"))
+	assert.True(changed, "Expected bob's pinned key to be kept")
+	_, ok := ring.Get("mallory")
+	assert.False(ok)
+}
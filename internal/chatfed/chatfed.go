@@ -0,0 +1,204 @@
+package chatfed
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/vinh0604/go-network-concepts/internal/chatmodels"
+	"github.com/vinh0604/go-network-concepts/internal/chatutils"
+)
+
+// HandshakeTimeout bounds how long a peer server may take to introduce
+// itself.
+const HandshakeTimeout = 10 * time.Second
+
+var ErrBadHandshake = errors.New("invalid link handshake")
+
+// Hello is the first payload each server sends on a link.
+func Hello(name string, token string) chatmodels.Payload {
+	hello := chatmodels.Payload{MsgType: chatmodels.MsgTypeLink, Nick: &name}
+	if token != "" {
+		hello.Token = &token
+	}
+	return hello
+}
+
+// Handshake exchanges hellos with a peer server and returns its name. The
+// peer must present the same token, and a name other than ours.
+func Handshake(conn net.Conn, readBuf *chatutils.ReadBuffer, name string, token string) (string, error) {
+	conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	writeErr := make(chan error, 1)
+	go func() {
+		writeErr <- chatutils.WriteMessage(conn, Hello(name, token))
+	}()
+	peer, err := chatutils.ReadNextMessage(conn, readBuf)
+	if err != nil {
+		return "", err
+	}
+	if err := <-writeErr; err != nil {
+		return "", err
+	}
+
+	if peer.MsgType != chatmodels.MsgTypeLink || peer.Nick == nil || *peer.Nick == "" {
+		return "", ErrBadHandshake
+	}
+	peerToken := ""
+	if peer.Token != nil {
+		peerToken = *peer.Token
+	}
+	if subtle.ConstantTimeCompare([]byte(peerToken), []byte(token)) != 1 {
+		return "", fmt.Errorf("%w: wrong token from %s", ErrBadHandshake, *peer.Nick)
+	}
+	if *peer.Nick == name {
+		return "", fmt.Errorf("%w: peer uses our name %s", ErrBadHandshake, name)
+	}
+	return *peer.Nick, nil
+}
+
+// IDs hands out message IDs that are unique across linked servers and
+// across restarts.
+type IDs struct {
+	prefix string
+	last   atomic.Uint64
+}
+
+func NewIDs(server string) *IDs {
+	boot := make([]byte, 4)
+	rand.Read(boot)
+	return &IDs{prefix: server + "-" + hex.EncodeToString(boot) + "-"}
+}
+
+func (ids *IDs) Next() string {
+	return ids.prefix + strconv.FormatUint(ids.last.Add(1), 10)
+}
+
+// Seen remembers recently relayed message IDs so loops of links are
+// harmless. It is safe for concurrent use.
+type Seen struct {
+	mu       sync.Mutex
+	capacity int
+	order    []string
+	ids      map[string]bool
+}
+
+func NewSeen(capacity int) *Seen {
+	return &Seen{capacity: capacity, ids: map[string]bool{}}
+}
+
+// Mark records id and reports whether it is new.
+func (s *Seen) Mark(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ids[id] {
+		return false
+	}
+	s.ids[id] = true
+	s.order = append(s.order, id)
+	for len(s.order) > s.capacity {
+		delete(s.ids, s.order[0])
+		s.order = s.order[1:]
+	}
+	return true
+}
+
+// Member is a user connected to another server, reached through Link.
+type Member[K comparable] struct {
+	Nick      string
+	Origin    string
+	Link      K
+	PublicKey []byte
+}
+
+// Members holds the users of linked servers by nick, ignoring case. It is
+// safe for concurrent use.
+type Members[K comparable] struct {
+	mu     sync.Mutex
+	byNick map[string]Member[K]
+}
+
+func NewMembers[K comparable]() *Members[K] {
+	return &Members[K]{byNick: map[string]Member[K]{}}
+}
+
+func (m *Members[K]) Add(member Member[K]) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.byNick[strings.ToLower(member.Nick)] = member
+}
+
+func (m *Members[K]) Remove(nick string) (Member[K], bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	member, ok := m.byNick[strings.ToLower(nick)]
+	delete(m.byNick, strings.ToLower(nick))
+	return member, ok
+}
+
+func (m *Members[K]) Rename(oldNick string, newNick string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	member, ok := m.byNick[strings.ToLower(oldNick)]
+	if !ok {
+		return false
+	}
+	delete(m.byNick, strings.ToLower(oldNick))
+	member.Nick = newNick
+	m.byNick[strings.ToLower(newNick)] = member
+	return true
+}
+
+func (m *Members[K]) Lookup(nick string) (Member[K], bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	member, ok := m.byNick[strings.ToLower(nick)]
+	return member, ok
+}
+
+func (m *Members[K]) Nicks() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	nicks := make([]string, 0, len(m.byNick))
+	for _, member := range m.byNick {
+		nicks = append(nicks, member.Nick)
+	}
+	slices.Sort(nicks)
+	return nicks
+}
+
+// DropLink forgets every user reached through link, after a netsplit, and
+// returns them sorted by nick.
+func (m *Members[K]) DropLink(link K) []Member[K] {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	lost := []Member[K]{}
+	for key, member := range m.byNick {
+		if member.Link == link {
+			lost = append(lost, member)
+			delete(m.byNick, key)
+		}
+	}
+	slices.SortFunc(lost, func(a, b Member[K]) int {
+		return strings.Compare(a.Nick, b.Nick)
+	})
+	return lost
+}
+
+// SplitMessage announces a netsplit to local users.
+func SplitMessage(server string, lost []string) string {
+	if len(lost) == 0 {
+		return fmt.Sprintf("[Netsplit: lost the link to %s]", server)
+	}
+	return fmt.Sprintf("[Netsplit: lost the link to %s, %d user(s) left: %s]", server, len(lost), strings.Join(lost, ", "))
+}
@@ -0,0 +1,105 @@
+package chatfed
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vinh0604/go-network-concepts/internal/chatutils"
+)
+
+func handshakePair(nameA, tokenA, nameB, tokenB string) (string, error, string, error) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	type result struct {
+		peer string
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		peer, err := Handshake(b, &chatutils.ReadBuffer{}, nameB, tokenB)
+		done <- result{peer, err}
+	}()
+	peerA, errA := Handshake(a, &chatutils.ReadBuffer{}, nameA, tokenA)
+	r := <-done
+	return peerA, errA, r.peer, r.err
+}
+
+func TestHandshake(t *testing.T) {
+	peerA, errA, peerB, errB := handshakePair("lab-a", "s3cret", "lab-b", "s3cret")
+	assert.NoError(t, errA)
+	assert.NoError(t, errB)
+	assert.Equal(t, "lab-b", peerA)
+	assert.Equal(t, "lab-a", peerB)
+}
+
+func TestHandshakeRejectsWrongToken(t *testing.T) {
+	_, errA, _, errB := handshakePair("lab-a", "s3cret", "lab-b", "guess")
+	assert.ErrorIs(t, errA, ErrBadHandshake)
+	assert.ErrorIs(t, errB, ErrBadHandshake)
+}
+
+func TestHandshakeRejectsOwnName(t *testing.T) {
+	_, errA, _, _ := handshakePair("lab", "", "lab", "")
+	assert.ErrorIs(t, errA, ErrBadHandshake, "Expected a link to ourselves to be refused")
+}
+
+func TestIDs(t *testing.T) {
+	assert := assert.New(t)
+	ids := NewIDs("east")
+	first, second := ids.Next(), ids.Next()
+	assert.True(strings.HasPrefix(first, "east-"))
+	assert.NotEqual(first, second)
+	assert.NotEqual(first, NewIDs("east").Next(), "Expected a restarted server not to reuse IDs")
+}
+
+func TestSeen(t *testing.T) {
+	assert := assert.New(t)
+	seen := NewSeen(2)
+	assert.True(seen.Mark("a-1"))
+	assert.False(seen.Mark("a-1"), "Expected a looped message to be dropped")
+	assert.True(seen.Mark("a-2"))
+	assert.True(seen.Mark("b-1"))
+	assert.True(seen.Mark("a-1"), "Expected the oldest IDs to be forgotten")
+}
+
+func TestMembers(t *testing.T) {
+	assert := assert.New(t)
+	members := NewMembers[string]()
+	members.Add(Member[string]{Nick: "Carol", Origin: "lab-b", Link: "link-b"})
+	members.Add(Member[string]{Nick: "dave", Origin: "lab-c", Link: "link-b"})
+	members.Add(Member[string]{Nick: "erin", Origin: "lab-d", Link: "link-d"})
+
+	member, ok := members.Lookup("carol")
+	assert.True(ok)
+	assert.Equal("lab-b", member.Origin)
+
+	assert.True(members.Rename("carol", "caroline"))
+	assert.False(members.Rename("nobody", "somebody"))
+	assert.Equal([]string{"caroline", "dave", "erin"}, members.Nicks())
+
+	lost := members.DropLink("link-b")
+	nicks := []string{}
+	for _, member := range lost {
+		nicks = append(nicks, member.Nick)
+	}
+	assert.Equal([]string{"caroline", "dave"}, nicks, "Expected users behind the link, wherever they came from, to be lost")
+	assert.Equal([]string{"erin"}, members.Nicks())
+
+	_, ok = members.Remove("ERIN")
+	assert.True(ok)
+	assert.Empty(members.Nicks())
+}
+
+func TestSplitMessage(t *testing.T) {
+	assert.Equal(t, "[Netsplit: lost the link to lab-b, 2 user(s) left: carol, dave]", SplitMessage("lab-b", []string{"carol", "dave"}))
+	assert.Equal(t, "[Netsplit: lost the link to lab-b]", SplitMessage("lab-b", nil))
+}
+
+func TestHelloOmitsEmptyToken(t *testing.T) {
+	assert.Nil(t, Hello("lab-a", "").Token)
+	assert.Equal(t, "s3cret", *Hello("lab-a", "s3cret").Token)
+}
@@ -0,0 +1,489 @@
+package chatfile
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/vinh0604/go-network-concepts/internal/chatmodels"
+)
+
+const (
+	// ChunkSize keeps a base64-encoded chunk and its JSON envelope well
+	// under the 64K limit of the chat framing.
+	ChunkSize = 32 * 1024
+	// Window is the number of chunks a sender may have in flight before it
+	// must wait for an ack.
+	Window      = 4
+	MaxFileSize = 16 << 20
+	// MaxNameLength bounds the file name carried in an offer.
+	MaxNameLength = 255
+
+	AnswerAccept = "accept"
+	AnswerReject = "reject"
+
+	// Statuses sent in the Msg of a final ack.
+	StatusOK               = "ok"
+	StatusChecksumMismatch = "checksum mismatch"
+	StatusCancelled        = "cancelled"
+
+	// Everyone is the /send target that offers a file to the whole room.
+	Everyone = "*"
+)
+
+var (
+	ErrTooLarge        = fmt.Errorf("file is larger than %d bytes", MaxFileSize)
+	ErrEmptyFile       = errors.New("file is empty")
+	ErrUnknownTransfer = errors.New("unknown file transfer")
+	ErrAlreadyStarted  = errors.New("file transfer already started")
+	ErrWindowExceeded  = errors.New("too many unacknowledged chunks")
+	ErrBadChunk        = errors.New("chunk does not fit the file")
+	ErrBadOffer        = errors.New("malformed file offer")
+)
+
+func NewTransferID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Checksum returns the hex SHA-256 of data.
+func Checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// CheckOffer validates the fields of a file offer relayed to recipients.
+func CheckOffer(file *chatmodels.File) error {
+	if file.TransferID == "" {
+		return fmt.Errorf("%w: no transfer ID", ErrBadOffer)
+	}
+	if file.Size <= 0 {
+		return ErrEmptyFile
+	}
+	if file.Size > MaxFileSize {
+		return ErrTooLarge
+	}
+	if file.Name == "" || len(file.Name) > MaxNameLength {
+		return fmt.Errorf("%w: file name must be 1 to %d bytes", ErrBadOffer, MaxNameLength)
+	}
+	if len(file.Checksum) != 2*sha256.Size {
+		return fmt.Errorf("%w: invalid checksum", ErrBadOffer)
+	}
+	return nil
+}
+
+// CheckChunk validates a chunk of length bytes at offset in a file of the
+// given size.
+func CheckChunk(offset int64, length int, size int64) error {
+	if offset < 0 || offset%ChunkSize != 0 || length <= 0 || length > ChunkSize || offset+int64(length) > size {
+		return ErrBadChunk
+	}
+	return nil
+}
+
+// Outgoing is a file being sent, held in memory.
+type Outgoing struct {
+	ID     string
+	Target string
+	Name   string
+
+	data     []byte
+	checksum string
+	next     int64
+	acked    int64
+}
+
+func NewOutgoing(target string, path string) (*Outgoing, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, fmt.Errorf("%s is a directory", path)
+	}
+	if info.Size() > MaxFileSize {
+		return nil, ErrTooLarge
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, ErrEmptyFile
+	}
+	return &Outgoing{
+		ID:       NewTransferID(),
+		Target:   target,
+		Name:     filepath.Base(path),
+		data:     data,
+		checksum: Checksum(data),
+	}, nil
+}
+
+func (o *Outgoing) Size() int64 {
+	return int64(len(o.data))
+}
+
+func (o *Outgoing) Offer() chatmodels.Payload {
+	return chatmodels.Payload{
+		MsgType: chatmodels.MsgTypeFileOffer,
+		Nick:    &o.Target,
+		File: &chatmodels.File{
+			TransferID: o.ID,
+			Name:       o.Name,
+			Size:       o.Size(),
+			Checksum:   o.checksum,
+		},
+	}
+}
+
+// Ack records that the receivers have the first offset bytes.
+func (o *Outgoing) Ack(offset int64) {
+	o.acked = max(o.acked, min(offset, o.Size()))
+}
+
+func (o *Outgoing) Done() bool {
+	return o.acked >= o.Size()
+}
+
+// NextChunks returns the chunks the window allows, advancing past them.
+func (o *Outgoing) NextChunks() []chatmodels.Payload {
+	chunks := []chatmodels.Payload{}
+	for o.next < o.Size() && o.next-o.acked < Window*ChunkSize {
+		end := min(o.next+ChunkSize, o.Size())
+		chunks = append(chunks, chatmodels.Payload{
+			MsgType: chatmodels.MsgTypeFileChunk,
+			Nick:    &o.Target,
+			File: &chatmodels.File{
+				TransferID: o.ID,
+				Offset:     o.next,
+				Data:       o.data[o.next:end],
+			},
+		})
+		o.next = end
+	}
+	return chunks
+}
+
+// Incoming is a file offered to us, assembled in memory until complete.
+type Incoming struct {
+	ID   string
+	From string
+	Name string
+	Size int64
+
+	checksum string
+	data     []byte
+	received []bool
+}
+
+// NewIncoming validates a file offer.
+func NewIncoming(offer *chatmodels.Payload) (*Incoming, error) {
+	file := offer.File
+	if file == nil || file.TransferID == "" {
+		return nil, errors.New("file offer without a transfer ID")
+	}
+	if file.Size <= 0 {
+		return nil, ErrEmptyFile
+	}
+	if file.Size > MaxFileSize {
+		return nil, ErrTooLarge
+	}
+	name := filepath.Base(file.Name)
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		return nil, fmt.Errorf("invalid file name %q", file.Name)
+	}
+	from := ""
+	if offer.Nick != nil {
+		from = *offer.Nick
+	}
+	return &Incoming{
+		ID:       file.TransferID,
+		From:     from,
+		Name:     name,
+		Size:     file.Size,
+		checksum: file.Checksum,
+	}, nil
+}
+
+func (in *Incoming) Answer(accept bool) chatmodels.Payload {
+	answer := AnswerReject
+	if accept {
+		answer = AnswerAccept
+		in.data = make([]byte, in.Size)
+		in.received = make([]bool, (in.Size+ChunkSize-1)/ChunkSize)
+	}
+	return chatmodels.Payload{
+		MsgType: chatmodels.MsgTypeFileAnswer,
+		Nick:    &in.From,
+		Msg:     &answer,
+		File:    &chatmodels.File{TransferID: in.ID},
+	}
+}
+
+// Write stores a chunk and returns the ack to send back, final with the
+// checksum status once the file is complete.
+func (in *Incoming) Write(chunk *chatmodels.File) (chatmodels.Payload, error) {
+	if in.received == nil {
+		return chatmodels.Payload{}, ErrUnknownTransfer
+	}
+	if err := CheckChunk(chunk.Offset, len(chunk.Data), in.Size); err != nil {
+		return chatmodels.Payload{}, err
+	}
+	copy(in.data[chunk.Offset:], chunk.Data)
+	in.received[chunk.Offset/ChunkSize] = true
+
+	ack := chatmodels.Payload{
+		MsgType: chatmodels.MsgTypeFileAck,
+		Nick:    &in.From,
+		File:    &chatmodels.File{TransferID: in.ID, Offset: in.contiguous()},
+	}
+	if in.Complete() {
+		status := StatusOK
+		if in.Verify() != nil {
+			status = StatusChecksumMismatch
+		}
+		ack.Msg = &status
+	}
+	return ack, nil
+}
+
+func (in *Incoming) contiguous() int64 {
+	n := int64(0)
+	for _, ok := range in.received {
+		if !ok {
+			break
+		}
+		n += ChunkSize
+	}
+	return min(n, in.Size)
+}
+
+func (in *Incoming) Complete() bool {
+	return in.received != nil && in.contiguous() == in.Size
+}
+
+func (in *Incoming) Verify() error {
+	if !in.Complete() {
+		return errors.New("file transfer is incomplete")
+	}
+	if Checksum(in.data) != in.checksum {
+		return errors.New(StatusChecksumMismatch)
+	}
+	return nil
+}
+
+// Save writes the verified file into dir without overwriting, and returns
+// its path.
+func (in *Incoming) Save(dir string) (string, error) {
+	if err := in.Verify(); err != nil {
+		return "", err
+	}
+	ext := filepath.Ext(in.Name)
+	stem := strings.TrimSuffix(in.Name, ext)
+	for i := 0; ; i++ {
+		name := in.Name
+		if i > 0 {
+			name = stem + "-" + strconv.Itoa(i) + ext
+		}
+		path := filepath.Join(dir, name)
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if _, err := bytes.NewReader(in.data).WriteTo(f); err != nil {
+			f.Close()
+			return "", err
+		}
+		return path, f.Close()
+	}
+}
+
+// Tracker keeps the server side of file transfers, so a file offered to the
+// room advances at the pace of the slowest receiver. It is not safe for
+// concurrent use.
+type Tracker[K comparable] struct {
+	transfers map[string]*transfer[K]
+}
+
+type transfer[K comparable] struct {
+	sender     K
+	size       int64
+	started    bool
+	forwarded  int64
+	recipients map[K]*recipient
+}
+
+type recipient struct {
+	answered bool
+	done     bool
+	acked    int64
+}
+
+func NewTracker[K comparable]() *Tracker[K] {
+	return &Tracker[K]{transfers: map[string]*transfer[K]{}}
+}
+
+func (t *Tracker[K]) Offer(id string, sender K, recipients []K, size int64) error {
+	if _, ok := t.transfers[id]; ok || id == "" {
+		return fmt.Errorf("duplicate file transfer ID %q", id)
+	}
+	if size <= 0 {
+		return ErrEmptyFile
+	}
+	if size > MaxFileSize {
+		return ErrTooLarge
+	}
+	tr := &transfer[K]{sender: sender, size: size, recipients: map[K]*recipient{}}
+	for _, r := range recipients {
+		tr.recipients[r] = &recipient{}
+	}
+	t.transfers[id] = tr
+	return nil
+}
+
+// Answer records a recipient's decision and returns the sender to forward
+// it to.
+func (t *Tracker[K]) Answer(id string, from K, accept bool) (K, error) {
+	var sender K
+	tr, r, err := t.lookupRecipient(id, from)
+	if err != nil {
+		return sender, err
+	}
+	if r.answered {
+		return sender, fmt.Errorf("file transfer %s already answered", id)
+	}
+	if accept && tr.started {
+		return sender, ErrAlreadyStarted
+	}
+	r.answered = true
+	if !accept {
+		delete(tr.recipients, from)
+		if len(tr.recipients) == 0 {
+			delete(t.transfers, id)
+		}
+	}
+	return tr.sender, nil
+}
+
+// Chunk checks a chunk from the sender against the window and returns the
+// recipients to relay it to.
+func (t *Tracker[K]) Chunk(id string, from K, offset int64, length int) ([]K, error) {
+	tr, ok := t.transfers[id]
+	if !ok || tr.sender != from {
+		return nil, ErrUnknownTransfer
+	}
+	if err := CheckChunk(offset, length, tr.size); err != nil {
+		return nil, err
+	}
+	targets := []K{}
+	for k, r := range tr.recipients {
+		if r.answered && !r.done {
+			targets = append(targets, k)
+		}
+	}
+	if len(targets) == 0 {
+		return nil, ErrUnknownTransfer
+	}
+	if offset+int64(length)-tr.progress() > Window*ChunkSize {
+		return nil, ErrWindowExceeded
+	}
+	tr.started = true
+	return targets, nil
+}
+
+// Ack records a recipient's progress. It returns the sender, the offset
+// every accepting recipient has reached, and whether that advanced.
+func (t *Tracker[K]) Ack(id string, from K, offset int64, final bool) (K, int64, bool, error) {
+	var sender K
+	tr, r, err := t.lookupRecipient(id, from)
+	if err != nil {
+		return sender, 0, false, err
+	}
+	if !r.answered {
+		return sender, 0, false, ErrUnknownTransfer
+	}
+	r.acked = max(r.acked, min(offset, tr.size))
+	r.done = r.done || final
+
+	progress := tr.progress()
+	advanced := progress > tr.forwarded
+	tr.forwarded = max(tr.forwarded, progress)
+
+	allDone := true
+	for _, r := range tr.recipients {
+		if r.answered && !r.done {
+			allDone = false
+		}
+	}
+	if allDone {
+		delete(t.transfers, id)
+	}
+	return tr.sender, progress, advanced, nil
+}
+
+func (tr *transfer[K]) progress() int64 {
+	progress := tr.size
+	for _, r := range tr.recipients {
+		if r.answered && !r.done {
+			progress = min(progress, r.acked)
+		}
+	}
+	return progress
+}
+
+func (t *Tracker[K]) lookupRecipient(id string, from K) (*transfer[K], *recipient, error) {
+	tr, ok := t.transfers[id]
+	if !ok {
+		return nil, nil, ErrUnknownTransfer
+	}
+	r, ok := tr.recipients[from]
+	if !ok {
+		return nil, nil, ErrUnknownTransfer
+	}
+	return tr, r, nil
+}
+
+// Cancelled names a transfer dropped because a participant left, and who
+// should be told.
+type Cancelled[K comparable] struct {
+	ID     string
+	Notify []K
+}
+
+// Drop forgets a participant that disconnected and returns the transfers
+// that can no longer finish.
+func (t *Tracker[K]) Drop(conn K) []Cancelled[K] {
+	cancelled := []Cancelled[K]{}
+	for id, tr := range t.transfers {
+		if tr.sender == conn {
+			notify := []K{}
+			for k := range tr.recipients {
+				notify = append(notify, k)
+			}
+			delete(t.transfers, id)
+			cancelled = append(cancelled, Cancelled[K]{ID: id, Notify: notify})
+			continue
+		}
+		if _, ok := tr.recipients[conn]; !ok {
+			continue
+		}
+		delete(tr.recipients, conn)
+		if len(tr.recipients) == 0 {
+			delete(t.transfers, id)
+			cancelled = append(cancelled, Cancelled[K]{ID: id, Notify: []K{tr.sender}})
+		}
+	}
+	return cancelled
+}
@@ -0,0 +1,236 @@
+package chatfile
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vinh0604/go-network-concepts/internal/chatmodels"
+)
+
+func writeFile(t *testing.T, size int) (string, []byte) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), size/16+1)[:size]
+	path := filepath.Join(t.TempDir(), "report.txt")
+	assert.NoError(t, os.WriteFile(path, data, 0o644))
+	return path, data
+}
+
+func offerFrom(o *Outgoing, from string) *chatmodels.Payload {
+	offer := o.Offer()
+	offer.Nick = &from
+	return &offer
+}
+
+func TestTransferRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+	path, data := writeFile(t, 5*ChunkSize+100)
+
+	out, err := NewOutgoing("bob", path)
+	assert.NoError(err)
+	assert.Equal("report.txt", out.Name)
+
+	in, err := NewIncoming(offerFrom(out, "alice"))
+	assert.NoError(err)
+	assert.Equal("alice", in.From)
+	assert.Equal(int64(len(data)), in.Size)
+	answer := in.Answer(true)
+	assert.Equal(AnswerAccept, *answer.Msg)
+
+	chunks := out.NextChunks()
+	assert.Len(chunks, Window, "Expected the sender to stop at the window")
+	assert.Empty(out.NextChunks())
+
+	var ack chatmodels.Payload
+	for len(chunks) > 0 {
+		for _, chunk := range chunks {
+			ack, err = in.Write(chunk.File)
+			assert.NoError(err)
+			out.Ack(ack.File.Offset)
+		}
+		chunks = out.NextChunks()
+	}
+
+	assert.True(out.Done())
+	assert.True(in.Complete())
+	if assert.NotNil(ack.Msg) {
+		assert.Equal(StatusOK, *ack.Msg)
+	}
+
+	dir := t.TempDir()
+	saved, err := in.Save(dir)
+	assert.NoError(err)
+	assert.Equal(filepath.Join(dir, "report.txt"), saved)
+	saved, err = in.Save(dir)
+	assert.NoError(err)
+	assert.Equal(filepath.Join(dir, "report-1.txt"), saved, "Expected existing files to be kept")
+	got, _ := os.ReadFile(saved)
+	assert.Equal(data, got)
+}
+
+func TestChunksFitFraming(t *testing.T) {
+	path, _ := writeFile(t, ChunkSize)
+	out, err := NewOutgoing("bob", path)
+	assert.NoError(t, err)
+
+	encoded, err := json.Marshal(out.NextChunks()[0])
+	assert.NoError(t, err)
+	assert.Less(t, len(encoded), math.MaxUint16)
+}
+
+func TestOutOfOrderChunks(t *testing.T) {
+	assert := assert.New(t)
+	path, _ := writeFile(t, 2*ChunkSize+1)
+	out, _ := NewOutgoing("bob", path)
+	in, _ := NewIncoming(offerFrom(out, "alice"))
+	in.Answer(true)
+
+	chunks := out.NextChunks()
+	ack, err := in.Write(chunks[2].File)
+	assert.NoError(err)
+	assert.Equal(int64(0), ack.File.Offset, "Expected acks to cover only bytes without gaps")
+	assert.Nil(ack.Msg)
+
+	in.Write(chunks[0].File)
+	ack, _ = in.Write(chunks[1].File)
+	assert.Equal(in.Size, ack.File.Offset)
+	assert.Equal(StatusOK, *ack.Msg)
+}
+
+func TestChecksumMismatch(t *testing.T) {
+	path, _ := writeFile(t, 10)
+	out, _ := NewOutgoing("bob", path)
+	offer := offerFrom(out, "alice")
+	offer.File.Checksum = Checksum([]byte("something else"))
+	in, _ := NewIncoming(offer)
+	in.Answer(true)
+
+	ack, err := in.Write(out.NextChunks()[0].File)
+	assert.NoError(t, err)
+	assert.Equal(t, StatusChecksumMismatch, *ack.Msg)
+	_, err = in.Save(t.TempDir())
+	assert.Error(t, err, "Expected a corrupt file not to be saved")
+}
+
+func TestRejectsBadOffersAndChunks(t *testing.T) {
+	assert := assert.New(t)
+	nick := "alice"
+
+	_, err := NewIncoming(&chatmodels.Payload{Nick: &nick, File: &chatmodels.File{TransferID: "x", Name: "a", Size: MaxFileSize + 1}})
+	assert.ErrorIs(err, ErrTooLarge)
+
+	in, err := NewIncoming(&chatmodels.Payload{Nick: &nick, File: &chatmodels.File{TransferID: "x", Name: "../../etc/passwd", Size: 10}})
+	assert.NoError(err)
+	assert.Equal("passwd", in.Name, "Expected directories to be stripped from the name")
+
+	_, err = in.Write(&chatmodels.File{TransferID: "x", Data: []byte("hi")})
+	assert.ErrorIs(err, ErrUnknownTransfer, "Expected chunks before accepting to be refused")
+
+	in.Answer(true)
+	_, err = in.Write(&chatmodels.File{TransferID: "x", Offset: 5, Data: []byte("hi")})
+	assert.ErrorIs(err, ErrBadChunk)
+	_, err = in.Write(&chatmodels.File{TransferID: "x", Data: make([]byte, 11)})
+	assert.ErrorIs(err, ErrBadChunk)
+}
+
+func TestCheckOfferAndChunk(t *testing.T) {
+	assert := assert.New(t)
+	sum := Checksum([]byte("hello"))
+
+	assert.NoError(CheckOffer(&chatmodels.File{TransferID: "x", Name: "a.txt", Size: 5, Checksum: sum}))
+	assert.ErrorIs(CheckOffer(&chatmodels.File{TransferID: "x", Name: "a.txt", Size: MaxFileSize + 1, Checksum: sum}), ErrTooLarge)
+	assert.ErrorIs(CheckOffer(&chatmodels.File{TransferID: "x", Name: strings.Repeat("a", MaxNameLength+1), Size: 5, Checksum: sum}), ErrBadOffer)
+	assert.ErrorIs(CheckOffer(&chatmodels.File{TransferID: "x", Name: "a.txt", Size: 5, Checksum: strings.Repeat("0", 1<<16)}), ErrBadOffer)
+	assert.ErrorIs(CheckOffer(&chatmodels.File{Name: "a.txt", Size: 5, Checksum: sum}), ErrBadOffer)
+
+	assert.NoError(CheckChunk(ChunkSize, ChunkSize, 3*ChunkSize))
+	assert.ErrorIs(CheckChunk(0, ChunkSize+1, 3*ChunkSize), ErrBadChunk, "Expected oversized chunks to be refused")
+	assert.ErrorIs(CheckChunk(2*ChunkSize, ChunkSize, 2*ChunkSize+10), ErrBadChunk, "Expected chunks past the end to be refused")
+	assert.ErrorIs(CheckChunk(-ChunkSize, 10, 3*ChunkSize), ErrBadChunk)
+	assert.ErrorIs(CheckChunk(0, 0, 3*ChunkSize), ErrBadChunk)
+}
+
+func TestNewOutgoingErrors(t *testing.T) {
+	dir := t.TempDir()
+	_, err := NewOutgoing("bob", dir)
+	assert.Error(t, err)
+
+	empty := filepath.Join(dir, "empty")
+	os.WriteFile(empty, nil, 0o644)
+	_, err = NewOutgoing("bob", empty)
+	assert.ErrorIs(t, err, ErrEmptyFile)
+}
+
+func TestTrackerWindowAndAcks(t *testing.T) {
+	assert := assert.New(t)
+	tracker := NewTracker[string]()
+	size := int64(6 * ChunkSize)
+	assert.NoError(tracker.Offer("t1", "alice", []string{"bob", "carol", "dave"}, size))
+	assert.Error(tracker.Offer("t1", "alice", []string{"bob"}, size))
+
+	_, err := tracker.Chunk("t1", "alice", 0, ChunkSize)
+	assert.ErrorIs(err, ErrUnknownTransfer, "Expected no chunks before anyone accepts")
+
+	sender, err := tracker.Answer("t1", "bob", true)
+	assert.NoError(err)
+	assert.Equal("alice", sender)
+	tracker.Answer("t1", "carol", true)
+	tracker.Answer("t1", "dave", false)
+
+	_, err = tracker.Chunk("t1", "bob", 0, ChunkSize)
+	assert.ErrorIs(err, ErrUnknownTransfer, "Expected only the sender to send chunks")
+
+	for i := int64(0); i < Window; i++ {
+		targets, err := tracker.Chunk("t1", "alice", i*ChunkSize, ChunkSize)
+		assert.NoError(err)
+		assert.ElementsMatch([]string{"bob", "carol"}, targets)
+	}
+	_, err = tracker.Chunk("t1", "alice", Window*ChunkSize, ChunkSize)
+	assert.ErrorIs(err, ErrWindowExceeded)
+
+	_, progress, advanced, err := tracker.Ack("t1", "bob", 2*ChunkSize, false)
+	assert.NoError(err)
+	assert.Equal(int64(0), progress, "Expected progress to wait for the slowest receiver")
+	assert.False(advanced)
+
+	_, progress, advanced, _ = tracker.Ack("t1", "carol", ChunkSize, false)
+	assert.Equal(int64(ChunkSize), progress)
+	assert.True(advanced)
+	_, err = tracker.Chunk("t1", "alice", Window*ChunkSize, ChunkSize)
+	assert.NoError(err)
+
+	_, err = tracker.Answer("t1", "dave", true)
+	assert.Error(err, "Expected a rejected recipient to be forgotten")
+
+	tracker.Ack("t1", "bob", size, true)
+	tracker.Ack("t1", "carol", size, true)
+	assert.Empty(tracker.transfers, "Expected finished transfers to be removed")
+}
+
+func TestTrackerLateAccept(t *testing.T) {
+	tracker := NewTracker[string]()
+	tracker.Offer("t1", "alice", []string{"bob", "carol"}, 10)
+	tracker.Answer("t1", "bob", true)
+	tracker.Chunk("t1", "alice", 0, 10)
+
+	_, err := tracker.Answer("t1", "carol", true)
+	assert.ErrorIs(t, err, ErrAlreadyStarted)
+}
+
+func TestTrackerDrop(t *testing.T) {
+	assert := assert.New(t)
+	tracker := NewTracker[string]()
+	tracker.Offer("t1", "alice", []string{"bob"}, 10)
+	tracker.Offer("t2", "bob", []string{"carol"}, 10)
+
+	cancelled := tracker.Drop("bob")
+	assert.ElementsMatch([]Cancelled[string]{
+		{ID: "t1", Notify: []string{"alice"}},
+		{ID: "t2", Notify: []string{"carol"}},
+	}, cancelled)
+	assert.Empty(tracker.transfers)
+}
@@ -0,0 +1,190 @@
+package chatheadless
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/vinh0604/go-network-concepts/internal/chatcmd"
+	"github.com/vinh0604/go-network-concepts/internal/chatfile"
+	"github.com/vinh0604/go-network-concepts/internal/chatmodels"
+	"github.com/vinh0604/go-network-concepts/internal/chatutils"
+)
+
+const (
+	FormatPlain = "plain"
+	FormatJSON  = "json"
+)
+
+type Options struct {
+	Nick  string
+	Token string
+	// Format is FormatPlain or FormatJSON.
+	Format string
+	// Linger keeps printing incoming messages for a while after the input
+	// ends, so replies to the last lines are not lost.
+	Linger time.Duration
+	// Commands parses "/" lines.
+	Commands *chatcmd.Registry
+	// Errors receives a line for every input line that could not be sent,
+	// such as an unknown command; nil discards them.
+	Errors io.Writer
+}
+
+func (o Options) Validate() error {
+	if o.Nick == "" {
+		return errors.New("nick cannot be empty")
+	}
+	if o.Format != FormatPlain && o.Format != FormatJSON {
+		return fmt.Errorf("invalid format %q: must be %s or %s", o.Format, FormatPlain, FormatJSON)
+	}
+	if o.Commands == nil {
+		return errors.New("no command registry")
+	}
+	return nil
+}
+
+// Run joins the chat on conn, sends every line read from in and prints
+// received payloads to out. It returns when the input ends or the server
+// closes the connection.
+func Run(conn net.Conn, opts Options, in io.Reader, out io.Writer) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+
+	hello := chatmodels.Payload{MsgType: chatmodels.MsgTypeHello, Nick: &opts.Nick}
+	if opts.Token != "" {
+		hello.Token = &opts.Token
+	}
+	if err := chatutils.WriteMessage(conn, hello); err != nil {
+		return fmt.Errorf("error sending hello message: %w", err)
+	}
+
+	readDone := make(chan error, 1)
+	go func() {
+		readDone <- printPayloads(conn, opts.Format, out)
+	}()
+	inputDone := make(chan error, 1)
+	go func() {
+		inputDone <- sendLines(conn, in, opts.Commands, errorsTo(opts.Errors))
+	}()
+
+	select {
+	case err := <-readDone:
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		return err
+	case err := <-inputDone:
+		if err == nil {
+			select {
+			case <-readDone:
+				return nil
+			case <-time.After(opts.Linger):
+			}
+			err = chatutils.WriteMessage(conn, chatmodels.Payload{MsgType: chatmodels.MsgTypeLeave, Nick: &opts.Nick})
+		}
+		conn.Close()
+		<-readDone
+		return err
+	}
+}
+
+func errorsTo(w io.Writer) io.Writer {
+	if w == nil {
+		return io.Discard
+	}
+	return w
+}
+
+func sendLines(conn net.Conn, in io.Reader, commands *chatcmd.Registry, errOut io.Writer) error {
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		payload, err := linePayload(line, commands)
+		if errors.Is(err, errQuit) {
+			return nil
+		}
+		if err != nil {
+			fmt.Fprintln(errOut, err)
+			continue
+		}
+		if err := chatutils.WriteMessage(conn, payload); err != nil {
+			return fmt.Errorf("error sending message: %w", err)
+		}
+	}
+	return scanner.Err()
+}
+
+var errQuit = errors.New("quit")
+
+// linePayload turns an input line into the payload to send, or errQuit
+// for /quit.
+func linePayload(line string, commands *chatcmd.Registry) (chatmodels.Payload, error) {
+	if !chatcmd.IsCommand(line) {
+		return chatmodels.Payload{MsgType: chatmodels.MsgTypeChat, Msg: &line}, nil
+	}
+
+	invocation, err := commands.Parse(line)
+	if err != nil {
+		return chatmodels.Payload{}, err
+	}
+	if invocation.Spec.Server {
+		return chatmodels.Payload{MsgType: chatmodels.MsgTypeCommand, Msg: &line}, nil
+	}
+	args := invocation.Args
+	switch invocation.Spec.Name {
+	case "msg":
+		return chatmodels.Payload{MsgType: chatmodels.MsgTypeDM, Nick: &args[0], Msg: &args[1]}, nil
+	case "nick":
+		return chatmodels.Payload{MsgType: chatmodels.MsgTypeNick, Nick: &args[0]}, nil
+	case "who":
+		return chatmodels.Payload{MsgType: chatmodels.MsgTypeWho}, nil
+	case "quit":
+		return chatmodels.Payload{}, errQuit
+	}
+	return chatmodels.Payload{}, fmt.Errorf("/%s is not available in headless mode", invocation.Spec.Name)
+}
+
+func printPayloads(conn net.Conn, format string, out io.Writer) error {
+	readBuf := chatutils.ReadBuffer{}
+	encoder := json.NewEncoder(out)
+	for {
+		payload, err := chatutils.ReadNextMessage(conn, &readBuf)
+		if err != nil {
+			return err
+		}
+		if payload.MsgType == chatmodels.MsgTypePong || payload.MsgType == chatmodels.MsgTypeTyping || payload.MsgType == chatmodels.MsgTypeReceipt {
+			continue
+		}
+		if payload.MsgType == chatmodels.MsgTypeFileOffer && payload.File != nil {
+			reject := chatfile.AnswerReject
+			err = chatutils.WriteMessage(conn, chatmodels.Payload{
+				MsgType: chatmodels.MsgTypeFileAnswer,
+				Nick:    payload.Nick,
+				Msg:     &reject,
+				File:    &chatmodels.File{TransferID: payload.File.TransferID},
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		if format == FormatJSON {
+			err = encoder.Encode(payload)
+		} else {
+			_, err = fmt.Fprintln(out, chatutils.FormatPlainText(payload))
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package chatheadless
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vinh0604/go-network-concepts/internal/chatcmd"
+	"github.com/vinh0604/go-network-concepts/internal/chatmodels"
+	"github.com/vinh0604/go-network-concepts/internal/chatutils"
+)
+
+// commands mirrors the chat client's registry for the commands headless
+// mode cares about.
+func commands() *chatcmd.Registry {
+	registry := chatcmd.NewRegistry()
+	registry.Register(chatcmd.Spec{Name: "nick", MinArgs: 1, MaxArgs: 1})
+	registry.Register(chatcmd.Spec{Name: "msg", MinArgs: 2, MaxArgs: 2})
+	registry.Register(chatcmd.Spec{Name: "who", MaxArgs: 0})
+	registry.Register(chatcmd.Spec{Name: "quit", MaxArgs: 0})
+	registry.Register(chatcmd.Spec{Name: "search", MaxArgs: 1})
+	registry.Register(chatcmd.Spec{Name: "kick", MinArgs: 1, MaxArgs: 2, Server: true})
+	return registry
+}
+
+func TestLinePayload(t *testing.T) {
+	assert := assert.New(t)
+	registry := commands()
+
+	payload, err := linePayload("hello there", registry)
+	assert.NoError(err)
+	assert.Equal(chatmodels.MsgTypeChat, payload.MsgType)
+	assert.Equal("hello there", *payload.Msg)
+
+	payload, err = linePayload("/msg bob see you soon", registry)
+	assert.NoError(err)
+	assert.Equal(chatmodels.MsgTypeDM, payload.MsgType)
+	assert.Equal("bob", *payload.Nick)
+	assert.Equal("see you soon", *payload.Msg)
+
+	payload, err = linePayload("/NICK carol", registry)
+	assert.NoError(err)
+	assert.Equal(chatmodels.MsgTypeNick, payload.MsgType)
+	assert.Equal("carol", *payload.Nick)
+
+	payload, _ = linePayload("/who", registry)
+	assert.Equal(chatmodels.MsgTypeWho, payload.MsgType)
+
+	payload, err = linePayload("/kick bob spamming", registry)
+	assert.NoError(err)
+	assert.Equal(chatmodels.MsgTypeCommand, payload.MsgType, "Expected server commands to go to the server")
+	assert.Equal("/kick bob spamming", *payload.Msg)
+
+	_, err = linePayload("/msg bob", registry)
+	assert.EqualError(err, "usage: /msg", "Expected the registry's usage check")
+	_, err = linePayload("/frobnicate", registry)
+	assert.ErrorIs(err, chatcmd.ErrUnknownCommand)
+	_, err = linePayload("/search text", registry)
+	assert.EqualError(err, "/search is not available in headless mode")
+	_, err = linePayload("/quit", registry)
+	assert.ErrorIs(err, errQuit)
+}
+
+func TestValidate(t *testing.T) {
+	assert.NoError(t, Options{Nick: "alice", Format: FormatPlain, Commands: commands()}.Validate())
+	assert.Error(t, Options{Format: FormatPlain}.Validate(), "Expected an empty nick to be rejected")
+	assert.Error(t, Options{Nick: "alice", Format: "xml", Commands: commands()}.Validate(), "Expected an unknown format to be rejected")
+	assert.Error(t, Options{Nick: "alice", Format: FormatPlain}.Validate(), "Expected a missing registry to be rejected")
+}
+
+func TestRunPlain(t *testing.T) {
+	assert := assert.New(t)
+
+	client, server := net.Pipe()
+	defer server.Close()
+
+	received := make(chan []*chatmodels.Payload, 1)
+	go func() {
+		readBuf := chatutils.ReadBuffer{}
+		payloads := []*chatmodels.Payload{}
+		hello, _ := chatutils.ReadNextMessage(server, &readBuf)
+		payloads = append(payloads, hello)
+
+		bob, msg := "bob", "hi alice"
+		chatutils.WriteMessage(server, chatmodels.Payload{MsgType: chatmodels.MsgTypeChat, Nick: &bob, Msg: &msg})
+		for i := 0; i < 3; i++ {
+			payload, err := chatutils.ReadNextMessage(server, &readBuf)
+			if err != nil {
+				break
+			}
+			payloads = append(payloads, payload)
+		}
+		received <- payloads
+	}()
+
+	var out bytes.Buffer
+	var errOut bytes.Buffer
+	opts := Options{Nick: "alice", Format: FormatPlain, Linger: 100 * time.Millisecond, Commands: commands(), Errors: &errOut}
+	err := Run(client, opts, strings.NewReader("hello all\n\n/bogus\n/msg bob psst\n"), &out)
+	assert.NoError(err)
+	assert.Equal("bob: hi alice\n", out.String())
+	assert.Equal("unknown command: /bogus (try /help)\n", errOut.String(), "Expected unknown commands to be reported, not sent")
+
+	payloads := <-received
+	if assert.Len(payloads, 4) {
+		assert.Equal(chatmodels.MsgTypeHello, payloads[0].MsgType)
+		assert.Equal("alice", *payloads[0].Nick)
+		assert.Equal(chatmodels.MsgTypeChat, payloads[1].MsgType)
+		assert.Equal("hello all", *payloads[1].Msg)
+		assert.Equal(chatmodels.MsgTypeDM, payloads[2].MsgType)
+		assert.Equal(chatmodels.MsgTypeLeave, payloads[3].MsgType, "Expected a leave once the input ends")
+	}
+}
+
+func TestRunJSONUntilServerCloses(t *testing.T) {
+	client, server := net.Pipe()
+
+	go func() {
+		chatutils.ReadNextMessage(server, &chatutils.ReadBuffer{})
+		chatutils.WriteMessage(server, chatmodels.Payload{MsgType: chatmodels.MsgTypeWho, Nicks: []string{"alice", "bob"}})
+		server.Close()
+	}()
+
+	// The input never ends, so Run must return because the server hung up.
+	in, inWriter := io.Pipe()
+	defer inWriter.Close()
+
+	var out bytes.Buffer
+	err := Run(client, Options{Nick: "alice", Format: FormatJSON, Commands: commands()}, in, &out)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"MsgType":"who","Nick":null,"Msg":null,"Nicks":["alice","bob"]}`, out.String())
+}
+
+func TestRunDeclinesFileOffers(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	answers := make(chan *chatmodels.Payload, 1)
+	go func() {
+		readBuf := chatutils.ReadBuffer{}
+		chatutils.ReadNextMessage(server, &readBuf)
+		bob := "bob"
+		chatutils.WriteMessage(server, chatmodels.Payload{
+			MsgType: chatmodels.MsgTypeFileOffer,
+			Nick:    &bob,
+			File:    &chatmodels.File{TransferID: "t1", Name: "notes.txt", Size: 42},
+		})
+		answer, _ := chatutils.ReadNextMessage(server, &readBuf)
+		answers <- answer
+		server.Close()
+	}()
+
+	in, inWriter := io.Pipe()
+	defer inWriter.Close()
+
+	var out bytes.Buffer
+	assert.NoError(t, Run(client, Options{Nick: "alice", Format: FormatPlain, Commands: commands()}, in, &out))
+	assert.Equal(t, "[bob offered notes.txt (42 bytes)]\n", out.String())
+
+	answer := <-answers
+	if assert.NotNil(t, answer) {
+		assert.Equal(t, chatmodels.MsgTypeFileAnswer, answer.MsgType)
+		assert.Equal(t, "reject", *answer.Msg)
+		assert.Equal(t, "t1", answer.File.TransferID)
+	}
+}
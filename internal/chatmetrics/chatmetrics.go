@@ -0,0 +1,213 @@
+package chatmetrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type metric interface {
+	writeTo(w io.Writer) error
+}
+
+// Registry collects metrics and renders them in the Prometheus text
+// exposition format.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+func (r *Registry) WritePrometheus(w io.Writer) error {
+	r.mu.Lock()
+	metrics := slices.Clone(r.metrics)
+	r.mu.Unlock()
+
+	for _, m := range metrics {
+		if err := m.writeTo(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WritePrometheus(w)
+	})
+}
+
+type Counter struct {
+	name  string
+	help  string
+	value atomic.Uint64
+}
+
+func (r *Registry) NewCounter(name string, help string) *Counter {
+	c := &Counter{name: name, help: help}
+	r.register(c)
+	return c
+}
+
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+func (c *Counter) Add(n int) {
+	if n > 0 {
+		c.value.Add(uint64(n))
+	}
+}
+
+func (c *Counter) Value() uint64 {
+	return c.value.Load()
+}
+
+func (c *Counter) writeTo(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.name, c.help, c.name, c.name, c.Value())
+	return err
+}
+
+// CounterVec is a family of counters partitioned by the value of a single
+// label, e.g. errors_total{type="read"}.
+type CounterVec struct {
+	name   string
+	help   string
+	label  string
+	mu     sync.Mutex
+	values map[string]*atomic.Uint64
+}
+
+func (r *Registry) NewCounterVec(name string, help string, label string) *CounterVec {
+	cv := &CounterVec{name: name, help: help, label: label, values: make(map[string]*atomic.Uint64)}
+	r.register(cv)
+	return cv
+}
+
+func (cv *CounterVec) Inc(labelValue string) {
+	cv.mu.Lock()
+	value, ok := cv.values[labelValue]
+	if !ok {
+		value = &atomic.Uint64{}
+		cv.values[labelValue] = value
+	}
+	cv.mu.Unlock()
+	value.Add(1)
+}
+
+func (cv *CounterVec) Value(labelValue string) uint64 {
+	cv.mu.Lock()
+	defer cv.mu.Unlock()
+	if value, ok := cv.values[labelValue]; ok {
+		return value.Load()
+	}
+	return 0
+}
+
+func (cv *CounterVec) writeTo(w io.Writer) error {
+	cv.mu.Lock()
+	labelValues := make([]string, 0, len(cv.values))
+	for labelValue := range cv.values {
+		labelValues = append(labelValues, labelValue)
+	}
+	cv.mu.Unlock()
+	slices.Sort(labelValues)
+
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", cv.name, cv.help, cv.name); err != nil {
+		return err
+	}
+	for _, labelValue := range labelValues {
+		_, err := fmt.Fprintf(w, "%s{%s=%s} %d\n", cv.name, cv.label, strconv.Quote(labelValue), cv.Value(labelValue))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GaugeFunc is a gauge whose value is computed at scrape time.
+type GaugeFunc struct {
+	name  string
+	help  string
+	value func() float64
+}
+
+func (r *Registry) NewGaugeFunc(name string, help string, value func() float64) *GaugeFunc {
+	g := &GaugeFunc{name: name, help: help, value: value}
+	r.register(g)
+	return g
+}
+
+func (g *GaugeFunc) writeTo(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.name, g.help, g.name, g.name, formatFloat(g.value()))
+	return err
+}
+
+type Histogram struct {
+	name    string
+	help    string
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+// NewHistogram registers a histogram with the given upper bounds, which must
+// be sorted in increasing order. The +Inf bucket is added implicitly.
+func (r *Registry) NewHistogram(name string, help string, buckets []float64) *Histogram {
+	h := &Histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+	r.register(h)
+	return h
+}
+
+func (h *Histogram) Observe(value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+func (h *Histogram) writeTo(w io.Writer) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for i, bound := range h.buckets {
+		fmt.Fprintf(&sb, "%s_bucket{le=\"%s\"} %d\n", h.name, formatFloat(bound), h.counts[i])
+	}
+	fmt.Fprintf(&sb, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(&sb, "%s_sum %s\n%s_count %d\n", h.name, formatFloat(h.sum), h.name, h.count)
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
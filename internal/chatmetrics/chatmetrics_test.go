@@ -0,0 +1,75 @@
+package chatmetrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCounter(t *testing.T) {
+	registry := NewRegistry()
+	counter := registry.NewCounter("chat_messages_total", "Messages seen.")
+	counter.Inc()
+	counter.Add(4)
+	counter.Add(-1)
+
+	var sb strings.Builder
+	assert.NoError(t, registry.WritePrometheus(&sb))
+	assert.Equal(t, uint64(5), counter.Value(), "Expected negative additions to be ignored")
+	assert.Equal(t, "# HELP chat_messages_total Messages seen.\n# TYPE chat_messages_total counter\nchat_messages_total 5\n", sb.String())
+}
+
+func TestCounterVec(t *testing.T) {
+	registry := NewRegistry()
+	errors := registry.NewCounterVec("chat_errors_total", "Errors by type.", "type")
+	errors.Inc("write")
+	errors.Inc("read")
+	errors.Inc("write")
+
+	var sb strings.Builder
+	assert.NoError(t, registry.WritePrometheus(&sb))
+	assert.Equal(t, uint64(2), errors.Value("write"))
+	assert.Equal(t, uint64(0), errors.Value("decode"))
+	assert.Equal(t, "# HELP chat_errors_total Errors by type.\n# TYPE chat_errors_total counter\n"+
+		"chat_errors_total{type=\"read\"} 1\nchat_errors_total{type=\"write\"} 2\n", sb.String())
+}
+
+func TestGaugeFunc(t *testing.T) {
+	registry := NewRegistry()
+	clients := 3
+	registry.NewGaugeFunc("chat_connected_clients", "Connected clients.", func() float64 { return float64(clients) })
+
+	var sb strings.Builder
+	assert.NoError(t, registry.WritePrometheus(&sb))
+	assert.Contains(t, sb.String(), "# TYPE chat_connected_clients gauge\nchat_connected_clients 3\n")
+}
+
+func TestHistogram(t *testing.T) {
+	registry := NewRegistry()
+	histogram := registry.NewHistogram("chat_relay_duration_seconds", "Relay latency.", []float64{0.001, 0.01})
+	histogram.Observe(0.0005)
+	histogram.Observe(0.005)
+	histogram.Observe(2)
+
+	var sb strings.Builder
+	assert.NoError(t, registry.WritePrometheus(&sb))
+	assert.Equal(t, "# HELP chat_relay_duration_seconds Relay latency.\n# TYPE chat_relay_duration_seconds histogram\n"+
+		"chat_relay_duration_seconds_bucket{le=\"0.001\"} 1\n"+
+		"chat_relay_duration_seconds_bucket{le=\"0.01\"} 2\n"+
+		"chat_relay_duration_seconds_bucket{le=\"+Inf\"} 3\n"+
+		"chat_relay_duration_seconds_sum 2.0055\n"+
+		"chat_relay_duration_seconds_count 3\n", sb.String())
+}
+
+func TestHandler(t *testing.T) {
+	registry := NewRegistry()
+	registry.NewCounter("chat_messages_total", "Messages seen.").Inc()
+
+	recorder := httptest.NewRecorder()
+	registry.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, 200, recorder.Code)
+	assert.Contains(t, recorder.Header().Get("Content-Type"), "text/plain")
+	assert.Contains(t, recorder.Body.String(), "chat_messages_total 1\n")
+}
@@ -1,15 +1,63 @@
 package chatmodels
 
+import "time"
+
 const (
-	MsgTypeHello = "hello"
-	MsgTypeChat  = "chat"
-	MsgTypeJoin  = "join"
-	MsgTypeAnn   = "announcement"
-	MsgTypeDM    = "dm"
+	MsgTypeHello   = "hello"
+	MsgTypeChat    = "chat"
+	MsgTypeJoin    = "join"
+	MsgTypeLeave   = "leave"
+	MsgTypeAnn     = "announcement"
+	MsgTypeDM      = "dm"
+	MsgTypeCommand = "command"
+	MsgTypeTopic   = "topic"
+	MsgTypeNick    = "nick"
+	MsgTypeWho     = "who"
+	MsgTypePing    = "ping"
+	MsgTypePong    = "pong"
+	MsgTypeKey     = "key"
+	MsgTypeTyping  = "typing"
+	MsgTypeReceipt = "receipt"
+	MsgTypeLink    = "link"
+
+	MsgTypeFileOffer  = "file-offer"
+	MsgTypeFileAnswer = "file-answer"
+	MsgTypeFileChunk  = "file-chunk"
+	MsgTypeFileAck    = "file-ack"
 )
 
 type Payload struct {
 	MsgType string
 	Nick    *string
 	Msg     *string
+	Token   *string  `json:",omitempty"`
+	Nicks   []string `json:",omitempty"`
+	File    *File    `json:",omitempty"`
+	// PublicKey is an X25519 key: the sender's own in hello messages and
+	// encrypted DMs, or the requested nick's in replies to key messages.
+	PublicKey []byte `json:",omitempty"`
+	// Ciphertext and Nonce replace Msg in end-to-end encrypted DMs.
+	Ciphertext []byte `json:",omitempty"`
+	Nonce      []byte `json:",omitempty"`
+	// ID and Time are assigned by the server to chat messages and DMs. In a
+	// receipt, ID names the message it acknowledges.
+	ID   string     `json:",omitempty"`
+	Time *time.Time `json:",omitempty"`
+	// Ref is chosen by the client for a message it sends and echoed in the
+	// "sent" receipt, which tells it the ID the server assigned.
+	Ref string `json:",omitempty"`
+	// Origin and To name the origin server and DM recipient on links
+	// between servers.
+	Origin string `json:",omitempty"`
+	To     string `json:",omitempty"`
+}
+
+// File describes a file transfer in the file-* messages.
+type File struct {
+	TransferID string
+	Name       string `json:",omitempty"`
+	Size       int64  `json:",omitempty"`
+	Checksum   string `json:",omitempty"`
+	Offset     int64
+	Data       []byte `json:",omitempty"`
 }
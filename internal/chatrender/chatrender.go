@@ -0,0 +1,219 @@
+package chatrender
+
+import (
+	"hash/fnv"
+	"strings"
+
+	"github.com/charmbracelet/lipgloss"
+	"github.com/charmbracelet/x/ansi"
+)
+
+type Style int
+
+const (
+	Bold Style = 1 << iota
+	Italic
+	Code
+	URL
+	Mention
+)
+
+// Plain is the zero Style.
+const Plain Style = 0
+
+type Span struct {
+	Text  string
+	Style Style
+}
+
+// nickPalette holds ANSI colours readable on dark and light backgrounds.
+var nickPalette = []lipgloss.Color{"1", "2", "3", "4", "5", "6", "9", "10", "11", "12", "13", "14"}
+
+// NickColor picks a colour for nick from a fixed palette, so the same nick
+// gets the same colour in every client and across restarts.
+func NickColor(nick string) lipgloss.Color {
+	h := fnv.New32a()
+	h.Write([]byte(nick))
+	return nickPalette[h.Sum32()%uint32(len(nickPalette))]
+}
+
+// Parse splits a chat message into styled spans: *bold*, _italic_, `code`,
+// http(s) URLs and mentions of nick.
+func Parse(text string, nick string) []Span {
+	spans := []Span{}
+	parseEmphasis(text, Plain, nick, &spans)
+
+	merged := []Span{}
+	for _, span := range spans {
+		if span.Text == "" {
+			continue
+		}
+		if len(merged) > 0 && merged[len(merged)-1].Style == span.Style {
+			merged[len(merged)-1].Text += span.Text
+			continue
+		}
+		merged = append(merged, span)
+	}
+	return merged
+}
+
+// Mentions reports whether text mentions nick outside of code spans.
+func Mentions(text string, nick string) bool {
+	for _, span := range Parse(text, nick) {
+		if span.Style&Mention != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func parseEmphasis(text string, style Style, nick string, spans *[]Span) {
+	start := 0
+	for i := 0; i < len(text); i++ {
+		if atWordStart(text, i) {
+			if end := urlEnd(text, i); end > i {
+				// Skip over URLs so underscores in them are not emphasis.
+				i = end - 1
+				continue
+			}
+		}
+
+		var markerStyle Style
+		switch text[i] {
+		case '`':
+			markerStyle = Code
+		case '*':
+			markerStyle = Bold
+		case '_':
+			markerStyle = Italic
+		default:
+			continue
+		}
+		end := closingMarker(text, i)
+		if end < 0 {
+			continue
+		}
+
+		parseWords(text[start:i], style, nick, spans)
+		if markerStyle == Code {
+			*spans = append(*spans, Span{Text: text[i+1 : end], Style: style | Code})
+		} else {
+			parseEmphasis(text[i+1:end], style|markerStyle, nick, spans)
+		}
+		start = end + 1
+		i = end
+	}
+	parseWords(text[start:], style, nick, spans)
+}
+
+// closingMarker returns the index of the marker closing the one at open, or
+// -1 if open does not start a valid span.
+func closingMarker(text string, open int) int {
+	marker := text[open]
+	if !atWordStart(text, open) || open+1 >= len(text) || text[open+1] == ' ' {
+		return -1
+	}
+	for j := open + 2; j < len(text); j++ {
+		if text[j] != marker {
+			continue
+		}
+		if marker == '`' {
+			return j
+		}
+		if text[j-1] != ' ' && (j+1 == len(text) || !isWordByte(text[j+1])) {
+			return j
+		}
+	}
+	return -1
+}
+
+func parseWords(text string, style Style, nick string, spans *[]Span) {
+	start := 0
+	for i := 0; i < len(text); {
+		if !atWordStart(text, i) {
+			i++
+			continue
+		}
+		end := urlEnd(text, i)
+		spanStyle := style | URL
+		if end <= i {
+			end = mentionEnd(text, i, nick)
+			spanStyle = style | Mention
+		}
+		if end <= i {
+			i++
+			continue
+		}
+		*spans = append(*spans, Span{Text: text[start:i], Style: style})
+		*spans = append(*spans, Span{Text: text[i:end], Style: spanStyle})
+		start = end
+		i = end
+	}
+	*spans = append(*spans, Span{Text: text[start:], Style: style})
+}
+
+// urlEnd returns the end of an http(s) URL starting at i, leaving out
+// trailing punctuation, or i if there is none.
+func urlEnd(text string, i int) int {
+	rest := text[i:]
+	if !strings.HasPrefix(rest, "http://") && !strings.HasPrefix(rest, "https://") {
+		return i
+	}
+	end := strings.IndexAny(rest, " \t\n")
+	if end < 0 {
+		end = len(rest)
+	}
+	url := strings.TrimRight(rest[:end], ".,;:!?)'\"")
+	if strings.HasSuffix(url, "://") {
+		return i
+	}
+	return i + len(url)
+}
+
+// mentionEnd returns the end of a mention of nick starting at i, or i if
+// there is none.
+func mentionEnd(text string, i int, nick string) int {
+	if nick == "" {
+		return i
+	}
+	start := i
+	if text[start] == '@' {
+		start++
+	}
+	end := start + len(nick)
+	if end > len(text) || !strings.EqualFold(text[start:end], nick) {
+		return i
+	}
+	if end < len(text) && isWordByte(text[end]) {
+		return i
+	}
+	return end
+}
+
+func atWordStart(text string, i int) bool {
+	return i == 0 || !isWordByte(text[i-1])
+}
+
+func isWordByte(b byte) bool {
+	return b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9' || b == '_' || b == '-' || b >= 0x80
+}
+
+// Wrap word-wraps body to width columns after head with a hanging indent.
+func Wrap(head string, body string, width int) string {
+	indent := ansi.StringWidth(head)
+	if width-indent < 10 {
+		// Too narrow for a hanging indent to be readable.
+		return ansi.Wrap(head+body, max(width, 1), "")
+	}
+
+	lines := strings.Split(ansi.Wrap(body, width-indent, ""), "\n")
+	padding := strings.Repeat(" ", indent)
+	for i := range lines {
+		if i == 0 {
+			lines[i] = head + lines[i]
+		} else {
+			lines[i] = padding + lines[i]
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,59 @@
+package chatrender
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/charmbracelet/x/ansi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNickColorIsStable(t *testing.T) {
+	assert.Equal(t, NickColor("alice"), NickColor("alice"))
+	assert.Contains(t, nickPalette, NickColor("bob"))
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		spans []Span
+	}{
+		{"plain", "hello world", []Span{{"hello world", Plain}}},
+		{"bold", "a *big* deal", []Span{{"a ", Plain}, {"big", Bold}, {" deal", Plain}}},
+		{"italic", "_so_ nice", []Span{{"so", Italic}, {" nice", Plain}}},
+		{"nested", "*very _nice_*", []Span{{"very ", Bold}, {"nice", Bold | Italic}}},
+		{"code is literal", "run `go *test*`", []Span{{"run ", Plain}, {"go *test*", Code}}},
+		{"markers inside words", "snake_case_name and 2*3*4", []Span{{"snake_case_name and 2*3*4", Plain}}},
+		{"unclosed marker", "*nope", []Span{{"*nope", Plain}}},
+		{"url", "see https://example.com/a_b_c.", []Span{{"see ", Plain}, {"https://example.com/a_b_c", URL}, {".", Plain}}},
+		{"mention", "hey @Alice, look", []Span{{"hey ", Plain}, {"@Alice", Mention}, {", look", Plain}}},
+		{"mention needs whole word", "alicemania", []Span{{"alicemania", Plain}}},
+		{"mention in bold", "*alice!*", []Span{{"alice", Bold | Mention}, {"!", Bold}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.spans, Parse(tt.text, "alice"))
+		})
+	}
+}
+
+func TestMentions(t *testing.T) {
+	assert.True(t, Mentions("ping alice", "alice"))
+	assert.False(t, Mentions("ping `alice`", "alice"), "Expected mentions in code to be ignored")
+	assert.False(t, Mentions("ping bob", "alice"))
+}
+
+func TestWrap(t *testing.T) {
+	wrapped := Wrap("12:00 bob: ", "the quick brown fox jumps over the lazy dog", 30)
+	lines := strings.Split(wrapped, "\n")
+	assert.Equal(t, []string{
+		"12:00 bob: the quick brown fox",
+		"           jumps over the lazy",
+		"           dog",
+	}, lines)
+	for _, line := range lines {
+		assert.LessOrEqual(t, ansi.StringWidth(line), 30)
+	}
+}
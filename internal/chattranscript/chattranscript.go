@@ -0,0 +1,157 @@
+package chattranscript
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vinh0604/go-network-concepts/internal/chatmodels"
+	"github.com/vinh0604/go-network-concepts/internal/chatutils"
+)
+
+const (
+	Received = "in"
+	Sent     = "out"
+)
+
+// Entry is one line of a transcript file.
+type Entry struct {
+	Time      time.Time          `json:"time"`
+	Direction string             `json:"direction"`
+	Payload   chatmodels.Payload `json:"payload"`
+}
+
+// Text renders the entry without its timestamp, the way the chat-client
+// shows it.
+func (e Entry) Text() string {
+	if e.Direction == Sent && e.Payload.MsgType == chatmodels.MsgTypeDM {
+		nick, msg := "", ""
+		if e.Payload.Nick != nil {
+			nick = *e.Payload.Nick
+		}
+		if e.Payload.Msg != nil {
+			msg = *e.Payload.Msg
+		}
+		return fmt.Sprintf("[DM to %s] %s", nick, msg)
+	}
+	return chatutils.FormatPlainText(&e.Payload)
+}
+
+// Writer appends entries to a transcript file as JSON lines. It is safe for
+// concurrent use.
+type Writer struct {
+	mu      sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+// Create opens path for appending, creating it if needed, so sessions
+// accumulate in the same transcript.
+func Create(path string) (*Writer, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{file: f, encoder: json.NewEncoder(f)}, nil
+}
+
+func (w *Writer) Write(entry Entry) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.encoder.Encode(entry)
+}
+
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.file.Close()
+}
+
+// Read parses a transcript. Blank lines are skipped; a malformed line is an
+// error naming its line number.
+func Read(r io.Reader) ([]Entry, error) {
+	entries := []Entry{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var entry Entry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			return nil, fmt.Errorf("transcript line %d: %w", lineNo, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+func Load(path string) ([]Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Read(f)
+}
+
+// Search returns the indexes of the entries whose text contains query,
+// ignoring case.
+func Search(entries []Entry, query string) []int {
+	query = strings.ToLower(query)
+	matches := []int{}
+	for i, entry := range entries {
+		if strings.Contains(strings.ToLower(entry.Text()), query) {
+			matches = append(matches, i)
+		}
+	}
+	return matches
+}
+
+const timeLayout = "2006-01-02 15:04:05"
+
+func ExportText(w io.Writer, entries []Entry) error {
+	for _, entry := range entries {
+		if _, err := fmt.Fprintf(w, "%s %s\n", entry.Time.Local().Format(timeLayout), entry.Text()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExportHTML writes a standalone HTML page. Every message is escaped, so the
+// page is safe to open whatever the other users sent.
+func ExportHTML(w io.Writer, entries []Entry, title string) error {
+	var sb strings.Builder
+	sb.WriteString("<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n")
+	fmt.Fprintf(&sb, "<title>%s</title>\n", html.EscapeString(title))
+	sb.WriteString("<style>\n")
+	sb.WriteString("body { font-family: monospace; }\n")
+	sb.WriteString("time { color: #888; margin-right: 1em; }\n")
+	sb.WriteString(".out { color: #804080; }\n")
+	sb.WriteString(".system { color: #c03030; }\n")
+	sb.WriteString("</style>\n</head>\n<body>\n")
+	fmt.Fprintf(&sb, "<h1>%s</h1>\n", html.EscapeString(title))
+	for _, entry := range entries {
+		class := entry.Direction
+		if entry.Payload.MsgType != chatmodels.MsgTypeChat && entry.Payload.MsgType != chatmodels.MsgTypeDM {
+			class = "system"
+		}
+		fmt.Fprintf(&sb, "<div class=\"%s\"><time datetime=\"%s\">%s</time>%s</div>\n",
+			class,
+			entry.Time.Format(time.RFC3339),
+			entry.Time.Local().Format(timeLayout),
+			html.EscapeString(entry.Text()))
+	}
+	sb.WriteString("</body>\n</html>\n")
+
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
@@ -0,0 +1,84 @@
+package chattranscript
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vinh0604/go-network-concepts/internal/chatmodels"
+)
+
+func entry(direction string, msgType string, nick string, msg string) Entry {
+	return Entry{
+		Time:      time.Date(2024, 5, 1, 10, 30, 0, 0, time.Local),
+		Direction: direction,
+		Payload:   chatmodels.Payload{MsgType: msgType, Nick: &nick, Msg: &msg},
+	}
+}
+
+func TestWriteAndLoad(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "transcript.jsonl")
+
+	w, err := Create(path)
+	assert.NoError(err)
+	assert.NoError(w.Write(entry(Received, chatmodels.MsgTypeChat, "bob", "hi alice")))
+	assert.NoError(w.Close())
+
+	// A second session appends to the same file.
+	w, err = Create(path)
+	assert.NoError(err)
+	assert.NoError(w.Write(entry(Sent, chatmodels.MsgTypeChat, "alice", "hi bob")))
+	assert.NoError(w.Close())
+
+	entries, err := Load(path)
+	assert.NoError(err)
+	if assert.Len(entries, 2) {
+		assert.Equal(Received, entries[0].Direction)
+		assert.Equal("bob: hi alice", entries[0].Text())
+		assert.Equal("alice: hi bob", entries[1].Text())
+		assert.True(entries[0].Time.Equal(time.Date(2024, 5, 1, 10, 30, 0, 0, time.Local)))
+	}
+}
+
+func TestReadReportsBadLine(t *testing.T) {
+	_, err := Read(strings.NewReader("{\"direction\":\"in\"}\n\nnot json\n"))
+	assert.ErrorContains(t, err, "line 3")
+}
+
+func TestSearch(t *testing.T) {
+	entries := []Entry{
+		entry(Received, chatmodels.MsgTypeChat, "bob", "Lunch at noon?"),
+		entry(Sent, chatmodels.MsgTypeChat, "alice", "sure"),
+		entry(Received, chatmodels.MsgTypeDM, "bob", "bring the LUNCH money"),
+	}
+	assert.Equal(t, []int{0, 2}, Search(entries, "lunch"))
+	assert.Equal(t, []int{0, 2}, Search(entries, "bob"), "Expected nicks to be searchable")
+	assert.Empty(t, Search(entries, "dinner"))
+}
+
+func TestSentDMText(t *testing.T) {
+	assert.Equal(t, "[DM to bob] psst", entry(Sent, chatmodels.MsgTypeDM, "bob", "psst").Text())
+	assert.Equal(t, "[DM from bob] psst", entry(Received, chatmodels.MsgTypeDM, "bob", "psst").Text())
+}
+
+func TestExportText(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, ExportText(&buf, []Entry{entry(Received, chatmodels.MsgTypeJoin, "bob", "")}))
+	assert.Equal(t, "2024-05-01 10:30:00 [bob joined the chat]\n", buf.String())
+}
+
+func TestExportHTMLEscapes(t *testing.T) {
+	var buf bytes.Buffer
+	err := ExportHTML(&buf, []Entry{entry(Received, chatmodels.MsgTypeChat, "bob", "<script>alert(1)</script>")}, "Chat & friends")
+	assert.NoError(t, err)
+
+	out := buf.String()
+	assert.Contains(t, out, "<title>Chat &amp; friends</title>")
+	assert.Contains(t, out, "bob: &lt;script&gt;alert(1)&lt;/script&gt;")
+	assert.NotContains(t, out, "<script>")
+	assert.Contains(t, out, `<div class="in">`)
+}
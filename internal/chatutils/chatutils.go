@@ -3,10 +3,16 @@ package chatutils
 import (
 	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
 	"net"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/vinh0604/go-network-concepts/internal/chatmodels"
+	"github.com/vinh0604/go-network-concepts/internal/websocket"
 )
 
 const payloadLenBytesSize = 2
@@ -64,6 +70,74 @@ func readIntoBuffer(conn net.Conn, readBuf *ReadBuffer) error {
 	return nil
 }
 
+// EncodeMessage returns payload as JSON behind its length prefix, or
+// ErrPayloadTooLarge when it does not fit the prefix.
+func EncodeMessage(payload chatmodels.Payload) ([]byte, error) {
+	jsonBytes, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	if len(jsonBytes) > math.MaxUint16 {
+		return nil, ErrPayloadTooLarge
+	}
+
+	out := binary.BigEndian.AppendUint16(make([]byte, 0, payloadLenBytesSize+len(jsonBytes)), uint16(len(jsonBytes)))
+	return append(out, jsonBytes...), nil
+}
+
+// WriteMessage encodes payload behind its length prefix and writes both in a
+// single call, so concurrent writers never interleave partial messages.
+func WriteMessage(conn net.Conn, payload chatmodels.Payload) error {
+	out, err := EncodeMessage(payload)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(out)
+	return err
+}
+
+// FormatPlainText renders a payload the way the chat-client TUI shows it,
+// without any styling.
+func FormatPlainText(payload *chatmodels.Payload) string {
+	nick := ""
+	if payload.Nick != nil {
+		nick = *payload.Nick
+	}
+	msg := ""
+	if payload.Msg != nil {
+		msg = *payload.Msg
+	}
+
+	switch payload.MsgType {
+	case chatmodels.MsgTypeChat:
+		return nick + ": " + msg
+	case chatmodels.MsgTypeDM:
+		if payload.Msg == nil && payload.Ciphertext != nil {
+			msg = "(encrypted)"
+		}
+		return fmt.Sprintf("[DM from %s] %s", nick, msg)
+	case chatmodels.MsgTypeJoin:
+		return fmt.Sprintf("[%s joined the chat]", nick)
+	case chatmodels.MsgTypeLeave:
+		return fmt.Sprintf("[%s left the chat]", nick)
+	case chatmodels.MsgTypeNick:
+		return fmt.Sprintf("[%s is now known as %s]", msg, nick)
+	case chatmodels.MsgTypeWho:
+		return fmt.Sprintf("[Online (%d): %s]", len(payload.Nicks), strings.Join(payload.Nicks, ", "))
+	case chatmodels.MsgTypeTopic:
+		return fmt.Sprintf("[Topic set by %s: %s]", nick, msg)
+	case chatmodels.MsgTypeAnn:
+		return msg
+	case chatmodels.MsgTypeFileOffer:
+		if payload.File != nil {
+			return fmt.Sprintf("[%s offered %s (%d bytes)]", nick, payload.File.Name, payload.File.Size)
+		}
+		return fmt.Sprintf("[%s offered a file]", nick)
+	default:
+		return fmt.Sprintf("[%s] %s", payload.MsgType, msg)
+	}
+}
+
 func min(a, b int) int {
 	if a < b {
 		return a
@@ -71,16 +145,89 @@ func min(a, b int) int {
 	return b
 }
 
+var ErrPayloadTooLarge = errors.New("payload exceeds the 2-byte length prefix")
+
+// WebSocketConn adapts a WebSocket connection to the length-prefixed stream
+// used by the TCP protocol. Every text message carries one Payload.
+type WebSocketConn struct {
+	net.Conn
+	ws       *websocket.Conn
+	readBuf  []byte
+	writeMu  sync.Mutex
+	writeBuf []byte
+}
+
+func NewWebSocketConn(ws *websocket.Conn) *WebSocketConn {
+	return &WebSocketConn{Conn: ws.NetConn(), ws: ws}
+}
+
+func (c *WebSocketConn) Read(b []byte) (int, error) {
+	for len(c.readBuf) == 0 {
+		opcode, message, err := c.ws.ReadMessage()
+		if err != nil {
+			return 0, err
+		}
+		if opcode != websocket.OpText {
+			continue
+		}
+		if len(message) > 0xFFFF {
+			c.ws.CloseWithCode(websocket.CloseTooBig, "")
+			return 0, ErrPayloadTooLarge
+		}
+		c.readBuf = binary.BigEndian.AppendUint16(nil, uint16(len(message)))
+		c.readBuf = append(c.readBuf, message...)
+	}
+
+	n := copy(b, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	return n, nil
+}
+
+func (c *WebSocketConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.writeBuf = append(c.writeBuf, b...)
+	for len(c.writeBuf) >= payloadLenBytesSize {
+		payloadLength := int(binary.BigEndian.Uint16(c.writeBuf[:payloadLenBytesSize]))
+		if len(c.writeBuf) < payloadLenBytesSize+payloadLength {
+			break
+		}
+		if err := c.ws.WriteMessage(websocket.OpText, c.writeBuf[payloadLenBytesSize:payloadLenBytesSize+payloadLength]); err != nil {
+			return 0, err
+		}
+		c.writeBuf = c.writeBuf[payloadLenBytesSize+payloadLength:]
+	}
+	return len(b), nil
+}
+
+func (c *WebSocketConn) Close() error {
+	return c.ws.Close()
+}
+
 type ConnectionInfo struct {
 	Conn net.Conn
 	Nick string
 }
 
+// ClientDetails extends ConnectionInfo with bookkeeping that is only needed
+// for reporting, such as the admin /clients view.
+type ClientDetails struct {
+	ConnectionInfo
+	ConnectedSince time.Time
+}
+
 type ConnectionManager struct {
-	addCh    chan ConnectionInfo
-	removeCh chan removeRequest
-	listCh   chan chan []ConnectionInfo
-	existCh  chan existRequest
+	addCh     chan ConnectionInfo
+	removeCh  chan removeRequest
+	listCh    chan chan []ConnectionInfo
+	detailsCh chan chan []ClientDetails
+	existCh   chan existRequest
+}
+
+type connEntry struct {
+	nick           string
+	connectedSince time.Time
 }
 
 type removeRequest struct {
@@ -95,39 +242,46 @@ type existRequest struct {
 
 func NewConnectionManager() *ConnectionManager {
 	return &ConnectionManager{
-		addCh:    make(chan ConnectionInfo),
-		removeCh: make(chan removeRequest),
-		listCh:   make(chan chan []ConnectionInfo),
-		existCh:  make(chan existRequest),
+		addCh:     make(chan ConnectionInfo),
+		removeCh:  make(chan removeRequest),
+		listCh:    make(chan chan []ConnectionInfo),
+		detailsCh: make(chan chan []ClientDetails),
+		existCh:   make(chan existRequest),
 	}
 }
 
 func (cm *ConnectionManager) Run() {
-	conns := make(map[net.Conn]string)
+	conns := make(map[net.Conn]connEntry)
 	for {
 		select {
 		case connInfo := <-cm.addCh:
-			conns[connInfo.Conn] = connInfo.Nick
+			conns[connInfo.Conn] = connEntry{nick: connInfo.Nick, connectedSince: time.Now()}
 		case req := <-cm.removeCh:
-			nick, exists := conns[req.conn]
+			entry, exists := conns[req.conn]
 			if exists {
 				delete(conns, req.conn)
-				req.respCh <- &nick
+				req.respCh <- &entry.nick
 			} else {
 				req.respCh <- nil
 			}
 		case respCh := <-cm.listCh:
 			listResult := make([]ConnectionInfo, 0, len(conns))
-			for conn, nick := range conns {
-				listResult = append(listResult, ConnectionInfo{conn, nick})
+			for conn, entry := range conns {
+				listResult = append(listResult, ConnectionInfo{conn, entry.nick})
 			}
 			respCh <- listResult
+		case respCh := <-cm.detailsCh:
+			detailsResult := make([]ClientDetails, 0, len(conns))
+			for conn, entry := range conns {
+				detailsResult = append(detailsResult, ClientDetails{ConnectionInfo{conn, entry.nick}, entry.connectedSince})
+			}
+			respCh <- detailsResult
 		case req := <-cm.existCh:
-			nick, ok := conns[req.conn]
+			entry, ok := conns[req.conn]
 			if !ok {
 				req.respCh <- nil
 			} else {
-				req.respCh <- &nick
+				req.respCh <- &entry.nick
 			}
 		}
 	}
@@ -149,6 +303,12 @@ func (cm *ConnectionManager) List() []ConnectionInfo {
 	return <-respCh
 }
 
+func (cm *ConnectionManager) ListDetails() []ClientDetails {
+	respCh := make(chan []ClientDetails)
+	cm.detailsCh <- respCh
+	return <-respCh
+}
+
 func (cm *ConnectionManager) GetNick(conn net.Conn) *string {
 	respCh := make(chan *string)
 	cm.existCh <- existRequest{conn: conn, respCh: respCh}
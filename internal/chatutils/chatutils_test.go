@@ -4,10 +4,13 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"net"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/vinh0604/go-network-concepts/internal/chatmodels"
+	"github.com/vinh0604/go-network-concepts/internal/websocket"
 )
 
 func TestReadNextMessage(t *testing.T) {
@@ -116,6 +119,51 @@ func TestReadNextMessageMultipleMessages(t *testing.T) {
 	assert.Equal(*testPayload2.Msg, *receivedPayload2.Msg, "Msg mismatch")
 }
 
+func TestWriteMessage(t *testing.T) {
+	assert := assert.New(t)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		err := WriteMessage(client, chatmodels.Payload{MsgType: chatmodels.MsgTypeHello, Nick: stringPtr("alice")})
+		assert.NoError(err, "WriteMessage failed")
+	}()
+
+	receivedPayload, err := ReadNextMessage(server, &ReadBuffer{})
+	assert.NoError(err, "ReadNextMessage failed")
+	assert.Equal(chatmodels.MsgTypeHello, receivedPayload.MsgType)
+	assert.Equal("alice", *receivedPayload.Nick)
+
+	tooLarge := string(make([]byte, 70000))
+	err = WriteMessage(client, chatmodels.Payload{MsgType: chatmodels.MsgTypeChat, Msg: &tooLarge})
+	assert.ErrorIs(err, ErrPayloadTooLarge)
+}
+
+func TestEncodeMessage(t *testing.T) {
+	assert := assert.New(t)
+
+	out, err := EncodeMessage(chatmodels.Payload{MsgType: chatmodels.MsgTypeWho})
+	assert.NoError(err)
+	assert.Equal(len(out)-2, int(out[0])<<8|int(out[1]), "Expected the prefix to hold the JSON length")
+
+	// Escaping can grow a message well past its raw length.
+	escaped := strings.Repeat("<", 20000)
+	_, err = EncodeMessage(chatmodels.Payload{MsgType: chatmodels.MsgTypeChat, Msg: &escaped})
+	assert.ErrorIs(err, ErrPayloadTooLarge)
+}
+
+func TestFormatPlainText(t *testing.T) {
+	bob, alice, hi := "bob", "alice", "hi"
+	assert.Equal(t, "bob: hi", FormatPlainText(&chatmodels.Payload{MsgType: chatmodels.MsgTypeChat, Nick: &bob, Msg: &hi}))
+	assert.Equal(t, "[DM from bob] hi", FormatPlainText(&chatmodels.Payload{MsgType: chatmodels.MsgTypeDM, Nick: &bob, Msg: &hi}))
+	assert.Equal(t, "[DM from bob] (encrypted)", FormatPlainText(&chatmodels.Payload{MsgType: chatmodels.MsgTypeDM, Nick: &bob, Ciphertext: []byte{1}, Nonce: []byte{2}}))
+	assert.Equal(t, "[alice is now known as bob]", FormatPlainText(&chatmodels.Payload{MsgType: chatmodels.MsgTypeNick, Nick: &bob, Msg: &alice}))
+	assert.Equal(t, "[Online (2): alice, bob]", FormatPlainText(&chatmodels.Payload{MsgType: chatmodels.MsgTypeWho, Nicks: []string{"alice", "bob"}}))
+	assert.Equal(t, "[bob offered notes.txt (42 bytes)]", FormatPlainText(&chatmodels.Payload{MsgType: chatmodels.MsgTypeFileOffer, Nick: &bob, File: &chatmodels.File{Name: "notes.txt", Size: 42}}))
+}
+
 // Helper function to create a pointer to a string
 func stringPtr(s string) *string {
 	return &s
@@ -178,3 +226,60 @@ func TestConnectionManager(t *testing.T) {
 	assert.Nil(cm.GetNick(conn1), "Expected conn1 to not exist")
 	assert.Nil(cm.GetNick(nonExistentConn), "Expected nonExistentConn to not exist")
 }
+
+func TestConnectionManagerListDetails(t *testing.T) {
+	assert := assert.New(t)
+
+	cm := NewConnectionManager()
+	go cm.Run()
+
+	before := time.Now()
+	conn1 := &net.TCPConn{}
+	cm.Add(conn1, "user1")
+
+	details := cm.ListDetails()
+	assert.Len(details, 1, "Expected 1 connection")
+	assert.Equal(ConnectionInfo{Conn: conn1, Nick: "user1"}, details[0].ConnectionInfo)
+	assert.False(details[0].ConnectedSince.Before(before), "Expected connected-since to be set when the connection was added")
+
+	cm.Remove(conn1)
+	assert.Empty(cm.ListDetails(), "Expected no connections after removal")
+}
+
+func TestWebSocketConn(t *testing.T) {
+	assert := assert.New(t)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	serverConnCh := make(chan *WebSocketConn)
+	go func() {
+		ws, err := websocket.Accept(server)
+		assert.NoError(err, "WebSocket handshake failed")
+		serverConnCh <- NewWebSocketConn(ws)
+	}()
+	clientWs, err := websocket.Client(client, "localhost", "/")
+	assert.NoError(err, "Client handshake failed")
+	serverConn := <-serverConnCh
+
+	// A WebSocket text message is read back as a length-prefixed payload
+	go clientWs.WriteMessage(websocket.OpText, []byte(`{"MsgType":"hello","Nick":"alice","Msg":null}`))
+	payload, err := ReadNextMessage(serverConn, &ReadBuffer{})
+	assert.NoError(err, "ReadNextMessage failed")
+	assert.Equal(chatmodels.MsgTypeHello, payload.MsgType)
+	assert.Equal("alice", *payload.Nick)
+
+	// Length-prefixed writes, even split across calls, become one text message each
+	payloadBytes, _ := json.Marshal(chatmodels.Payload{MsgType: chatmodels.MsgTypeChat, Msg: stringPtr("hi")})
+	go func() {
+		message := binary.BigEndian.AppendUint16(nil, uint16(len(payloadBytes)))
+		message = append(message, payloadBytes...)
+		serverConn.Write(message[:5])
+		serverConn.Write(message[5:])
+	}()
+	opcode, message, err := clientWs.ReadMessage()
+	assert.NoError(err, "Client ReadMessage failed")
+	assert.Equal(websocket.OpText, opcode)
+	assert.JSONEq(string(payloadBytes), string(message))
+}
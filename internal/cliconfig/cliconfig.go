@@ -0,0 +1,208 @@
+package cliconfig
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Config layers settings for the default flag set: flags, then environment
+// variables, then the -config JSON file.
+type Config struct {
+	fs        *flag.FlagSet
+	envPrefix string
+	file      string
+}
+
+// New registers -config on the default flag set and installs a usage message
+// naming the environment variables after envPrefix.
+func New(envPrefix string, synopsis string, description string) *Config {
+	c := newConfig(flag.CommandLine, envPrefix)
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "Usage: %s [flags] %s\n\n", flag.CommandLine.Name(), synopsis)
+		if description != "" {
+			fmt.Fprintf(out, "%s\n\n", description)
+		}
+		fmt.Fprintln(out, "Flags:")
+		flag.PrintDefaults()
+		fmt.Fprintf(out, "\nEvery flag can also be set with the environment variable %s_<FLAG>\n", envPrefix)
+		fmt.Fprintln(out, "(upper case, dashes as underscores) or as a key in the -config file.")
+	}
+	return c
+}
+
+func newConfig(fs *flag.FlagSet, envPrefix string) *Config {
+	c := &Config{fs: fs, envPrefix: envPrefix}
+	fs.StringVar(&c.file, "config", "", "JSON file with flag values, e.g. {\"port\": 8080}")
+	return c
+}
+
+// Parse parses the command line and applies the environment and the config
+// file, failing like flag errors do.
+func (c *Config) Parse() {
+	flag.Parse()
+	if err := c.apply(os.LookupEnv); err != nil {
+		c.Fail(err)
+	}
+}
+
+// Fail reports an invalid configuration and exits with status 2.
+func (c *Config) Fail(err error) {
+	fmt.Fprintln(c.fs.Output(), "Error:", err)
+	c.fs.Usage()
+	os.Exit(2)
+}
+
+// Args returns the positional arguments, failing unless there are between
+// min and max of them.
+func (c *Config) Args(min int, max int) []string {
+	args := c.fs.Args()
+	if len(args) < min || len(args) > max {
+		c.Fail(fmt.Errorf("expected %s positional arguments, got %d", argCount(min, max), len(args)))
+	}
+	return args
+}
+
+// Validate fails on the first non-nil error.
+func (c *Config) Validate(errs ...error) {
+	for _, err := range errs {
+		if err != nil {
+			c.Fail(err)
+		}
+	}
+}
+
+func argCount(min int, max int) string {
+	if min == max {
+		return strconv.Itoa(min)
+	}
+	return fmt.Sprintf("%d to %d", min, max)
+}
+
+func (c *Config) apply(lookupEnv func(string) (string, bool)) error {
+	explicit := map[string]bool{}
+	c.fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	if !explicit["config"] {
+		if value, ok := lookupEnv(c.EnvName("config")); ok {
+			c.file = value
+		}
+	}
+
+	fileValues := map[string]string{}
+	if c.file != "" {
+		var err error
+		fileValues, err = loadFile(c.file)
+		if err != nil {
+			return err
+		}
+	}
+	for name := range fileValues {
+		if name == "config" || c.fs.Lookup(name) == nil {
+			return fmt.Errorf("unknown setting %q in %s", name, c.file)
+		}
+	}
+
+	var err error
+	c.fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || explicit[f.Name] || f.Name == "config" {
+			return
+		}
+		source := ""
+		value, ok := lookupEnv(c.EnvName(f.Name))
+		if ok {
+			source = "environment variable " + c.EnvName(f.Name)
+		} else if value, ok = fileValues[f.Name]; ok {
+			source = c.file
+		}
+		if ok {
+			if setErr := c.fs.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("invalid value %q for -%s from %s: %w", value, f.Name, source, setErr)
+			}
+		}
+	})
+	return err
+}
+
+// EnvName returns the environment variable that overrides the named flag.
+func (c *Config) EnvName(flagName string) string {
+	return c.envPrefix + "_" + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+func loadFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening config file: %w", err)
+	}
+	defer f.Close()
+
+	raw := map[string]any{}
+	decoder := json.NewDecoder(f)
+	decoder.UseNumber()
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("error parsing config file %s: %w", path, err)
+	}
+
+	values := map[string]string{}
+	for name, value := range raw {
+		switch value := value.(type) {
+		case string:
+			values[name] = value
+		case json.Number:
+			values[name] = value.String()
+		case bool:
+			values[name] = strconv.FormatBool(value)
+		default:
+			return nil, fmt.Errorf("setting %q in %s must be a string, number or boolean", name, path)
+		}
+	}
+	return values, nil
+}
+
+// ValidatePort checks that port is a usable TCP or UDP port number.
+func ValidatePort(port int) error {
+	if port < 1 || port > 65535 {
+		return fmt.Errorf("invalid port %d: must be between 1 and 65535", port)
+	}
+	return nil
+}
+
+// ParsePort parses and validates a port given as a positional argument.
+func ParsePort(value string) (int, error) {
+	port, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid port %q: not a number", value)
+	}
+	return port, ValidatePort(port)
+}
+
+// ValidateHost checks a host name or IP address used as a bind address or
+// server to connect to. An empty bind address means all interfaces.
+func ValidateHost(host string) error {
+	if strings.ContainsAny(host, " /") || strings.Count(host, ":") == 1 {
+		return fmt.Errorf("invalid host %q: give the port separately", host)
+	}
+	return nil
+}
+
+// ValidateAddr checks an optional host:port listen address such as ":8081".
+func ValidateAddr(addr string) error {
+	if addr == "" {
+		return nil
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid address %q: %w", addr, err)
+	}
+	if _, err := ParsePort(port); err != nil {
+		return fmt.Errorf("invalid address %q: %w", addr, err)
+	}
+	return nil
+}
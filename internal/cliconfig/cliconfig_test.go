@@ -0,0 +1,118 @@
+package cliconfig
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testFlags struct {
+	port   int
+	listen string
+	debug  bool
+}
+
+func newTestConfig() (*Config, *testFlags) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	c := newConfig(fs, "TEST")
+	flags := &testFlags{}
+	fs.IntVar(&flags.port, "port", 8080, "")
+	fs.StringVar(&flags.listen, "listen", "", "")
+	fs.BoolVar(&flags.debug, "debug", false, "")
+	return c, flags
+}
+
+func env(values map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := values[name]
+		return value, ok
+	}
+}
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.json")
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	return path
+}
+
+func TestEnvName(t *testing.T) {
+	c, _ := newTestConfig()
+	assert.Equal(t, "TEST_WS_ADDR", c.EnvName("ws-addr"))
+}
+
+func TestApplyPrecedence(t *testing.T) {
+	assert := assert.New(t)
+	path := writeConfig(t, `{"port": 9000, "listen": "127.0.0.1", "debug": true}`)
+
+	c, flags := newTestConfig()
+	assert.NoError(c.fs.Parse([]string{"-config", path}))
+	assert.NoError(c.apply(env(nil)))
+	assert.Equal(9000, flags.port, "Expected the config file to override defaults")
+	assert.Equal("127.0.0.1", flags.listen)
+	assert.True(flags.debug)
+
+	c, flags = newTestConfig()
+	assert.NoError(c.fs.Parse([]string{"-config", path}))
+	assert.NoError(c.apply(env(map[string]string{"TEST_PORT": "9100"})))
+	assert.Equal(9100, flags.port, "Expected the environment to override the config file")
+
+	c, flags = newTestConfig()
+	assert.NoError(c.fs.Parse([]string{"-config", path, "-port", "9200"}))
+	assert.NoError(c.apply(env(map[string]string{"TEST_PORT": "9100"})))
+	assert.Equal(9200, flags.port, "Expected command-line flags to win")
+}
+
+func TestApplyConfigFromEnv(t *testing.T) {
+	path := writeConfig(t, `{"port": 9000}`)
+
+	c, flags := newTestConfig()
+	assert.NoError(t, c.fs.Parse(nil))
+	assert.NoError(t, c.apply(env(map[string]string{"TEST_CONFIG": path})))
+	assert.Equal(t, 9000, flags.port)
+}
+
+func TestApplyErrors(t *testing.T) {
+	c, _ := newTestConfig()
+	assert.NoError(t, c.fs.Parse(nil))
+	assert.ErrorContains(t, c.apply(env(map[string]string{"TEST_PORT": "eighty"})), "TEST_PORT")
+
+	c, _ = newTestConfig()
+	assert.NoError(t, c.fs.Parse([]string{"-config", writeConfig(t, `{"prot": 9000}`)}))
+	assert.ErrorContains(t, c.apply(env(nil)), `unknown setting "prot"`)
+
+	c, _ = newTestConfig()
+	assert.NoError(t, c.fs.Parse([]string{"-config", writeConfig(t, `{"port": [1]}`)}))
+	assert.Error(t, c.apply(env(nil)), "Expected non-scalar values to be rejected")
+
+	c, _ = newTestConfig()
+	assert.NoError(t, c.fs.Parse([]string{"-config", filepath.Join(t.TempDir(), "missing.json")}))
+	assert.Error(t, c.apply(env(nil)), "Expected a missing config file to be an error")
+}
+
+func TestValidation(t *testing.T) {
+	assert := assert.New(t)
+
+	port, err := ParsePort("8080")
+	assert.NoError(err)
+	assert.Equal(8080, port)
+	_, err = ParsePort("http")
+	assert.Error(err)
+	assert.Error(ValidatePort(0))
+	assert.Error(ValidatePort(70000))
+
+	assert.NoError(ValidateHost(""))
+	assert.NoError(ValidateHost("::1"))
+	assert.NoError(ValidateHost("example.com"))
+	assert.Error(ValidateHost("localhost:8080"))
+
+	assert.NoError(ValidateAddr(""))
+	assert.NoError(ValidateAddr(":8081"))
+	assert.NoError(ValidateAddr("[::1]:8081"))
+	assert.Error(ValidateAddr("8081"))
+	assert.Error(ValidateAddr(":0"))
+}
@@ -0,0 +1,584 @@
+package hpack
+
+import (
+	"errors"
+	"fmt"
+)
+
+// DefaultTableSize is the dynamic table size both ends start with,
+// RFC 9113 section 6.5.2.
+const DefaultTableSize = 4096
+
+var (
+	ErrTruncated          = errors.New("hpack: truncated header block")
+	ErrIntegerOverflow    = errors.New("hpack: integer overflow")
+	ErrInvalidIndex       = errors.New("hpack: invalid table index")
+	ErrInvalidHuffman     = errors.New("hpack: invalid Huffman-coded string")
+	ErrTableSizeUpdate    = errors.New("hpack: invalid dynamic table size update")
+	ErrStringTooLong      = errors.New("hpack: string literal too long")
+	ErrHeaderListTooLarge = errors.New("hpack: header list too large")
+)
+
+// HeaderField is one name-value pair. Sensitive fields are never indexed.
+type HeaderField struct {
+	Name      string
+	Value     string
+	Sensitive bool
+}
+
+// Size is what the field counts against a dynamic table or a header list
+// limit, RFC 7541 section 4.1.
+func (f HeaderField) Size() uint32 {
+	return uint32(len(f.Name) + len(f.Value) + 32)
+}
+
+func (f HeaderField) String() string {
+	return fmt.Sprintf("%s: %s", f.Name, f.Value)
+}
+
+// staticTable is RFC 7541 Appendix A; index 1 is the first entry.
+var staticTable = []HeaderField{
+	{Name: ":authority"},
+	{Name: ":method", Value: "GET"},
+	{Name: ":method", Value: "POST"},
+	{Name: ":path", Value: "/"},
+	{Name: ":path", Value: "/index.html"},
+	{Name: ":scheme", Value: "http"},
+	{Name: ":scheme", Value: "https"},
+	{Name: ":status", Value: "200"},
+	{Name: ":status", Value: "204"},
+	{Name: ":status", Value: "206"},
+	{Name: ":status", Value: "304"},
+	{Name: ":status", Value: "400"},
+	{Name: ":status", Value: "404"},
+	{Name: ":status", Value: "500"},
+	{Name: "accept-charset"},
+	{Name: "accept-encoding", Value: "gzip, deflate"},
+	{Name: "accept-language"},
+	{Name: "accept-ranges"},
+	{Name: "accept"},
+	{Name: "access-control-allow-origin"},
+	{Name: "age"},
+	{Name: "allow"},
+	{Name: "authorization"},
+	{Name: "cache-control"},
+	{Name: "content-disposition"},
+	{Name: "content-encoding"},
+	{Name: "content-language"},
+	{Name: "content-length"},
+	{Name: "content-location"},
+	{Name: "content-range"},
+	{Name: "content-type"},
+	{Name: "cookie"},
+	{Name: "date"},
+	{Name: "etag"},
+	{Name: "expect"},
+	{Name: "expires"},
+	{Name: "from"},
+	{Name: "host"},
+	{Name: "if-match"},
+	{Name: "if-modified-since"},
+	{Name: "if-none-match"},
+	{Name: "if-range"},
+	{Name: "if-unmodified-since"},
+	{Name: "last-modified"},
+	{Name: "link"},
+	{Name: "location"},
+	{Name: "max-forwards"},
+	{Name: "proxy-authenticate"},
+	{Name: "proxy-authorization"},
+	{Name: "range"},
+	{Name: "referer"},
+	{Name: "refresh"},
+	{Name: "retry-after"},
+	{Name: "server"},
+	{Name: "set-cookie"},
+	{Name: "strict-transport-security"},
+	{Name: "transfer-encoding"},
+	{Name: "user-agent"},
+	{Name: "vary"},
+	{Name: "via"},
+	{Name: "www-authenticate"},
+}
+
+// dynamicTable holds recently indexed fields, newest last in entries but
+// first by index, RFC 7541 section 2.3.2.
+type dynamicTable struct {
+	entries []HeaderField
+	size    uint32
+	maxSize uint32
+}
+
+func (t *dynamicTable) add(f HeaderField) {
+	t.entries = append(t.entries, f)
+	t.size += f.Size()
+	t.evict()
+}
+
+func (t *dynamicTable) setMaxSize(n uint32) {
+	t.maxSize = n
+	t.evict()
+}
+
+// evict drops the oldest entries until the table fits. A field larger
+// than the whole table just empties it.
+func (t *dynamicTable) evict() {
+	drop := 0
+	for t.size > t.maxSize && drop < len(t.entries) {
+		t.size -= t.entries[drop].Size()
+		drop++
+	}
+	if drop > 0 {
+		t.entries = append(t.entries[:0], t.entries[drop:]...)
+	}
+}
+
+// field returns the entry at a combined static and dynamic index.
+func (t *dynamicTable) field(index uint64) (HeaderField, bool) {
+	if index == 0 {
+		return HeaderField{}, false
+	}
+	if index <= uint64(len(staticTable)) {
+		return staticTable[index-1], true
+	}
+	index -= uint64(len(staticTable))
+	if index > uint64(len(t.entries)) {
+		return HeaderField{}, false
+	}
+	return t.entries[uint64(len(t.entries))-index], true
+}
+
+// search returns the index of an entry matching f exactly, or failing
+// that one with its name, with 0 for neither.
+func (t *dynamicTable) search(f HeaderField) (index uint64, exact bool) {
+	for i, entry := range staticTable {
+		if entry.Name != f.Name {
+			continue
+		}
+		if entry.Value == f.Value {
+			return uint64(i + 1), true
+		}
+		if index == 0 {
+			index = uint64(i + 1)
+		}
+	}
+	for i := len(t.entries) - 1; i >= 0; i-- {
+		entry := t.entries[i]
+		if entry.Name != f.Name {
+			continue
+		}
+		dynamicIndex := uint64(len(staticTable) + len(t.entries) - i)
+		if entry.Value == f.Value && !f.Sensitive {
+			return dynamicIndex, true
+		}
+		if index == 0 {
+			index = dynamicIndex
+		}
+	}
+	return index, false
+}
+
+// Decoder decodes header blocks from one peer. Blocks must be decoded in
+// the order they were sent since each can change the dynamic table.
+type Decoder struct {
+	table dynamicTable
+	// maxTableSize is the limit advertised to the peer; its size
+	// updates may not exceed it.
+	maxTableSize uint32
+	// MaxHeaderListSize bounds the decoded fields, 0 for no limit.
+	MaxHeaderListSize uint32
+	// MaxStringLength bounds each name and value, 0 for no limit.
+	MaxStringLength int
+}
+
+func NewDecoder(maxTableSize uint32) *Decoder {
+	return &Decoder{table: dynamicTable{maxSize: maxTableSize}, maxTableSize: maxTableSize}
+}
+
+// Decode decodes a complete header block. After ErrHeaderListTooLarge the
+// table is still in step with the peer; after any other error it isn't.
+func (d *Decoder) Decode(block []byte) ([]HeaderField, error) {
+	var fields []HeaderField
+	var listSize uint32
+	tooLarge := false
+	sawField := false
+
+	for len(block) > 0 {
+		b := block[0]
+		var field HeaderField
+		var err error
+		switch {
+		case b&0x80 != 0:
+			// Indexed header field, section 6.1.
+			var index uint64
+			index, block, err = readInt(block, 7)
+			if err != nil {
+				return nil, err
+			}
+			var ok bool
+			if field, ok = d.table.field(index); !ok {
+				return nil, fmt.Errorf("%w: %d", ErrInvalidIndex, index)
+			}
+		case b&0xc0 == 0x40:
+			// Literal with incremental indexing, section 6.2.1.
+			field, block, err = d.readLiteral(block, 6)
+			if err != nil {
+				return nil, err
+			}
+			d.table.add(field)
+		case b&0xe0 == 0x20:
+			// Dynamic table size update, section 6.3; only allowed
+			// before the first field of a block.
+			var size uint64
+			size, block, err = readInt(block, 5)
+			if err != nil {
+				return nil, err
+			}
+			if sawField || size > uint64(d.maxTableSize) {
+				return nil, ErrTableSizeUpdate
+			}
+			d.table.setMaxSize(uint32(size))
+			continue
+		default:
+			// Literal without indexing (0000) or never indexed (0001),
+			// sections 6.2.2 and 6.2.3.
+			field, block, err = d.readLiteral(block, 4)
+			if err != nil {
+				return nil, err
+			}
+			field.Sensitive = b&0x10 != 0
+		}
+
+		sawField = true
+		listSize += field.Size()
+		if d.MaxHeaderListSize > 0 && listSize > d.MaxHeaderListSize {
+			tooLarge = true
+		}
+		if !tooLarge {
+			fields = append(fields, field)
+		}
+	}
+	if tooLarge {
+		return fields, ErrHeaderListTooLarge
+	}
+	return fields, nil
+}
+
+// SetMaxTableSize changes the limit advertised to the peer. The peer
+// acknowledges it with a size update in its next block.
+func (d *Decoder) SetMaxTableSize(n uint32) {
+	d.maxTableSize = n
+	if d.table.maxSize > n {
+		d.table.setMaxSize(n)
+	}
+}
+
+func (d *Decoder) readLiteral(block []byte, prefix uint8) (HeaderField, []byte, error) {
+	index, block, err := readInt(block, prefix)
+	if err != nil {
+		return HeaderField{}, nil, err
+	}
+	var field HeaderField
+	if index > 0 {
+		named, ok := d.table.field(index)
+		if !ok {
+			return HeaderField{}, nil, fmt.Errorf("%w: %d", ErrInvalidIndex, index)
+		}
+		field.Name = named.Name
+	} else if field.Name, block, err = d.readString(block); err != nil {
+		return HeaderField{}, nil, err
+	}
+	field.Value, block, err = d.readString(block)
+	return field, block, err
+}
+
+// readString reads a string literal, section 5.2.
+func (d *Decoder) readString(block []byte) (string, []byte, error) {
+	if len(block) == 0 {
+		return "", nil, ErrTruncated
+	}
+	huffman := block[0]&0x80 != 0
+	length, block, err := readInt(block, 7)
+	if err != nil {
+		return "", nil, err
+	}
+	if length > uint64(len(block)) {
+		return "", nil, ErrTruncated
+	}
+	// A Huffman code is at least 5 bits a byte, so the decoded string
+	// is at most 8/5 of the encoded length.
+	limit := uint64(d.MaxStringLength)
+	if d.MaxStringLength > 0 && (!huffman && length > limit || huffman && length*5/8 > limit) {
+		return "", nil, ErrStringTooLong
+	}
+	data := block[:length]
+	block = block[length:]
+	if !huffman {
+		return string(data), block, nil
+	}
+	s, err := HuffmanDecode(data)
+	if err == nil && d.MaxStringLength > 0 && len(s) > d.MaxStringLength {
+		err = ErrStringTooLong
+	}
+	return s, block, err
+}
+
+// readInt reads an integer with an n-bit prefix, section 5.1.
+func readInt(block []byte, n uint8) (uint64, []byte, error) {
+	if len(block) == 0 {
+		return 0, nil, ErrTruncated
+	}
+	mask := uint64(1)<<n - 1
+	value := uint64(block[0]) & mask
+	block = block[1:]
+	if value < mask {
+		return value, block, nil
+	}
+	for shift := uint(0); ; shift += 7 {
+		if len(block) == 0 {
+			return 0, nil, ErrTruncated
+		}
+		// Anything past 2^32 is no sensible index, length or size.
+		if shift > 28 {
+			return 0, nil, ErrIntegerOverflow
+		}
+		b := block[0]
+		block = block[1:]
+		value += uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return value, block, nil
+		}
+	}
+}
+
+// appendInt appends value with an n-bit prefix, keeping the bits of
+// first above the prefix.
+func appendInt(dst []byte, first byte, n uint8, value uint64) []byte {
+	mask := uint64(1)<<n - 1
+	if value < mask {
+		return append(dst, first|byte(value))
+	}
+	dst = append(dst, first|byte(mask))
+	value -= mask
+	for value >= 0x80 {
+		dst = append(dst, byte(value&0x7f)|0x80)
+		value >>= 7
+	}
+	return append(dst, byte(value))
+}
+
+// Encoder encodes header blocks for one peer.
+type Encoder struct {
+	table dynamicTable
+	// sizeUpdate is set when the table size changed since the last
+	// block, which the next block must announce.
+	sizeUpdate bool
+	// minSize is the smallest size the table passed through since the
+	// last block, announced first so the peer evicts the same entries.
+	minSize uint32
+}
+
+func NewEncoder() *Encoder {
+	return &Encoder{table: dynamicTable{maxSize: DefaultTableSize}}
+}
+
+// SetMaxTableSize applies the peer's SETTINGS_HEADER_TABLE_SIZE. The
+// encoder uses no more than DefaultTableSize even when allowed more.
+func (e *Encoder) SetMaxTableSize(n uint32) {
+	n = min(n, DefaultTableSize)
+	if n == e.table.maxSize {
+		return
+	}
+	if !e.sizeUpdate || n < e.minSize {
+		e.minSize = n
+	}
+	e.sizeUpdate = true
+	e.table.setMaxSize(n)
+}
+
+// Encode encodes fields as one header block.
+func (e *Encoder) Encode(fields []HeaderField) []byte {
+	var block []byte
+	if e.sizeUpdate {
+		if e.minSize < e.table.maxSize {
+			block = appendInt(block, 0x20, 5, uint64(e.minSize))
+		}
+		block = appendInt(block, 0x20, 5, uint64(e.table.maxSize))
+		e.sizeUpdate = false
+	}
+
+	for _, field := range fields {
+		index, exact := e.table.search(field)
+		switch {
+		case exact:
+			block = appendInt(block, 0x80, 7, index)
+			continue
+		case field.Sensitive:
+			block = appendInt(block, 0x10, 4, index)
+		case field.Size() > e.table.maxSize:
+			// Indexing would only flush the table.
+			block = appendInt(block, 0x00, 4, index)
+		default:
+			block = appendInt(block, 0x40, 6, index)
+			e.table.add(field)
+		}
+		if index == 0 {
+			block = appendString(block, field.Name)
+		}
+		block = appendString(block, field.Value)
+	}
+	return block
+}
+
+// appendString appends a string literal, Huffman-coded when that is
+// shorter.
+func appendString(dst []byte, s string) []byte {
+	if n := HuffmanEncodedLen(s); n < len(s) {
+		dst = appendInt(dst, 0x80, 7, uint64(n))
+		return HuffmanEncode(dst, s)
+	}
+	dst = appendInt(dst, 0x00, 7, uint64(len(s)))
+	return append(dst, s...)
+}
+
+// HuffmanEncodedLen returns the length of s once Huffman-coded.
+func HuffmanEncodedLen(s string) int {
+	bits := 0
+	for i := 0; i < len(s); i++ {
+		bits += int(huffmanCodeLengths[s[i]])
+	}
+	return (bits + 7) / 8
+}
+
+// HuffmanEncode appends the Huffman coding of s to dst, padding the last
+// byte with the most significant bits of EOS, which are all ones.
+func HuffmanEncode(dst []byte, s string) []byte {
+	var acc uint64
+	var bits uint
+	for i := 0; i < len(s); i++ {
+		length := uint(huffmanCodeLengths[s[i]])
+		acc = acc<<length | uint64(huffmanCodes[s[i]])
+		bits += length
+		for bits >= 8 {
+			bits -= 8
+			dst = append(dst, byte(acc>>bits))
+		}
+	}
+	if bits > 0 {
+		acc = acc<<(8-bits) | 0xff>>bits
+		dst = append(dst, byte(acc))
+	}
+	return dst
+}
+
+// huffmanNode is a node of the decoding tree. Leaves have a symbol;
+// inner nodes the tree indexes of their children, 0 for none.
+type huffmanNode struct {
+	children [2]uint16
+	symbol   int16
+}
+
+var huffmanTree = buildHuffmanTree()
+
+func buildHuffmanTree() []huffmanNode {
+	tree := []huffmanNode{{symbol: -1}}
+	for sym := 0; sym < 256; sym++ {
+		code, length := huffmanCodes[sym], huffmanCodeLengths[sym]
+		node := 0
+		for i := int(length) - 1; i >= 0; i-- {
+			bit := code >> uint(i) & 1
+			if tree[node].children[bit] == 0 {
+				tree = append(tree, huffmanNode{symbol: -1})
+				tree[node].children[bit] = uint16(len(tree) - 1)
+			}
+			node = int(tree[node].children[bit])
+		}
+		tree[node].symbol = int16(sym)
+	}
+	return tree
+}
+
+// HuffmanDecode decodes a Huffman-coded string. Padding must be fewer
+// than eight bits, all ones, section 5.2; EOS itself may not appear.
+func HuffmanDecode(data []byte) (string, error) {
+	out := make([]byte, 0, len(data)*8/5)
+	node := 0
+	padding := 0
+	allOnes := true
+	for _, b := range data {
+		for i := 7; i >= 0; i-- {
+			bit := b >> uint(i) & 1
+			next := huffmanTree[node].children[bit]
+			if next == 0 {
+				return "", ErrInvalidHuffman
+			}
+			node = int(next)
+			padding++
+			allOnes = allOnes && bit == 1
+			if sym := huffmanTree[node].symbol; sym >= 0 {
+				out = append(out, byte(sym))
+				node, padding, allOnes = 0, 0, true
+			}
+		}
+	}
+	if padding > 7 || !allOnes {
+		return "", ErrInvalidHuffman
+	}
+	return string(out), nil
+}
+
+// huffmanCodes and huffmanCodeLengths are the static Huffman code of
+// RFC 7541 Appendix B, indexed by byte value. EOS, symbol 256, is 30 ones.
+var huffmanCodes = [256]uint32{
+	0x1ff8, 0x7fffd8, 0xfffffe2, 0xfffffe3, 0xfffffe4, 0xfffffe5, 0xfffffe6, 0xfffffe7,
+	0xfffffe8, 0xffffea, 0x3ffffffc, 0xfffffe9, 0xfffffea, 0x3ffffffd, 0xfffffeb, 0xfffffec,
+	0xfffffed, 0xfffffee, 0xfffffef, 0xffffff0, 0xffffff1, 0xffffff2, 0x3ffffffe, 0xffffff3,
+	0xffffff4, 0xffffff5, 0xffffff6, 0xffffff7, 0xffffff8, 0xffffff9, 0xffffffa, 0xffffffb,
+	0x14, 0x3f8, 0x3f9, 0xffa, 0x1ff9, 0x15, 0xf8, 0x7fa,
+	0x3fa, 0x3fb, 0xf9, 0x7fb, 0xfa, 0x16, 0x17, 0x18,
+	0x0, 0x1, 0x2, 0x19, 0x1a, 0x1b, 0x1c, 0x1d,
+	0x1e, 0x1f, 0x5c, 0xfb, 0x7ffc, 0x20, 0xffb, 0x3fc,
+	0x1ffa, 0x21, 0x5d, 0x5e, 0x5f, 0x60, 0x61, 0x62,
+	0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69, 0x6a,
+	0x6b, 0x6c, 0x6d, 0x6e, 0x6f, 0x70, 0x71, 0x72,
+	0xfc, 0x73, 0xfd, 0x1ffb, 0x7fff0, 0x1ffc, 0x3ffc, 0x22,
+	0x7ffd, 0x3, 0x23, 0x4, 0x24, 0x5, 0x25, 0x26,
+	0x27, 0x6, 0x74, 0x75, 0x28, 0x29, 0x2a, 0x7,
+	0x2b, 0x76, 0x2c, 0x8, 0x9, 0x2d, 0x77, 0x78,
+	0x79, 0x7a, 0x7b, 0x7ffe, 0x7fc, 0x3ffd, 0x1ffd, 0xffffffc,
+	0xfffe6, 0x3fffd2, 0xfffe7, 0xfffe8, 0x3fffd3, 0x3fffd4, 0x3fffd5, 0x7fffd9,
+	0x3fffd6, 0x7fffda, 0x7fffdb, 0x7fffdc, 0x7fffdd, 0x7fffde, 0xffffeb, 0x7fffdf,
+	0xffffec, 0xffffed, 0x3fffd7, 0x7fffe0, 0xffffee, 0x7fffe1, 0x7fffe2, 0x7fffe3,
+	0x7fffe4, 0x1fffdc, 0x3fffd8, 0x7fffe5, 0x3fffd9, 0x7fffe6, 0x7fffe7, 0xffffef,
+	0x3fffda, 0x1fffdd, 0xfffe9, 0x3fffdb, 0x3fffdc, 0x7fffe8, 0x7fffe9, 0x1fffde,
+	0x7fffea, 0x3fffdd, 0x3fffde, 0xfffff0, 0x1fffdf, 0x3fffdf, 0x7fffeb, 0x7fffec,
+	0x1fffe0, 0x1fffe1, 0x3fffe0, 0x1fffe2, 0x7fffed, 0x3fffe1, 0x7fffee, 0x7fffef,
+	0xfffea, 0x3fffe2, 0x3fffe3, 0x3fffe4, 0x7ffff0, 0x3fffe5, 0x3fffe6, 0x7ffff1,
+	0x3ffffe0, 0x3ffffe1, 0xfffeb, 0x7fff1, 0x3fffe7, 0x7ffff2, 0x3fffe8, 0x1ffffec,
+	0x3ffffe2, 0x3ffffe3, 0x3ffffe4, 0x7ffffde, 0x7ffffdf, 0x3ffffe5, 0xfffff1, 0x1ffffed,
+	0x7fff2, 0x1fffe3, 0x3ffffe6, 0x7ffffe0, 0x7ffffe1, 0x3ffffe7, 0x7ffffe2, 0xfffff2,
+	0x1fffe4, 0x1fffe5, 0x3ffffe8, 0x3ffffe9, 0xffffffd, 0x7ffffe3, 0x7ffffe4, 0x7ffffe5,
+	0xfffec, 0xfffff3, 0xfffed, 0x1fffe6, 0x3fffe9, 0x1fffe7, 0x1fffe8, 0x7ffff3,
+	0x3fffea, 0x3fffeb, 0x1ffffee, 0x1ffffef, 0xfffff4, 0xfffff5, 0x3ffffea, 0x7ffff4,
+	0x3ffffeb, 0x7ffffe6, 0x3ffffec, 0x3ffffed, 0x7ffffe7, 0x7ffffe8, 0x7ffffe9, 0x7ffffea,
+	0x7ffffeb, 0xffffffe, 0x7ffffec, 0x7ffffed, 0x7ffffee, 0x7ffffef, 0x7fffff0, 0x3ffffee,
+}
+
+var huffmanCodeLengths = [256]uint8{
+	13, 23, 28, 28, 28, 28, 28, 28, 28, 24, 30, 28, 28, 30, 28, 28,
+	28, 28, 28, 28, 28, 28, 30, 28, 28, 28, 28, 28, 28, 28, 28, 28,
+	6, 10, 10, 12, 13, 6, 8, 11, 10, 10, 8, 11, 8, 6, 6, 6,
+	5, 5, 5, 6, 6, 6, 6, 6, 6, 6, 7, 8, 15, 6, 12, 10,
+	13, 6, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7,
+	7, 7, 7, 7, 7, 7, 7, 7, 8, 7, 8, 13, 19, 13, 14, 6,
+	15, 5, 6, 5, 6, 5, 6, 6, 6, 5, 7, 7, 6, 6, 6, 5,
+	6, 7, 6, 5, 5, 6, 7, 7, 7, 7, 7, 15, 11, 14, 13, 28,
+	20, 22, 20, 20, 22, 22, 22, 23, 22, 23, 23, 23, 23, 23, 24, 23,
+	24, 24, 22, 23, 24, 23, 23, 23, 23, 21, 22, 23, 22, 23, 23, 24,
+	22, 21, 20, 22, 22, 23, 23, 21, 23, 22, 22, 24, 21, 22, 23, 23,
+	21, 21, 22, 21, 23, 22, 23, 23, 20, 22, 22, 22, 23, 22, 22, 23,
+	26, 26, 20, 19, 22, 23, 22, 25, 26, 26, 26, 27, 27, 26, 24, 25,
+	19, 21, 26, 27, 27, 26, 27, 24, 21, 21, 26, 26, 28, 27, 27, 27,
+	20, 24, 20, 21, 22, 21, 21, 23, 22, 22, 25, 25, 24, 24, 26, 23,
+	26, 27, 26, 26, 27, 27, 27, 27, 27, 28, 27, 27, 27, 27, 27, 26,
+}
@@ -0,0 +1,211 @@
+package hpack
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestIntegers(t *testing.T) {
+	// RFC 7541 C.1.
+	tests := []struct {
+		value  uint64
+		prefix uint8
+		want   string
+	}{
+		{10, 5, "0a"},
+		{1337, 5, "1f9a0a"},
+		{42, 8, "2a"},
+		{31, 5, "1f00"},
+	}
+	for _, tc := range tests {
+		encoded := appendInt(nil, 0, tc.prefix, tc.value)
+		assert.Equal(t, tc.want, hex.EncodeToString(encoded))
+		value, rest, err := readInt(encoded, tc.prefix)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.value, value)
+		assert.Empty(t, rest)
+	}
+
+	_, _, err := readInt([]byte{0x1f, 0x80}, 5)
+	assert.ErrorIs(t, err, ErrTruncated)
+	_, _, err = readInt([]byte{0x1f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}, 5)
+	assert.ErrorIs(t, err, ErrIntegerOverflow)
+}
+
+// requests are RFC 7541 C.3 and C.4: the same three requests on one
+// connection, without and with Huffman coding.
+var requests = [][]HeaderField{
+	{{Name: ":method", Value: "GET"}, {Name: ":scheme", Value: "http"}, {Name: ":path", Value: "/"}, {Name: ":authority", Value: "www.example.com"}},
+	{{Name: ":method", Value: "GET"}, {Name: ":scheme", Value: "http"}, {Name: ":path", Value: "/"}, {Name: ":authority", Value: "www.example.com"}, {Name: "cache-control", Value: "no-cache"}},
+	{{Name: ":method", Value: "GET"}, {Name: ":scheme", Value: "https"}, {Name: ":path", Value: "/index.html"}, {Name: ":authority", Value: "www.example.com"}, {Name: "custom-key", Value: "custom-value"}},
+}
+
+func TestDecodeRequests(t *testing.T) {
+	for name, blocks := range map[string][]string{
+		"plain": {
+			"8286 8441 0f77 7777 2e65 7861 6d70 6c65 2e63 6f6d",
+			"8286 84be 5808 6e6f 2d63 6163 6865",
+			"8287 85bf 400a 6375 7374 6f6d 2d6b 6579 0c63 7573 746f 6d2d 7661 6c75 65",
+		},
+		"huffman": {
+			"8286 8441 8cf1 e3c2 e5f2 3a6b a0ab 90f4 ff",
+			"8286 84be 5886 a8eb 1064 9cbf",
+			"8287 85bf 4088 25a8 49e9 5ba9 7d7f 8925 a849 e95b b8e8 b4bf",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			d := NewDecoder(DefaultTableSize)
+			for i, block := range blocks {
+				fields, err := d.Decode(unhex(t, block))
+				assert.NoError(t, err)
+				assert.Equal(t, requests[i], fields)
+			}
+			assert.Equal(t, uint32(164), d.table.size)
+		})
+	}
+}
+
+func TestEncodeRequests(t *testing.T) {
+	// The encoder makes the same choices as the C.4 example.
+	e := NewEncoder()
+	want := []string{
+		"828684418cf1e3c2e5f23a6ba0ab90f4ff",
+		"828684be5886a8eb10649cbf",
+		"828785bf408825a849e95ba97d7f8925a849e95bb8e8b4bf",
+	}
+	for i, fields := range requests {
+		assert.Equal(t, want[i], hex.EncodeToString(e.Encode(fields)))
+	}
+}
+
+func TestDecodeResponsesWithEviction(t *testing.T) {
+	// RFC 7541 C.6: responses with a 256-byte table, so entries are
+	// evicted.
+	d := NewDecoder(256)
+	blocks := []string{
+		"4882 6402 5885 aec3 771a 4b61 96d0 7abe 9410 54d4 44a8 2005 9504 0b81 66e0 82a6 2d1b ff6e 919d 29ad 1718 63c7 8f0b 97c8 e9ae 82ae 43d3",
+		"4883 640e ffc1 c0bf",
+		"88c1 6196 d07a be94 1054 d444 a820 0595 040b 8166 e084 a62d 1bff c05a 839b d9ab 77ad 94e7 821d d7f2 e6c7 b335 dfdf cd5b 3960 d5af 2708 7f36 72c1 ab27 0fb5 291f 9587 3160 65c0 03ed 4ee5 b106 3d50 07",
+	}
+	want := [][]HeaderField{
+		{{Name: ":status", Value: "302"}, {Name: "cache-control", Value: "private"}, {Name: "date", Value: "Mon, 21 Oct 2013 20:13:21 GMT"}, {Name: "location", Value: "https://www.example.com"}},
+		{{Name: ":status", Value: "307"}, {Name: "cache-control", Value: "private"}, {Name: "date", Value: "Mon, 21 Oct 2013 20:13:21 GMT"}, {Name: "location", Value: "https://www.example.com"}},
+		{{Name: ":status", Value: "200"}, {Name: "cache-control", Value: "private"}, {Name: "date", Value: "Mon, 21 Oct 2013 20:13:22 GMT"}, {Name: "location", Value: "https://www.example.com"}, {Name: "content-encoding", Value: "gzip"}, {Name: "set-cookie", Value: "foo=ASDJKHQKBZXOQWEOPIUAXQWEOIU; max-age=3600; version=1"}},
+	}
+	for i, block := range blocks {
+		fields, err := d.Decode(unhex(t, block))
+		assert.NoError(t, err)
+		assert.Equal(t, want[i], fields)
+	}
+	assert.Equal(t, uint32(215), d.table.size)
+	assert.Len(t, d.table.entries, 3)
+}
+
+func TestRoundTrip(t *testing.T) {
+	e := NewEncoder()
+	d := NewDecoder(DefaultTableSize)
+	for i := 0; i < 50; i++ {
+		fields := []HeaderField{
+			{Name: ":status", Value: "200"},
+			{Name: "content-type", Value: "text/html; charset=utf-8"},
+			{Name: "content-length", Value: strings.Repeat("9", i%7+1)},
+			{Name: "x-big", Value: strings.Repeat("v", i*40)},
+			{Name: "set-cookie", Value: "session=secret", Sensitive: true},
+		}
+		block := e.Encode(fields)
+		got, err := d.Decode(block)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, fields, got)
+		assert.LessOrEqual(t, d.table.size, uint32(DefaultTableSize))
+		assert.Equal(t, e.table.entries, d.table.entries, "Both tables evolve the same way")
+	}
+	for _, entry := range d.table.entries {
+		assert.NotEqual(t, "set-cookie", entry.Name, "Sensitive fields are never indexed")
+	}
+}
+
+func TestTableSizeUpdate(t *testing.T) {
+	assert := assert.New(t)
+	e := NewEncoder()
+	d := NewDecoder(DefaultTableSize)
+	fields := []HeaderField{{Name: "x-a", Value: "1"}}
+	d.Decode(e.Encode(fields))
+	assert.Len(d.table.entries, 1)
+
+	// The peer shrinks the table to nothing and grows it back before the
+	// next block; both sizes go out so the decoder empties its table too.
+	e.SetMaxTableSize(0)
+	e.SetMaxTableSize(100)
+	block := e.Encode(fields)
+	assert.Equal([]byte{0x20, 0x3f, 0x45}, block[:3])
+	got, err := d.Decode(block)
+	assert.NoError(err)
+	assert.Equal(fields, got)
+	assert.Equal(uint32(100), d.table.maxSize)
+	assert.Len(d.table.entries, 1)
+
+	_, err = NewDecoder(100).Decode([]byte{0x3f, 0xe1, 0x1f})
+	assert.ErrorIs(err, ErrTableSizeUpdate, "Larger than the advertised limit")
+	_, err = NewDecoder(4096).Decode([]byte{0x82, 0x20})
+	assert.ErrorIs(err, ErrTableSizeUpdate, "After the first field")
+}
+
+func TestDecodeErrors(t *testing.T) {
+	d := NewDecoder(DefaultTableSize)
+	_, err := d.Decode([]byte{0x80})
+	assert.ErrorIs(t, err, ErrInvalidIndex, "Index 0")
+	_, err = d.Decode([]byte{0xbe})
+	assert.ErrorIs(t, err, ErrInvalidIndex, "Empty dynamic table")
+	_, err = d.Decode([]byte{0x40, 0x05, 'a'})
+	assert.ErrorIs(t, err, ErrTruncated)
+
+	d.MaxHeaderListSize = 100
+	block := NewEncoder().Encode([]HeaderField{{Name: "a", Value: "1"}, {Name: "b", Value: strings.Repeat("x", 100)}, {Name: "c", Value: "3"}})
+	fields, err := d.Decode(block)
+	assert.ErrorIs(t, err, ErrHeaderListTooLarge)
+	assert.Equal(t, []HeaderField{{Name: "a", Value: "1"}}, fields)
+	assert.Len(t, d.table.entries, 3, "The whole block is still processed")
+
+	d = NewDecoder(DefaultTableSize)
+	d.MaxStringLength = 10
+	_, err = d.Decode(NewEncoder().Encode([]HeaderField{{Name: "a", Value: strings.Repeat("x", 11)}}))
+	assert.ErrorIs(t, err, ErrStringTooLong)
+}
+
+func TestHuffman(t *testing.T) {
+	assert := assert.New(t)
+	var all strings.Builder
+	for i := 0; i < 256; i++ {
+		all.WriteByte(byte(i))
+	}
+	for _, s := range []string{"", "a", "www.example.com", "no-cache", all.String()} {
+		encoded := HuffmanEncode(nil, s)
+		assert.Len(encoded, HuffmanEncodedLen(s))
+		decoded, err := HuffmanDecode(encoded)
+		assert.NoError(err)
+		assert.Equal(s, decoded)
+	}
+
+	// 'a' is 00011; padding with zeros, or with a whole byte of ones, is
+	// invalid.
+	_, err := HuffmanDecode([]byte{0x18})
+	assert.ErrorIs(err, ErrInvalidHuffman)
+	_, err = HuffmanDecode([]byte{0x1f, 0xff})
+	assert.ErrorIs(err, ErrInvalidHuffman)
+	// EOS is 30 ones.
+	_, err = HuffmanDecode([]byte{0xff, 0xff, 0xff, 0xff})
+	assert.ErrorIs(err, ErrInvalidHuffman)
+}
@@ -0,0 +1,1134 @@
+package http1
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/textproto"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultMaxRequestLine = 8192
+	DefaultMaxHeaderBytes = 16 << 10
+	DefaultMaxHeaders     = 100
+	DefaultMaxBodyBytes   = 10 << 20
+)
+
+const (
+	DefaultIdleTimeout  = 5 * time.Second
+	DefaultReadTimeout  = 30 * time.Second
+	DefaultWriteTimeout = 30 * time.Second
+	DefaultMaxRequests  = 100
+)
+
+// TimeFormat is the IMF-fixdate format used by Date and Last-Modified.
+const TimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// ParseTime parses an HTTP date in IMF-fixdate or one of the two obsolete
+// formats recipients must still accept, RFC 9110 section 5.6.7.
+func ParseTime(value string) (time.Time, error) {
+	var err error
+	for _, layout := range []string{TimeFormat, "Monday, 02-Jan-06 15:04:05 GMT", time.ANSIC} {
+		var t time.Time
+		if t, err = time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+const (
+	StatusContinue                    = 100
+	StatusOK                          = 200
+	StatusNoContent                   = 204
+	StatusPartialContent              = 206
+	StatusMovedPermanently            = 301
+	StatusFound                       = 302
+	StatusNotModified                 = 304
+	StatusTemporaryRedirect           = 307
+	StatusPermanentRedirect           = 308
+	StatusBadRequest                  = 400
+	StatusForbidden                   = 403
+	StatusNotFound                    = 404
+	StatusMethodNotAllowed            = 405
+	StatusRequestTimeout              = 408
+	StatusLengthRequired              = 411
+	StatusPreconditionFailed          = 412
+	StatusContentTooLarge             = 413
+	StatusURITooLong                  = 414
+	StatusRangeNotSatisfiable         = 416
+	StatusRequestHeaderFieldsTooLarge = 431
+	StatusInternalServerError         = 500
+	StatusNotImplemented              = 501
+	StatusBadGateway                  = 502
+	StatusServiceUnavailable          = 503
+	StatusGatewayTimeout              = 504
+	StatusHTTPVersionNotSupported     = 505
+)
+
+var statusText = map[int]string{
+	100: "Continue",
+	200: "OK",
+	204: "No Content",
+	206: "Partial Content",
+	301: "Moved Permanently",
+	302: "Found",
+	304: "Not Modified",
+	307: "Temporary Redirect",
+	308: "Permanent Redirect",
+	400: "Bad Request",
+	403: "Forbidden",
+	404: "Not Found",
+	405: "Method Not Allowed",
+	408: "Request Timeout",
+	411: "Length Required",
+	412: "Precondition Failed",
+	413: "Content Too Large",
+	414: "URI Too Long",
+	416: "Range Not Satisfiable",
+	431: "Request Header Fields Too Large",
+	500: "Internal Server Error",
+	501: "Not Implemented",
+	502: "Bad Gateway",
+	503: "Service Unavailable",
+	504: "Gateway Timeout",
+	505: "HTTP Version Not Supported",
+}
+
+// StatusText returns the reason phrase for code, or "" when it's unknown.
+func StatusText(code int) string {
+	return statusText[code]
+}
+
+// StatusLine formats the start of a response, e.g. "HTTP/1.1 404 Not Found".
+func StatusLine(code int) string {
+	return fmt.Sprintf("HTTP/1.1 %d %s", code, StatusText(code))
+}
+
+// Error is a malformed or oversized request. Status is the response code
+// the server should answer with before closing the connection.
+type Error struct {
+	Status int
+	Reason string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("http1: %d %s: %s", e.Status, StatusText(e.Status), e.Reason)
+}
+
+func errorf(status int, format string, args ...any) *Error {
+	return &Error{Status: status, Reason: fmt.Sprintf(format, args...)}
+}
+
+// StatusOf returns the status carried by an *Error in err's chain, or 0
+// when err is an I/O error and there is nobody left to answer.
+func StatusOf(err error) int {
+	var httpErr *Error
+	if errors.As(err, &httpErr) {
+		return httpErr.Status
+	}
+	return 0
+}
+
+// Limits bounds what ReadRequest accepts. Zero fields use the defaults.
+type Limits struct {
+	MaxRequestLine int
+	MaxHeaderBytes int
+	MaxHeaders     int
+	MaxBodyBytes   int64
+}
+
+func (l Limits) withDefaults() Limits {
+	if l.MaxRequestLine <= 0 {
+		l.MaxRequestLine = DefaultMaxRequestLine
+	}
+	if l.MaxHeaderBytes <= 0 {
+		l.MaxHeaderBytes = DefaultMaxHeaderBytes
+	}
+	if l.MaxHeaders <= 0 {
+		l.MaxHeaders = DefaultMaxHeaders
+	}
+	if l.MaxBodyBytes <= 0 {
+		l.MaxBodyBytes = DefaultMaxBodyBytes
+	}
+	return l
+}
+
+// Header maps lower-cased field names to their values in the order they
+// were received.
+type Header map[string][]string
+
+func (h Header) Get(name string) string {
+	if values := h[strings.ToLower(name)]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func (h Header) Values(name string) []string {
+	return h[strings.ToLower(name)]
+}
+
+func (h Header) Has(name string) bool {
+	_, ok := h[strings.ToLower(name)]
+	return ok
+}
+
+func (h Header) Add(name string, value string) {
+	key := strings.ToLower(name)
+	h[key] = append(h[key], value)
+}
+
+func (h Header) Set(name string, value string) {
+	h[strings.ToLower(name)] = []string{value}
+}
+
+func (h Header) Del(name string) {
+	delete(h, strings.ToLower(name))
+}
+
+// HasToken reports whether a comma-separated header such as Connection
+// lists token, ignoring case.
+func (h Header) HasToken(name string, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type Request struct {
+	Method string
+	// Target is the request-target exactly as sent; Path is its decoded
+	// path and RawQuery the part after '?'.
+	Target   string
+	Path     string
+	RawQuery string
+	Proto    string
+	Major    int
+	Minor    int
+	Header   Header
+	Host     string
+	// ContentLength is -1 for chunked bodies.
+	ContentLength int64
+	Chunked       bool
+	// Body reports an *Error with status 413 past the limit. Trailer is
+	// filled in once a chunked body has been read.
+	Body    io.Reader
+	Trailer Header
+	// RemoteAddr and TLS are filled in by Server; TLS is set when the
+	// request arrived over an encrypted connection.
+	RemoteAddr string
+	TLS        bool
+}
+
+// ReadRequest reads one request head from r and sets up Body to read what
+// follows it. A connection that closes before the first byte gives io.EOF.
+func ReadRequest(r *bufio.Reader, limits Limits) (*Request, error) {
+	limits = limits.withDefaults()
+
+	var line string
+	for {
+		var err error
+		line, err = readLine(r, limits.MaxRequestLine)
+		if errors.Is(err, errLineTooLong) {
+			return nil, errorf(StatusURITooLong, "request line longer than %d bytes", limits.MaxRequestLine)
+		}
+		if err != nil {
+			return nil, err
+		}
+		// Empty lines before the request line are ignored, RFC 9112
+		// section 2.2.
+		if line != "" {
+			break
+		}
+	}
+
+	req, err := parseRequestLine(line)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header, err = readHeader(r, limits)
+	if err != nil {
+		return nil, unexpected(err)
+	}
+
+	hosts := req.Header.Values("Host")
+	if len(hosts) > 1 {
+		return nil, errorf(StatusBadRequest, "multiple Host headers")
+	}
+	if len(hosts) == 1 {
+		req.Host = hosts[0]
+	} else if req.Minor >= 1 {
+		return nil, errorf(StatusBadRequest, "missing Host header")
+	}
+
+	if err := setupBody(req, r, limits); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// KeepAlive reports whether the client will send another request on the
+// connection.
+func (r *Request) KeepAlive() bool {
+	return keepAlive(r.Minor, r.Header)
+}
+
+func keepAlive(minor int, header Header) bool {
+	if header.HasToken("Connection", "close") {
+		return false
+	}
+	if minor == 0 {
+		return header.HasToken("Connection", "keep-alive")
+	}
+	return true
+}
+
+func parseRequestLine(line string) (*Request, error) {
+	method, rest, ok1 := strings.Cut(line, " ")
+	target, proto, ok2 := strings.Cut(rest, " ")
+	if !ok1 || !ok2 || strings.Contains(proto, " ") {
+		return nil, errorf(StatusBadRequest, "malformed request line %q", line)
+	}
+	if !IsToken(method) {
+		return nil, errorf(StatusBadRequest, "invalid method %q", method)
+	}
+	if target == "" {
+		return nil, errorf(StatusBadRequest, "empty request target")
+	}
+
+	major, minor, ok := parseVersion(proto)
+	if !ok {
+		return nil, errorf(StatusBadRequest, "malformed HTTP version %q", proto)
+	}
+	if major != 1 {
+		return nil, errorf(StatusHTTPVersionNotSupported, "unsupported version %s", proto)
+	}
+
+	req := &Request{Method: method, Target: target, Proto: proto, Major: major, Minor: minor}
+	switch {
+	case target == "*":
+		if method != "OPTIONS" {
+			return nil, errorf(StatusBadRequest, "asterisk target with %s", method)
+		}
+		req.Path = "*"
+	case method == "CONNECT":
+		// authority-form: host:port
+		req.Path = target
+	default:
+		u, err := url.ParseRequestURI(target)
+		if err != nil {
+			return nil, errorf(StatusBadRequest, "invalid request target %q", target)
+		}
+		req.Path = u.Path
+		if req.Path == "" {
+			req.Path = "/"
+		}
+		req.RawQuery = u.RawQuery
+	}
+	return req, nil
+}
+
+// parseVersion accepts "HTTP/" followed by a single-digit major and minor
+// version.
+func parseVersion(proto string) (int, int, bool) {
+	if len(proto) != len("HTTP/1.1") || !strings.HasPrefix(proto, "HTTP/") || proto[6] != '.' {
+		return 0, 0, false
+	}
+	major, minor := proto[5], proto[7]
+	if major < '0' || major > '9' || minor < '0' || minor > '9' {
+		return 0, 0, false
+	}
+	return int(major - '0'), int(minor - '0'), true
+}
+
+// readHeader reads header fields up to the empty line that ends them,
+// joining obsolete folded lines with a space.
+func readHeader(r *bufio.Reader, limits Limits) (Header, error) {
+	header := Header{}
+	size := 0
+	count := 0
+	lastKey := ""
+	for {
+		line, err := readLine(r, limits.MaxHeaderBytes-size)
+		if errors.Is(err, errLineTooLong) {
+			return nil, errorf(StatusRequestHeaderFieldsTooLarge, "header section larger than %d bytes", limits.MaxHeaderBytes)
+		}
+		if err != nil {
+			return nil, err
+		}
+		size += len(line) + 2
+		if line == "" {
+			return header, nil
+		}
+
+		if line[0] == ' ' || line[0] == '\t' {
+			if lastKey == "" {
+				return nil, errorf(StatusBadRequest, "continuation line before the first header")
+			}
+			values := header[lastKey]
+			values[len(values)-1] = strings.TrimSpace(values[len(values)-1] + " " + strings.TrimSpace(line))
+			continue
+		}
+
+		name, value, found := strings.Cut(line, ":")
+		if !found {
+			return nil, errorf(StatusBadRequest, "malformed header line %q", line)
+		}
+		// No whitespace is allowed between the field name and the colon,
+		// RFC 9112 section 5.1.
+		if !IsToken(name) {
+			return nil, errorf(StatusBadRequest, "invalid header name %q", name)
+		}
+		count++
+		if count > limits.MaxHeaders {
+			return nil, errorf(StatusRequestHeaderFieldsTooLarge, "more than %d header fields", limits.MaxHeaders)
+		}
+		lastKey = strings.ToLower(name)
+		header[lastKey] = append(header[lastKey], strings.TrimSpace(value))
+	}
+}
+
+// setupBody decides how the message body is framed, RFC 9112 section 6.
+func setupBody(req *Request, r *bufio.Reader, limits Limits) error {
+	req.Body = eofReader{}
+	encodings := req.Header.Values("Transfer-Encoding")
+	lengths := req.Header.Values("Content-Length")
+
+	if len(encodings) > 0 {
+		// A message with both could be framed differently by a proxy in
+		// front of us, which is how request smuggling works.
+		if len(lengths) > 0 {
+			return errorf(StatusBadRequest, "both Transfer-Encoding and Content-Length")
+		}
+		if req.Minor == 0 {
+			return errorf(StatusBadRequest, "Transfer-Encoding in an HTTP/1.0 request")
+		}
+		codings := strings.Split(strings.Join(encodings, ","), ",")
+		if len(codings) != 1 || !strings.EqualFold(strings.TrimSpace(codings[0]), "chunked") {
+			return errorf(StatusBadRequest, "unsupported Transfer-Encoding %q", strings.Join(encodings, ", "))
+		}
+		req.Chunked = true
+		req.ContentLength = -1
+		req.Trailer = Header{}
+		req.Body = &chunkedReader{r: r, trailer: &req.Trailer, limits: limits}
+		return nil
+	}
+
+	if len(lengths) == 0 {
+		return nil
+	}
+	length, err := parseContentLength(lengths)
+	if err != nil {
+		return err
+	}
+	if length > limits.MaxBodyBytes {
+		return errorf(StatusContentTooLarge, "body of %d bytes exceeds %d", length, limits.MaxBodyBytes)
+	}
+	req.ContentLength = length
+	if length > 0 {
+		req.Body = &lengthReader{r: r, remaining: length}
+	}
+	return nil
+}
+
+// parseContentLength accepts repeated Content-Length values only when
+// they agree.
+func parseContentLength(lengths []string) (int64, error) {
+	length := int64(-1)
+	for _, value := range strings.Split(strings.Join(lengths, ","), ",") {
+		value = strings.TrimSpace(value)
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 0 || value[0] == '+' {
+			return 0, errorf(StatusBadRequest, "invalid Content-Length %q", value)
+		}
+		if length >= 0 && n != length {
+			return 0, errorf(StatusBadRequest, "conflicting Content-Length values")
+		}
+		length = n
+	}
+	return length, nil
+}
+
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
+
+// lengthReader reads a body framed by Content-Length.
+type lengthReader struct {
+	r         *bufio.Reader
+	remaining int64
+}
+
+func (l *lengthReader) Read(b []byte) (int, error) {
+	if l.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(b)) > l.remaining {
+		b = b[:l.remaining]
+	}
+	n, err := l.r.Read(b)
+	l.remaining -= int64(n)
+	if err == io.EOF && l.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// chunkedReader decodes the chunked transfer coding, RFC 9112 section 7.1.
+type chunkedReader struct {
+	r *bufio.Reader
+	// trailer receives the trailer section once the last chunk is read.
+	trailer   *Header
+	limits    Limits
+	remaining int64
+	total     int64
+	started   bool
+	done      bool
+	err       error
+}
+
+func (c *chunkedReader) Read(b []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.done {
+		return 0, io.EOF
+	}
+	if c.remaining == 0 {
+		if c.started {
+			if err := c.readChunkEnd(); err != nil {
+				c.err = err
+				return 0, err
+			}
+		}
+		c.started = true
+		if err := c.readChunkSize(); err != nil {
+			c.err = err
+			return 0, err
+		}
+		if c.done {
+			return 0, io.EOF
+		}
+	}
+
+	if int64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.r.Read(b)
+	c.remaining -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		c.err = err
+	}
+	return n, err
+}
+
+func (c *chunkedReader) readChunkSize() error {
+	line, err := readLine(c.r, c.limits.MaxRequestLine)
+	if errors.Is(err, errLineTooLong) {
+		return errorf(StatusBadRequest, "chunk size line too long")
+	}
+	if err != nil {
+		return unexpected(err)
+	}
+	// Chunk extensions after ';' carry nothing we use.
+	sizeText, _, _ := strings.Cut(line, ";")
+	sizeText = strings.TrimRight(sizeText, " \t")
+	size, err := strconv.ParseInt(sizeText, 16, 64)
+	if err != nil || size < 0 || sizeText == "" || sizeText[0] == '+' || sizeText[0] == '-' {
+		return errorf(StatusBadRequest, "invalid chunk size %q", line)
+	}
+	if size > c.limits.MaxBodyBytes-c.total {
+		return errorf(StatusContentTooLarge, "chunked body exceeds %d bytes", c.limits.MaxBodyBytes)
+	}
+	c.total += size
+	c.remaining = size
+	if size > 0 {
+		return nil
+	}
+
+	trailer, err := readHeader(c.r, c.limits)
+	if err != nil {
+		return unexpected(err)
+	}
+	*c.trailer = trailer
+	c.done = true
+	return nil
+}
+
+func (c *chunkedReader) readChunkEnd() error {
+	line, err := readLine(c.r, 2)
+	if err != nil && !errors.Is(err, errLineTooLong) {
+		return unexpected(err)
+	}
+	if err != nil || line != "" {
+		return errorf(StatusBadRequest, "missing CRLF after chunk data")
+	}
+	return nil
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+var errLineTooLong = errors.New("line too long")
+
+// readLine reads a line of at most limit bytes including its terminator,
+// which is CRLF or a bare LF, and returns it without the terminator.
+func readLine(r *bufio.Reader, limit int) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > limit {
+			return "", errLineTooLong
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF && len(line) > 0 {
+			return "", io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return "", err
+		}
+		break
+	}
+
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	for _, c := range line {
+		if c == '\r' || c == 0 {
+			return "", errorf(StatusBadRequest, "stray CR or NUL in line")
+		}
+	}
+	return string(line), nil
+}
+
+// IsToken reports whether s is a non-empty RFC 9110 token, as a method or
+// field name must be.
+func IsToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= ' ' || c >= 0x7f || strings.IndexByte("\"(),/:;<=>?@[\\]{}", c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Handler answers one request. Headers set on w before the first Write
+// or WriteHeader are sent with the response.
+type Handler func(w *Response, req *Request)
+
+// Server runs Handler for every request on a connection, keeping the
+// connection open between requests.
+type Server struct {
+	Handler Handler
+	Limits  Limits
+	// IdleTimeout is how long to wait for the next request, and bounds
+	// reading its head. ReadTimeout then bounds reading the body and
+	// WriteTimeout writing the response. MaxRequests caps the requests
+	// served on one connection; 1 turns keep-alive off.
+	IdleTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	MaxRequests  int
+}
+
+// ServeConn serves requests from conn until the client or the limits end
+// the connection, then closes it. It returns the error that ended the
+// connection, or nil when it ended cleanly or sat idle.
+func (s *Server) ServeConn(conn net.Conn) error {
+	defer conn.Close()
+	idle := s.IdleTimeout
+	if idle <= 0 {
+		idle = DefaultIdleTimeout
+	}
+	readTimeout := s.ReadTimeout
+	if readTimeout <= 0 {
+		readTimeout = DefaultReadTimeout
+	}
+	writeTimeout := s.WriteTimeout
+	if writeTimeout <= 0 {
+		writeTimeout = DefaultWriteTimeout
+	}
+	maxRequests := s.MaxRequests
+	if maxRequests <= 0 {
+		maxRequests = DefaultMaxRequests
+	}
+
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	defer writer.Flush()
+	for served := 1; ; served++ {
+		conn.SetReadDeadline(time.Now().Add(idle))
+		req, err := ReadRequest(reader, s.Limits)
+		if err != nil {
+			if status := StatusOf(err); status != 0 {
+				WriteError(writer, status, err.Error())
+				return err
+			}
+			var netErr net.Error
+			if err == io.EOF || served > 1 && errors.As(err, &netErr) && netErr.Timeout() {
+				return nil
+			}
+			return err
+		}
+		req.RemoteAddr = conn.RemoteAddr().String()
+		_, req.TLS = conn.(*tls.Conn)
+		conn.SetReadDeadline(time.Now().Add(readTimeout))
+		conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+
+		w := newResponse(writer, req, req.KeepAlive() && served < maxRequests)
+		w.conn = conn
+		var expect *continueReader
+		if req.Minor >= 1 && (req.Chunked || req.ContentLength > 0) && strings.EqualFold(req.Header.Get("Expect"), "100-continue") {
+			expect = &continueReader{r: req.Body, resp: w}
+			req.Body = expect
+			w.expect = expect
+		}
+		s.Handler(w, req)
+		// The rest of the body must be consumed before the next request,
+		// unless the client was never told to send it.
+		var bodyErr error
+		if expect != nil && !expect.sent {
+			w.keepAlive = false
+		} else if _, bodyErr = io.Copy(io.Discard, req.Body); bodyErr != nil {
+			w.keepAlive = false
+		}
+		if err := w.finish(); err != nil {
+			return err
+		}
+		if !w.keepAlive {
+			return bodyErr
+		}
+		if reader.Buffered() == 0 {
+			if err := writer.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// continueReader sends the interim 100 Continue response a client asked
+// for with Expect: 100-continue once the handler starts reading the body.
+type continueReader struct {
+	r    io.Reader
+	resp *Response
+	sent bool
+}
+
+func (c *continueReader) Read(b []byte) (int, error) {
+	if !c.sent {
+		c.sent = true
+		if !c.resp.wroteHeader {
+			c.resp.w.WriteString(StatusLine(StatusContinue) + "\r\n\r\n")
+			if err := c.resp.w.Flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return c.r.Read(b)
+}
+
+// ServeRequest runs handler for a request that didn't arrive on an
+// HTTP/1.x connection and writes the response to w in HTTP/1.1 form.
+func ServeRequest(handler Handler, req *Request, w io.Writer) error {
+	writer := bufio.NewWriter(w)
+	// An HTTP/1.0 request keeps the response free of chunked framing.
+	resp := newResponse(writer, &Request{Method: req.Method, Minor: 0, Header: req.Header}, false)
+	handler(resp, req)
+	if err := resp.finish(); err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+// WriteError writes a plain text response that closes the connection.
+func WriteError(w io.Writer, status int, message string) error {
+	resp := newResponse(bufio.NewWriter(w), &Request{Method: "GET", Minor: 1, Header: Header{}}, false)
+	resp.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	resp.Header.Set("Content-Length", strconv.Itoa(len(message)))
+	resp.WriteHeader(status)
+	resp.Write([]byte(message))
+	if err := resp.finish(); err != nil {
+		return err
+	}
+	return resp.w.Flush()
+}
+
+// AllowMethod reports whether req's method is one of methods, and sets
+// the Allow header a 405 response must carry when it isn't.
+func AllowMethod(w *Response, req *Request, methods ...string) bool {
+	if slices.Contains(methods, req.Method) {
+		return true
+	}
+	w.Header.Set("Allow", strings.Join(methods, ", "))
+	return false
+}
+
+var ErrBodyTooLong = errors.New("http1: response body longer than Content-Length")
+
+// Response writes one response. The body is framed by the Content-Length
+// header when the handler sets it, chunked otherwise, or for HTTP/1.0
+// clients by closing the connection.
+type Response struct {
+	Header Header
+
+	w *bufio.Writer
+	// conn is the connection under w, when ReadFrom may bypass the
+	// buffer.
+	conn io.Writer
+	// expect is set while the client waits for 100 Continue before
+	// sending the body.
+	expect      *continueReader
+	req         *Request
+	keepAlive   bool
+	status      int
+	wroteHeader bool
+	noBody      bool
+	chunked     bool
+	// remaining is what's left of a declared Content-Length, or -1.
+	remaining int64
+}
+
+func newResponse(w *bufio.Writer, req *Request, keepAlive bool) *Response {
+	return &Response{Header: Header{}, w: w, req: req, keepAlive: keepAlive, remaining: -1}
+}
+
+// Status returns the status sent, or 0 before the header is written.
+func (r *Response) Status() int {
+	return r.status
+}
+
+func (r *Response) WriteHeader(status int) {
+	if r.wroteHeader {
+		return
+	}
+	r.wroteHeader = true
+	r.status = status
+
+	switch {
+	case status < 200 || status == StatusNoContent || status == StatusNotModified:
+		r.noBody = true
+		r.remaining = 0
+		r.Header.Del("Content-Length")
+	case r.Header.Has("Content-Length"):
+		length, err := strconv.ParseInt(r.Header.Get("Content-Length"), 10, 64)
+		if err != nil || length < 0 {
+			r.Header.Del("Content-Length")
+			r.keepAlive = false
+		} else {
+			r.remaining = length
+		}
+	case r.req.Method == "HEAD":
+	case r.req.Minor >= 1:
+		r.Header.Set("Transfer-Encoding", "chunked")
+		r.chunked = true
+	default:
+		r.keepAlive = false
+	}
+	if r.req.Method == "HEAD" {
+		r.noBody = true
+	}
+	// The body never asked for may or may not follow.
+	if r.expect != nil && !r.expect.sent {
+		r.keepAlive = false
+	}
+
+	if !r.keepAlive {
+		r.Header.Set("Connection", "close")
+	} else if r.req.Minor == 0 {
+		r.Header.Set("Connection", "keep-alive")
+	}
+	if !r.Header.Has("Date") {
+		r.Header.Set("Date", time.Now().UTC().Format(TimeFormat))
+	}
+
+	fmt.Fprintf(r.w, "%s\r\n", StatusLine(status))
+	writeHeader(r.w, r.Header)
+}
+
+// canonicalName spells a header name the way it is usually written.
+func canonicalName(name string) string {
+	switch name {
+	case "etag":
+		return "ETag"
+	case "www-authenticate":
+		return "WWW-Authenticate"
+	}
+	return textproto.CanonicalMIMEHeaderKey(name)
+}
+
+func (r *Response) Write(b []byte) (int, error) {
+	if !r.wroteHeader {
+		r.WriteHeader(StatusOK)
+	}
+	if r.noBody || len(b) == 0 {
+		return len(b), nil
+	}
+	if r.remaining >= 0 && int64(len(b)) > r.remaining {
+		n, _ := r.Write(b[:r.remaining])
+		return n, ErrBodyTooLong
+	}
+
+	if r.chunked {
+		fmt.Fprintf(r.w, "%x\r\n", len(b))
+	}
+	n, err := r.w.Write(b)
+	if r.remaining >= 0 {
+		r.remaining -= int64(n)
+	}
+	if r.chunked && err == nil {
+		_, err = r.w.WriteString("\r\n")
+	}
+	return n, err
+}
+
+// ReadFrom lets io.Copy hand a body to the connection directly, so a file
+// goes out with sendfile(2).
+func (r *Response) ReadFrom(src io.Reader) (int64, error) {
+	if !r.wroteHeader {
+		r.WriteHeader(StatusOK)
+	}
+	direct, ok := r.conn.(io.ReaderFrom)
+	if !ok || r.noBody || r.chunked {
+		return io.Copy(writerOnly{r}, src)
+	}
+	if r.remaining >= 0 {
+		if limited, ok := src.(*io.LimitedReader); !ok || limited.N > r.remaining {
+			src = io.LimitReader(src, r.remaining)
+		}
+	}
+	if err := r.w.Flush(); err != nil {
+		return 0, err
+	}
+	n, err := direct.ReadFrom(src)
+	if r.remaining >= 0 {
+		r.remaining -= n
+	}
+	return n, err
+}
+
+// writerOnly hides Response.ReadFrom from io.Copy.
+type writerOnly struct {
+	io.Writer
+}
+
+// Flush sends what has been written so far to the client.
+func (r *Response) Flush() error {
+	if !r.wroteHeader {
+		r.WriteHeader(StatusOK)
+	}
+	return r.w.Flush()
+}
+
+func (r *Response) finish() error {
+	if !r.wroteHeader {
+		if !r.Header.Has("Content-Length") && !r.Header.Has("Transfer-Encoding") {
+			r.Header.Set("Content-Length", "0")
+		}
+		r.WriteHeader(StatusOK)
+	}
+	if r.chunked {
+		r.w.WriteString("0\r\n\r\n")
+	}
+	// A body shorter than its Content-Length leaves the client waiting
+	// for bytes that never come; closing tells it the response is cut.
+	if r.remaining > 0 && !r.noBody {
+		r.keepAlive = false
+	}
+	if !r.keepAlive {
+		return r.w.Flush()
+	}
+	return nil
+}
+
+// Write sends the request to w as a client or proxy does. A body of
+// unknown length (ContentLength -1) is sent chunked.
+func (r *Request) Write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	proto := r.Proto
+	if proto == "" {
+		proto = "HTTP/1.1"
+	}
+	fmt.Fprintf(bw, "%s %s %s\r\n", r.Method, r.Target, proto)
+	if r.Host != "" {
+		fmt.Fprintf(bw, "Host: %s\r\n", r.Host)
+	}
+	header := Header{}
+	for name, values := range r.Header {
+		if name != "host" && name != "transfer-encoding" {
+			header[name] = values
+		}
+	}
+	switch {
+	case r.ContentLength < 0:
+		header.Set("Transfer-Encoding", "chunked")
+	case r.ContentLength > 0:
+		header.Set("Content-Length", strconv.FormatInt(r.ContentLength, 10))
+	}
+	writeHeader(bw, header)
+
+	if r.Body != nil && r.ContentLength != 0 {
+		var err error
+		if r.ContentLength < 0 {
+			err = writeChunked(bw, r.Body)
+		} else {
+			var n int64
+			n, err = io.Copy(bw, io.LimitReader(r.Body, r.ContentLength))
+			if err == nil && n < r.ContentLength {
+				err = io.ErrUnexpectedEOF
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// writeHeader writes the fields in a stable order and the empty line that
+// ends them.
+func writeHeader(w *bufio.Writer, header Header) {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		for _, value := range header[name] {
+			fmt.Fprintf(w, "%s: %s\r\n", canonicalName(name), value)
+		}
+	}
+	w.WriteString("\r\n")
+}
+
+func writeChunked(w *bufio.Writer, body io.Reader) error {
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			fmt.Fprintf(w, "%x\r\n", n)
+			w.Write(buf[:n])
+			if _, werr := w.WriteString("\r\n"); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			_, err = w.WriteString("0\r\n\r\n")
+			return err
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// ClientResponse is a response read from a server, as a client or proxy
+// sees it.
+type ClientResponse struct {
+	Proto      string
+	Major      int
+	Minor      int
+	StatusCode int
+	Reason     string
+	Header     Header
+	// ContentLength is -1 when the body is chunked or runs to the end of
+	// the connection.
+	ContentLength int64
+	Chunked       bool
+	// Close is set when the connection can't carry another request.
+	Close   bool
+	Body    io.Reader
+	Trailer Header
+}
+
+// ReadResponse reads a response head from r and sets up Body, RFC 9112
+// section 6.3. method is the request's, as a response to HEAD has no body.
+func ReadResponse(r *bufio.Reader, method string, limits Limits) (*ClientResponse, error) {
+	limits = limits.withDefaults()
+	limits.MaxBodyBytes = math.MaxInt64
+
+	line, err := readLine(r, limits.MaxRequestLine)
+	if errors.Is(err, errLineTooLong) {
+		return nil, errorf(StatusBadGateway, "status line longer than %d bytes", limits.MaxRequestLine)
+	}
+	if err != nil {
+		return nil, err
+	}
+	proto, rest, _ := strings.Cut(line, " ")
+	codeText, reason, _ := strings.Cut(rest, " ")
+	major, minor, ok := parseVersion(proto)
+	code, err := strconv.Atoi(codeText)
+	if !ok || major != 1 || err != nil || len(codeText) != 3 || code < 100 {
+		return nil, errorf(StatusBadGateway, "malformed status line %q", line)
+	}
+	resp := &ClientResponse{Proto: proto, Major: major, Minor: minor, StatusCode: code, Reason: reason, ContentLength: -1, Body: eofReader{}}
+
+	resp.Header, err = readHeader(r, limits)
+	if err != nil {
+		return nil, unexpected(err)
+	}
+	resp.Close = !keepAlive(minor, resp.Header)
+
+	if method == "HEAD" || code < 200 || code == StatusNoContent || code == StatusNotModified {
+		resp.ContentLength = 0
+		return resp, nil
+	}
+	if encodings := resp.Header.Values("Transfer-Encoding"); len(encodings) > 0 {
+		codings := strings.Split(strings.Join(encodings, ","), ",")
+		if len(codings) == 1 && strings.EqualFold(strings.TrimSpace(codings[0]), "chunked") {
+			resp.Chunked = true
+			resp.Trailer = Header{}
+			resp.Body = &chunkedReader{r: r, trailer: &resp.Trailer, limits: limits}
+			return resp, nil
+		}
+		// Any other coding can only be read until the connection closes.
+		resp.Close = true
+		resp.Body = r
+		return resp, nil
+	}
+	if lengths := resp.Header.Values("Content-Length"); len(lengths) > 0 {
+		length, err := parseContentLength(lengths)
+		if err != nil {
+			return nil, err
+		}
+		resp.ContentLength = length
+		if length > 0 {
+			resp.Body = &lengthReader{r: r, remaining: length}
+		}
+		return resp, nil
+	}
+	resp.Close = true
+	resp.Body = r
+	return resp, nil
+}
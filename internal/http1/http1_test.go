@@ -0,0 +1,640 @@
+package http1
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func read(raw string, limits Limits) (*Request, string, error) {
+	req, err := ReadRequest(bufio.NewReader(strings.NewReader(raw)), limits)
+	if err != nil {
+		return nil, "", err
+	}
+	body, err := io.ReadAll(req.Body)
+	return req, string(body), err
+}
+
+func TestReadRequest(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string
+		method   string
+		path     string
+		query    string
+		minor    int
+		body     string
+		header   map[string]string
+		chunked  bool
+		trailers map[string]string
+	}{
+		{
+			name:   "simple GET",
+			raw:    "GET /index.html HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			method: "GET", path: "/index.html", minor: 1,
+			header: map[string]string{"host": "example.com"},
+		},
+		{
+			name:   "query and escaped path",
+			raw:    "GET /my%20file.txt?x=1&y=a+b HTTP/1.1\r\nHost: h\r\n\r\n",
+			method: "GET", path: "/my file.txt", query: "x=1&y=a+b", minor: 1,
+		},
+		{
+			name:   "absolute form",
+			raw:    "GET http://example.com/a/b HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			method: "GET", path: "/a/b", minor: 1,
+		},
+		{
+			name:   "HTTP/1.0 without Host",
+			raw:    "GET / HTTP/1.0\r\n\r\n",
+			method: "GET", path: "/", minor: 0,
+		},
+		{
+			name:   "leading empty lines and bare LF",
+			raw:    "\r\n\nHEAD /x HTTP/1.1\nHost: h\n\n",
+			method: "HEAD", path: "/x", minor: 1,
+		},
+		{
+			name:   "header names ignore case and values are trimmed",
+			raw:    "GET / HTTP/1.1\r\nHOST: h\r\nX-Custom:   spaced out \t\r\n\r\n",
+			method: "GET", path: "/", minor: 1,
+			header: map[string]string{"Host": "h", "x-custom": "spaced out"},
+		},
+		{
+			name:   "folded header",
+			raw:    "GET / HTTP/1.1\r\nHost: h\r\nX-Long: first\r\n  second\r\n\tthird\r\n\r\n",
+			method: "GET", path: "/", minor: 1,
+			header: map[string]string{"x-long": "first second third"},
+		},
+		{
+			name:   "content length body",
+			raw:    "POST /form HTTP/1.1\r\nHost: h\r\nContent-Length: 11\r\n\r\nhello worldGET / HTTP/1.1",
+			method: "POST", path: "/form", minor: 1, body: "hello world",
+		},
+		{
+			name:   "repeated equal content lengths",
+			raw:    "POST / HTTP/1.1\r\nHost: h\r\nContent-Length: 3, 3\r\n\r\nabc",
+			method: "POST", path: "/", minor: 1, body: "abc",
+		},
+		{
+			name:   "chunked body with extension and trailer",
+			raw:    "POST / HTTP/1.1\r\nHost: h\r\nTransfer-Encoding: chunked\r\n\r\n5;name=v\r\nhello\r\n6\r\n world\r\n0\r\nX-Checksum: abc\r\n\r\n",
+			method: "POST", path: "/", minor: 1, body: "hello world", chunked: true,
+			trailers: map[string]string{"x-checksum": "abc"},
+		},
+		{
+			name:   "OPTIONS asterisk",
+			raw:    "OPTIONS * HTTP/1.1\r\nHost: h\r\n\r\n",
+			method: "OPTIONS", path: "*", minor: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+			req, body, err := read(test.raw, Limits{})
+			if !assert.NoError(err) {
+				return
+			}
+			assert.Equal(test.method, req.Method)
+			assert.Equal(test.path, req.Path)
+			assert.Equal(test.query, req.RawQuery)
+			assert.Equal(1, req.Major)
+			assert.Equal(test.minor, req.Minor)
+			assert.Equal(test.body, body)
+			assert.Equal(test.chunked, req.Chunked)
+			for name, value := range test.header {
+				assert.Equal(value, req.Header.Get(name), name)
+			}
+			for name, value := range test.trailers {
+				assert.Equal(value, req.Trailer.Get(name), name)
+			}
+		})
+	}
+}
+
+func TestReadRequestErrors(t *testing.T) {
+	longHeader := "X-Big: " + strings.Repeat("a", 200) + "\r\n"
+	tests := []struct {
+		name   string
+		raw    string
+		limits Limits
+		status int
+	}{
+		{"missing version", "GET /\r\n\r\n", Limits{}, 400},
+		{"extra space", "GET  / HTTP/1.1\r\nHost: h\r\n\r\n", Limits{}, 400},
+		{"trailing space in method", "GET / HTTP/1.1 \r\nHost: h\r\n\r\n", Limits{}, 400},
+		{"bad method", "G(T / HTTP/1.1\r\nHost: h\r\n\r\n", Limits{}, 400},
+		{"bad version", "GET / HTTP/one\r\nHost: h\r\n\r\n", Limits{}, 400},
+		{"lower case proto", "GET / http/1.1\r\nHost: h\r\n\r\n", Limits{}, 400},
+		{"HTTP/2", "GET / HTTP/2.0\r\nHost: h\r\n\r\n", Limits{}, 505},
+		{"HTTP/0.9", "GET / HTTP/0.9\r\n\r\n", Limits{}, 505},
+		{"relative target", "GET index.html HTTP/1.1\r\nHost: h\r\n\r\n", Limits{}, 400},
+		{"missing host", "GET / HTTP/1.1\r\n\r\n", Limits{}, 400},
+		{"two hosts", "GET / HTTP/1.1\r\nHost: a\r\nHost: b\r\n\r\n", Limits{}, 400},
+		{"space before colon", "GET / HTTP/1.1\r\nHost : h\r\n\r\n", Limits{}, 400},
+		{"header without colon", "GET / HTTP/1.1\r\nHost: h\r\nnonsense\r\n\r\n", Limits{}, 400},
+		{"fold before first header", "GET / HTTP/1.1\r\n continued\r\nHost: h\r\n\r\n", Limits{}, 400},
+		{"stray CR", "GET / HTTP/1.1\r\nHost: h\rX\r\n\r\n", Limits{}, 400},
+		{"request line too long", "GET /" + strings.Repeat("a", 100) + " HTTP/1.1\r\nHost: h\r\n\r\n", Limits{MaxRequestLine: 64}, 414},
+		{"header section too large", "GET / HTTP/1.1\r\nHost: h\r\n" + longHeader + "\r\n", Limits{MaxHeaderBytes: 128}, 431},
+		{"too many headers", "GET / HTTP/1.1\r\nHost: h\r\nA: 1\r\nB: 2\r\nC: 3\r\n\r\n", Limits{MaxHeaders: 3}, 431},
+		{"negative content length", "POST / HTTP/1.1\r\nHost: h\r\nContent-Length: -1\r\n\r\n", Limits{}, 400},
+		{"non-numeric content length", "POST / HTTP/1.1\r\nHost: h\r\nContent-Length: 1e3\r\n\r\n", Limits{}, 400},
+		{"conflicting content lengths", "POST / HTTP/1.1\r\nHost: h\r\nContent-Length: 3\r\nContent-Length: 4\r\n\r\nabcd", Limits{}, 400},
+		{"content length over limit", "POST / HTTP/1.1\r\nHost: h\r\nContent-Length: 100\r\n\r\n", Limits{MaxBodyBytes: 10}, 413},
+		{"length and chunked", "POST / HTTP/1.1\r\nHost: h\r\nContent-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\n", Limits{}, 400},
+		{"unknown transfer coding", "POST / HTTP/1.1\r\nHost: h\r\nTransfer-Encoding: gzip\r\n\r\n", Limits{}, 400},
+		{"chunked in HTTP/1.0", "POST / HTTP/1.0\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", Limits{}, 400},
+		{"bad chunk size", "POST / HTTP/1.1\r\nHost: h\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\n", Limits{}, 400},
+		{"chunk without CRLF", "POST / HTTP/1.1\r\nHost: h\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabcd\r\n0\r\n\r\n", Limits{}, 400},
+		{"chunked over limit", "POST / HTTP/1.1\r\nHost: h\r\nTransfer-Encoding: chunked\r\n\r\n8\r\n12345678\r\n8\r\n12345678\r\n0\r\n\r\n", Limits{MaxBodyBytes: 10}, 413},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, err := read(test.raw, test.limits)
+			assert.Equal(t, test.status, StatusOf(err), "error: %v", err)
+		})
+	}
+}
+
+func TestReadRequestTruncated(t *testing.T) {
+	assert := assert.New(t)
+
+	_, _, err := read("", Limits{})
+	assert.Equal(io.EOF, err, "A closed connection before any byte is a clean EOF")
+
+	_, _, err = read("GET / HTTP/1.1\r\nHost: h\r\n", Limits{})
+	assert.ErrorIs(err, io.ErrUnexpectedEOF)
+
+	_, _, err = read("POST / HTTP/1.1\r\nHost: h\r\nContent-Length: 10\r\n\r\nabc", Limits{})
+	assert.ErrorIs(err, io.ErrUnexpectedEOF)
+
+	_, _, err = read("POST / HTTP/1.1\r\nHost: h\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nab", Limits{})
+	assert.ErrorIs(err, io.ErrUnexpectedEOF)
+	assert.Equal(0, StatusOf(err))
+}
+
+func TestReadPipelinedRequests(t *testing.T) {
+	assert := assert.New(t)
+	r := bufio.NewReader(strings.NewReader(
+		"POST /a HTTP/1.1\r\nHost: h\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n" +
+			"GET /b HTTP/1.1\r\nHost: h\r\n\r\n"))
+
+	first, err := ReadRequest(r, Limits{})
+	assert.NoError(err)
+	body, err := io.ReadAll(first.Body)
+	assert.NoError(err)
+	assert.Equal("abc", string(body))
+
+	second, err := ReadRequest(r, Limits{})
+	assert.NoError(err)
+	assert.Equal("/b", second.Path)
+}
+
+func TestHeaderHasToken(t *testing.T) {
+	header := Header{}
+	header.Add("Connection", "keep-alive, Upgrade")
+	assert.True(t, header.HasToken("connection", "upgrade"))
+	assert.False(t, header.HasToken("connection", "close"))
+}
+
+func TestParseTime(t *testing.T) {
+	want := time.Date(1994, time.November, 6, 8, 49, 37, 0, time.UTC)
+	for _, value := range []string{"Sun, 06 Nov 1994 08:49:37 GMT", "Sunday, 06-Nov-94 08:49:37 GMT", "Sun Nov  6 08:49:37 1994"} {
+		got, err := ParseTime(value)
+		assert.NoError(t, err, value)
+		assert.True(t, want.Equal(got), value)
+	}
+	_, err := ParseTime("yesterday")
+	assert.Error(t, err)
+}
+
+func TestStatusLine(t *testing.T) {
+	assert.Equal(t, "HTTP/1.1 431 Request Header Fields Too Large", StatusLine(431))
+}
+
+func echoPath(w *Response, req *Request) {
+	body := "path " + req.Path
+	w.Header.Set("Content-Type", "text/plain")
+	w.Header.Set("Content-Length", fmt.Sprint(len(body)))
+	w.Write([]byte(body))
+}
+
+// startServer serves s on a loopback listener and returns its address.
+// ServeConn results are sent on the returned channel.
+func startServer(t testing.TB, s *Server) (string, chan error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	results := make(chan error, 16)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() { results <- s.ServeConn(conn) }()
+		}
+	}()
+	return ln.Addr().String(), results
+}
+
+func dial(t *testing.T, addr string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn, bufio.NewReader(conn)
+}
+
+func readResponse(t *testing.T, r *bufio.Reader, method string) (*http.Response, string) {
+	resp, err := http.ReadResponse(r, &http.Request{Method: method})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(body)
+}
+
+func assertClosed(t *testing.T, r *bufio.Reader) {
+	_, err := r.ReadByte()
+	assert.Equal(t, io.EOF, err, "Expected the server to close the connection")
+}
+
+func TestServeKeepAlive(t *testing.T) {
+	assert := assert.New(t)
+	addr, _ := startServer(t, &Server{Handler: echoPath})
+	conn, r := dial(t, addr)
+
+	for _, path := range []string{"/one", "/two"} {
+		fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: h\r\n\r\n", path)
+		resp, body := readResponse(t, r, "GET")
+		assert.Equal(200, resp.StatusCode)
+		assert.Equal("path "+path, body)
+		assert.False(resp.Close)
+		assert.NotEmpty(resp.Header.Get("Date"))
+	}
+}
+
+func TestServePipelined(t *testing.T) {
+	assert := assert.New(t)
+	addr, _ := startServer(t, &Server{Handler: echoPath})
+	conn, r := dial(t, addr)
+
+	conn.Write([]byte("GET /a HTTP/1.1\r\nHost: h\r\n\r\n" +
+		"POST /b HTTP/1.1\r\nHost: h\r\nContent-Length: 5\r\n\r\nhello" +
+		"HEAD /c HTTP/1.1\r\nHost: h\r\n\r\n" +
+		"GET /d HTTP/1.1\r\nHost: h\r\nConnection: close\r\n\r\n"))
+
+	for _, want := range []struct{ method, body string }{{"GET", "path /a"}, {"POST", "path /b"}, {"HEAD", ""}, {"GET", "path /d"}} {
+		resp, body := readResponse(t, r, want.method)
+		assert.Equal(200, resp.StatusCode)
+		assert.Equal(want.body, body)
+	}
+	assertClosed(t, r)
+}
+
+func TestServeConnectionClose(t *testing.T) {
+	tests := []struct {
+		name    string
+		request string
+		close   bool
+	}{
+		{"HTTP/1.1 default", "GET / HTTP/1.1\r\nHost: h\r\n\r\n", false},
+		{"HTTP/1.1 close", "GET / HTTP/1.1\r\nHost: h\r\nConnection: close\r\n\r\n", true},
+		{"HTTP/1.0 default", "GET / HTTP/1.0\r\n\r\n", true},
+		{"HTTP/1.0 keep-alive", "GET / HTTP/1.0\r\nConnection: Keep-Alive\r\n\r\n", false},
+	}
+	addr, _ := startServer(t, &Server{Handler: echoPath})
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn, r := dial(t, addr)
+			conn.Write([]byte(test.request))
+			resp, _ := readResponse(t, r, "GET")
+			assert.Equal(t, test.close, resp.Close)
+			if test.close {
+				assertClosed(t, r)
+			}
+		})
+	}
+}
+
+func TestServeMaxRequests(t *testing.T) {
+	addr, _ := startServer(t, &Server{Handler: echoPath, MaxRequests: 2})
+	conn, r := dial(t, addr)
+
+	conn.Write([]byte("GET /1 HTTP/1.1\r\nHost: h\r\n\r\nGET /2 HTTP/1.1\r\nHost: h\r\n\r\nGET /3 HTTP/1.1\r\nHost: h\r\n\r\n"))
+	first, _ := readResponse(t, r, "GET")
+	second, _ := readResponse(t, r, "GET")
+	assert.False(t, first.Close)
+	assert.True(t, second.Close)
+	assertClosed(t, r)
+}
+
+func TestServeIdleTimeout(t *testing.T) {
+	addr, results := startServer(t, &Server{Handler: echoPath, IdleTimeout: 50 * time.Millisecond})
+	conn, r := dial(t, addr)
+
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: h\r\n\r\n"))
+	readResponse(t, r, "GET")
+	assertClosed(t, r)
+	assert.NoError(t, <-results, "An idle keep-alive connection closes cleanly")
+}
+
+func TestServeReadTimeout(t *testing.T) {
+	assert := assert.New(t)
+	addr, results := startServer(t, &Server{IdleTimeout: time.Second, ReadTimeout: 50 * time.Millisecond, Handler: func(w *Response, req *Request) {
+		if _, err := io.ReadAll(req.Body); err != nil {
+			w.WriteHeader(StatusRequestTimeout)
+		}
+	}})
+	conn, r := dial(t, addr)
+
+	start := time.Now()
+	conn.Write([]byte("POST / HTTP/1.1\r\nHost: h\r\nContent-Length: 10\r\n\r\nshort"))
+	resp, _ := readResponse(t, r, "POST")
+	assert.Equal(StatusRequestTimeout, resp.StatusCode)
+	assert.Less(time.Since(start), 500*time.Millisecond, "The body is bounded by ReadTimeout, not IdleTimeout")
+	assert.Error(<-results)
+}
+
+func TestServeWriteTimeout(t *testing.T) {
+	addr, results := startServer(t, &Server{WriteTimeout: 50 * time.Millisecond, Handler: func(w *Response, req *Request) {
+		chunk := make([]byte, 64<<10)
+		for {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+	}})
+	conn, _ := dial(t, addr)
+
+	// The client never reads, so the server's writes block once the
+	// socket buffers fill.
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: h\r\n\r\n"))
+	select {
+	case err := <-results:
+		var netErr net.Error
+		assert.True(t, errors.As(err, &netErr) && netErr.Timeout(), "Expected a write timeout, got %v", err)
+	case <-time.After(3 * time.Second):
+		t.Fatal("Expected WriteTimeout to end the connection")
+	}
+}
+
+func TestServeExpectContinue(t *testing.T) {
+	assert := assert.New(t)
+	addr, _ := startServer(t, &Server{Handler: func(w *Response, req *Request) {
+		if req.Path == "/reject" {
+			w.WriteHeader(StatusForbidden)
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+		w.Write(body)
+	}})
+	conn, r := dial(t, addr)
+
+	conn.Write([]byte("POST / HTTP/1.1\r\nHost: h\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n"))
+	interim, _ := readResponse(t, r, "POST")
+	assert.Equal(StatusContinue, interim.StatusCode)
+	conn.Write([]byte("hello"))
+	resp, body := readResponse(t, r, "POST")
+	assert.Equal(200, resp.StatusCode)
+	assert.Equal("hello", body)
+	assert.False(resp.Close)
+
+	// Refused without reading, the body is never asked for, so the
+	// connection can't carry another request.
+	conn.Write([]byte("POST /reject HTTP/1.1\r\nHost: h\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n"))
+	resp, _ = readResponse(t, r, "POST")
+	assert.Equal(StatusForbidden, resp.StatusCode)
+	assert.True(resp.Close)
+	assertClosed(t, r)
+}
+
+func TestServeChunkedResponse(t *testing.T) {
+	assert := assert.New(t)
+	addr, _ := startServer(t, &Server{Handler: func(w *Response, req *Request) {
+		w.Write([]byte("streamed "))
+		w.Flush()
+		w.Write([]byte("in parts"))
+	}})
+
+	conn, r := dial(t, addr)
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: h\r\n\r\n"))
+	resp, body := readResponse(t, r, "GET")
+	assert.Equal([]string{"chunked"}, resp.TransferEncoding)
+	assert.Equal("streamed in parts", body)
+
+	// HTTP/1.0 has no chunked coding, so the end of the body is marked by
+	// closing the connection.
+	conn, r = dial(t, addr)
+	conn.Write([]byte("GET / HTTP/1.0\r\nConnection: keep-alive\r\n\r\n"))
+	resp, body = readResponse(t, r, "GET")
+	assert.Empty(resp.TransferEncoding)
+	assert.True(resp.Close)
+	assert.Equal("streamed in parts", body)
+}
+
+func TestServeBadRequest(t *testing.T) {
+	assert := assert.New(t)
+	addr, results := startServer(t, &Server{Handler: echoPath})
+	conn, r := dial(t, addr)
+
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: h\r\n\r\nNONSENSE\r\n\r\n"))
+	ok, _ := readResponse(t, r, "GET")
+	assert.Equal(200, ok.StatusCode)
+	bad, body := readResponse(t, r, "GET")
+	assert.Equal(400, bad.StatusCode)
+	assert.Contains(body, "malformed request line")
+	assert.True(bad.Close)
+	assertClosed(t, r)
+	assert.Equal(400, StatusOf(<-results))
+}
+
+func TestAllowMethod(t *testing.T) {
+	assert := assert.New(t)
+	handler := func(w *Response, req *Request) {
+		if !AllowMethod(w, req, "GET", "HEAD") {
+			w.WriteHeader(StatusMethodNotAllowed)
+			return
+		}
+		io.WriteString(w, "ok")
+	}
+	addr, _ := startServer(t, &Server{Handler: handler})
+	conn, r := dial(t, addr)
+
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: h\r\n\r\nPOST / HTTP/1.1\r\nHost: h\r\nContent-Length: 0\r\n\r\n"))
+	ok, body := readResponse(t, r, "GET")
+	assert.Equal(200, ok.StatusCode)
+	assert.Equal("ok", body)
+	resp, _ := readResponse(t, r, "POST")
+	assert.Equal(StatusMethodNotAllowed, resp.StatusCode)
+	assert.Equal("GET, HEAD", resp.Header.Get("Allow"))
+}
+
+func benchmarkServe(b *testing.B, keepAlive bool) {
+	addr, _ := startServer(b, &Server{Handler: echoPath, MaxRequests: 1 << 30})
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: !keepAlive}}
+	defer client.CloseIdleConnections()
+	url := "http://" + addr + "/bench"
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		resp, err := client.Get(url)
+		if err != nil {
+			b.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+}
+
+// Compare with: go test -bench Serve ./internal/http1
+func BenchmarkServeKeepAlive(b *testing.B) {
+	benchmarkServe(b, true)
+}
+
+func BenchmarkServeNoKeepAlive(b *testing.B) {
+	benchmarkServe(b, false)
+}
+
+func TestResponseReadFrom(t *testing.T) {
+	assert := assert.New(t)
+	content := strings.Repeat("0123456789", 10000)
+	path := t.TempDir() + "/file"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	addr, _ := startServer(t, &Server{Handler: func(w *Response, req *Request) {
+		file, _ := os.Open(path)
+		defer file.Close()
+		w.Header.Set("Content-Length", fmt.Sprint(len(content)-5))
+		file.Seek(5, io.SeekStart)
+		n, err := io.Copy(w, file)
+		assert.NoError(err)
+		assert.Equal(int64(len(content)-5), n, "The copy stops at Content-Length")
+	}})
+	conn, r := dial(t, addr)
+
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: h\r\n\r\nGET / HTTP/1.1\r\nHost: h\r\n\r\n"))
+	for i := 0; i < 2; i++ {
+		resp, body := readResponse(t, r, "GET")
+		assert.Equal(200, resp.StatusCode)
+		assert.Equal(content[5:], body)
+	}
+}
+
+func TestReadResponse(t *testing.T) {
+	tests := []struct {
+		name   string
+		raw    string
+		method string
+		status int
+		body   string
+		length int64
+		close  bool
+	}{
+		{name: "content length", raw: "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhelloEXTRA", method: "GET", status: 200, body: "hello", length: 5},
+		{name: "chunked", raw: "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n2\r\nde\r\n0\r\nX-Sum: 5\r\n\r\n", method: "GET", status: 200, body: "abcde", length: -1},
+		{name: "until close", raw: "HTTP/1.1 200 OK\r\n\r\nall of it", method: "GET", status: 200, body: "all of it", length: -1, close: true},
+		{name: "connection close", raw: "HTTP/1.1 404 Not Found\r\nConnection: close\r\nContent-Length: 2\r\n\r\nno", method: "GET", status: 404, body: "no", length: 2, close: true},
+		{name: "http/1.0", raw: "HTTP/1.0 200 OK\r\nContent-Length: 2\r\n\r\nok", method: "GET", status: 200, body: "ok", length: 2, close: true},
+		{name: "head", raw: "HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\n", method: "HEAD", status: 200, length: 0},
+		{name: "not modified", raw: "HTTP/1.1 304 Not Modified\r\nContent-Length: 100\r\n\r\n", method: "GET", status: 304, length: 0},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert := assert.New(t)
+			resp, err := ReadResponse(bufio.NewReader(strings.NewReader(tc.raw)), tc.method, Limits{})
+			if !assert.NoError(err) {
+				return
+			}
+			body, err := io.ReadAll(resp.Body)
+			assert.NoError(err)
+			assert.Equal(tc.status, resp.StatusCode)
+			assert.Equal(tc.body, string(body))
+			assert.Equal(tc.length, resp.ContentLength)
+			assert.Equal(tc.close, resp.Close)
+		})
+	}
+
+	resp, _ := ReadResponse(bufio.NewReader(strings.NewReader(tests[1].raw)), "GET", Limits{})
+	io.ReadAll(resp.Body)
+	assert.Equal(t, "5", resp.Trailer.Get("X-Sum"))
+	assert.Equal(t, "OK", resp.Reason)
+
+	for _, raw := range []string{"HTTP/1.1 2000 OK\r\n\r\n", "HTTP/2 200 OK\r\n\r\n", "garbage\r\n\r\n", "HTTP/1.1 200 OK\r\nContent-Length: x\r\n\r\n"} {
+		_, err := ReadResponse(bufio.NewReader(strings.NewReader(raw)), "GET", Limits{})
+		assert.Error(t, err, raw)
+	}
+}
+
+func TestRequestWrite(t *testing.T) {
+	assert := assert.New(t)
+	var sb strings.Builder
+	req := &Request{
+		Method:        "POST",
+		Target:        "/submit?x=1",
+		Host:          "example.com",
+		Header:        Header{"host": {"ignored"}, "content-type": {"text/plain"}, "transfer-encoding": {"gzip"}},
+		ContentLength: 4,
+		Body:          strings.NewReader("bodyEXTRA"),
+	}
+	assert.NoError(req.Write(&sb))
+	assert.Equal("POST /submit?x=1 HTTP/1.1\r\nHost: example.com\r\nContent-Length: 4\r\nContent-Type: text/plain\r\n\r\nbody", sb.String())
+
+	sb.Reset()
+	req = &Request{Method: "PUT", Target: "/", Host: "h", Header: Header{}, ContentLength: -1, Body: strings.NewReader("streamed")}
+	assert.NoError(req.Write(&sb))
+	parsed, body, err := read(sb.String(), Limits{})
+	assert.NoError(err)
+	assert.True(parsed.Chunked)
+	assert.Equal("streamed", body)
+
+	short := &Request{Method: "POST", Target: "/", Header: Header{}, ContentLength: 10, Body: strings.NewReader("short")}
+	assert.ErrorIs(short.Write(io.Discard), io.ErrUnexpectedEOF)
+}
+
+func TestServeRequest(t *testing.T) {
+	assert := assert.New(t)
+	var sb strings.Builder
+	req := &Request{Method: "GET", Target: "/", Path: "/", Proto: "HTTP/2.0", Major: 2, Header: Header{}, Body: strings.NewReader("")}
+	err := ServeRequest(func(w *Response, req *Request) {
+		w.Header.Set("X-Proto", req.Proto)
+		io.WriteString(w, "streamed")
+		w.Flush()
+		io.WriteString(w, " body")
+	}, req, &sb)
+	assert.NoError(err)
+
+	resp, err := ReadResponse(bufio.NewReader(strings.NewReader(sb.String())), "GET", Limits{})
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal(200, resp.StatusCode)
+	assert.Equal("HTTP/2.0", resp.Header.Get("X-Proto"))
+	assert.Empty(resp.Header.Get("Transfer-Encoding"), "The body runs to the end rather than being chunked")
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal("streamed body", string(body))
+}
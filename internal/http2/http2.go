@@ -0,0 +1,1242 @@
+package http2
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/vinh0604/go-network-concepts/internal/hpack"
+	"github.com/vinh0604/go-network-concepts/internal/http1"
+)
+
+// NextProto is the ALPN protocol ID for HTTP/2 over TLS.
+const NextProto = "h2"
+
+// ClientPreface opens every HTTP/2 connection, RFC 9113 section 3.4.
+const ClientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+const (
+	frameHeaderLen = 9
+	// DefaultMaxFrameSize is the initial SETTINGS_MAX_FRAME_SIZE.
+	DefaultMaxFrameSize     = 16384
+	maxAllowedFrameSize     = 1<<24 - 1
+	DefaultInitialWindow    = 65535
+	maxWindow               = 1<<31 - 1
+	DefaultMaxStreams       = 100
+	initialStreamRecvWindow = 1 << 18
+	initialConnRecvWindow   = 1 << 20
+)
+
+type FrameType uint8
+
+const (
+	FrameData         FrameType = 0x0
+	FrameHeaders      FrameType = 0x1
+	FramePriority     FrameType = 0x2
+	FrameRSTStream    FrameType = 0x3
+	FrameSettings     FrameType = 0x4
+	FramePushPromise  FrameType = 0x5
+	FramePing         FrameType = 0x6
+	FrameGoAway       FrameType = 0x7
+	FrameWindowUpdate FrameType = 0x8
+	FrameContinuation FrameType = 0x9
+)
+
+var frameNames = map[FrameType]string{
+	FrameData:         "DATA",
+	FrameHeaders:      "HEADERS",
+	FramePriority:     "PRIORITY",
+	FrameRSTStream:    "RST_STREAM",
+	FrameSettings:     "SETTINGS",
+	FramePushPromise:  "PUSH_PROMISE",
+	FramePing:         "PING",
+	FrameGoAway:       "GOAWAY",
+	FrameWindowUpdate: "WINDOW_UPDATE",
+	FrameContinuation: "CONTINUATION",
+}
+
+func (t FrameType) String() string {
+	if name, ok := frameNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN_FRAME_%d", uint8(t))
+}
+
+const (
+	FlagEndStream  = 0x1
+	FlagAck        = 0x1
+	FlagEndHeaders = 0x4
+	FlagPadded     = 0x8
+	FlagPriority   = 0x20
+)
+
+// ErrCode is the reason carried by RST_STREAM and GOAWAY, RFC 9113
+// section 7.
+type ErrCode uint32
+
+const (
+	ErrCodeNo                 ErrCode = 0x0
+	ErrCodeProtocol           ErrCode = 0x1
+	ErrCodeInternal           ErrCode = 0x2
+	ErrCodeFlowControl        ErrCode = 0x3
+	ErrCodeSettingsTimeout    ErrCode = 0x4
+	ErrCodeStreamClosed       ErrCode = 0x5
+	ErrCodeFrameSize          ErrCode = 0x6
+	ErrCodeRefusedStream      ErrCode = 0x7
+	ErrCodeCancel             ErrCode = 0x8
+	ErrCodeCompression        ErrCode = 0x9
+	ErrCodeConnect            ErrCode = 0xa
+	ErrCodeEnhanceYourCalm    ErrCode = 0xb
+	ErrCodeInadequateSecurity ErrCode = 0xc
+	ErrCodeHTTP11Required     ErrCode = 0xd
+)
+
+var errCodeNames = []string{
+	"NO_ERROR", "PROTOCOL_ERROR", "INTERNAL_ERROR", "FLOW_CONTROL_ERROR",
+	"SETTINGS_TIMEOUT", "STREAM_CLOSED", "FRAME_SIZE_ERROR", "REFUSED_STREAM",
+	"CANCEL", "COMPRESSION_ERROR", "CONNECT_ERROR", "ENHANCE_YOUR_CALM",
+	"INADEQUATE_SECURITY", "HTTP_1_1_REQUIRED",
+}
+
+func (c ErrCode) String() string {
+	if int(c) < len(errCodeNames) {
+		return errCodeNames[c]
+	}
+	return fmt.Sprintf("UNKNOWN_ERROR_%d", uint32(c))
+}
+
+// SettingID names a SETTINGS parameter, RFC 9113 section 6.5.2.
+type SettingID uint16
+
+const (
+	SettingHeaderTableSize      SettingID = 0x1
+	SettingEnablePush           SettingID = 0x2
+	SettingMaxConcurrentStreams SettingID = 0x3
+	SettingInitialWindowSize    SettingID = 0x4
+	SettingMaxFrameSize         SettingID = 0x5
+	SettingMaxHeaderListSize    SettingID = 0x6
+)
+
+type Setting struct {
+	ID    SettingID
+	Value uint32
+}
+
+// ConnError ends the whole connection with a GOAWAY.
+type ConnError struct {
+	Code   ErrCode
+	Reason string
+}
+
+func (e *ConnError) Error() string {
+	return fmt.Sprintf("http2: connection error %s: %s", e.Code, e.Reason)
+}
+
+// StreamError ends one stream with a RST_STREAM.
+type StreamError struct {
+	StreamID uint32
+	Code     ErrCode
+	Reason   string
+}
+
+func (e *StreamError) Error() string {
+	return fmt.Sprintf("http2: stream %d error %s: %s", e.StreamID, e.Code, e.Reason)
+}
+
+func connErrorf(code ErrCode, format string, args ...any) *ConnError {
+	return &ConnError{Code: code, Reason: fmt.Sprintf(format, args...)}
+}
+
+func streamErrorf(id uint32, code ErrCode, format string, args ...any) *StreamError {
+	return &StreamError{StreamID: id, Code: code, Reason: fmt.Sprintf(format, args...)}
+}
+
+// Frame is one frame, RFC 9113 section 4.1.
+type Frame struct {
+	Type     FrameType
+	Flags    uint8
+	StreamID uint32
+	Payload  []byte
+}
+
+func (f Frame) Has(flag uint8) bool {
+	return f.Flags&flag != 0
+}
+
+// ReadFrame reads one frame; a payload over maxSize is a FRAME_SIZE_ERROR.
+func ReadFrame(r io.Reader, maxSize uint32) (Frame, error) {
+	var header [frameHeaderLen]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return Frame{}, err
+	}
+	length := uint32(header[0])<<16 | uint32(header[1])<<8 | uint32(header[2])
+	frame := Frame{
+		Type:     FrameType(header[3]),
+		Flags:    header[4],
+		StreamID: binary.BigEndian.Uint32(header[5:]) & (1<<31 - 1),
+	}
+	if length > maxSize {
+		return Frame{}, connErrorf(ErrCodeFrameSize, "%s frame of %d bytes exceeds %d", frame.Type, length, maxSize)
+	}
+	frame.Payload = make([]byte, length)
+	if _, err := io.ReadFull(r, frame.Payload); err != nil {
+		return Frame{}, unexpected(err)
+	}
+	return frame, nil
+}
+
+// WriteFrame writes f, which must fit the peer's maximum frame size.
+func WriteFrame(w io.Writer, f Frame) error {
+	buf := make([]byte, frameHeaderLen, frameHeaderLen+len(f.Payload))
+	buf[0], buf[1], buf[2] = byte(len(f.Payload)>>16), byte(len(f.Payload)>>8), byte(len(f.Payload))
+	buf[3] = byte(f.Type)
+	buf[4] = f.Flags
+	binary.BigEndian.PutUint32(buf[5:], f.StreamID&(1<<31-1))
+	_, err := w.Write(append(buf, f.Payload...))
+	return err
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// ParseSettings decodes a SETTINGS payload.
+func ParseSettings(payload []byte) ([]Setting, error) {
+	if len(payload)%6 != 0 {
+		return nil, connErrorf(ErrCodeFrameSize, "SETTINGS payload of %d bytes", len(payload))
+	}
+	settings := make([]Setting, 0, len(payload)/6)
+	for i := 0; i < len(payload); i += 6 {
+		settings = append(settings, Setting{
+			ID:    SettingID(binary.BigEndian.Uint16(payload[i:])),
+			Value: binary.BigEndian.Uint32(payload[i+2:]),
+		})
+	}
+	return settings, nil
+}
+
+func AppendSettings(dst []byte, settings ...Setting) []byte {
+	for _, s := range settings {
+		dst = binary.BigEndian.AppendUint16(dst, uint16(s.ID))
+		dst = binary.BigEndian.AppendUint32(dst, s.Value)
+	}
+	return dst
+}
+
+// stripPadding removes the padding of a PADDED frame, RFC 9113 section
+// 6.1.
+func stripPadding(f Frame) ([]byte, error) {
+	if !f.Has(FlagPadded) {
+		return f.Payload, nil
+	}
+	if len(f.Payload) == 0 {
+		return nil, connErrorf(ErrCodeFrameSize, "padded %s frame without a pad length", f.Type)
+	}
+	padding := int(f.Payload[0])
+	if padding >= len(f.Payload) {
+		return nil, connErrorf(ErrCodeProtocol, "padding longer than the %s frame", f.Type)
+	}
+	return f.Payload[1 : len(f.Payload)-padding], nil
+}
+
+// Server serves HTTP/2 connections with an http1.Handler, so one set of
+// handlers serves both protocols.
+type Server struct {
+	Handler http1.Handler
+	// Limits.MaxHeaderBytes is advertised as SETTINGS_MAX_HEADER_LIST_SIZE
+	// and MaxBodyBytes bounds request bodies.
+	Limits http1.Limits
+	// IdleTimeout closes a connection with no open streams.
+	IdleTimeout time.Duration
+	// MaxConcurrentStreams bounds the handlers running at once on a
+	// connection, reset streams included. Streams beyond it are refused.
+	MaxConcurrentStreams uint32
+}
+
+// ServeConn speaks HTTP/2 on conn, which has already negotiated it, until
+// either end closes the connection, then closes it. It returns the error
+// that ended the connection, or nil when it ended cleanly or sat idle.
+func (s *Server) ServeConn(conn net.Conn) error {
+	limits := s.Limits
+	if limits.MaxHeaderBytes <= 0 {
+		limits.MaxHeaderBytes = http1.DefaultMaxHeaderBytes
+	}
+	if limits.MaxBodyBytes <= 0 {
+		limits.MaxBodyBytes = http1.DefaultMaxBodyBytes
+	}
+	sc := &serverConn{
+		server:           s,
+		conn:             conn,
+		limits:           limits,
+		idleTimeout:      s.IdleTimeout,
+		maxStreams:       s.MaxConcurrentStreams,
+		reader:           bufio.NewReader(conn),
+		writer:           bufio.NewWriter(conn),
+		encoder:          hpack.NewEncoder(),
+		decoder:          hpack.NewDecoder(hpack.DefaultTableSize),
+		streams:          map[uint32]*stream{},
+		sendWindow:       DefaultInitialWindow,
+		recvWindow:       initialConnRecvWindow,
+		peerStreamWindow: DefaultInitialWindow,
+		peerMaxFrameSize: DefaultMaxFrameSize,
+	}
+	if sc.idleTimeout <= 0 {
+		sc.idleTimeout = http1.DefaultIdleTimeout
+	}
+	if sc.maxStreams == 0 {
+		sc.maxStreams = DefaultMaxStreams
+	}
+	sc.decoder.MaxHeaderListSize = uint32(limits.MaxHeaderBytes)
+	sc.decoder.MaxStringLength = limits.MaxHeaderBytes
+	sc.cond = sync.NewCond(&sc.mu)
+	return sc.serve()
+}
+
+type serverConn struct {
+	server      *Server
+	conn        net.Conn
+	limits      http1.Limits
+	idleTimeout time.Duration
+	maxStreams  uint32
+	reader      *bufio.Reader
+	// decoder and the fields below it up to wmu belong to the goroutine
+	// reading frames.
+	decoder *hpack.Decoder
+	// headerBlock collects a HEADERS frame's block across CONTINUATION
+	// frames; continuing is the stream it belongs to.
+	headerBlock  []byte
+	continuing   *pendingHeaders
+	lastStreamID uint32
+	// peerGoneAway is set by the client's GOAWAY, after which a reset
+	// connection is just the client leaving.
+	peerGoneAway bool
+	handlers     sync.WaitGroup
+
+	// wmu serialises frames on the connection and guards the encoder,
+	// whose table must see header blocks in the order they are sent.
+	wmu     sync.Mutex
+	writer  *bufio.Writer
+	encoder *hpack.Encoder
+
+	// mu guards the fields below; cond announces window growth, resets
+	// and the connection closing.
+	mu               sync.Mutex
+	cond             *sync.Cond
+	streams          map[uint32]*stream
+	sendWindow       int64
+	recvWindow       int64
+	peerStreamWindow int64
+	peerMaxFrameSize uint32
+	closed           bool
+	// active counts the streams whose handler is still running, reset
+	// or not, and is what maxStreams limits.
+	active int
+}
+
+type pendingHeaders struct {
+	streamID  uint32
+	endStream bool
+	// trailers is set when the block ends a request body rather than
+	// starting a request.
+	trailers bool
+}
+
+type stream struct {
+	id   uint32
+	body *requestBody
+	// The fields below are guarded by serverConn.mu.
+	sendWindow int64
+	recvWindow int64
+	// remoteClosed is set once the client has sent END_STREAM, and
+	// reset once either end has reset the stream.
+	remoteClosed bool
+	reset        bool
+}
+
+func (sc *serverConn) serve() error {
+	defer sc.conn.Close()
+	defer sc.shutdown()
+
+	sc.conn.SetReadDeadline(time.Now().Add(sc.idleTimeout))
+	preface := make([]byte, len(ClientPreface))
+	if _, err := io.ReadFull(sc.reader, preface); err != nil {
+		return fmt.Errorf("reading preface: %w", err)
+	}
+	if string(preface) != ClientPreface {
+		return sc.goAway(connErrorf(ErrCodeProtocol, "invalid connection preface %q", preface))
+	}
+
+	settings := AppendSettings(nil,
+		Setting{SettingMaxConcurrentStreams, sc.maxStreams},
+		Setting{SettingInitialWindowSize, initialStreamRecvWindow},
+		Setting{SettingMaxHeaderListSize, uint32(sc.limits.MaxHeaderBytes)},
+		Setting{SettingEnablePush, 0},
+	)
+	if err := sc.writeFrame(Frame{Type: FrameSettings, Payload: settings}); err != nil {
+		return err
+	}
+	if err := sc.writeWindowUpdate(0, initialConnRecvWindow-DefaultInitialWindow); err != nil {
+		return err
+	}
+
+	for first := true; ; first = false {
+		if sc.openStreams() == 0 && sc.continuing == nil {
+			sc.conn.SetReadDeadline(time.Now().Add(sc.idleTimeout))
+		} else {
+			sc.conn.SetReadDeadline(time.Time{})
+		}
+		frame, err := ReadFrame(sc.reader, DefaultMaxFrameSize)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return sc.goAway(nil)
+			}
+			// A client may drop a connection with nothing in flight at
+			// any time, and often resets it over frames it never read.
+			if err == io.EOF || sc.peerGoneAway || errors.Is(err, syscall.ECONNRESET) && sc.openStreams() == 0 {
+				return nil
+			}
+			return sc.goAway(err)
+		}
+		if first && (frame.Type != FrameSettings || frame.Has(FlagAck)) {
+			return sc.goAway(connErrorf(ErrCodeProtocol, "first frame is %s, not SETTINGS", frame.Type))
+		}
+
+		err = sc.handleFrame(frame)
+		var streamErr *StreamError
+		if errors.As(err, &streamErr) {
+			sc.resetStream(streamErr.StreamID, streamErr.Code)
+			continue
+		}
+		if err != nil {
+			return sc.goAway(err)
+		}
+	}
+}
+
+// goAway sends a GOAWAY for err, nil being a graceful close, and returns
+// err.
+func (sc *serverConn) goAway(err error) error {
+	code := ErrCodeNo
+	debug := ""
+	var connErr *ConnError
+	if errors.As(err, &connErr) {
+		code, debug = connErr.Code, connErr.Reason
+	} else if err != nil {
+		code = ErrCodeInternal
+	}
+	payload := binary.BigEndian.AppendUint32(nil, sc.lastStreamID)
+	payload = binary.BigEndian.AppendUint32(payload, uint32(code))
+	payload = append(payload, debug...)
+	sc.writeFrame(Frame{Type: FrameGoAway, Payload: payload})
+	return err
+}
+
+// shutdown fails every open stream and waits for their handlers.
+func (sc *serverConn) shutdown() {
+	sc.mu.Lock()
+	sc.closed = true
+	for _, st := range sc.streams {
+		st.reset = true
+		st.body.closeWithError(errConnClosed)
+	}
+	sc.cond.Broadcast()
+	sc.mu.Unlock()
+	sc.conn.Close()
+	sc.handlers.Wait()
+}
+
+var (
+	errConnClosed   = errors.New("http2: connection closed")
+	errStreamClosed = errors.New("http2: stream reset")
+)
+
+func (sc *serverConn) openStreams() int {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return len(sc.streams)
+}
+
+func (sc *serverConn) handleFrame(f Frame) error {
+	if sc.continuing != nil && (f.Type != FrameContinuation || f.StreamID != sc.continuing.streamID) {
+		return connErrorf(ErrCodeProtocol, "%s frame while a header block is incomplete", f.Type)
+	}
+	switch f.Type {
+	case FrameData:
+		return sc.handleData(f)
+	case FrameHeaders:
+		return sc.handleHeaders(f)
+	case FrameContinuation:
+		if sc.continuing == nil {
+			return connErrorf(ErrCodeProtocol, "CONTINUATION without HEADERS")
+		}
+		return sc.addHeaderFragment(f.Payload, f.Has(FlagEndHeaders))
+	case FramePriority:
+		if f.StreamID == 0 {
+			return connErrorf(ErrCodeProtocol, "PRIORITY on stream 0")
+		}
+		if len(f.Payload) != 5 {
+			return streamErrorf(f.StreamID, ErrCodeFrameSize, "PRIORITY of %d bytes", len(f.Payload))
+		}
+		// Priorities are deprecated, RFC 9113 section 5.3.2.
+		return nil
+	case FrameRSTStream:
+		return sc.handleRSTStream(f)
+	case FrameSettings:
+		return sc.handleSettings(f)
+	case FramePushPromise:
+		return connErrorf(ErrCodeProtocol, "PUSH_PROMISE from a client")
+	case FramePing:
+		if f.StreamID != 0 {
+			return connErrorf(ErrCodeProtocol, "PING on stream %d", f.StreamID)
+		}
+		if len(f.Payload) != 8 {
+			return connErrorf(ErrCodeFrameSize, "PING of %d bytes", len(f.Payload))
+		}
+		if f.Has(FlagAck) {
+			return nil
+		}
+		return sc.writeFrame(Frame{Type: FramePing, Flags: FlagAck, Payload: f.Payload})
+	case FrameGoAway:
+		if f.StreamID != 0 {
+			return connErrorf(ErrCodeProtocol, "GOAWAY on stream %d", f.StreamID)
+		}
+		sc.peerGoneAway = true
+		return nil
+	case FrameWindowUpdate:
+		return sc.handleWindowUpdate(f)
+	}
+	// Unknown frame types are ignored, RFC 9113 section 4.1.
+	return nil
+}
+
+func (sc *serverConn) handleSettings(f Frame) error {
+	if f.StreamID != 0 {
+		return connErrorf(ErrCodeProtocol, "SETTINGS on stream %d", f.StreamID)
+	}
+	if f.Has(FlagAck) {
+		if len(f.Payload) != 0 {
+			return connErrorf(ErrCodeFrameSize, "SETTINGS acknowledgement with a payload")
+		}
+		return nil
+	}
+	settings, err := ParseSettings(f.Payload)
+	if err != nil {
+		return err
+	}
+
+	for _, setting := range settings {
+		switch setting.ID {
+		case SettingHeaderTableSize:
+			sc.wmu.Lock()
+			sc.encoder.SetMaxTableSize(setting.Value)
+			sc.wmu.Unlock()
+		case SettingEnablePush:
+			if setting.Value > 1 {
+				return connErrorf(ErrCodeProtocol, "SETTINGS_ENABLE_PUSH of %d", setting.Value)
+			}
+		case SettingInitialWindowSize:
+			if setting.Value > maxWindow {
+				return connErrorf(ErrCodeFlowControl, "SETTINGS_INITIAL_WINDOW_SIZE of %d", setting.Value)
+			}
+			// The change applies to the windows of open streams too,
+			// and may leave them negative, section 6.9.2.
+			sc.mu.Lock()
+			delta := int64(setting.Value) - sc.peerStreamWindow
+			sc.peerStreamWindow = int64(setting.Value)
+			for _, st := range sc.streams {
+				st.sendWindow += delta
+				if st.sendWindow > maxWindow {
+					sc.mu.Unlock()
+					return connErrorf(ErrCodeFlowControl, "stream %d window overflow", st.id)
+				}
+			}
+			sc.cond.Broadcast()
+			sc.mu.Unlock()
+		case SettingMaxFrameSize:
+			if setting.Value < DefaultMaxFrameSize || setting.Value > maxAllowedFrameSize {
+				return connErrorf(ErrCodeProtocol, "SETTINGS_MAX_FRAME_SIZE of %d", setting.Value)
+			}
+			sc.mu.Lock()
+			sc.peerMaxFrameSize = setting.Value
+			sc.mu.Unlock()
+		}
+	}
+	return sc.writeFrame(Frame{Type: FrameSettings, Flags: FlagAck})
+}
+
+func (sc *serverConn) handleWindowUpdate(f Frame) error {
+	if len(f.Payload) != 4 {
+		return connErrorf(ErrCodeFrameSize, "WINDOW_UPDATE of %d bytes", len(f.Payload))
+	}
+	increment := int64(binary.BigEndian.Uint32(f.Payload) & (1<<31 - 1))
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if f.StreamID == 0 {
+		if increment == 0 {
+			return connErrorf(ErrCodeProtocol, "WINDOW_UPDATE of 0")
+		}
+		sc.sendWindow += increment
+		if sc.sendWindow > maxWindow {
+			return connErrorf(ErrCodeFlowControl, "connection window overflow")
+		}
+		sc.cond.Broadcast()
+		return nil
+	}
+
+	st := sc.streams[f.StreamID]
+	if st == nil {
+		if f.StreamID > sc.lastStreamID {
+			return connErrorf(ErrCodeProtocol, "WINDOW_UPDATE on idle stream %d", f.StreamID)
+		}
+		// The stream may have just closed at our end.
+		return nil
+	}
+	if increment == 0 {
+		return streamErrorf(f.StreamID, ErrCodeProtocol, "WINDOW_UPDATE of 0")
+	}
+	st.sendWindow += increment
+	if st.sendWindow > maxWindow {
+		return streamErrorf(f.StreamID, ErrCodeFlowControl, "window overflow")
+	}
+	sc.cond.Broadcast()
+	return nil
+}
+
+func (sc *serverConn) handleRSTStream(f Frame) error {
+	if f.StreamID == 0 {
+		return connErrorf(ErrCodeProtocol, "RST_STREAM on stream 0")
+	}
+	if len(f.Payload) != 4 {
+		return connErrorf(ErrCodeFrameSize, "RST_STREAM of %d bytes", len(f.Payload))
+	}
+	if f.StreamID > sc.lastStreamID {
+		return connErrorf(ErrCodeProtocol, "RST_STREAM on idle stream %d", f.StreamID)
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if st := sc.streams[f.StreamID]; st != nil {
+		st.reset = true
+		st.body.closeWithError(errStreamClosed)
+		delete(sc.streams, st.id)
+		sc.cond.Broadcast()
+	}
+	return nil
+}
+
+func (sc *serverConn) handleData(f Frame) error {
+	if f.StreamID == 0 {
+		return connErrorf(ErrCodeProtocol, "DATA on stream 0")
+	}
+	if f.StreamID > sc.lastStreamID {
+		return connErrorf(ErrCodeProtocol, "DATA on idle stream %d", f.StreamID)
+	}
+	// The whole frame, padding included, counts against flow control.
+	length := int64(len(f.Payload))
+
+	sc.mu.Lock()
+	sc.recvWindow -= length
+	if sc.recvWindow < 0 {
+		sc.mu.Unlock()
+		return connErrorf(ErrCodeFlowControl, "DATA beyond the connection window")
+	}
+	st := sc.streams[f.StreamID]
+	if st == nil || st.remoteClosed {
+		sc.mu.Unlock()
+		// Nobody will read it, so the connection gets its credit back.
+		if err := sc.creditConn(length); err != nil {
+			return err
+		}
+		return streamErrorf(f.StreamID, ErrCodeStreamClosed, "DATA after the stream ended")
+	}
+	st.recvWindow -= length
+	if st.recvWindow < 0 {
+		sc.mu.Unlock()
+		if err := sc.creditConn(length); err != nil {
+			return err
+		}
+		return streamErrorf(f.StreamID, ErrCodeFlowControl, "DATA beyond the stream window")
+	}
+	if f.Has(FlagEndStream) {
+		st.remoteClosed = true
+	}
+	sc.mu.Unlock()
+
+	data, err := stripPadding(f)
+	if err != nil {
+		return err
+	}
+	if padding := length - int64(len(data)); padding > 0 {
+		if err := sc.credit(st, padding); err != nil {
+			return err
+		}
+	}
+	buffered, err := st.body.write(data)
+	if err != nil {
+		return streamErrorf(f.StreamID, ErrCodeProtocol, "%v", err)
+	}
+	if !buffered && len(data) > 0 {
+		if err := sc.creditConn(int64(len(data))); err != nil {
+			return err
+		}
+	}
+	if f.Has(FlagEndStream) {
+		if err := st.body.end(); err != nil {
+			return streamErrorf(f.StreamID, ErrCodeProtocol, "%v", err)
+		}
+	}
+	return nil
+}
+
+func (sc *serverConn) handleHeaders(f Frame) error {
+	if f.StreamID == 0 || f.StreamID%2 == 0 {
+		return connErrorf(ErrCodeProtocol, "HEADERS on stream %d", f.StreamID)
+	}
+	payload, err := stripPadding(f)
+	if err != nil {
+		return err
+	}
+	if f.Has(FlagPriority) {
+		if len(payload) < 5 {
+			return connErrorf(ErrCodeFrameSize, "HEADERS too short for its priority")
+		}
+		payload = payload[5:]
+	}
+
+	pending := &pendingHeaders{streamID: f.StreamID, endStream: f.Has(FlagEndStream)}
+	if f.StreamID <= sc.lastStreamID {
+		sc.mu.Lock()
+		st := sc.streams[f.StreamID]
+		open := st != nil && !st.remoteClosed
+		sc.mu.Unlock()
+		// A second HEADERS on an open stream carries trailers and must
+		// end it.
+		if !open || !pending.endStream {
+			return connErrorf(ErrCodeProtocol, "HEADERS on stream %d, which is not new", f.StreamID)
+		}
+		pending.trailers = true
+	} else {
+		sc.lastStreamID = f.StreamID
+	}
+
+	sc.continuing = pending
+	sc.headerBlock = sc.headerBlock[:0]
+	return sc.addHeaderFragment(payload, f.Has(FlagEndHeaders))
+}
+
+// addHeaderFragment handles a header block once its last fragment is in.
+func (sc *serverConn) addHeaderFragment(fragment []byte, endHeaders bool) error {
+	sc.headerBlock = append(sc.headerBlock, fragment...)
+	// A compressed block needs no more room than the fields themselves,
+	// give or take; anything much bigger is abuse.
+	if len(sc.headerBlock) > 4*sc.limits.MaxHeaderBytes {
+		return connErrorf(ErrCodeEnhanceYourCalm, "header block larger than %d bytes", 4*sc.limits.MaxHeaderBytes)
+	}
+	if !endHeaders {
+		return nil
+	}
+	pending := sc.continuing
+	sc.continuing = nil
+
+	// The block is decoded even when the stream will be refused, to
+	// keep the decoder's table in step with the client's encoder.
+	fields, err := sc.decoder.Decode(sc.headerBlock)
+	tooLarge := errors.Is(err, hpack.ErrHeaderListTooLarge)
+	if err != nil && !tooLarge {
+		return connErrorf(ErrCodeCompression, "%v", err)
+	}
+
+	if pending.trailers {
+		sc.mu.Lock()
+		st := sc.streams[pending.streamID]
+		if st != nil {
+			st.remoteClosed = true
+		}
+		sc.mu.Unlock()
+		if st != nil {
+			if err := st.body.end(); err != nil {
+				return streamErrorf(pending.streamID, ErrCodeProtocol, "%v", err)
+			}
+		}
+		return nil
+	}
+
+	sc.mu.Lock()
+	refused := uint32(sc.active) >= sc.maxStreams
+	sc.mu.Unlock()
+	if refused {
+		return streamErrorf(pending.streamID, ErrCodeRefusedStream, "more than %d concurrent streams", sc.maxStreams)
+	}
+
+	var req *http1.Request
+	if !tooLarge {
+		req, err = newRequest(fields, pending.endStream)
+		if err != nil {
+			return streamErrorf(pending.streamID, ErrCodeProtocol, "%v", err)
+		}
+	}
+
+	st := &stream{
+		id:           pending.streamID,
+		recvWindow:   initialStreamRecvWindow,
+		remoteClosed: pending.endStream,
+	}
+	st.body = newRequestBody(sc, st, sc.limits.MaxBodyBytes)
+	if pending.endStream {
+		st.body.end()
+	}
+	sc.mu.Lock()
+	st.sendWindow = sc.peerStreamWindow
+	sc.streams[st.id] = st
+	sc.active++
+	sc.mu.Unlock()
+
+	handler := sc.server.Handler
+	switch {
+	case tooLarge:
+		handler = errorHandler(http1.StatusRequestHeaderFieldsTooLarge, "request header fields too large")
+	case req.ContentLength > sc.limits.MaxBodyBytes:
+		handler = errorHandler(http1.StatusContentTooLarge, fmt.Sprintf("body of %d bytes exceeds %d", req.ContentLength, sc.limits.MaxBodyBytes))
+	}
+	if req == nil {
+		req = &http1.Request{Method: "GET", Header: http1.Header{}}
+	}
+	if req.ContentLength >= 0 {
+		st.body.declared = req.ContentLength
+	}
+	req.Body = st.body
+	req.RemoteAddr = sc.conn.RemoteAddr().String()
+	req.TLS = isTLS(sc.conn)
+
+	sc.handlers.Add(1)
+	go sc.runHandler(st, req, handler)
+	return nil
+}
+
+func errorHandler(status int, message string) http1.Handler {
+	return func(w *http1.Response, req *http1.Request) {
+		w.Header.Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header.Set("Content-Length", strconv.Itoa(len(message)))
+		w.WriteHeader(status)
+		io.WriteString(w, message)
+	}
+}
+
+// connectionSpecific are the HTTP/1.1 fields HTTP/2 forbids, RFC 9113
+// section 8.2.2; "te" is allowed only as "trailers".
+var connectionSpecific = []string{"connection", "keep-alive", "proxy-connection", "transfer-encoding", "upgrade"}
+
+// newRequest builds the request from a stream's header fields, checking
+// the rules of RFC 9113 sections 8.2 and 8.3.1.
+func newRequest(fields []hpack.HeaderField, endStream bool) (*http1.Request, error) {
+	req := &http1.Request{Proto: "HTTP/2.0", Major: 2, Header: http1.Header{}}
+	pseudo := map[string]string{}
+	regular := false
+	var cookies []string
+	for _, field := range fields {
+		if strings.ToLower(field.Name) != field.Name {
+			return nil, fmt.Errorf("upper-case field name %q", field.Name)
+		}
+		// Section 8.2.1: these would split or end the field when the
+		// request is passed on as HTTP/1.1.
+		if strings.ContainsAny(field.Value, "\r\n\x00") {
+			return nil, fmt.Errorf("CR, LF or NUL in the value of %s", field.Name)
+		}
+		if strings.HasPrefix(field.Name, ":") {
+			if regular {
+				return nil, fmt.Errorf("pseudo-header %s after regular fields", field.Name)
+			}
+			switch field.Name {
+			case ":method", ":scheme", ":authority", ":path":
+			default:
+				return nil, fmt.Errorf("unknown pseudo-header %s", field.Name)
+			}
+			if _, dup := pseudo[field.Name]; dup {
+				return nil, fmt.Errorf("repeated pseudo-header %s", field.Name)
+			}
+			pseudo[field.Name] = field.Value
+			continue
+		}
+		regular = true
+		if !http1.IsToken(field.Name) {
+			return nil, fmt.Errorf("invalid field name %q", field.Name)
+		}
+		if slices.Contains(connectionSpecific, field.Name) || field.Name == "te" && field.Value != "trailers" {
+			return nil, fmt.Errorf("connection-specific field %s", field.Name)
+		}
+		// Cookies may be split into several fields for better
+		// compression and are rejoined for HTTP/1.1, section 8.2.3.
+		if field.Name == "cookie" {
+			cookies = append(cookies, field.Value)
+			continue
+		}
+		req.Header.Add(field.Name, field.Value)
+	}
+	if len(cookies) > 0 {
+		req.Header.Set("Cookie", strings.Join(cookies, "; "))
+	}
+
+	req.Method = pseudo[":method"]
+	req.Target = pseudo[":path"]
+	if req.Method == "" || req.Target == "" || pseudo[":scheme"] == "" {
+		return nil, errors.New("missing :method, :scheme or :path")
+	}
+	if !http1.IsToken(req.Method) {
+		return nil, fmt.Errorf("invalid :method %q", req.Method)
+	}
+	if req.Method == "CONNECT" {
+		return nil, errors.New("CONNECT is not supported")
+	}
+	if req.Target == "*" {
+		if req.Method != "OPTIONS" {
+			return nil, fmt.Errorf("asterisk target with %s", req.Method)
+		}
+		req.Path = "*"
+	} else {
+		u, err := url.ParseRequestURI(req.Target)
+		if err != nil {
+			return nil, fmt.Errorf("invalid :path %q", req.Target)
+		}
+		req.Path = u.Path
+		req.RawQuery = u.RawQuery
+	}
+
+	req.Host = pseudo[":authority"]
+	if req.Host == "" {
+		req.Host = req.Header.Get("Host")
+	}
+
+	req.ContentLength = -1
+	if endStream {
+		req.ContentLength = 0
+	}
+	if lengths := req.Header.Values("Content-Length"); len(lengths) > 0 {
+		n, err := strconv.ParseInt(lengths[0], 10, 64)
+		if err != nil || n < 0 || len(lengths) > 1 || endStream && n != 0 {
+			return nil, fmt.Errorf("invalid content-length %q", strings.Join(lengths, ", "))
+		}
+		req.ContentLength = n
+	}
+	return req, nil
+}
+
+func isTLS(conn net.Conn) bool {
+	_, ok := conn.(*tls.Conn)
+	return ok
+}
+
+// runHandler serves one stream. The handler's HTTP/1.1 response is read
+// back from a pipe and sent as frames.
+func (sc *serverConn) runHandler(st *stream, req *http1.Request, handler http1.Handler) {
+	defer sc.handlers.Done()
+	defer func() {
+		if n := st.body.discard(); n > 0 {
+			sc.creditConn(n)
+		}
+		sc.mu.Lock()
+		sc.active--
+		sc.mu.Unlock()
+	}()
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(http1.ServeRequest(handler, req, pw))
+	}()
+	defer pr.Close()
+
+	err := sc.writeResponse(st, req, bufio.NewReader(pr))
+	if err != nil {
+		sc.resetStream(st.id, ErrCodeInternal)
+		pr.CloseWithError(err)
+		return
+	}
+
+	sc.mu.Lock()
+	delete(sc.streams, st.id)
+	remoteOpen := !st.remoteClosed && !st.reset
+	st.reset = true
+	sc.mu.Unlock()
+	st.body.closeWithError(errStreamClosed)
+	if remoteOpen {
+		// The response is complete without the rest of the request
+		// body; NO_ERROR asks the client to stop sending it, section
+		// 8.1.
+		sc.writeRSTStream(st.id, ErrCodeNo)
+	}
+}
+
+func (sc *serverConn) writeResponse(st *stream, req *http1.Request, r *bufio.Reader) error {
+	var resp *http1.ClientResponse
+	for resp == nil || resp.StatusCode < 200 {
+		var err error
+		resp, err = http1.ReadResponse(r, req.Method, http1.Limits{})
+		if err != nil {
+			return err
+		}
+	}
+
+	fields := []hpack.HeaderField{{Name: ":status", Value: strconv.Itoa(resp.StatusCode)}}
+	names := make([]string, 0, len(resp.Header))
+	for name := range resp.Header {
+		if !slices.Contains(connectionSpecific, name) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		for _, value := range resp.Header[name] {
+			fields = append(fields, hpack.HeaderField{Name: name, Value: value, Sensitive: name == "set-cookie"})
+		}
+	}
+	bodyless := req.Method == "HEAD" || resp.ContentLength == 0
+	if err := sc.writeHeaders(st, fields, bodyless); err != nil || bodyless {
+		return err
+	}
+
+	buf := make([]byte, DefaultMaxFrameSize)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if werr := sc.writeData(st, buf[:n], false); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return sc.writeData(st, nil, true)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// writeHeaders encodes and sends a header block, split into HEADERS and
+// CONTINUATION frames with nothing in between, section 4.3.
+func (sc *serverConn) writeHeaders(st *stream, fields []hpack.HeaderField, endStream bool) error {
+	sc.mu.Lock()
+	maxFrame := int(sc.peerMaxFrameSize)
+	reset := st.reset || sc.closed
+	sc.mu.Unlock()
+	if reset {
+		return errStreamClosed
+	}
+
+	sc.wmu.Lock()
+	defer sc.wmu.Unlock()
+	block := sc.encoder.Encode(fields)
+	frameType := FrameHeaders
+	for first := true; first || len(block) > 0; first = false {
+		fragment := block[:min(len(block), maxFrame)]
+		block = block[len(fragment):]
+		var flags uint8
+		if first && endStream {
+			flags |= FlagEndStream
+		}
+		if len(block) == 0 {
+			flags |= FlagEndHeaders
+		}
+		if err := WriteFrame(sc.writer, Frame{Type: frameType, Flags: flags, StreamID: st.id, Payload: fragment}); err != nil {
+			return err
+		}
+		frameType = FrameContinuation
+	}
+	return sc.writer.Flush()
+}
+
+// writeData sends data within the connection's and the stream's send
+// windows, waiting for WINDOW_UPDATE frames when they run out.
+func (sc *serverConn) writeData(st *stream, data []byte, endStream bool) error {
+	for {
+		sc.mu.Lock()
+		for !sc.closed && !st.reset && len(data) > 0 && (sc.sendWindow <= 0 || st.sendWindow <= 0) {
+			sc.cond.Wait()
+		}
+		if sc.closed || st.reset {
+			sc.mu.Unlock()
+			return errStreamClosed
+		}
+		n := int64(min(len(data), int(sc.peerMaxFrameSize)))
+		n = min(n, sc.sendWindow, st.sendWindow)
+		sc.sendWindow -= n
+		st.sendWindow -= n
+		sc.mu.Unlock()
+
+		chunk := data[:n]
+		data = data[n:]
+		var flags uint8
+		if endStream && len(data) == 0 {
+			flags = FlagEndStream
+		}
+		if err := sc.writeFrame(Frame{Type: FrameData, Flags: flags, StreamID: st.id, Payload: chunk}); err != nil {
+			return err
+		}
+		if len(data) == 0 {
+			return nil
+		}
+	}
+}
+
+func (sc *serverConn) writeFrame(f Frame) error {
+	sc.wmu.Lock()
+	defer sc.wmu.Unlock()
+	if err := WriteFrame(sc.writer, f); err != nil {
+		return err
+	}
+	return sc.writer.Flush()
+}
+
+func (sc *serverConn) writeWindowUpdate(streamID uint32, increment int64) error {
+	return sc.writeFrame(Frame{Type: FrameWindowUpdate, StreamID: streamID, Payload: binary.BigEndian.AppendUint32(nil, uint32(increment))})
+}
+
+func (sc *serverConn) writeRSTStream(streamID uint32, code ErrCode) error {
+	return sc.writeFrame(Frame{Type: FrameRSTStream, StreamID: streamID, Payload: binary.BigEndian.AppendUint32(nil, uint32(code))})
+}
+
+// resetStream ends a stream at our end.
+func (sc *serverConn) resetStream(id uint32, code ErrCode) {
+	sc.mu.Lock()
+	if st := sc.streams[id]; st != nil {
+		st.reset = true
+		st.body.closeWithError(errStreamClosed)
+		delete(sc.streams, id)
+		sc.cond.Broadcast()
+	}
+	sc.mu.Unlock()
+	sc.writeRSTStream(id, code)
+}
+
+// credit returns n bytes of receive window for st and the connection once
+// the handler has read them.
+func (sc *serverConn) credit(st *stream, n int64) error {
+	sc.mu.Lock()
+	open := !st.remoteClosed && !st.reset
+	if open {
+		st.recvWindow += n
+	}
+	sc.mu.Unlock()
+	if open {
+		if err := sc.writeWindowUpdate(st.id, n); err != nil {
+			return err
+		}
+	}
+	return sc.creditConn(n)
+}
+
+func (sc *serverConn) creditConn(n int64) error {
+	sc.mu.Lock()
+	sc.recvWindow += n
+	sc.mu.Unlock()
+	return sc.writeWindowUpdate(0, n)
+}
+
+// requestBody buffers the DATA frames of one stream for its handler, at
+// most the stream's receive window.
+type requestBody struct {
+	sc     *serverConn
+	stream *stream
+	limit  int64
+	// declared is the request's content-length, or -1.
+	declared int64
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	buf      bytes.Buffer
+	received int64
+	err      error
+}
+
+func newRequestBody(sc *serverConn, st *stream, limit int64) *requestBody {
+	b := &requestBody{sc: sc, stream: st, limit: limit, declared: -1}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// write adds data to the body, reporting whether it was kept.
+func (b *requestBody) write(data []byte) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.received += int64(len(data))
+	if b.declared >= 0 && b.received > b.declared {
+		return false, fmt.Errorf("body longer than its content-length of %d", b.declared)
+	}
+	if b.err != nil {
+		return false, nil
+	}
+	b.buf.Write(data)
+	b.cond.Broadcast()
+	return true, nil
+}
+
+// end marks the body complete after END_STREAM.
+func (b *requestBody) end() error {
+	b.mu.Lock()
+	short := b.declared >= 0 && b.received != b.declared
+	b.mu.Unlock()
+	if short {
+		b.closeWithError(io.ErrUnexpectedEOF)
+		return fmt.Errorf("body of %d bytes, content-length %d", b.received, b.declared)
+	}
+	b.closeWithError(io.EOF)
+	return nil
+}
+
+func (b *requestBody) closeWithError(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err == nil {
+		b.err = err
+	}
+	b.cond.Broadcast()
+}
+
+// discard closes the body and returns the number of bytes it dropped.
+func (b *requestBody) discard() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err == nil {
+		b.err = errStreamClosed
+	}
+	n := int64(b.buf.Len())
+	b.buf.Reset()
+	b.cond.Broadcast()
+	return n
+}
+
+func (b *requestBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	for b.buf.Len() == 0 && b.err == nil {
+		b.cond.Wait()
+	}
+	if b.buf.Len() == 0 {
+		err := b.err
+		b.mu.Unlock()
+		return 0, err
+	}
+	n, _ := b.buf.Read(p)
+	total := b.received - int64(b.buf.Len())
+	b.mu.Unlock()
+
+	if total > b.limit {
+		err := &http1.Error{Status: http1.StatusContentTooLarge, Reason: fmt.Sprintf("body exceeds %d bytes", b.limit)}
+		b.closeWithError(err)
+		return 0, err
+	}
+	b.sc.credit(b.stream, int64(n))
+	return n, nil
+}
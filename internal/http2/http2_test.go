@@ -0,0 +1,552 @@
+package http2
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vinh0604/go-network-concepts/internal/hpack"
+	"github.com/vinh0604/go-network-concepts/internal/http1"
+)
+
+func echo(w *http1.Response, req *http1.Request) {
+	body, _ := io.ReadAll(req.Body)
+	w.Header.Set("Content-Type", "text/plain")
+	w.Header.Set("Connection", "keep-alive")
+	w.Header.Add("Set-Cookie", "a=1")
+	fmt.Fprintf(w, "%s %s %s host=%s tls=%t cookie=%s body=%s",
+		req.Proto, req.Method, req.Target, req.Host, req.TLS, req.Header.Get("Cookie"), body)
+}
+
+// listenPlain serves HTTP/2 without TLS ("prior knowledge"), which is
+// enough to drive the server frame by frame.
+func listenPlain(t *testing.T, server *Server) string {
+	sock, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sock.Close() })
+	go func() {
+		for {
+			conn, err := sock.Accept()
+			if err != nil {
+				return
+			}
+			go server.ServeConn(conn)
+		}
+	}()
+	return sock.Addr().String()
+}
+
+// listenTLS serves HTTP/2 or HTTP/1.1 over TLS as ALPN decides, the way
+// webserver does.
+func listenTLS(t *testing.T, handler http1.Handler) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		NextProtos:   []string{NextProto, "http/1.1"},
+	}
+	sock, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sock.Close() })
+	h2 := &Server{Handler: handler}
+	h1 := &http1.Server{Handler: handler}
+	go func() {
+		for {
+			conn, err := sock.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				tlsConn := conn.(*tls.Conn)
+				if err := tlsConn.Handshake(); err != nil {
+					conn.Close()
+					return
+				}
+				if tlsConn.ConnectionState().NegotiatedProtocol == NextProto {
+					h2.ServeConn(conn)
+				} else {
+					h1.ServeConn(conn)
+				}
+			}()
+		}
+	}()
+	return sock.Addr().String()
+}
+
+func client(http2 bool) *http.Client {
+	transport := &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: http2,
+	}
+	if !http2 {
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return &http.Client{Transport: transport}
+}
+
+func do(t *testing.T, c *http.Client, method string, url string, body string) (*http.Response, string) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Cookie", "x=1")
+	req.Header.Add("Cookie", "y=2")
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(data)
+}
+
+func TestServeTLS(t *testing.T) {
+	assert := assert.New(t)
+	addr := listenTLS(t, echo)
+	h2 := client(true)
+
+	resp, body := do(t, h2, "GET", "https://"+addr+"/a?b=1", "")
+	assert.Equal("HTTP/2.0", resp.Proto)
+	assert.Equal(200, resp.StatusCode)
+	assert.Equal("HTTP/2.0 GET /a?b=1 host="+addr+" tls=true cookie=x=1; y=2 body=", body, "Split cookies are joined")
+	assert.Equal("text/plain", resp.Header.Get("Content-Type"))
+	assert.Equal("a=1", resp.Header.Get("Set-Cookie"))
+	assert.Empty(resp.Header.Get("Connection"), "Connection-specific fields are dropped")
+
+	resp, body = do(t, h2, "POST", "https://"+addr+"/upload", strings.Repeat("x", 100000))
+	assert.Equal("HTTP/2.0", resp.Proto)
+	assert.True(strings.HasSuffix(body, "body="+strings.Repeat("x", 100000)), "A body larger than the initial windows")
+
+	resp, body = do(t, h2, "HEAD", "https://"+addr+"/", "")
+	assert.Equal(200, resp.StatusCode)
+	assert.Empty(body)
+
+	resp, body = do(t, client(false), "GET", "https://"+addr+"/old", "")
+	assert.Equal("HTTP/1.1", resp.Proto, "Clients without h2 fall back to HTTP/1.1")
+	assert.True(strings.HasPrefix(body, "HTTP/1.1 GET /old"), body)
+}
+
+func TestServeConcurrentStreams(t *testing.T) {
+	release := make(chan struct{})
+	var started sync.WaitGroup
+	started.Add(5)
+	addr := listenTLS(t, func(w *http1.Response, req *http1.Request) {
+		started.Done()
+		<-release
+		io.WriteString(w, req.Path)
+	})
+	h2 := client(true)
+
+	var wg sync.WaitGroup
+	bodies := make([]string, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, bodies[i] = do(t, h2, "GET", fmt.Sprintf("https://%s/%d", addr, i), "")
+		}(i)
+	}
+	// Every handler runs at once on what is a single connection.
+	started.Wait()
+	close(release)
+	wg.Wait()
+	for i, body := range bodies {
+		assert.Equal(t, fmt.Sprintf("/%d", i), body)
+	}
+}
+
+// h2conn is a client speaking raw frames.
+type h2conn struct {
+	t       *testing.T
+	conn    net.Conn
+	reader  *bufio.Reader
+	encoder *hpack.Encoder
+	decoder *hpack.Decoder
+}
+
+func dial(t *testing.T, addr string, settings ...Setting) *h2conn {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	c := &h2conn{t: t, conn: conn, reader: bufio.NewReader(conn), encoder: hpack.NewEncoder(), decoder: hpack.NewDecoder(hpack.DefaultTableSize)}
+	io.WriteString(conn, ClientPreface)
+	c.write(Frame{Type: FrameSettings, Payload: AppendSettings(nil, settings...)})
+	return c
+}
+
+func (c *h2conn) write(f Frame) {
+	if err := WriteFrame(c.conn, f); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// next returns the next frame that isn't a SETTINGS or WINDOW_UPDATE on
+// the connection.
+func (c *h2conn) next() Frame {
+	for {
+		f, err := ReadFrame(c.reader, maxAllowedFrameSize)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		if f.Type != FrameSettings && !(f.Type == FrameWindowUpdate && f.StreamID == 0) {
+			return f
+		}
+	}
+}
+
+func (c *h2conn) request(id uint32, method string, path string, endStream bool) {
+	block := c.encoder.Encode([]hpack.HeaderField{
+		{Name: ":method", Value: method},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":authority", Value: "example.com"},
+		{Name: ":path", Value: path},
+	})
+	flags := uint8(FlagEndHeaders)
+	if endStream {
+		flags |= FlagEndStream
+	}
+	c.write(Frame{Type: FrameHeaders, Flags: flags, StreamID: id, Payload: block})
+}
+
+func (c *h2conn) goAwayCode() ErrCode {
+	for {
+		f := c.next()
+		if f.Type == FrameGoAway {
+			return ErrCode(binary.BigEndian.Uint32(f.Payload[4:]))
+		}
+	}
+}
+
+func TestServerFrames(t *testing.T) {
+	assert := assert.New(t)
+	addr := listenPlain(t, &Server{Handler: echo})
+
+	c := dial(t, addr)
+	first, err := ReadFrame(c.reader, DefaultMaxFrameSize)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal(FrameSettings, first.Type, "The server's preface is a SETTINGS frame")
+
+	c.write(Frame{Type: FramePing, Payload: []byte("12345678")})
+	ack := c.next()
+	for ack.Type == FrameSettings || ack.Type == FrameWindowUpdate {
+		ack = c.next()
+	}
+	assert.Equal(Frame{Type: FramePing, Flags: FlagAck, Payload: []byte("12345678")}, ack)
+
+	c.request(1, "GET", "/x", true)
+	headers := c.next()
+	assert.Equal(FrameHeaders, headers.Type)
+	assert.Equal(uint32(1), headers.StreamID)
+	fields, err := c.decoder.Decode(headers.Payload)
+	assert.NoError(err)
+	assert.Equal(hpack.HeaderField{Name: ":status", Value: "200"}, fields[0])
+	data := c.next()
+	assert.Equal(FrameData, data.Type)
+	assert.Equal("HTTP/2.0 GET /x host=example.com tls=false cookie= body=", string(data.Payload))
+	end := c.next()
+	assert.True(end.Has(FlagEndStream))
+	assert.Empty(end.Payload)
+
+	c.request(2, "GET", "/", true)
+	assert.Equal(ErrCodeProtocol, c.goAwayCode(), "Clients use odd stream IDs")
+}
+
+func TestServerProtocolErrors(t *testing.T) {
+	addr := listenPlain(t, &Server{Handler: echo})
+	tests := map[string]struct {
+		frames []Frame
+		code   ErrCode
+	}{
+		"push promise":       {[]Frame{{Type: FramePushPromise, StreamID: 1, Payload: make([]byte, 4)}}, ErrCodeProtocol},
+		"ping on stream":     {[]Frame{{Type: FramePing, StreamID: 1, Payload: make([]byte, 8)}}, ErrCodeProtocol},
+		"short ping":         {[]Frame{{Type: FramePing, Payload: make([]byte, 4)}}, ErrCodeFrameSize},
+		"data on idle":       {[]Frame{{Type: FrameData, StreamID: 5, Payload: []byte("x")}}, ErrCodeProtocol},
+		"zero window update": {[]Frame{{Type: FrameWindowUpdate, Payload: make([]byte, 4)}}, ErrCodeProtocol},
+		"window overflow":    {[]Frame{{Type: FrameWindowUpdate, Payload: []byte{0x7f, 0xff, 0xff, 0xff}}}, ErrCodeFlowControl},
+		"bad frame size":     {[]Frame{{Type: FrameSettings, Payload: AppendSettings(nil, Setting{SettingMaxFrameSize, 100})}}, ErrCodeProtocol},
+		"bad hpack":          {[]Frame{{Type: FrameHeaders, Flags: FlagEndHeaders | FlagEndStream, StreamID: 1, Payload: []byte{0xff, 0xff}}}, ErrCodeCompression},
+		"interleaved headers": {[]Frame{
+			{Type: FrameHeaders, StreamID: 1, Payload: []byte{0x82}},
+			{Type: FramePing, Payload: make([]byte, 8)},
+		}, ErrCodeProtocol},
+		"oversized frame": {[]Frame{{Type: FramePing, Payload: make([]byte, DefaultMaxFrameSize+1)}}, ErrCodeFrameSize},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := dial(t, addr)
+			for _, f := range test.frames {
+				c.write(f)
+			}
+			assert.Equal(t, test.code, c.goAwayCode())
+		})
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadAll(conn)
+	assert.NoError(t, err, "An HTTP/1.1 request in place of the preface is hung up on")
+}
+
+func TestServerStreamErrors(t *testing.T) {
+	assert := assert.New(t)
+	addr := listenPlain(t, &Server{Handler: echo})
+	c := dial(t, addr)
+
+	block := c.encoder.Encode([]hpack.HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: "/"},
+		{Name: "connection", Value: "close"},
+	})
+	c.write(Frame{Type: FrameHeaders, Flags: FlagEndHeaders | FlagEndStream, StreamID: 1, Payload: block})
+	reset := c.next()
+	assert.Equal(FrameRSTStream, reset.Type, "A malformed request resets only its stream")
+	assert.Equal(ErrCodeProtocol, ErrCode(binary.BigEndian.Uint32(reset.Payload)))
+
+	c.request(3, "GET", "/still-open", true)
+	headers := c.next()
+	assert.Equal(FrameHeaders, headers.Type)
+	assert.Equal(uint32(3), headers.StreamID)
+}
+
+func TestNewRequestRejectsMalformedFields(t *testing.T) {
+	base := []hpack.HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "https"},
+		{Name: ":authority", Value: "example.com"},
+		{Name: ":path", Value: "/"},
+	}
+	with := func(fields ...hpack.HeaderField) []hpack.HeaderField {
+		return append(append([]hpack.HeaderField{}, base...), fields...)
+	}
+	replace := func(name string, value string) []hpack.HeaderField {
+		fields := with()
+		for i := range fields {
+			if fields[i].Name == name {
+				fields[i].Value = value
+			}
+		}
+		return fields
+	}
+
+	req, err := newRequest(with(hpack.HeaderField{Name: "x-ok", Value: "fine"}), true)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "example.com", req.Host)
+	}
+
+	tests := map[string][]hpack.HeaderField{
+		"method with a space": replace(":method", "GET /admin HTTP/1.1\r\nX:"),
+		"method with a slash": replace(":method", "G/ET"),
+		"CRLF in authority":   replace(":authority", "example.com\r\nX-Injected: 1"),
+		"NUL in path":         replace(":path", "/a\x00b"),
+		"LF in value":         with(hpack.HeaderField{Name: "x-a", Value: "1\nx-b: 2"}),
+		"CR in value":         with(hpack.HeaderField{Name: "x-a", Value: "1\r"}),
+		"space in name":       with(hpack.HeaderField{Name: "x a", Value: "1"}),
+		"colon inside name":   with(hpack.HeaderField{Name: "x:a", Value: "1"}),
+		"empty name":          with(hpack.HeaderField{Name: "", Value: "1"}),
+		"upper-case name":     with(hpack.HeaderField{Name: "X-A", Value: "1"}),
+		"non-ASCII name":      with(hpack.HeaderField{Name: "x-\xe9", Value: "1"}),
+		"NUL in cookie crumb": with(hpack.HeaderField{Name: "cookie", Value: "a=1\x00"}),
+		"separator in name":   with(hpack.HeaderField{Name: "x(a)", Value: "1"}),
+	}
+	for name, fields := range tests {
+		_, err := newRequest(fields, true)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestServerFlowControl(t *testing.T) {
+	assert := assert.New(t)
+	body := strings.Repeat("y", 100)
+	addr := listenPlain(t, &Server{Handler: func(w *http1.Response, req *http1.Request) {
+		io.WriteString(w, body)
+	}})
+	// The client will take no more than 10 bytes of DATA per stream until
+	// it sends WINDOW_UPDATE.
+	c := dial(t, addr, Setting{SettingInitialWindowSize, 10})
+	c.request(1, "GET", "/", true)
+
+	assert.Equal(FrameHeaders, c.next().Type)
+	data := c.next()
+	assert.Equal(FrameData, data.Type)
+	assert.Equal(body[:10], string(data.Payload))
+
+	c.write(Frame{Type: FrameWindowUpdate, StreamID: 1, Payload: binary.BigEndian.AppendUint32(nil, 1000)})
+	var rest string
+	for {
+		f := c.next()
+		rest += string(f.Payload)
+		if f.Has(FlagEndStream) {
+			break
+		}
+	}
+	assert.Equal(body[10:], rest)
+}
+
+func TestServerRequestBody(t *testing.T) {
+	assert := assert.New(t)
+	addr := listenPlain(t, &Server{Handler: echo, Limits: http1.Limits{MaxBodyBytes: 5}})
+	c := dial(t, addr)
+
+	block := c.encoder.Encode([]hpack.HeaderField{
+		{Name: ":method", Value: "POST"},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: "/"},
+		{Name: "content-length", Value: "10"},
+	})
+	c.write(Frame{Type: FrameHeaders, Flags: FlagEndHeaders, StreamID: 1, Payload: block})
+	headers := c.next()
+	fields, err := c.decoder.Decode(headers.Payload)
+	assert.NoError(err)
+	assert.Equal("413", fields[0].Value, "A declared body over the limit is refused")
+
+	c.request(3, "POST", "/", false)
+	// Padding is stripped from the body.
+	c.write(Frame{Type: FrameData, Flags: FlagPadded | FlagEndStream, StreamID: 3, Payload: []byte("\x03abc\x00\x00\x00")})
+	for {
+		f := c.next()
+		if f.Type == FrameData && f.StreamID == 3 {
+			assert.True(strings.HasSuffix(string(f.Payload), "body=abc"), string(f.Payload))
+			break
+		}
+	}
+}
+
+func TestServerCountsResetStreamsUntilHandlersReturn(t *testing.T) {
+	assert := assert.New(t)
+	release := make(chan struct{})
+	var started sync.WaitGroup
+	started.Add(2)
+	addr := listenPlain(t, &Server{MaxConcurrentStreams: 2, Handler: func(w *http1.Response, req *http1.Request) {
+		if req.Path == "/slow" {
+			started.Done()
+			<-release
+		}
+	}})
+	c := dial(t, addr)
+
+	// Opening and at once resetting streams doesn't free their slots
+	// while the handlers still run.
+	for _, id := range []uint32{1, 3} {
+		c.request(id, "GET", "/slow", true)
+		c.write(Frame{Type: FrameRSTStream, StreamID: id, Payload: binary.BigEndian.AppendUint32(nil, uint32(ErrCodeCancel))})
+	}
+	started.Wait()
+	c.request(5, "GET", "/", true)
+	for {
+		f := c.next()
+		if f.StreamID == 5 {
+			assert.Equal(FrameRSTStream, f.Type)
+			assert.Equal(ErrCodeRefusedStream, ErrCode(binary.BigEndian.Uint32(f.Payload)))
+			break
+		}
+	}
+
+	close(release)
+	for id := uint32(7); ; id += 2 {
+		c.request(id, "GET", "/", true)
+		f := c.next()
+		for f.StreamID != id {
+			f = c.next()
+		}
+		if f.Type == FrameHeaders {
+			break
+		}
+		// The handlers may not have finished yet.
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServerCreditsUnreadBody(t *testing.T) {
+	assert := assert.New(t)
+	release := make(chan struct{})
+	addr := listenPlain(t, &Server{Handler: func(w *http1.Response, req *http1.Request) {
+		<-release
+		io.WriteString(w, "ignored the body")
+	}})
+	c := dial(t, addr)
+
+	c.request(1, "POST", "/", false)
+	c.write(Frame{Type: FrameData, StreamID: 1, Payload: make([]byte, 1000)})
+	// Frames are handled in order, so once the PING is answered the body
+	// is sitting in the stream's buffer.
+	c.write(Frame{Type: FramePing, Payload: []byte("buffered")})
+	for f := c.next(); f.Type != FramePing; f = c.next() {
+	}
+	close(release)
+
+	for {
+		f, err := ReadFrame(c.reader, maxAllowedFrameSize)
+		if !assert.NoError(err) {
+			return
+		}
+		if f.Type == FrameWindowUpdate && f.StreamID == 0 && binary.BigEndian.Uint32(f.Payload) == 1000 {
+			break
+		}
+	}
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	var buf strings.Builder
+	f := Frame{Type: FrameHeaders, Flags: FlagEndHeaders, StreamID: 7, Payload: []byte("abc")}
+	assert.NoError(t, WriteFrame(&buf, f))
+	assert.Equal(t, "\x00\x00\x03\x01\x04\x00\x00\x00\x07abc", buf.String())
+
+	got, err := ReadFrame(strings.NewReader(buf.String()), DefaultMaxFrameSize)
+	assert.NoError(t, err)
+	assert.Equal(t, f, got)
+
+	_, err = ReadFrame(strings.NewReader(buf.String()[:10]), DefaultMaxFrameSize)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	_, err = ReadFrame(strings.NewReader(buf.String()), 2)
+	assert.Error(t, err)
+
+	assert.Equal(t, "WINDOW_UPDATE", FrameWindowUpdate.String())
+	assert.Equal(t, "FLOW_CONTROL_ERROR", ErrCodeFlowControl.String())
+}
@@ -0,0 +1,1014 @@
+package httpfile
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/vinh0604/go-network-concepts/internal/http1"
+)
+
+// MaxRanges caps the ranges served from one request; with more the whole
+// file is sent.
+const MaxRanges = 16
+
+var (
+	// ErrInvalidRange means the Range header can't be parsed. RFC 9110
+	// section 14.2 says such a header is ignored.
+	ErrInvalidRange = errors.New("httpfile: invalid range")
+	// ErrUnsatisfiable means none of the ranges overlap the file.
+	ErrUnsatisfiable = errors.New("httpfile: range not satisfiable")
+)
+
+// Range is a byte range of a file of known size.
+type Range struct {
+	Start  int64
+	Length int64
+}
+
+// ContentRange formats the Content-Range value for r.
+func (r Range) ContentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.Start, r.Start+r.Length-1, size)
+}
+
+// ParseRange parses a "bytes=" Range header against a file of size bytes,
+// RFC 9110 section 14.1.2.
+func ParseRange(header string, size int64) ([]Range, error) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found {
+		return nil, ErrInvalidRange
+	}
+
+	ranges := []Range{}
+	parts := strings.Split(spec, ",")
+	if len(parts) > MaxRanges {
+		return nil, ErrInvalidRange
+	}
+	var total int64
+	for _, part := range parts {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		first, last, found := strings.Cut(part, "-")
+		if !found {
+			return nil, ErrInvalidRange
+		}
+
+		if first == "" {
+			// A suffix range: the last N bytes.
+			n, err := parsePos(last)
+			if err != nil {
+				return nil, err
+			}
+			if n == 0 || size == 0 {
+				continue
+			}
+			n = min(n, size)
+			ranges = append(ranges, Range{Start: size - n, Length: n})
+			total += n
+			continue
+		}
+
+		start, err := parsePos(first)
+		if err != nil {
+			return nil, err
+		}
+		end := size - 1
+		if last != "" {
+			if end, err = parsePos(last); err != nil {
+				return nil, err
+			}
+			if end < start {
+				return nil, ErrInvalidRange
+			}
+			end = min(end, size-1)
+		}
+		if start >= size {
+			continue
+		}
+		ranges = append(ranges, Range{Start: start, Length: end - start + 1})
+		total += end - start + 1
+	}
+
+	if len(ranges) == 0 {
+		return nil, ErrUnsatisfiable
+	}
+	// Overlapping ranges adding up to more than the file are a cheap way
+	// to make a server send the same bytes over and over.
+	if total > size {
+		return nil, ErrInvalidRange
+	}
+	return ranges, nil
+}
+
+func parsePos(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s[0] < '0' || s[0] > '9' {
+		return 0, ErrInvalidRange
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, ErrInvalidRange
+	}
+	return n, nil
+}
+
+// DefaultType is sent for files whose type can't be determined.
+const DefaultType = "application/octet-stream"
+
+// sniffLen is how much of a file is inspected when its extension is
+// unknown, as in the WHATWG MIME Sniffing standard.
+const sniffLen = 512
+
+var defaultTypes = map[string]string{
+	".html":  "text/html",
+	".htm":   "text/html",
+	".txt":   "text/plain",
+	".log":   "text/plain",
+	".md":    "text/plain",
+	".csv":   "text/csv",
+	".css":   "text/css",
+	".js":    "text/javascript",
+	".mjs":   "text/javascript",
+	".json":  "application/json",
+	".xml":   "application/xml",
+	".svg":   "image/svg+xml",
+	".jpg":   "image/jpeg",
+	".jpeg":  "image/jpeg",
+	".png":   "image/png",
+	".gif":   "image/gif",
+	".webp":  "image/webp",
+	".ico":   "image/vnd.microsoft.icon",
+	".pdf":   "application/pdf",
+	".m3u8":  "application/vnd.apple.mpegurl",
+	".ts":    "video/mp2t",
+	".mp4":   "video/mp4",
+	".webm":  "video/webm",
+	".mp3":   "audio/mpeg",
+	".wasm":  "application/wasm",
+	".woff":  "font/woff",
+	".woff2": "font/woff2",
+	".zip":   "application/zip",
+	".gz":    "application/gzip",
+}
+
+// MIMETypes maps file extensions to media types. It is not safe to modify
+// while serving.
+type MIMETypes struct {
+	byExt map[string]string
+}
+
+func NewMIMETypes() *MIMETypes {
+	types := &MIMETypes{byExt: map[string]string{}}
+	for ext, mediaType := range defaultTypes {
+		types.byExt[ext] = mediaType
+	}
+	return types
+}
+
+// Add registers mediaType for ext, with or without its leading dot.
+func (m *MIMETypes) Add(ext string, mediaType string) {
+	ext = strings.ToLower(ext)
+	if !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	m.byExt[ext] = mediaType
+}
+
+// Load reads entries in the mime.types format, overriding registered ones.
+func (m *MIMETypes) Load(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if !strings.Contains(fields[0], "/") {
+			return fmt.Errorf("line %d: %q is not a media type", lineNo, fields[0])
+		}
+		for _, ext := range fields[1:] {
+			m.Add(ext, fields[0])
+		}
+	}
+	return scanner.Err()
+}
+
+func (m *MIMETypes) LoadFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := m.Load(file); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// ByExtension returns the media type registered for path's extension.
+func (m *MIMETypes) ByExtension(path string) (string, bool) {
+	mediaType, ok := m.byExt[strings.ToLower(filepath.Ext(path))]
+	return mediaType, ok
+}
+
+// TypeOf returns the Content-Type for the file at path, sniffing content
+// when the extension is unknown. content is left at its start.
+func (m *MIMETypes) TypeOf(path string, content io.ReadSeeker) (string, error) {
+	if mediaType, ok := m.ByExtension(path); ok {
+		return withCharset(mediaType), nil
+	}
+
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(content, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return withCharset(Sniff(head[:n])), nil
+}
+
+// withCharset marks text as UTF-8.
+func withCharset(mediaType string) string {
+	if strings.HasPrefix(mediaType, "text/") && !strings.Contains(mediaType, "charset") {
+		return mediaType + "; charset=utf-8"
+	}
+	return mediaType
+}
+
+var signatures = []struct {
+	offset    int
+	magic     []byte
+	mediaType string
+}{
+	{0, []byte("%PDF-"), "application/pdf"},
+	{0, []byte("\x89PNG\r\n\x1a\n"), "image/png"},
+	{0, []byte("\xff\xd8\xff"), "image/jpeg"},
+	{0, []byte("GIF87a"), "image/gif"},
+	{0, []byte("GIF89a"), "image/gif"},
+	{0, []byte("\x00\x00\x01\x00"), "image/vnd.microsoft.icon"},
+	{0, []byte("PK\x03\x04"), "application/zip"},
+	{0, []byte("\x1f\x8b\x08"), "application/gzip"},
+	{0, []byte("\x00asm"), "application/wasm"},
+	{0, []byte("wOFF"), "font/woff"},
+	{0, []byte("wOF2"), "font/woff2"},
+	{0, []byte("ID3"), "audio/mpeg"},
+	{0, []byte("\x1a\x45\xdf\xa3"), "video/webm"},
+	{0, []byte("#EXTM3U"), "application/vnd.apple.mpegurl"},
+	{4, []byte("ftyp"), "video/mp4"},
+	{8, []byte("WEBP"), "image/webp"},
+}
+
+// Sniff guesses a media type from the first bytes of a file.
+func Sniff(head []byte) string {
+	for _, sig := range signatures {
+		if len(head) >= sig.offset+len(sig.magic) && bytes.Equal(head[sig.offset:sig.offset+len(sig.magic)], sig.magic) {
+			if sig.offset == 8 && !bytes.HasPrefix(head, []byte("RIFF")) {
+				continue
+			}
+			return sig.mediaType
+		}
+	}
+	// MPEG transport streams are 188-byte packets starting with 0x47.
+	if len(head) > 188 && head[0] == 0x47 && head[188] == 0x47 {
+		return "video/mp2t"
+	}
+
+	text := bytes.TrimLeft(head, "\t\n\r\f ")
+	text = bytes.TrimPrefix(text, []byte("\xef\xbb\xbf"))
+	lower := bytes.ToLower(text[:min(len(text), 16)])
+	for _, tag := range []string{"<!doctype html", "<html", "<head", "<body", "<script", "<!--", "<p>", "<div", "<table", "<title"} {
+		if bytes.HasPrefix(lower, []byte(tag)) {
+			return "text/html"
+		}
+	}
+	if bytes.HasPrefix(lower, []byte("<?xml")) {
+		if bytes.Contains(head, []byte("<svg")) {
+			return "image/svg+xml"
+		}
+		return "text/xml"
+	}
+	if bytes.HasPrefix(lower, []byte("<svg")) {
+		return "image/svg+xml"
+	}
+
+	if isText(head) {
+		return "text/plain"
+	}
+	return DefaultType
+}
+
+// isText reports whether head looks like UTF-8 text without control
+// characters other than whitespace.
+func isText(head []byte) bool {
+	if len(head) == 0 {
+		return true
+	}
+	for i := 0; i < len(head); {
+		r, size := utf8.DecodeRune(head[i:])
+		if r == utf8.RuneError && size == 1 {
+			return len(head)-i < utf8.UTFMax && !utf8.FullRune(head[i:])
+		}
+		if r < 0x20 && r != '\t' && r != '\n' && r != '\r' && r != '\f' || r == 0x7f {
+			return false
+		}
+		i += size
+	}
+	return true
+}
+
+// ETag returns a strong validator built from the file's size and
+// modification time.
+func ETag(info fs.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.Size(), info.ModTime().UnixNano())
+}
+
+// HashETag returns a strong validator from the SHA-256 of content.
+func HashETag(content io.Reader) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, content); err != nil {
+		return "", err
+	}
+	return `"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`, nil
+}
+
+// HashCache remembers content hash ETags by path until the file's size or
+// modification time changes. It is safe for concurrent use.
+type HashCache struct {
+	mu      sync.Mutex
+	entries map[string]hashEntry
+}
+
+type hashEntry struct {
+	size    int64
+	modTime time.Time
+	etag    string
+}
+
+func NewHashCache() *HashCache {
+	return &HashCache{entries: map[string]hashEntry{}}
+}
+
+func (c *HashCache) ETag(path string, info fs.FileInfo) (string, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[path]
+	c.mu.Unlock()
+	if ok && entry.size == info.Size() && entry.modTime.Equal(info.ModTime()) {
+		return entry.etag, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	etag, err := HashETag(file)
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	c.entries[path] = hashEntry{size: info.Size(), modTime: info.ModTime(), etag: etag}
+	c.mu.Unlock()
+	return etag, nil
+}
+
+// SetValidators sets Last-Modified, when modTime is known, and ETag.
+func SetValidators(w *http1.Response, modTime time.Time, etag string) {
+	if !modTime.IsZero() && modTime.Unix() > 0 {
+		w.Header.Set("Last-Modified", modTime.UTC().Format(http1.TimeFormat))
+	}
+	if etag != "" {
+		w.Header.Set("ETag", etag)
+	}
+}
+
+// CachePolicy maps lower-cased file extensions, with their dot, to a
+// Cache-Control value. The "*" entry applies to every other file.
+type CachePolicy map[string]string
+
+// ParseCachePolicy parses entries separated by ';', each a
+// comma-separated list of extensions, '=', and the Cache-Control value:
+//
+//	.html,.htm=no-cache; .css,.js=public, max-age=86400; *=max-age=300
+func ParseCachePolicy(spec string) (CachePolicy, error) {
+	policy := CachePolicy{}
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		exts, value, found := strings.Cut(entry, "=")
+		value = strings.TrimSpace(value)
+		if !found || value == "" {
+			return nil, fmt.Errorf("cache policy %q: expected extensions=Cache-Control value", entry)
+		}
+		for _, ext := range strings.Split(exts, ",") {
+			ext = strings.ToLower(strings.TrimSpace(ext))
+			if ext != "*" && (len(ext) < 2 || ext[0] != '.') {
+				return nil, fmt.Errorf("cache policy %q: extension %q must start with a dot", entry, ext)
+			}
+			policy[ext] = value
+		}
+	}
+	return policy, nil
+}
+
+// For returns the Cache-Control value for path, or "" when none applies.
+func (p CachePolicy) For(path string) string {
+	if value, ok := p[strings.ToLower(filepath.Ext(path))]; ok {
+		return value
+	}
+	return p["*"]
+}
+
+// checkPreconditions evaluates the conditional headers of req against the
+// validators set on w, RFC 9110 section 13.2.2. It returns the status to
+// answer with instead of the content, or 0.
+func checkPreconditions(w *http1.Response, req *http1.Request) int {
+	etag := w.Header.Get("ETag")
+	modTime, modErr := http1.ParseTime(w.Header.Get("Last-Modified"))
+	hasModTime := modErr == nil
+
+	if ifMatch := req.Header.Get("If-Match"); ifMatch != "" {
+		if !matchETag(ifMatch, etag, false) {
+			return http1.StatusPreconditionFailed
+		}
+	} else if since, err := http1.ParseTime(req.Header.Get("If-Unmodified-Since")); err == nil && hasModTime {
+		if modTime.After(since) {
+			return http1.StatusPreconditionFailed
+		}
+	}
+
+	getOrHead := req.Method == "GET" || req.Method == "HEAD"
+	if ifNoneMatch := req.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		if matchETag(ifNoneMatch, etag, true) {
+			if getOrHead {
+				return http1.StatusNotModified
+			}
+			return http1.StatusPreconditionFailed
+		}
+	} else if since, err := http1.ParseTime(req.Header.Get("If-Modified-Since")); err == nil && hasModTime && getOrHead {
+		if !modTime.After(since) {
+			return http1.StatusNotModified
+		}
+	}
+	return 0
+}
+
+// matchETag reports whether the list of entity tags in header matches
+// etag, using the weak or strong comparison.
+func matchETag(header string, etag string, weak bool) bool {
+	if etag == "" {
+		return false
+	}
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if weak {
+			if strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		} else if candidate == etag && !strings.HasPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// rangeApplies evaluates If-Range: the Range header only counts when the
+// representation is still the one the client has part of.
+func rangeApplies(w *http1.Response, req *http1.Request) bool {
+	ifRange := req.Header.Get("If-Range")
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		return matchETag(ifRange, w.Header.Get("ETag"), false)
+	}
+	since, err := http1.ParseTime(ifRange)
+	if err != nil {
+		return false
+	}
+	modTime, err := http1.ParseTime(w.Header.Get("Last-Modified"))
+	return err == nil && modTime.Equal(since)
+}
+
+// ServeContent streams content of size bytes as the response to req,
+// handling Range and conditional requests against the validators set on w.
+func ServeContent(w *http1.Response, req *http1.Request, content io.ReadSeeker, size int64, contentType string) error {
+	if status := checkPreconditions(w, req); status != 0 {
+		if status != http1.StatusNotModified {
+			w.Header.Set("Content-Length", "0")
+		}
+		w.WriteHeader(status)
+		return nil
+	}
+
+	w.Header.Set("Accept-Ranges", "bytes")
+	w.Header.Set("Content-Type", contentType)
+
+	var ranges []Range
+	if header := req.Header.Get("Range"); header != "" && req.Method == "GET" && rangeApplies(w, req) {
+		var err error
+		ranges, err = ParseRange(header, size)
+		if errors.Is(err, ErrUnsatisfiable) {
+			message := fmt.Sprintf("Range %s not satisfiable for %d bytes", header, size)
+			w.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			w.Header.Set("Content-Type", "text/plain; charset=utf-8")
+			w.Header.Set("Content-Length", strconv.Itoa(len(message)))
+			w.Header.Del("Content-Encoding")
+			w.WriteHeader(http1.StatusRangeNotSatisfiable)
+			_, err := io.WriteString(w, message)
+			return err
+		}
+	}
+
+	switch len(ranges) {
+	case 0:
+		w.Header.Set("Content-Length", strconv.FormatInt(size, 10))
+		w.WriteHeader(http1.StatusOK)
+		if req.Method == "HEAD" {
+			return nil
+		}
+		return copyRange(w, content, Range{Start: 0, Length: size})
+	case 1:
+		w.Header.Set("Content-Range", ranges[0].ContentRange(size))
+		w.Header.Set("Content-Length", strconv.FormatInt(ranges[0].Length, 10))
+		w.WriteHeader(http1.StatusPartialContent)
+		return copyRange(w, content, ranges[0])
+	}
+
+	boundary := newBoundary()
+	headers := make([]string, len(ranges))
+	length := int64(len(closingBoundary(boundary)))
+	for i, r := range ranges {
+		headers[i] = partHeader(boundary, contentType, r.ContentRange(size), i == 0)
+		length += int64(len(headers[i])) + r.Length
+	}
+	w.Header.Set("Content-Type", "multipart/byteranges; boundary="+boundary)
+	w.Header.Set("Content-Length", strconv.FormatInt(length, 10))
+	w.WriteHeader(http1.StatusPartialContent)
+	for i, r := range ranges {
+		if _, err := io.WriteString(w, headers[i]); err != nil {
+			return err
+		}
+		if err := copyRange(w, content, r); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, closingBoundary(boundary))
+	return err
+}
+
+func copyRange(w *http1.Response, content io.ReadSeeker, r Range) error {
+	if _, err := content.Seek(r.Start, io.SeekStart); err != nil {
+		return err
+	}
+	n, err := io.Copy(w, io.LimitReader(content, r.Length))
+	if err == nil && n < r.Length {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func newBoundary() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func partHeader(boundary string, contentType string, contentRange string, first bool) string {
+	header := fmt.Sprintf("--%s\r\nContent-Type: %s\r\nContent-Range: %s\r\n\r\n", boundary, contentType, contentRange)
+	if !first {
+		header = "\r\n" + header
+	}
+	return header
+}
+
+func closingBoundary(boundary string) string {
+	return "\r\n--" + boundary + "--\r\n"
+}
+
+// MinCompressSize is the smallest body worth compressing; below it the
+// gzip header and trailer eat most of the savings.
+const MinCompressSize = 256
+
+// Coding is one entry of an Accept-Encoding header.
+type Coding struct {
+	Name string
+	Q    float64
+}
+
+// ParseAcceptEncoding parses an Accept-Encoding header into lower-cased
+// codings with their q-values.
+func ParseAcceptEncoding(header string) []Coding {
+	codings := []Coding{}
+	for _, entry := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(entry, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, found := strings.Cut(strings.TrimSpace(param), "=")
+			if !found || strings.ToLower(strings.TrimSpace(key)) != "q" {
+				continue
+			}
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil || parsed < 0 || parsed > 1 {
+				parsed = 0
+			}
+			q = parsed
+		}
+		codings = append(codings, Coding{Name: name, Q: q})
+	}
+	return codings
+}
+
+// Negotiate picks the content coding to use from the ones the server
+// supports, in order of preference, or "" for identity.
+func Negotiate(acceptEncoding string, supported ...string) string {
+	codings := ParseAcceptEncoding(acceptEncoding)
+	qOf := func(name string) (float64, bool) {
+		for _, coding := range codings {
+			if coding.Name == name {
+				return coding.Q, true
+			}
+		}
+		for _, coding := range codings {
+			if coding.Name == "*" {
+				return coding.Q, true
+			}
+		}
+		return 0, false
+	}
+
+	identity, named := qOf("identity")
+	if !named {
+		identity = 1
+	}
+	best, bestQ := "", 0.0
+	for _, name := range supported {
+		q, _ := qOf(name)
+		if q > bestQ {
+			best, bestQ = name, q
+		}
+	}
+	if best == "" || bestQ < identity {
+		return ""
+	}
+	return best
+}
+
+// Compressible reports whether a response of contentType is worth
+// compressing.
+func Compressible(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	if strings.HasPrefix(mediaType, "text/") {
+		return true
+	}
+	return slices.Contains([]string{
+		"application/json",
+		"application/javascript",
+		"application/xml",
+		"application/wasm",
+		"application/vnd.apple.mpegurl",
+		"image/svg+xml",
+		"image/vnd.microsoft.icon",
+	}, mediaType)
+}
+
+// EncodedETag derives the validator of an encoded representation, which
+// must differ from the identity one because its bytes do.
+func EncodedETag(etag string, coding string) string {
+	if coding == "" || !strings.HasSuffix(etag, `"`) {
+		return etag
+	}
+	return etag[:len(etag)-1] + "-" + coding + `"`
+}
+
+// NewEncoder returns a writer that compresses into w with coding. HTTP's
+// deflate is the zlib format of RFC 1950, not a raw deflate stream.
+func NewEncoder(w io.Writer, coding string) (io.WriteCloser, error) {
+	switch coding {
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	case "deflate":
+		return zlib.NewWriter(w), nil
+	}
+	return nil, fmt.Errorf("httpfile: unsupported content coding %q", coding)
+}
+
+// Compress encodes data in one go.
+func Compress(data []byte, coding string) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder, err := NewEncoder(&buf, coding)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := encoder.Write(data); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ServeEncoded is ServeContent for a body compressed on the fly with
+// coding. Range requests get the whole representation.
+func ServeEncoded(w *http1.Response, req *http1.Request, content io.Reader, contentType string, coding string) error {
+	if status := checkPreconditions(w, req); status != 0 {
+		if status != http1.StatusNotModified {
+			w.Header.Set("Content-Length", "0")
+		}
+		w.WriteHeader(status)
+		return nil
+	}
+
+	w.Header.Set("Content-Type", contentType)
+	w.Header.Set("Content-Encoding", coding)
+	w.Header.Del("Content-Length")
+	w.WriteHeader(http1.StatusOK)
+	if req.Method == "HEAD" {
+		return nil
+	}
+
+	encoder, err := NewEncoder(w, coding)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(encoder, content); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+var (
+	ErrNotFound  = errors.New("httpfile: not found")
+	ErrForbidden = errors.New("httpfile: forbidden")
+)
+
+// SymlinkPolicy decides which symbolic links a Resolver follows.
+type SymlinkPolicy int
+
+const (
+	// SymlinksInsideRoot follows links whose target stays under the root.
+	SymlinksInsideRoot SymlinkPolicy = iota
+	// SymlinksFollow follows every link, wherever it points.
+	SymlinksFollow
+	// SymlinksDeny refuses any path that goes through a link.
+	SymlinksDeny
+)
+
+func ParseSymlinkPolicy(name string) (SymlinkPolicy, error) {
+	switch name {
+	case "inside":
+		return SymlinksInsideRoot, nil
+	case "follow":
+		return SymlinksFollow, nil
+	case "deny":
+		return SymlinksDeny, nil
+	}
+	return 0, fmt.Errorf("unknown symlink policy %q (expected inside, follow or deny)", name)
+}
+
+// Resolver maps URL paths to files under a root directory.
+type Resolver struct {
+	root         string
+	symlinks     SymlinkPolicy
+	hideDotfiles bool
+}
+
+// NewResolver resolves root to an absolute path without symbolic links.
+func NewResolver(root string, symlinks SymlinkPolicy, hideDotfiles bool) (*Resolver, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	real, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return nil, err
+	}
+	return &Resolver{root: real, symlinks: symlinks, hideDotfiles: hideDotfiles}, nil
+}
+
+func (r *Resolver) Root() string {
+	return r.root
+}
+
+// Resolve maps a decoded URL path to a file under the root, checking each
+// component against the symbolic link policy. Hidden names are reported as
+// ErrNotFound, links the policy refuses as ErrForbidden.
+func (r *Resolver) Resolve(urlPath string) (string, error) {
+	if strings.IndexByte(urlPath, 0) >= 0 {
+		return "", ErrNotFound
+	}
+
+	current := r.root
+	for _, name := range strings.Split(path.Clean("/"+urlPath), "/") {
+		if name == "" {
+			continue
+		}
+		if r.Hidden(name) {
+			return "", ErrNotFound
+		}
+		next := filepath.Join(current, name)
+		info, err := os.Lstat(next)
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.ENOTDIR) {
+			return "", ErrNotFound
+		}
+		if err != nil {
+			return "", err
+		}
+
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if r.symlinks == SymlinksDeny {
+				return "", ErrForbidden
+			}
+			target, err := filepath.EvalSymlinks(next)
+			if errors.Is(err, fs.ErrNotExist) {
+				return "", ErrNotFound
+			}
+			if err != nil {
+				return "", err
+			}
+			if r.symlinks == SymlinksInsideRoot && !Within(r.root, target) {
+				return "", ErrForbidden
+			}
+			next = target
+		}
+		current = next
+	}
+	return current, nil
+}
+
+// OpenPrecompressed opens the ".gz" sibling of the file at urlPath when
+// there is one at least as new as info, and returns it with its path.
+func (r *Resolver) OpenPrecompressed(urlPath string, info fs.FileInfo) (*os.File, string, fs.FileInfo, bool) {
+	gzPath, err := r.Resolve(urlPath + ".gz")
+	if err != nil {
+		return nil, "", nil, false
+	}
+	file, err := os.Open(gzPath)
+	if err != nil {
+		return nil, "", nil, false
+	}
+	gzInfo, err := file.Stat()
+	if err != nil || !gzInfo.Mode().IsRegular() || gzInfo.ModTime().Before(info.ModTime()) {
+		file.Close()
+		return nil, "", nil, false
+	}
+	return file, gzPath, gzInfo, true
+}
+
+// Hidden reports whether name is a dotfile the resolver hides.
+func (r *Resolver) Hidden(name string) bool {
+	return r.hideDotfiles && strings.HasPrefix(name, ".")
+}
+
+// Within reports whether target is root or under it, by path components.
+func Within(root string, target string) bool {
+	rel, err := filepath.Rel(root, target)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
+// DirLocation returns where to redirect a request for the directory at
+// urlPath so it ends in a slash. The path is cleaned so a leading "//"
+// can't name another host.
+func DirLocation(urlPath string, rawQuery string) string {
+	cleaned := path.Clean("/" + urlPath)
+	if cleaned != "/" {
+		cleaned += "/"
+	}
+	return (&url.URL{Path: cleaned, RawQuery: rawQuery}).String()
+}
+
+// Entry is one file in a directory listing.
+type Entry struct {
+	Name    string
+	IsDir   bool
+	Size    int64
+	ModTime time.Time
+}
+
+// SortEntries orders a listing by "name", "size" or "mtime", directories
+// first.
+func SortEntries(entries []Entry, key string, desc bool) {
+	slices.SortStableFunc(entries, func(a, b Entry) int {
+		if a.IsDir != b.IsDir {
+			if a.IsDir {
+				return -1
+			}
+			return 1
+		}
+		var order int
+		switch key {
+		case "size":
+			order = compareInt64(a.Size, b.Size)
+		case "mtime":
+			order = a.ModTime.Compare(b.ModTime)
+		}
+		if order == 0 {
+			order = strings.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name))
+		}
+		if desc {
+			return -order
+		}
+		return order
+	})
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// Listing renders an HTML index of the directory at urlPath, which ends
+// in '/'.
+func Listing(urlPath string, entries []Entry, key string, desc bool) []byte {
+	if key != "size" && key != "mtime" {
+		key = "name"
+	}
+	SortEntries(entries, key, desc)
+	base := (&url.URL{Path: urlPath}).EscapedPath()
+	title := html.EscapeString(urlPath)
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><title>Index of %s</title></head><body>\n", title)
+	fmt.Fprintf(&sb, "<h1>Index of %s</h1>\n<table>\n<tr>", title)
+	for _, column := range []struct{ key, label string }{{"name", "Name"}, {"size", "Size"}, {"mtime", "Modified"}} {
+		order := "asc"
+		if column.key == key && !desc {
+			order = "desc"
+		}
+		fmt.Fprintf(&sb, "<th><a href=\"?sort=%s&amp;order=%s\">%s</a></th>", column.key, order, column.label)
+	}
+	sb.WriteString("</tr>\n")
+	if urlPath != "/" {
+		sb.WriteString("<tr><td><a href=\"../\">../</a></td><td></td><td></td></tr>\n")
+	}
+	for _, entry := range entries {
+		name, href, size := entry.Name, base+url.PathEscape(entry.Name), FormatSize(entry.Size)
+		if entry.IsDir {
+			name, href, size = name+"/", href+"/", "-"
+		}
+		fmt.Fprintf(&sb, "<tr><td><a href=\"%s\">%s</a></td><td>%s</td><td>%s</td></tr>\n",
+			html.EscapeString(href), html.EscapeString(name), size, entry.ModTime.UTC().Format("2006-01-02 15:04"))
+	}
+	sb.WriteString("</table>\n</body></html>\n")
+	return []byte(sb.String())
+}
+
+// FormatSize formats a byte count with binary units, e.g. "1.5 KiB".
+func FormatSize(size int64) string {
+	if size < 1024 {
+		return fmt.Sprintf("%d B", size)
+	}
+	value := float64(size)
+	for _, unit := range []string{"KiB", "MiB", "GiB", "TiB"} {
+		value /= 1024
+		if value < 1024 || unit == "TiB" {
+			return fmt.Sprintf("%.1f %s", value, unit)
+		}
+	}
+	return ""
+}
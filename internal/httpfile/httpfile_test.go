@@ -0,0 +1,678 @@
+package httpfile
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vinh0604/go-network-concepts/internal/http1"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		header string
+		size   int64
+		want   []Range
+		err    error
+	}{
+		{"bytes=0-499", 1000, []Range{{0, 500}}, nil},
+		{"bytes=500-", 1000, []Range{{500, 500}}, nil},
+		{"bytes=-200", 1000, []Range{{800, 200}}, nil},
+		{"bytes=-5000", 1000, []Range{{0, 1000}}, nil},
+		{"bytes=900-5000", 1000, []Range{{900, 100}}, nil},
+		{"bytes=0-0, -1", 1000, []Range{{0, 1}, {999, 1}}, nil},
+		{"bytes=0-9,,20-29", 1000, []Range{{0, 10}, {20, 10}}, nil},
+		{"bytes=2000-, 10-19", 1000, []Range{{10, 10}}, nil},
+		{"bytes=1000-", 1000, nil, ErrUnsatisfiable},
+		{"bytes=-0", 1000, nil, ErrUnsatisfiable},
+		{"bytes=0-", 0, nil, ErrUnsatisfiable},
+		{"bytes=5-1", 1000, nil, ErrInvalidRange},
+		{"bytes=abc", 1000, nil, ErrInvalidRange},
+		{"bytes=-+5", 1000, nil, ErrInvalidRange},
+		{"items=0-5", 1000, nil, ErrInvalidRange},
+		{"bytes=0-999,0-999", 1000, nil, ErrInvalidRange},
+		{"bytes=" + strings.Repeat("0-0,", MaxRanges+1), 1000, nil, ErrInvalidRange},
+	}
+
+	for _, test := range tests {
+		ranges, err := ParseRange(test.header, test.size)
+		assert.Equal(t, test.err, err, test.header)
+		assert.Equal(t, test.want, ranges, test.header)
+	}
+}
+
+func TestContentRange(t *testing.T) {
+	assert.Equal(t, "bytes 0-499/1234", Range{Start: 0, Length: 500}.ContentRange(1234))
+}
+
+// serve runs ServeContent over a loopback connection for the file at path
+// and returns the parsed response.
+func serve(t *testing.T, path string, method string, headers ...string) (*http.Response, []byte) {
+	return serveWith(t, func(w *http1.Response, req *http1.Request) {
+		file, err := os.Open(path)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer file.Close()
+		info, _ := file.Stat()
+		SetValidators(w, info.ModTime(), ETag(info))
+		assert.NoError(t, ServeContent(w, req, file, info.Size(), "text/plain"))
+	}, method, headers...)
+}
+
+// serveWith sends one request to handler and returns the raw response,
+// without undoing any Content-Encoding.
+func serveWith(t *testing.T, handler http1.Handler, method string, headers ...string) (*http.Response, []byte) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	server := &http1.Server{Handler: handler}
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			server.ServeConn(conn)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	request := fmt.Sprintf("%s /file HTTP/1.1\r\nHost: h\r\nConnection: close\r\n", method)
+	for _, header := range headers {
+		request += header + "\r\n"
+	}
+	conn.Write([]byte(request + "\r\n"))
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: method})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err, "The body must match its Content-Length")
+	return resp, body
+}
+
+func writeFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "file.txt")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestServeContent(t *testing.T) {
+	assert := assert.New(t)
+	path := writeFile(t, "0123456789abcdefghij")
+
+	resp, body := serve(t, path, "GET")
+	assert.Equal(200, resp.StatusCode)
+	assert.Equal("bytes", resp.Header.Get("Accept-Ranges"))
+	assert.Equal("0123456789abcdefghij", string(body))
+
+	resp, body = serve(t, path, "HEAD")
+	assert.Equal(200, resp.StatusCode)
+	assert.Equal(int64(20), resp.ContentLength)
+	assert.Empty(body)
+
+	resp, body = serve(t, path, "GET", "Range: bytes=5-9")
+	assert.Equal(206, resp.StatusCode)
+	assert.Equal("bytes 5-9/20", resp.Header.Get("Content-Range"))
+	assert.Equal("56789", string(body))
+
+	resp, body = serve(t, path, "GET", "Range: bytes=-3")
+	assert.Equal(206, resp.StatusCode)
+	assert.Equal("hij", string(body))
+
+	resp, _ = serve(t, path, "GET", "Range: bytes=20-")
+	assert.Equal(416, resp.StatusCode)
+	assert.Equal("bytes */20", resp.Header.Get("Content-Range"))
+
+	resp, body = serve(t, path, "GET", "Range: bytes=9-2")
+	assert.Equal(200, resp.StatusCode, "An invalid range is ignored")
+	assert.Len(body, 20)
+}
+
+func TestServeContentMultipleRanges(t *testing.T) {
+	assert := assert.New(t)
+	path := writeFile(t, "0123456789abcdefghij")
+
+	resp, body := serve(t, path, "GET", "Range: bytes=0-1,10-12,-2")
+	assert.Equal(206, resp.StatusCode)
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	assert.NoError(err)
+	assert.Equal("multipart/byteranges", mediaType)
+
+	reader := multipart.NewReader(strings.NewReader(string(body)), params["boundary"])
+	want := []struct{ contentRange, data string }{{"bytes 0-1/20", "01"}, {"bytes 10-12/20", "abc"}, {"bytes 18-19/20", "ij"}}
+	for _, part := range want {
+		p, err := reader.NextPart()
+		if !assert.NoError(err) {
+			return
+		}
+		data, _ := io.ReadAll(p)
+		assert.Equal(part.contentRange, p.Header.Get("Content-Range"))
+		assert.Equal("text/plain", p.Header.Get("Content-Type"))
+		assert.Equal(part.data, string(data))
+	}
+	_, err = reader.NextPart()
+	assert.Equal(io.EOF, err)
+}
+
+func TestValidators(t *testing.T) {
+	assert := assert.New(t)
+	path := writeFile(t, "version one")
+	info, _ := os.Stat(path)
+	etag := ETag(info)
+	assert.Regexp(`^"[0-9a-f]+-[0-9a-f]+"$`, etag)
+
+	cache := NewHashCache()
+	hashed, err := cache.ETag(path, info)
+	assert.NoError(err)
+	again, _ := cache.ETag(path, info)
+	assert.Equal(hashed, again)
+
+	later := info.ModTime().Add(time.Hour)
+	os.WriteFile(path, []byte("version two"), 0o644)
+	os.Chtimes(path, later, later)
+	info, _ = os.Stat(path)
+	assert.NotEqual(etag, ETag(info))
+	changed, _ := cache.ETag(path, info)
+	assert.NotEqual(hashed, changed, "A changed file is hashed again")
+
+	// Touching a file changes the metadata ETag but not the hash.
+	os.Chtimes(path, later.Add(time.Hour), later.Add(time.Hour))
+	touched, _ := os.Stat(path)
+	assert.NotEqual(ETag(info), ETag(touched))
+	rehashed, _ := cache.ETag(path, touched)
+	assert.Equal(changed, rehashed)
+}
+
+func TestCachePolicy(t *testing.T) {
+	assert := assert.New(t)
+	policy, err := ParseCachePolicy(".html,.HTM=no-cache; .css,.js=public, max-age=86400; *=max-age=300")
+	assert.NoError(err)
+	assert.Equal("no-cache", policy.For("/a/index.htm"))
+	assert.Equal("public, max-age=86400", policy.For("app.JS"))
+	assert.Equal("max-age=300", policy.For("photo.png"))
+
+	empty, err := ParseCachePolicy("")
+	assert.NoError(err)
+	assert.Equal("", empty.For("x.css"))
+
+	_, err = ParseCachePolicy("css=max-age=1")
+	assert.Error(err)
+	_, err = ParseCachePolicy(".css")
+	assert.Error(err)
+}
+
+func TestServeContentConditional(t *testing.T) {
+	path := writeFile(t, "0123456789")
+	modTime := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	os.Chtimes(path, modTime, modTime)
+	info, _ := os.Stat(path)
+	etag := ETag(info)
+	lastModified := modTime.Format(http1.TimeFormat)
+	earlier := modTime.Add(-time.Hour).Format(http1.TimeFormat)
+
+	tests := []struct {
+		name    string
+		method  string
+		headers []string
+		status  int
+		body    string
+	}{
+		{"If-None-Match hit", "GET", []string{"If-None-Match: " + etag}, 304, ""},
+		{"If-None-Match in a list", "GET", []string{`If-None-Match: "other", ` + etag}, 304, ""},
+		{"If-None-Match weak", "GET", []string{"If-None-Match: W/" + etag}, 304, ""},
+		{"If-None-Match star", "HEAD", []string{"If-None-Match: *"}, 304, ""},
+		{"If-None-Match miss", "GET", []string{`If-None-Match: "other"`}, 200, "0123456789"},
+		{"If-Modified-Since current", "GET", []string{"If-Modified-Since: " + lastModified}, 304, ""},
+		{"If-Modified-Since stale", "GET", []string{"If-Modified-Since: " + earlier}, 200, "0123456789"},
+		{"If-None-Match wins over If-Modified-Since", "GET", []string{`If-None-Match: "other"`, "If-Modified-Since: " + lastModified}, 200, "0123456789"},
+		{"If-Match miss", "GET", []string{`If-Match: "other"`}, 412, ""},
+		{"If-Match weak never matches", "GET", []string{"If-Match: W/" + etag}, 412, ""},
+		{"If-Unmodified-Since stale", "GET", []string{"If-Unmodified-Since: " + earlier}, 412, ""},
+		{"If-Range current ETag", "GET", []string{"Range: bytes=0-3", "If-Range: " + etag}, 206, "0123"},
+		{"If-Range stale ETag", "GET", []string{"Range: bytes=0-3", `If-Range: "old"`}, 200, "0123456789"},
+		{"If-Range current date", "GET", []string{"Range: bytes=-2", "If-Range: " + lastModified}, 206, "89"},
+		{"If-Range stale date", "GET", []string{"Range: bytes=-2", "If-Range: " + earlier}, 200, "0123456789"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp, body := serve(t, path, test.method, test.headers...)
+			assert.Equal(t, test.status, resp.StatusCode)
+			assert.Equal(t, test.body, string(body))
+			if test.status == 304 {
+				assert.Equal(t, etag, resp.Header.Get("ETag"))
+				assert.Equal(t, lastModified, resp.Header.Get("Last-Modified"))
+				assert.Empty(t, resp.Header.Get("Content-Length"))
+			}
+		})
+	}
+}
+
+func TestMIMETypes(t *testing.T) {
+	assert := assert.New(t)
+	types := NewMIMETypes()
+
+	for path, want := range map[string]string{
+		"style.css":       "text/css",
+		"app.JS":          "text/javascript",
+		"data.json":       "application/json",
+		"logo.svg":        "image/svg+xml",
+		"live/index.m3u8": "application/vnd.apple.mpegurl",
+		"seg-001.ts":      "video/mp2t",
+		"photo.jpeg":      "image/jpeg",
+	} {
+		got, ok := types.ByExtension(path)
+		assert.True(ok, path)
+		assert.Equal(want, got, path)
+	}
+	_, ok := types.ByExtension("archive.unknownext")
+	assert.False(ok)
+
+	err := types.Load(strings.NewReader("# comment\n\napplication/x-custom  cst cust  # trailing\ntext/markdown md\n"))
+	assert.NoError(err)
+	custom, _ := types.ByExtension("a.CUST")
+	assert.Equal("application/x-custom", custom)
+	markdown, _ := types.ByExtension("README.md")
+	assert.Equal("text/markdown", markdown, "Loaded entries override the defaults")
+
+	assert.Error(types.Load(strings.NewReader("notatype ext\n")))
+}
+
+func TestMIMETypesTypeOf(t *testing.T) {
+	assert := assert.New(t)
+	types := NewMIMETypes()
+	dir := t.TempDir()
+
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"page.html", "<p>hi</p>", "text/html; charset=utf-8"},
+		{"notes", "just some text\n", "text/plain; charset=utf-8"},
+		{"page", "  <!DOCTYPE html><html></html>", "text/html; charset=utf-8"},
+		{"image", "\x89PNG\r\n\x1a\n\x00\x00", "image/png"},
+		{"doc", "%PDF-1.7\n", "application/pdf"},
+		{"blob", "\x00\x01\x02\x03binary", DefaultType},
+		{"empty", "", "text/plain; charset=utf-8"},
+	}
+	for _, test := range tests {
+		path := filepath.Join(dir, test.name)
+		os.WriteFile(path, []byte(test.content), 0o644)
+		file, _ := os.Open(path)
+		got, err := types.TypeOf(path, file)
+		assert.NoError(err, test.name)
+		assert.Equal(test.want, got, test.name)
+
+		rest, _ := io.ReadAll(file)
+		assert.Equal(test.content, string(rest), "TypeOf rewinds the file")
+		file.Close()
+	}
+}
+
+func TestSniff(t *testing.T) {
+	ts := make([]byte, 376)
+	ts[0], ts[188] = 0x47, 0x47
+
+	tests := []struct {
+		head string
+		want string
+	}{
+		{"\xff\xd8\xff\xe0", "image/jpeg"},
+		{"GIF89a", "image/gif"},
+		{"RIFF\x00\x00\x00\x00WEBPVP8 ", "image/webp"},
+		{"RIFF\x00\x00\x00\x00WAVEfmt ", DefaultType},
+		{"\x00\x00\x00\x18ftypmp42", "video/mp4"},
+		{"#EXTM3U\n#EXT-X-VERSION:3\n", "application/vnd.apple.mpegurl"},
+		{string(ts), "video/mp2t"},
+		{"\xef\xbb\xbf<html>", "text/html"},
+		{"<?xml version=\"1.0\"?><svg xmlns=\"http://www.w3.org/2000/svg\"/>", "image/svg+xml"},
+		{"<?xml version=\"1.0\"?><feed/>", "text/xml"},
+		{"héllo wörld", "text/plain"},
+		{"cut off \xc3", "text/plain"},
+		{"bad \xc3 utf-8 in the middle", DefaultType},
+		{"bell\x07", DefaultType},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.want, Sniff([]byte(test.head)), "%q", test.head)
+	}
+}
+
+func TestParseAcceptEncoding(t *testing.T) {
+	assert.Equal(t, []Coding{{"gzip", 1}, {"deflate", 0.5}, {"br", 0}, {"*", 0.1}},
+		ParseAcceptEncoding("GZip, deflate;q=0.5, br;q=2, *;Q=0.1"))
+	assert.Empty(t, ParseAcceptEncoding(""))
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"gzip, deflate, br", "gzip"},
+		{"deflate", "deflate"},
+		{"deflate, gzip;q=0.8", "deflate"},
+		{"gzip;q=0", ""},
+		{"gzip;q=0, *", "deflate"},
+		{"*", "gzip"},
+		{"br", ""},
+		{"gzip;q=0.5, identity", ""},
+		{"gzip;q=0.5, identity;q=0.5", "gzip"},
+		{"identity;q=0, *;q=0.3", "gzip"},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.want, Negotiate(test.header, "gzip", "deflate"), test.header)
+	}
+}
+
+func TestCompressible(t *testing.T) {
+	assert := assert.New(t)
+	assert.True(Compressible("text/html; charset=utf-8"))
+	assert.True(Compressible("application/json"))
+	assert.True(Compressible("image/svg+xml"))
+	assert.False(Compressible("image/png"))
+	assert.False(Compressible("video/mp2t"))
+	assert.False(Compressible(DefaultType))
+}
+
+func TestEncodedETag(t *testing.T) {
+	assert.Equal(t, `"abc-gzip"`, EncodedETag(`"abc"`, "gzip"))
+	assert.Equal(t, `W/"abc-deflate"`, EncodedETag(`W/"abc"`, "deflate"))
+	assert.Equal(t, `"abc"`, EncodedETag(`"abc"`, ""))
+}
+
+func decompress(t *testing.T, coding string, data []byte) string {
+	var reader io.Reader
+	var err error
+	switch coding {
+	case "gzip":
+		reader, err = gzip.NewReader(bytes.NewReader(data))
+	case "deflate":
+		reader, err = zlib.NewReader(bytes.NewReader(data))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(plain)
+}
+
+func TestCompress(t *testing.T) {
+	text := strings.Repeat("<li><a href=\"/file\">file</a></li>\n", 100)
+	for _, coding := range []string{"gzip", "deflate"} {
+		compressed, err := Compress([]byte(text), coding)
+		assert.NoError(t, err)
+		assert.Less(t, len(compressed), len(text)/10, "A listing shrinks noticeably")
+		assert.Equal(t, text, decompress(t, coding, compressed))
+	}
+	_, err := Compress([]byte(text), "br")
+	assert.Error(t, err)
+}
+
+func TestServeEncoded(t *testing.T) {
+	text := strings.Repeat("All work and no play makes Jack a dull boy.\n", 200)
+	path := writeFile(t, text)
+	handler := func(coding string) http1.Handler {
+		return func(w *http1.Response, req *http1.Request) {
+			file, _ := os.Open(path)
+			defer file.Close()
+			info, _ := file.Stat()
+			w.Header.Set("Vary", "Accept-Encoding")
+			SetValidators(w, info.ModTime(), EncodedETag(ETag(info), coding))
+			assert.NoError(t, ServeEncoded(w, req, file, "text/plain; charset=utf-8", coding))
+		}
+	}
+
+	for _, coding := range []string{"gzip", "deflate"} {
+		t.Run(coding, func(t *testing.T) {
+			assert := assert.New(t)
+			resp, body := serveWith(t, handler(coding), "GET", "Range: bytes=0-9")
+			assert.Equal(200, resp.StatusCode, "Ranges are not applied to on-the-fly encodings")
+			assert.Equal(coding, resp.Header.Get("Content-Encoding"))
+			assert.Equal("Accept-Encoding", resp.Header.Get("Vary"))
+			assert.Empty(resp.Header.Get("Accept-Ranges"))
+			assert.Less(len(body), len(text)/10)
+			assert.Equal(text, decompress(t, coding, body))
+
+			resp, _ = serveWith(t, handler(coding), "GET", "If-None-Match: "+resp.Header.Get("ETag"))
+			assert.Equal(304, resp.StatusCode)
+			assert.Equal("Accept-Encoding", resp.Header.Get("Vary"))
+		})
+	}
+}
+
+func TestOpenPrecompressed(t *testing.T) {
+	assert := assert.New(t)
+	path := writeFile(t, "plain")
+	info, _ := os.Stat(path)
+	resolver, err := NewResolver(filepath.Dir(path), SymlinksInsideRoot, true)
+	assert.NoError(err)
+
+	_, _, _, ok := resolver.OpenPrecompressed("/file.txt", info)
+	assert.False(ok, "No sibling")
+
+	compressed, _ := Compress([]byte("plain"), "gzip")
+	os.WriteFile(path+".gz", compressed, 0o644)
+	file, gzPath, gzInfo, ok := resolver.OpenPrecompressed("/file.txt", info)
+	if assert.True(ok) {
+		assert.Equal(filepath.Join(resolver.Root(), "file.txt.gz"), gzPath)
+		assert.Equal(int64(len(compressed)), gzInfo.Size())
+		file.Close()
+	}
+
+	later := info.ModTime().Add(time.Hour)
+	os.Chtimes(path, later, later)
+	info, _ = os.Stat(path)
+	_, _, _, ok = resolver.OpenPrecompressed("/file.txt", info)
+	assert.False(ok, "A sibling older than the file is stale")
+}
+
+func TestOpenPrecompressedFollowsResolver(t *testing.T) {
+	base, root := resolverTree(t)
+	compressed, _ := Compress([]byte("www-secret/key"), "gzip")
+	os.WriteFile(filepath.Join(base, "www-secret", "key.gz"), compressed, 0o644)
+	os.WriteFile(filepath.Join(root, "secret.txt"), []byte("placeholder"), 0o644)
+	os.Symlink(filepath.Join(base, "www-secret", "key.gz"), filepath.Join(root, "secret.txt.gz"))
+	info, _ := os.Stat(filepath.Join(root, "secret.txt"))
+	old := info.ModTime().Add(-time.Hour)
+	os.Chtimes(filepath.Join(root, "secret.txt"), old, old)
+	info, _ = os.Stat(filepath.Join(root, "secret.txt"))
+
+	inside, _ := NewResolver(root, SymlinksInsideRoot, true)
+	_, _, _, ok := inside.OpenPrecompressed("/secret.txt", info)
+	assert.False(t, ok, "Expected a sibling linking out of the root to be refused")
+
+	follow, _ := NewResolver(root, SymlinksFollow, true)
+	file, _, _, ok := follow.OpenPrecompressed("/secret.txt", info)
+	if assert.True(t, ok, "Expected the follow policy to allow the link") {
+		file.Close()
+	}
+}
+
+// resolverTree lays out base/www as the root with a sibling
+// base/www-secret, and returns base and the real root path.
+func resolverTree(t *testing.T) (string, string) {
+	base, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(base, "www")
+	for _, dir := range []string{"www/docs", "www/.git", "www-secret"} {
+		os.MkdirAll(filepath.Join(base, dir), 0o755)
+	}
+	for _, file := range []string{"www/index.html", "www/docs/a.txt", "www/.env", "www/.git/config", "www-secret/key"} {
+		os.WriteFile(filepath.Join(base, file), []byte(file), 0o644)
+	}
+	os.Symlink(filepath.Join(root, "docs"), filepath.Join(root, "inside"))
+	os.Symlink(filepath.Join(base, "www-secret"), filepath.Join(root, "outside"))
+	os.Symlink("../www-secret/key", filepath.Join(root, "key"))
+	os.Symlink("missing", filepath.Join(root, "dangling"))
+	return base, root
+}
+
+func TestResolve(t *testing.T) {
+	base, root := resolverTree(t)
+	tests := []struct {
+		path   string
+		policy SymlinkPolicy
+		want   string
+		err    error
+	}{
+		{path: "/", want: root},
+		{path: "/index.html", want: root + "/index.html"},
+		{path: "/docs/../index.html", want: root + "/index.html"},
+		{path: "/../www-secret/key", err: ErrNotFound},
+		{path: "/../../" + filepath.Base(base) + "/www-secret/key", err: ErrNotFound},
+		{path: "/missing", err: ErrNotFound},
+		{path: "/index.html/x", err: ErrNotFound},
+		{path: "/a\x00b", err: ErrNotFound},
+		{path: "/.env", err: ErrNotFound},
+		{path: "/.git/config", err: ErrNotFound},
+		{path: "/inside/a.txt", want: root + "/docs/a.txt"},
+		{path: "/outside/key", err: ErrForbidden},
+		{path: "/key", err: ErrForbidden},
+		{path: "/dangling", err: ErrNotFound},
+		{path: "/outside/key", policy: SymlinksFollow, want: base + "/www-secret/key"},
+		{path: "/key", policy: SymlinksFollow, want: base + "/www-secret/key"},
+		{path: "/inside/a.txt", policy: SymlinksDeny, err: ErrForbidden},
+		{path: "/docs/a.txt", policy: SymlinksDeny, want: root + "/docs/a.txt"},
+	}
+
+	for _, tc := range tests {
+		t.Run(fmt.Sprintf("%q/%d", tc.path, tc.policy), func(t *testing.T) {
+			resolver, err := NewResolver(root, tc.policy, true)
+			if !assert.NoError(t, err) {
+				return
+			}
+			got, err := resolver.Resolve(tc.path)
+			assert.ErrorIs(t, err, tc.err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestResolveDotfilesShown(t *testing.T) {
+	_, root := resolverTree(t)
+	resolver, _ := NewResolver(root, SymlinksInsideRoot, false)
+	got, err := resolver.Resolve("/.env")
+	assert.NoError(t, err)
+	assert.Equal(t, root+"/.env", got)
+}
+
+func TestWithin(t *testing.T) {
+	assert := assert.New(t)
+	assert.True(Within("/srv/www", "/srv/www"))
+	assert.True(Within("/srv/www", "/srv/www/a/b"))
+	assert.True(Within("/srv/www", "/srv/www/..a"))
+	assert.False(Within("/srv/www", "/srv/www-secret"))
+	assert.False(Within("/srv/www", "/srv"))
+	assert.False(Within("/srv/www", "/etc/passwd"))
+}
+
+func TestDirLocation(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("/assets/", DirLocation("/assets", ""))
+	assert.Equal("/assets/?sort=size", DirLocation("/assets", "sort=size"))
+	assert.Equal("/assets/", DirLocation("//evil.com/../assets", ""))
+	assert.Equal("/evil.com/", DirLocation("//evil.com", ""))
+	assert.Equal("/", DirLocation("/..", ""))
+}
+
+func TestSortEntries(t *testing.T) {
+	day := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	entries := func() []Entry {
+		return []Entry{
+			{Name: "b.txt", Size: 10, ModTime: day.Add(2 * time.Hour)},
+			{Name: "sub", IsDir: true, ModTime: day},
+			{Name: "A.txt", Size: 30, ModTime: day.Add(time.Hour)},
+			{Name: "c.txt", Size: 20, ModTime: day},
+		}
+	}
+	names := func(entries []Entry) []string {
+		var out []string
+		for _, e := range entries {
+			out = append(out, e.Name)
+		}
+		return out
+	}
+	tests := []struct {
+		key  string
+		desc bool
+		want []string
+	}{
+		{"name", false, []string{"sub", "A.txt", "b.txt", "c.txt"}},
+		{"name", true, []string{"sub", "c.txt", "b.txt", "A.txt"}},
+		{"size", false, []string{"sub", "b.txt", "c.txt", "A.txt"}},
+		{"mtime", true, []string{"sub", "b.txt", "A.txt", "c.txt"}},
+		{"bogus", false, []string{"sub", "A.txt", "b.txt", "c.txt"}},
+	}
+	for _, tc := range tests {
+		got := entries()
+		SortEntries(got, tc.key, tc.desc)
+		assert.Equal(t, tc.want, names(got), "%s desc=%v", tc.key, tc.desc)
+	}
+}
+
+func TestListing(t *testing.T) {
+	assert := assert.New(t)
+	mtime := time.Date(2024, 3, 5, 14, 30, 0, 0, time.UTC)
+	entries := []Entry{
+		{Name: "<script>.txt", Size: 1536, ModTime: mtime},
+		{Name: "a b#c?.txt", Size: 3, ModTime: mtime},
+		{Name: "sub", IsDir: true, ModTime: mtime},
+	}
+	page := string(Listing("/docs & more/", entries, "name", false))
+
+	assert.Contains(page, "<title>Index of /docs &amp; more/</title>")
+	assert.Contains(page, `<a href="../">../</a>`)
+	assert.Contains(page, `<a href="/docs%20&amp;%20more/sub/">sub/</a>`)
+	assert.Contains(page, `<a href="/docs%20&amp;%20more/%3Cscript%3E.txt">&lt;script&gt;.txt</a></td><td>1.5 KiB</td><td>2024-03-05 14:30</td>`)
+	assert.Contains(page, `<a href="/docs%20&amp;%20more/a%20b%23c%3F.txt">a b#c?.txt</a></td><td>3 B</td>`)
+	assert.NotContains(page, "<script>")
+	assert.NotContains(page, "/./")
+	assert.Contains(page, `<a href="?sort=name&amp;order=desc">Name</a>`, "The active column toggles its order")
+	assert.Contains(page, `<a href="?sort=size&amp;order=asc">Size</a>`)
+	assert.Less(strings.Index(page, "sub/"), strings.Index(page, "a b#c"), "Directories come first")
+
+	root := string(Listing("/", []Entry{{Name: "file"}}, "", false))
+	assert.Contains(root, `<a href="?sort=name&amp;order=desc">Name</a>`, "Name is the default order")
+	assert.NotContains(root, `href="../"`, "No parent link at the root")
+	assert.Contains(root, `<a href="/file">file</a>`)
+}
+
+func TestFormatSize(t *testing.T) {
+	assert.Equal(t, "0 B", FormatSize(0))
+	assert.Equal(t, "1023 B", FormatSize(1023))
+	assert.Equal(t, "1.0 KiB", FormatSize(1024))
+	assert.Equal(t, "2.5 MiB", FormatSize(5<<19))
+	assert.Equal(t, "3.0 GiB", FormatSize(3<<30))
+}
@@ -0,0 +1,437 @@
+package httpproxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vinh0604/go-network-concepts/internal/http1"
+)
+
+const (
+	DefaultDialTimeout     = 5 * time.Second
+	DefaultResponseTimeout = 30 * time.Second
+	DefaultMaxIdle         = 8
+	DefaultIdleTimeout     = 30 * time.Second
+	DefaultMaxFails        = 3
+	DefaultFailTimeout     = 10 * time.Second
+)
+
+// hopByHop are the fields that describe one connection rather than the
+// message, RFC 9110 section 7.6.1, so a proxy must not pass them on.
+var hopByHop = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"TE",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// RemoveHopByHop deletes the hop-by-hop fields from h, including any
+// listed in its Connection header.
+func RemoveHopByHop(h http1.Header) {
+	for _, value := range h.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHop {
+		h.Del(name)
+	}
+}
+
+// Balance is how a Proxy spreads requests over its upstreams.
+type Balance int
+
+const (
+	// RoundRobin takes the healthy upstreams in turn.
+	RoundRobin Balance = iota
+	// LeastConnections takes the healthy upstream with the fewest
+	// requests in flight.
+	LeastConnections
+)
+
+func ParseBalance(name string) (Balance, error) {
+	switch name {
+	case "", "round-robin":
+		return RoundRobin, nil
+	case "least-conn":
+		return LeastConnections, nil
+	}
+	return 0, fmt.Errorf("unknown balance %q (expected round-robin or least-conn)", name)
+}
+
+// Proxy forwards requests to a set of upstream HTTP/1.1 servers. MaxFails
+// failures in a row take an upstream out of rotation for FailTimeout.
+type Proxy struct {
+	// StripPrefix is removed from the request path before forwarding.
+	StripPrefix string
+	Balance     Balance
+	// PreserveHost sends the client's Host header upstream instead of
+	// the upstream's address.
+	PreserveHost bool
+
+	DialTimeout time.Duration
+	// ResponseTimeout bounds the wait for a response head.
+	ResponseTimeout time.Duration
+	// MaxIdle is the number of idle connections kept per upstream.
+	MaxIdle     int
+	IdleTimeout time.Duration
+	MaxFails    int
+	FailTimeout time.Duration
+
+	mu        sync.Mutex
+	upstreams []*upstream
+	next      int
+}
+
+type upstream struct {
+	addr string
+	// The fields below are guarded by Proxy.mu.
+	active    int
+	fails     int
+	downUntil time.Time
+	idle      []*upstreamConn
+}
+
+type upstreamConn struct {
+	net.Conn
+	reader *bufio.Reader
+	since  time.Time
+	reused bool
+}
+
+// New returns a Proxy for the host:port addresses in upstreams.
+func New(upstreams ...string) *Proxy {
+	p := &Proxy{}
+	for _, addr := range upstreams {
+		p.upstreams = append(p.upstreams, &upstream{addr: addr})
+	}
+	return p
+}
+
+// Serve forwards req and streams the upstream's response to w. An error
+// returned before w.Status is set is an *http1.Error carrying the status
+// to answer with. Failed requests move to the next upstream only when
+// they are safe to send again.
+func (p *Proxy) Serve(w *http1.Response, req *http1.Request) error {
+	if hasDotSegments(req.Path) {
+		// The upstream may resolve them to a path the route doesn't cover.
+		return &http1.Error{Status: http1.StatusBadRequest, Reason: "path with dot segments"}
+	}
+	body := &clientBody{r: req.Body}
+	out := p.outgoing(req, body)
+	replayable := req.ContentLength == 0 && (req.Method == "GET" || req.Method == "HEAD" || req.Method == "OPTIONS")
+
+	tried := map[*upstream]bool{}
+	var lastErr error
+	for {
+		u := p.pick(tried)
+		if u == nil {
+			break
+		}
+		tried[u] = true
+
+		conn, resp, sent, err := p.roundTrip(u, out, replayable)
+		if body.err != nil {
+			// The client, not the upstream, broke the exchange.
+			p.release(u, conn, false, true)
+			return body.err
+		}
+		if err != nil {
+			p.release(u, conn, false, false)
+			lastErr = fmt.Errorf("%s: %w", u.addr, err)
+			if sent && !replayable {
+				break
+			}
+			continue
+		}
+
+		err = p.stream(w, resp)
+		p.release(u, conn, err == nil && !resp.Close, !errors.Is(err, errUpstreamBody))
+		return err
+	}
+
+	if lastErr == nil {
+		return &http1.Error{Status: http1.StatusServiceUnavailable, Reason: "no healthy upstream"}
+	}
+	return &http1.Error{Status: http1.StatusBadGateway, Reason: lastErr.Error()}
+}
+
+// roundTrip sends out to u and reads the response head. sent reports
+// whether any of the request may have reached the upstream. Only
+// replayable requests take pooled connections, which may have been closed
+// by the upstream meanwhile.
+func (p *Proxy) roundTrip(u *upstream, out *http1.Request, replayable bool) (*upstreamConn, *http1.ClientResponse, bool, error) {
+	var conn *upstreamConn
+	if replayable {
+		conn = p.idleConn(u)
+	}
+	for {
+		if conn == nil {
+			var err error
+			conn, err = p.dial(u)
+			if err != nil {
+				return nil, nil, false, err
+			}
+		}
+		if !p.PreserveHost {
+			out.Host = u.addr
+		}
+
+		resp, err := p.exchange(conn, out)
+		if err == nil {
+			return conn, resp, true, nil
+		}
+		if conn.reused && replayable {
+			conn.Close()
+			conn = nil
+			continue
+		}
+		return conn, nil, true, err
+	}
+}
+
+func (p *Proxy) exchange(conn *upstreamConn, out *http1.Request) (*http1.ClientResponse, error) {
+	timeout := p.ResponseTimeout
+	if timeout <= 0 {
+		timeout = DefaultResponseTimeout
+	}
+	if err := out.Write(conn); err != nil {
+		return nil, fmt.Errorf("sending request: %w", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		resp, err := http1.ReadResponse(conn.reader, out.Method, http1.Limits{})
+		if err != nil {
+			return nil, fmt.Errorf("reading response: %w", err)
+		}
+		// Interim responses such as 100 Continue are for the hop that
+		// asked for them.
+		if resp.StatusCode >= 200 {
+			return resp, nil
+		}
+	}
+}
+
+// errUpstreamBody marks a response body the upstream broke off, as
+// opposed to a client that went away while it was being sent.
+var errUpstreamBody = errors.New("reading upstream body")
+
+// stream copies the response to the client, flushing after every read so
+// event streams aren't held up.
+func (p *Proxy) stream(w *http1.Response, resp *http1.ClientResponse) error {
+	for name, values := range resp.Header {
+		w.Header[name] = values
+	}
+	RemoveHopByHop(w.Header)
+	w.WriteHeader(resp.StatusCode)
+
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return fmt.Errorf("writing response: %w", werr)
+			}
+			if werr := w.Flush(); werr != nil {
+				return fmt.Errorf("writing response: %w", werr)
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %w", errUpstreamBody, err)
+		}
+	}
+}
+
+// pick chooses the next healthy upstream not yet tried, or nil.
+func (p *Proxy) pick(tried map[*upstream]bool) *upstream {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	var chosen *upstream
+	for i := range p.upstreams {
+		u := p.upstreams[(p.next+i)%len(p.upstreams)]
+		if tried[u] || now.Before(u.downUntil) {
+			continue
+		}
+		if chosen == nil || p.Balance == LeastConnections && u.active < chosen.active {
+			chosen = u
+		}
+		if p.Balance == RoundRobin {
+			break
+		}
+	}
+	if chosen != nil {
+		chosen.active++
+		p.next++
+	}
+	return chosen
+}
+
+// release ends a request on u, pooling the connection when keep is set.
+func (p *Proxy) release(u *upstream, conn *upstreamConn, keep bool, healthy bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	u.active--
+	if healthy {
+		u.fails = 0
+	} else {
+		u.fails++
+		if u.fails >= withDefault(p.MaxFails, DefaultMaxFails) {
+			u.fails = 0
+			u.downUntil = time.Now().Add(withDefault(p.FailTimeout, DefaultFailTimeout))
+		}
+	}
+
+	if conn == nil {
+		return
+	}
+	if !keep || len(u.idle) >= withDefault(p.MaxIdle, DefaultMaxIdle) {
+		conn.Close()
+		return
+	}
+	conn.since = time.Now()
+	conn.reused = true
+	u.idle = append(u.idle, conn)
+}
+
+// idleConn takes the most recently used pooled connection to u, closing
+// any that have been idle too long.
+func (p *Proxy) idleConn(u *upstream) *upstreamConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	expiry := time.Now().Add(-withDefault(p.IdleTimeout, DefaultIdleTimeout))
+	for len(u.idle) > 0 {
+		conn := u.idle[len(u.idle)-1]
+		u.idle = u.idle[:len(u.idle)-1]
+		if conn.since.After(expiry) {
+			return conn
+		}
+		conn.Close()
+	}
+	return nil
+}
+
+func (p *Proxy) dial(u *upstream) (*upstreamConn, error) {
+	conn, err := net.DialTimeout("tcp", u.addr, withDefault(p.DialTimeout, DefaultDialTimeout))
+	if err != nil {
+		return nil, err
+	}
+	return &upstreamConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// CloseIdle closes the pooled connections.
+func (p *Proxy) CloseIdle() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, u := range p.upstreams {
+		for _, conn := range u.idle {
+			conn.Close()
+		}
+		u.idle = nil
+	}
+}
+
+func withDefault[T int | time.Duration](value T, fallback T) T {
+	if value <= 0 {
+		return fallback
+	}
+	return value
+}
+
+// outgoing builds the request sent upstream, without hop-by-hop fields and
+// with X-Forwarded-* ones.
+func (p *Proxy) outgoing(req *http1.Request, body io.Reader) *http1.Request {
+	header := http1.Header{}
+	for name, values := range req.Header {
+		header[name] = values
+	}
+	RemoveHopByHop(header)
+
+	if ip, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		if prior := strings.Join(header.Values("X-Forwarded-For"), ", "); prior != "" {
+			ip = prior + ", " + ip
+		}
+		header.Set("X-Forwarded-For", ip)
+	}
+	if req.Host != "" {
+		header.Set("X-Forwarded-Host", req.Host)
+	}
+	proto := "http"
+	if req.TLS {
+		proto = "https"
+	}
+	header.Set("X-Forwarded-Proto", proto)
+
+	target := req.Target
+	if rest, ok := p.stripPrefix(req.Path); ok {
+		target = (&url.URL{Path: rest, RawQuery: req.RawQuery}).RequestURI()
+	}
+
+	return &http1.Request{
+		Method:        req.Method,
+		Target:        target,
+		Host:          req.Host,
+		Header:        header,
+		ContentLength: req.ContentLength,
+		Body:          body,
+	}
+}
+
+// stripPrefix removes StripPrefix from urlPath when it is a prefix of
+// whole segments, so "/api" comes off "/api/users" but not "/apiary".
+func (p *Proxy) stripPrefix(urlPath string) (string, bool) {
+	rest, ok := strings.CutPrefix(urlPath, p.StripPrefix)
+	if p.StripPrefix == "" || !ok {
+		return "", false
+	}
+	if !strings.HasPrefix(rest, "/") {
+		if rest != "" && !strings.HasSuffix(p.StripPrefix, "/") {
+			return "", false
+		}
+		rest = "/" + rest
+	}
+	return rest, true
+}
+
+// hasDotSegments reports whether urlPath has a "." or ".." segment.
+func hasDotSegments(urlPath string) bool {
+	for _, segment := range strings.Split(urlPath, "/") {
+		if segment == "." || segment == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// clientBody remembers a failure reading the client's request body, so
+// it isn't blamed on the upstream.
+type clientBody struct {
+	r   io.Reader
+	err error
+}
+
+func (b *clientBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err != nil && !errors.Is(err, io.EOF) {
+		b.err = err
+	}
+	return n, err
+}
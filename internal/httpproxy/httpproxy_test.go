@@ -0,0 +1,377 @@
+package httpproxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vinh0604/go-network-concepts/internal/http1"
+)
+
+// listen serves handler on a loopback port until the test ends.
+func listen(t *testing.T, handler http1.Handler) string {
+	return serve(t, &http1.Server{Handler: handler}, nil)
+}
+
+// serve runs server on a loopback port, counting accepted connections in
+// conns when it is given.
+func serve(t *testing.T, server *http1.Server, conns *atomic.Int32) string {
+	sock, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sock.Close() })
+	go func() {
+		for {
+			conn, err := sock.Accept()
+			if err != nil {
+				return
+			}
+			if conns != nil {
+				conns.Add(1)
+			}
+			go server.ServeConn(conn)
+		}
+	}()
+	return sock.Addr().String()
+}
+
+// echo answers with a summary of the request it received.
+func echo(name string) http1.Handler {
+	return func(w *http1.Response, req *http1.Request) {
+		body, _ := io.ReadAll(req.Body)
+		w.Header.Set("X-Upstream", name)
+		w.Header.Set("Keep-Alive", "timeout=5")
+		fmt.Fprintf(w, "%s %s host=%s conn=%s custom=%s body=%s",
+			req.Method, req.Target, req.Host, req.Header.Get("Connection"), req.Header.Get("X-Custom"), body)
+	}
+}
+
+// front serves p on a loopback port, answering errors the way a server
+// using it would.
+func front(t *testing.T, p *Proxy) string {
+	return listen(t, func(w *http1.Response, req *http1.Request) {
+		if err := p.Serve(w, req); err != nil && w.Status() == 0 {
+			w.Header.Set("Content-Type", "text/plain")
+			w.WriteHeader(http1.StatusOf(err))
+			io.WriteString(w, err.Error())
+		}
+	})
+}
+
+func do(t *testing.T, method string, url string, body string, header ...string) (*http.Response, string) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp, string(data)
+}
+
+func TestProxy(t *testing.T) {
+	assert := assert.New(t)
+	upstream := listen(t, echo("a"))
+	addr := front(t, New(upstream))
+
+	resp, body := do(t, "POST", "http://"+addr+"/path?q=1", "payload", "X-Custom", "yes", "Connection", "keep-alive, X-Custom")
+	assert.Equal(200, resp.StatusCode)
+	assert.Equal("a", resp.Header.Get("X-Upstream"))
+	assert.Empty(resp.Header.Get("Keep-Alive"), "Hop-by-hop fields from the upstream are dropped")
+	assert.Equal("POST /path?q=1 host="+upstream+" conn= custom= body=payload", body, "Fields named in Connection are dropped too")
+}
+
+func TestProxyForwardedHeaders(t *testing.T) {
+	assert := assert.New(t)
+	seen := make(chan http1.Header, 2)
+	hosts := make(chan string, 2)
+	upstream := listen(t, func(w *http1.Response, req *http1.Request) {
+		seen <- req.Header
+		hosts <- req.Host
+	})
+
+	addr := front(t, New(upstream))
+	do(t, "GET", "http://"+addr+"/", "", "X-Forwarded-For", "203.0.113.9")
+	header := <-seen
+	assert.Equal(upstream, <-hosts, "Host names the upstream")
+	assert.Equal("203.0.113.9, 127.0.0.1", header.Get("X-Forwarded-For"), "The client is appended to the chain")
+	assert.Equal(addr, header.Get("X-Forwarded-Host"))
+	assert.Equal("http", header.Get("X-Forwarded-Proto"))
+
+	preserving := New(upstream)
+	preserving.PreserveHost = true
+	addr = front(t, preserving)
+	do(t, "GET", "http://"+addr+"/", "")
+	<-seen
+	assert.Equal(addr, <-hosts, "PreserveHost passes the client's Host on")
+}
+
+func TestProxyStripPrefix(t *testing.T) {
+	upstream := listen(t, echo("a"))
+	p := New(upstream)
+	p.StripPrefix = "/api"
+	addr := front(t, p)
+
+	for path, want := range map[string]string{"/api/users?id=2": "GET /users?id=2 ", "/api": "GET / ", "/apiary": "GET /apiary "} {
+		_, body := do(t, "GET", "http://"+addr+path, "")
+		assert.True(t, strings.HasPrefix(body, want), "%s: %s", path, body)
+	}
+}
+
+func TestProxyRejectsDotSegments(t *testing.T) {
+	upstream := listen(t, echo("a"))
+	addr := front(t, New(upstream))
+
+	for _, path := range []string{"/public/../internal", "/public/./x", "/public/%2e%2e/internal"} {
+		resp, _ := do(t, "GET", "http://"+addr+path, "")
+		assert.Equal(t, 400, resp.StatusCode, path)
+	}
+}
+
+func TestProxyStatusAndFailover(t *testing.T) {
+	assert := assert.New(t)
+	upstream := listen(t, func(w *http1.Response, req *http1.Request) {
+		w.WriteHeader(http1.StatusNotFound)
+		io.WriteString(w, "missing")
+	})
+	deadAddr := broken(t)
+
+	addr := front(t, New(deadAddr, upstream))
+	resp, body := do(t, "GET", "http://"+addr+"/", "")
+	assert.Equal(404, resp.StatusCode, "Status passes through from the next upstream")
+	assert.Equal("missing", body)
+
+	addr = front(t, New(deadAddr, upstream))
+	resp, _ = do(t, "POST", "http://"+addr+"/", "once")
+	assert.Equal(http1.StatusBadGateway, resp.StatusCode, "A request with a body that may have been sent isn't replayed")
+
+	addr = front(t, New(deadAddr))
+	resp, _ = do(t, "GET", "http://"+addr+"/", "")
+	assert.Equal(http1.StatusBadGateway, resp.StatusCode)
+}
+
+// broken returns an upstream that hangs up on every connection. An
+// address nothing listens on would do too, but its port could be handed
+// to the next listener the test opens.
+func broken(t *testing.T) string {
+	sock, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sock.Close() })
+	go func() {
+		for {
+			conn, err := sock.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	return sock.Addr().String()
+}
+
+func TestRemoveHopByHop(t *testing.T) {
+	h := http1.Header{}
+	h.Set("Connection", "close, X-Secret")
+	h.Set("X-Secret", "1")
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Content-Type", "text/plain")
+	RemoveHopByHop(h)
+	assert.Equal(t, http1.Header{"content-type": {"text/plain"}}, h)
+}
+
+func TestProxyPoolsConnections(t *testing.T) {
+	assert := assert.New(t)
+	var conns atomic.Int32
+	upstream := serve(t, &http1.Server{Handler: echo("a")}, &conns)
+	p := New(upstream)
+	addr := front(t, p)
+
+	for i := 0; i < 5; i++ {
+		resp, _ := do(t, "GET", "http://"+addr+"/", "")
+		assert.Equal(200, resp.StatusCode)
+	}
+	assert.Equal(int32(1), conns.Load(), "Sequential requests share one upstream connection")
+
+	do(t, "POST", "http://"+addr+"/", "body")
+	assert.Equal(int32(2), conns.Load(), "A request with a body isn't sent on a pooled connection")
+	do(t, "GET", "http://"+addr+"/", "")
+	assert.Equal(int32(2), conns.Load(), "but its connection is pooled afterwards")
+}
+
+func TestProxyRetriesStalePooledConnection(t *testing.T) {
+	assert := assert.New(t)
+	// The upstream closes connections after a short idle time, leaving
+	// the pooled one dead.
+	upstream := serve(t, &http1.Server{Handler: echo("a"), IdleTimeout: 20 * time.Millisecond}, nil)
+	addr := front(t, New(upstream))
+	resp, _ := do(t, "GET", "http://"+addr+"/", "")
+	assert.Equal(200, resp.StatusCode)
+	time.Sleep(60 * time.Millisecond)
+	resp, body := do(t, "GET", "http://"+addr+"/", "")
+	assert.Equal(200, resp.StatusCode)
+	assert.Contains(body, "GET /")
+}
+
+func TestProxyRoundRobin(t *testing.T) {
+	a := listen(t, echo("a"))
+	b := listen(t, echo("b"))
+	addr := front(t, New(a, b))
+
+	var order []string
+	for i := 0; i < 4; i++ {
+		resp, _ := do(t, "GET", "http://"+addr+"/", "")
+		order = append(order, resp.Header.Get("X-Upstream"))
+	}
+	assert.Equal(t, []string{"a", "b", "a", "b"}, order)
+}
+
+func TestProxyLeastConnections(t *testing.T) {
+	assert := assert.New(t)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	slow := listen(t, func(w *http1.Response, req *http1.Request) {
+		w.Header.Set("X-Upstream", "slow")
+		if req.Path == "/slow" {
+			started <- struct{}{}
+			<-release
+		}
+	})
+	fast := listen(t, echo("fast"))
+	p := New(slow, fast)
+	p.Balance = LeastConnections
+	addr := front(t, p)
+
+	done := make(chan string)
+	go func() {
+		resp, _ := do(t, "GET", "http://"+addr+"/slow", "")
+		done <- resp.Header.Get("X-Upstream")
+	}()
+	<-started
+	for i := 0; i < 3; i++ {
+		resp, _ := do(t, "GET", "http://"+addr+"/", "")
+		assert.Equal("fast", resp.Header.Get("X-Upstream"), "The busy upstream is passed over")
+	}
+	close(release)
+	assert.Equal("slow", <-done)
+}
+
+func TestProxyPassiveHealthCheck(t *testing.T) {
+	assert := assert.New(t)
+	good := listen(t, echo("good"))
+	dead := broken(t)
+	p := New(dead, good)
+	p.MaxFails = 2
+	p.FailTimeout = time.Hour
+	addr := front(t, p)
+
+	for i := 0; i < 4; i++ {
+		resp, _ := do(t, "GET", "http://"+addr+"/", "")
+		assert.Equal("good", resp.Header.Get("X-Upstream"), "Failed upstreams are skipped for the next one")
+	}
+	p.mu.Lock()
+	down := time.Now().Before(p.upstreams[0].downUntil)
+	p.mu.Unlock()
+	assert.True(down, "Repeated failures take the upstream out of rotation")
+
+	p.upstreams[1].downUntil = time.Now().Add(time.Hour)
+	resp, _ := do(t, "GET", "http://"+addr+"/", "")
+	assert.Equal(http1.StatusServiceUnavailable, resp.StatusCode, "No healthy upstream left")
+}
+
+func TestProxyBrokenBodyCountsAsFailure(t *testing.T) {
+	sock, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sock.Close() })
+	go func() {
+		for {
+			conn, err := sock.Accept()
+			if err != nil {
+				return
+			}
+			// Promise 100 bytes, send a few and hang up.
+			http.ReadRequest(bufio.NewReader(conn))
+			io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\nshort")
+			conn.Close()
+		}
+	}()
+
+	p := New(sock.Addr().String())
+	p.MaxFails = 1
+	p.FailTimeout = time.Hour
+	addr := front(t, p)
+	req, _ := http.NewRequest("GET", "http://"+addr+"/", nil)
+	if resp, err := http.DefaultClient.Do(req); err == nil {
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	p.mu.Lock()
+	down := time.Now().Before(p.upstreams[0].downUntil)
+	p.mu.Unlock()
+	assert.True(t, down, "An upstream that breaks off its body counts as failed")
+}
+
+func TestProxyStreamsBodies(t *testing.T) {
+	assert := assert.New(t)
+	next := make(chan struct{})
+	upstream := listen(t, func(w *http1.Response, req *http1.Request) {
+		body, _ := io.ReadAll(req.Body)
+		fmt.Fprintf(w, "got %d bytes\n", len(body))
+		w.Flush()
+		<-next
+		io.WriteString(w, "done\n")
+	})
+	addr := front(t, New(upstream))
+
+	// A chunked upload of unknown length goes through as it is read.
+	upload, uploadWriter := io.Pipe()
+	go func() {
+		for i := 0; i < 4; i++ {
+			uploadWriter.Write([]byte(strings.Repeat("x", 1000)))
+		}
+		uploadWriter.Close()
+	}()
+	req, _ := http.NewRequest("POST", "http://"+addr+"/", upload)
+	resp, err := http.DefaultClient.Do(req)
+	if !assert.NoError(err) {
+		return
+	}
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+
+	line, err := reader.ReadString('\n')
+	assert.NoError(err)
+	assert.Equal("got 4000 bytes\n", line, "The first part arrives while the upstream is still working")
+	close(next)
+	line, _ = reader.ReadString('\n')
+	assert.Equal("done\n", line)
+}
+
+func TestParseBalance(t *testing.T) {
+	for name, want := range map[string]Balance{"": RoundRobin, "round-robin": RoundRobin, "least-conn": LeastConnections} {
+		got, err := ParseBalance(name)
+		assert.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+	_, err := ParseBalance("random")
+	assert.Error(t, err)
+}
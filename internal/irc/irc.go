@@ -0,0 +1,381 @@
+package irc
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/vinh0604/go-network-concepts/internal/chatmodels"
+)
+
+// maxLineLength is generous compared to the 512 bytes allowed by RFC 1459 so
+// that clients sending IRCv3 message tags are not cut off.
+const maxLineLength = 8192
+
+// encryptedNotice stands in for end-to-end encrypted DMs, which IRC clients
+// cannot decrypt.
+const encryptedNotice = "(encrypted message, use the chat client to read it)"
+
+const (
+	RplWelcome       = "001"
+	RplYourHost      = "002"
+	RplCreated       = "003"
+	RplMyInfo        = "004"
+	RplChannelModes  = "324"
+	RplEndOfWho      = "315"
+	RplNoTopic       = "331"
+	RplNamReply      = "353"
+	RplEndOfNames    = "366"
+	ErrNoSuchNick    = "401"
+	ErrNoSuchChan    = "403"
+	ErrUnknownCmd    = "421"
+	ErrNoMotd        = "422"
+	ErrNoNickGiven   = "431"
+	ErrNotOnChannel  = "442"
+	ErrNotRegistered = "451"
+	ErrNeedMoreArgs  = "461"
+)
+
+type Message struct {
+	Prefix  string
+	Command string
+	Params  []string
+}
+
+// ParseMessage parses a single IRC line without its trailing CRLF. IRCv3
+// message tags are accepted and discarded.
+func ParseMessage(line string) (*Message, error) {
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, "@") {
+		_, line, _ = strings.Cut(line, " ")
+	}
+	line = strings.TrimLeft(line, " ")
+
+	msg := &Message{}
+	if strings.HasPrefix(line, ":") {
+		msg.Prefix, line, _ = strings.Cut(line[1:], " ")
+		line = strings.TrimLeft(line, " ")
+	}
+
+	for line != "" {
+		if strings.HasPrefix(line, ":") {
+			msg.Params = append(msg.Params, line[1:])
+			break
+		}
+		var param string
+		param, line, _ = strings.Cut(line, " ")
+		line = strings.TrimLeft(line, " ")
+		if msg.Command == "" {
+			msg.Command = strings.ToUpper(param)
+		} else {
+			msg.Params = append(msg.Params, param)
+		}
+	}
+
+	if msg.Command == "" {
+		return nil, errors.New("irc: missing command")
+	}
+	return msg, nil
+}
+
+// String formats the message as one IRC line without its CRLF, stripping
+// what could forge extra lines or params.
+func (m *Message) String() string {
+	var sb strings.Builder
+	if m.Prefix != "" {
+		sb.WriteString(":" + strings.ReplaceAll(lineUnsafe.Replace(m.Prefix), " ", "_") + " ")
+	}
+	sb.WriteString(lineUnsafe.Replace(m.Command))
+	for i, param := range m.Params {
+		param = lineUnsafe.Replace(param)
+		sb.WriteString(" ")
+		if i < len(m.Params)-1 {
+			sb.WriteString(strings.ReplaceAll(param, " ", "_"))
+			continue
+		}
+		if param == "" || strings.Contains(param, " ") || strings.HasPrefix(param, ":") {
+			sb.WriteString(":")
+		}
+		sb.WriteString(param)
+	}
+	return sb.String()
+}
+
+// lineUnsafe removes the characters that end or corrupt an IRC line, RFC
+// 2812 section 2.3.1.
+var lineUnsafe = strings.NewReplacer("\r", "", "\n", " ", "\x00", "")
+
+// BridgeConn speaks IRC to the remote client while presenting the
+// length-prefixed chatmodels stream to the chat server.
+type BridgeConn struct {
+	net.Conn
+	scanner    *bufio.Scanner
+	serverName string
+	channel    string
+	readBuf    []byte
+
+	writeMu  sync.Mutex
+	writeBuf []byte
+
+	stateMu    sync.Mutex
+	nick       string
+	user       bool
+	registered bool
+	joined     bool
+}
+
+func NewBridgeConn(conn net.Conn, serverName string, channel string) *BridgeConn {
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 512), maxLineLength)
+	return &BridgeConn{
+		Conn:       conn,
+		scanner:    scanner,
+		serverName: serverName,
+		channel:    channel,
+	}
+}
+
+func (c *BridgeConn) Read(b []byte) (int, error) {
+	for len(c.readBuf) == 0 {
+		if !c.scanner.Scan() {
+			if err := c.scanner.Err(); err != nil {
+				return 0, err
+			}
+			return 0, io.EOF
+		}
+		if strings.TrimSpace(c.scanner.Text()) == "" {
+			continue
+		}
+
+		msg, err := ParseMessage(c.scanner.Text())
+		if err != nil {
+			continue
+		}
+		payload, err := c.handle(msg)
+		if err != nil {
+			return 0, err
+		}
+		if payload != nil {
+			jsonBytes, err := json.Marshal(payload)
+			if err != nil {
+				return 0, err
+			}
+			c.readBuf = binary.BigEndian.AppendUint16(nil, uint16(len(jsonBytes)))
+			c.readBuf = append(c.readBuf, jsonBytes...)
+		}
+	}
+
+	n := copy(b, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	return n, nil
+}
+
+// handle answers protocol housekeeping locally and returns the payload to
+// forward to the chat server, if any. io.EOF is returned on QUIT.
+func (c *BridgeConn) handle(msg *Message) (*chatmodels.Payload, error) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+
+	switch msg.Command {
+	case "PING":
+		c.reply("PONG", append([]string{c.serverName}, msg.Params...)...)
+	case "PONG", "CAP":
+		if msg.Command == "CAP" && len(msg.Params) > 0 && strings.ToUpper(msg.Params[0]) == "LS" {
+			c.reply("CAP", "*", "LS", "")
+		}
+	case "NICK":
+		if len(msg.Params) == 0 || msg.Params[0] == "" {
+			c.numeric(ErrNoNickGiven, "No nickname given")
+		} else if c.joined {
+			// The new nick takes effect once the server confirms it.
+			nick := msg.Params[0]
+			return &chatmodels.Payload{MsgType: chatmodels.MsgTypeNick, Nick: &nick}, nil
+		} else {
+			c.nick = msg.Params[0]
+			c.register()
+		}
+	case "USER":
+		if len(msg.Params) < 4 {
+			c.numeric(ErrNeedMoreArgs, "USER", "Not enough parameters")
+		} else {
+			c.user = true
+			c.register()
+		}
+	case "JOIN":
+		if !c.registered {
+			c.numeric(ErrNotRegistered, "You have not registered")
+		} else if len(msg.Params) == 0 || !strings.EqualFold(msg.Params[0], c.channel) {
+			c.numeric(ErrNoSuchChan, firstParam(msg), "Only "+c.channel+" is available")
+		} else if !c.joined {
+			c.joined = true
+			c.send(&Message{Prefix: hostmask(c.nick), Command: "JOIN", Params: []string{c.channel}})
+			c.numeric(RplNoTopic, c.channel, "No topic is set")
+			c.numeric(RplNamReply, "=", c.channel, c.nick)
+			c.numeric(RplEndOfNames, c.channel, "End of /NAMES list")
+			nick := c.nick
+			return &chatmodels.Payload{MsgType: chatmodels.MsgTypeHello, Nick: &nick}, nil
+		}
+	case "PRIVMSG":
+		if len(msg.Params) < 2 {
+			c.numeric(ErrNeedMoreArgs, "PRIVMSG", "Not enough parameters")
+		} else if !c.joined {
+			c.numeric(ErrNotOnChannel, c.channel, "You're not on that channel")
+		} else if strings.HasPrefix(msg.Params[0], "#") && !strings.EqualFold(msg.Params[0], c.channel) {
+			c.numeric(ErrNoSuchChan, msg.Params[0], "Only "+c.channel+" is available")
+		} else if !strings.EqualFold(msg.Params[0], c.channel) {
+			target, text := msg.Params[0], msg.Params[1]
+			return &chatmodels.Payload{MsgType: chatmodels.MsgTypeDM, Nick: &target, Msg: &text}, nil
+		} else {
+			text := msg.Params[1]
+			return &chatmodels.Payload{MsgType: chatmodels.MsgTypeChat, Msg: &text}, nil
+		}
+	case "PART":
+		if !c.joined {
+			c.numeric(ErrNotOnChannel, firstParam(msg), "You're not on that channel")
+		} else {
+			c.joined = false
+			c.send(&Message{Prefix: hostmask(c.nick), Command: "PART", Params: []string{c.channel}})
+			nick := c.nick
+			return &chatmodels.Payload{MsgType: chatmodels.MsgTypeLeave, Nick: &nick}, nil
+		}
+	case "QUIT":
+		c.reply("ERROR", "Closing link")
+		return nil, io.EOF
+	case "MODE":
+		if len(msg.Params) > 0 && strings.EqualFold(msg.Params[0], c.channel) {
+			c.numeric(RplChannelModes, c.channel, "+")
+		}
+	case "WHO":
+		c.numeric(RplEndOfWho, firstParam(msg), "End of /WHO list")
+	default:
+		c.numeric(ErrUnknownCmd, msg.Command, "Unknown command")
+	}
+	return nil, nil
+}
+
+func (c *BridgeConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.writeBuf = append(c.writeBuf, b...)
+	payloads := []chatmodels.Payload{}
+	for len(c.writeBuf) >= 2 {
+		payloadLength := int(binary.BigEndian.Uint16(c.writeBuf[:2]))
+		if len(c.writeBuf) < 2+payloadLength {
+			break
+		}
+		var payload chatmodels.Payload
+		if err := json.Unmarshal(c.writeBuf[2:2+payloadLength], &payload); err == nil {
+			payloads = append(payloads, payload)
+		}
+		c.writeBuf = c.writeBuf[2+payloadLength:]
+	}
+
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	for _, payload := range payloads {
+		for _, line := range c.translate(payload) {
+			if err := c.send(line); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return len(b), nil
+}
+
+func (c *BridgeConn) translate(payload chatmodels.Payload) []*Message {
+	if !c.joined && payload.MsgType != chatmodels.MsgTypeAnn {
+		return nil
+	}
+
+	nick := ""
+	if payload.Nick != nil {
+		nick = *payload.Nick
+	}
+	text := ""
+	if payload.Msg != nil {
+		text = *payload.Msg
+	} else if payload.Ciphertext != nil {
+		text = encryptedNotice
+	}
+
+	switch payload.MsgType {
+	case chatmodels.MsgTypeChat, chatmodels.MsgTypeDM:
+		target := c.channel
+		if payload.MsgType == chatmodels.MsgTypeDM {
+			target = c.nick
+		}
+		lines := []*Message{}
+		for _, line := range strings.Split(strings.ReplaceAll(text, "\r", ""), "\n") {
+			lines = append(lines, &Message{Prefix: hostmask(nick), Command: "PRIVMSG", Params: []string{target, line}})
+		}
+		return lines
+	case chatmodels.MsgTypeNick:
+		if text == c.nick {
+			c.nick = nick
+		}
+		return []*Message{{Prefix: hostmask(text), Command: "NICK", Params: []string{nick}}}
+	case chatmodels.MsgTypeJoin:
+		return []*Message{{Prefix: hostmask(nick), Command: "JOIN", Params: []string{c.channel}}}
+	case chatmodels.MsgTypeLeave:
+		return []*Message{{Prefix: hostmask(nick), Command: "PART", Params: []string{c.channel}}}
+	case chatmodels.MsgTypeTopic:
+		return []*Message{{Prefix: hostmask(nick), Command: "TOPIC", Params: []string{c.channel, text}}}
+	case chatmodels.MsgTypeAnn:
+		target := c.nick
+		if target == "" {
+			target = "*"
+		}
+		return []*Message{{Prefix: c.serverName, Command: "NOTICE", Params: []string{target, text}}}
+	}
+	return nil
+}
+
+// register welcomes the client once it has sent both NICK and USER, in
+// either order.
+func (c *BridgeConn) register() {
+	if c.registered || c.nick == "" || !c.user {
+		return
+	}
+	c.registered = true
+	c.numeric(RplWelcome, "Welcome to the chat network "+c.nick)
+	c.numeric(RplYourHost, "Your host is "+c.serverName)
+	c.numeric(RplCreated, "This server bridges IRC into chat-server")
+	c.numeric(RplMyInfo, c.serverName, "go-network-concepts", "o", "o")
+	c.numeric(ErrNoMotd, "MOTD File is missing")
+}
+
+func (c *BridgeConn) reply(command string, params ...string) error {
+	return c.send(&Message{Prefix: c.serverName, Command: command, Params: params})
+}
+
+func (c *BridgeConn) numeric(code string, params ...string) error {
+	target := c.nick
+	if target == "" {
+		target = "*"
+	}
+	return c.reply(code, append([]string{target}, params...)...)
+}
+
+func (c *BridgeConn) send(msg *Message) error {
+	_, err := c.Conn.Write([]byte(msg.String() + "\r\n"))
+	return err
+}
+
+func hostmask(nick string) string {
+	nick = strings.ReplaceAll(nick, " ", "_")
+	return fmt.Sprintf("%s!%s@chat", nick, nick)
+}
+
+func firstParam(msg *Message) string {
+	if len(msg.Params) == 0 {
+		return "*"
+	}
+	return msg.Params[0]
+}
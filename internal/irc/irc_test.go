@@ -0,0 +1,183 @@
+package irc
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vinh0604/go-network-concepts/internal/chatmodels"
+)
+
+func TestParseMessage(t *testing.T) {
+	tests := []struct {
+		line     string
+		expected *Message
+	}{
+		{"NICK alice", &Message{Command: "NICK", Params: []string{"alice"}}},
+		{"USER alice 0 * :Alice Liddell", &Message{Command: "USER", Params: []string{"alice", "0", "*", "Alice Liddell"}}},
+		{":bob!bob@host PRIVMSG #chat :hello there\r\n", &Message{Prefix: "bob!bob@host", Command: "PRIVMSG", Params: []string{"#chat", "hello there"}}},
+		{"@time=2024-01-01T00:00:00Z privmsg #chat ::)", &Message{Command: "PRIVMSG", Params: []string{"#chat", ":)"}}},
+		{"PING :irc.example.com", &Message{Command: "PING", Params: []string{"irc.example.com"}}},
+		{"QUIT", &Message{Command: "QUIT"}},
+	}
+
+	for _, test := range tests {
+		msg, err := ParseMessage(test.line)
+		assert.NoError(t, err, "Expected no error parsing %q", test.line)
+		assert.Equal(t, test.expected, msg, "Unexpected parse result for %q", test.line)
+	}
+
+	_, err := ParseMessage(":prefix.only")
+	assert.Error(t, err, "Expected an error when the command is missing")
+}
+
+func TestMessageString(t *testing.T) {
+	assert.Equal(t, ":bob!bob@chat PRIVMSG #chat :hello there",
+		(&Message{Prefix: "bob!bob@chat", Command: "PRIVMSG", Params: []string{"#chat", "hello there"}}).String())
+	assert.Equal(t, "JOIN #chat", (&Message{Command: "JOIN", Params: []string{"#chat"}}).String())
+	assert.Equal(t, "TOPIC #chat :", (&Message{Command: "TOPIC", Params: []string{"#chat", ""}}).String())
+}
+
+func TestMessageStringStripsLineBreaks(t *testing.T) {
+	injected := &Message{
+		Prefix:  "evil\r\nKILL alice!x@chat",
+		Command: "TOPIC",
+		Params:  []string{"#chat\r\nQUIT", "new topic\r\nPRIVMSG #chat :owned\x00"},
+	}
+	line := injected.String()
+	assert.NotContains(t, line, "\r")
+	assert.NotContains(t, line, "\n")
+	assert.NotContains(t, line, "\x00")
+	assert.Equal(t, ":evil_KILL_alice!x@chat TOPIC #chat_QUIT :new topic PRIVMSG #chat :owned", line)
+
+	msg, err := ParseMessage(line)
+	assert.NoError(t, err)
+	assert.Len(t, msg.Params, 2, "Expected the injected text to stay inside the original params")
+}
+
+func TestBridgeConnUserBeforeNick(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	bridge := NewBridgeConn(server, "chat.local", "#chat")
+	defer bridge.Close()
+	lines := bufio.NewReader(client)
+
+	go client.Write([]byte("USER alice 0 * :Alice\r\nNICK alice\r\n"))
+	go io.Copy(io.Discard, bridge)
+	expectLine(t, lines, ":chat.local 001 alice :Welcome to the chat network alice")
+}
+
+func TestBridgeConn(t *testing.T) {
+	assert := assert.New(t)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	bridge := NewBridgeConn(server, "chat.local", "#chat")
+	defer bridge.Close()
+	lines := bufio.NewReader(client)
+
+	go client.Write([]byte("CAP LS 302\r\nNICK alice\r\nUSER alice 0 * :Alice\r\nPING :keepalive\r\nJOIN #chat\r\nPRIVMSG #chat :hi all\r\nPART #chat\r\nQUIT :bye\r\n"))
+
+	// The server side of the bridge only ever sees chat payloads
+	payloads := make(chan *chatmodels.Payload)
+	go func() {
+		for {
+			payload, err := readPayload(bridge)
+			if err != nil {
+				close(payloads)
+				return
+			}
+			payloads <- payload
+		}
+	}()
+
+	expectLine(t, lines, ":chat.local CAP * LS :")
+	expectLine(t, lines, ":chat.local 001 alice :Welcome to the chat network alice")
+	for i := 0; i < 4; i++ {
+		lines.ReadString('\n')
+	}
+	expectLine(t, lines, ":chat.local PONG chat.local keepalive")
+	expectLine(t, lines, ":alice!alice@chat JOIN #chat")
+	for i := 0; i < 3; i++ {
+		lines.ReadString('\n')
+	}
+
+	hello := <-payloads
+	assert.Equal(chatmodels.MsgTypeHello, hello.MsgType)
+	assert.Equal("alice", *hello.Nick)
+	chat := <-payloads
+	assert.Equal(chatmodels.MsgTypeChat, chat.MsgType)
+	assert.Equal("hi all", *chat.Msg)
+
+	expectLine(t, lines, ":alice!alice@chat PART #chat")
+	leave := <-payloads
+	assert.Equal(chatmodels.MsgTypeLeave, leave.MsgType)
+
+	expectLine(t, lines, ":chat.local ERROR :Closing link")
+	_, open := <-payloads
+	assert.False(open, "Expected QUIT to end the payload stream")
+}
+
+func TestBridgeConnWrite(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	bridge := NewBridgeConn(server, "chat.local", "#chat")
+	defer bridge.Close()
+	lines := bufio.NewReader(client)
+
+	go client.Write([]byte("NICK alice\r\nUSER alice 0 * :Alice\r\nJOIN #chat\r\n"))
+	go io.Copy(io.Discard, bridge)
+	for i := 0; i < 9; i++ {
+		lines.ReadString('\n')
+	}
+
+	bob := "bob"
+	alice := "alice"
+	alicia := "alicia"
+	text := "first line\nsecond line"
+	secret := "psst"
+	go func() {
+		bridge.Write(encodePayload(chatmodels.Payload{MsgType: chatmodels.MsgTypeJoin, Nick: &bob}))
+		bridge.Write(encodePayload(chatmodels.Payload{MsgType: chatmodels.MsgTypeChat, Nick: &bob, Msg: &text}))
+		bridge.Write(encodePayload(chatmodels.Payload{MsgType: chatmodels.MsgTypeNick, Nick: &alicia, Msg: &alice}))
+		bridge.Write(encodePayload(chatmodels.Payload{MsgType: chatmodels.MsgTypeDM, Nick: &bob, Msg: &secret}))
+		bridge.Write(encodePayload(chatmodels.Payload{MsgType: chatmodels.MsgTypeDM, Nick: &bob, Ciphertext: []byte{1, 2}, Nonce: []byte{3}}))
+	}()
+
+	expectLine(t, lines, ":bob!bob@chat JOIN #chat")
+	expectLine(t, lines, ":bob!bob@chat PRIVMSG #chat :first line")
+	expectLine(t, lines, ":bob!bob@chat PRIVMSG #chat :second line")
+	expectLine(t, lines, ":alice!alice@chat NICK alicia")
+	expectLine(t, lines, ":bob!bob@chat PRIVMSG alicia psst")
+	expectLine(t, lines, ":bob!bob@chat PRIVMSG alicia :"+encryptedNotice)
+}
+
+func expectLine(t *testing.T, reader *bufio.Reader, expected string) {
+	line, err := reader.ReadString('\n')
+	assert.NoError(t, err, "Failed to read IRC line")
+	assert.Equal(t, expected, strings.TrimRight(line, "\r\n"))
+}
+
+func readPayload(conn net.Conn) (*chatmodels.Payload, error) {
+	lenBytes := make([]byte, 2)
+	if _, err := io.ReadFull(conn, lenBytes); err != nil {
+		return nil, err
+	}
+	jsonBytes := make([]byte, binary.BigEndian.Uint16(lenBytes))
+	if _, err := io.ReadFull(conn, jsonBytes); err != nil {
+		return nil, err
+	}
+	var payload chatmodels.Payload
+	err := json.Unmarshal(jsonBytes, &payload)
+	return &payload, err
+}
+
+func encodePayload(payload chatmodels.Payload) []byte {
+	jsonBytes, _ := json.Marshal(payload)
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(jsonBytes))), jsonBytes...)
+}
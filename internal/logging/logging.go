@@ -0,0 +1,101 @@
+package logging
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+)
+
+type Options struct {
+	Level  string
+	Format string
+}
+
+// RegisterFlags adds -log-level and -log-format to the default flag set. Call
+// it before flag.Parse and Options.Setup after.
+func RegisterFlags() *Options {
+	opts := &Options{}
+	flag.StringVar(&opts.Level, "log-level", "info", "Log level: debug, info, warn or error")
+	flag.StringVar(&opts.Format, "log-format", "text", "Log format: text or json")
+	return opts
+}
+
+// Setup builds a logger from the parsed flags and installs it as the slog
+// default.
+func (o *Options) Setup(w io.Writer) *slog.Logger {
+	logger, err := New(w, o.Level, o.Format)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		os.Exit(2)
+	}
+	slog.SetDefault(logger)
+	return logger
+}
+
+func New(w io.Writer, level string, format string) (*slog.Logger, error) {
+	slogLevel, err := ParseLevel(level)
+	if err != nil {
+		return nil, err
+	}
+
+	handlerOpts := &slog.HandlerOptions{Level: slogLevel}
+	switch strings.ToLower(format) {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, handlerOpts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, handlerOpts)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q: must be text or json", format)
+	}
+}
+
+func ParseLevel(level string) (slog.Level, error) {
+	var slogLevel slog.Level
+	if err := slogLevel.UnmarshalText([]byte(level)); err != nil {
+		return 0, fmt.Errorf("invalid log level %q: must be debug, info, warn or error", level)
+	}
+	return slogLevel, nil
+}
+
+// WithConn returns a logger that tags every record with the connection's
+// network and remote address, and its file descriptor when it has one.
+func WithConn(logger *slog.Logger, conn net.Conn) *slog.Logger {
+	logger = logger.With("network", conn.RemoteAddr().Network(), "remote_addr", conn.RemoteAddr().String())
+	if fd, ok := connFd(conn); ok {
+		logger = logger.With("fd", fd)
+	}
+	return logger
+}
+
+// connFd returns the descriptor under conn, looking through wrappers such
+// as *tls.Conn.
+func connFd(conn net.Conn) (uintptr, bool) {
+	if wrapper, ok := conn.(interface{ NetConn() net.Conn }); ok {
+		conn = wrapper.NetConn()
+	}
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return 0, false
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return 0, false
+	}
+	var fd uintptr
+	if err := raw.Control(func(f uintptr) { fd = f }); err != nil {
+		return 0, false
+	}
+	return fd, true
+}
+
+// Fatal logs an unrecoverable error and exits with status 1.
+func Fatal(logger *slog.Logger, msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,89 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLevel(t *testing.T) {
+	level, err := ParseLevel("debug")
+	assert.NoError(t, err)
+	assert.Equal(t, slog.LevelDebug, level)
+
+	level, err = ParseLevel("WARN")
+	assert.NoError(t, err, "Expected levels to be case-insensitive")
+	assert.Equal(t, slog.LevelWarn, level)
+
+	_, err = ParseLevel("verbose")
+	assert.Error(t, err, "Expected an error for an unknown level")
+}
+
+func TestNewJSON(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, "info", "json")
+	assert.NoError(t, err)
+
+	logger.Debug("hidden")
+	logger.Info("client joined", "nick", "alice")
+
+	var record map[string]any
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &record), "Expected exactly one JSON record")
+	assert.Equal(t, "INFO", record["level"])
+	assert.Equal(t, "client joined", record["msg"])
+	assert.Equal(t, "alice", record["nick"])
+}
+
+func TestNewText(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, "debug", "text")
+	assert.NoError(t, err)
+
+	logger.Debug("request", "path", "/index.html")
+	assert.Contains(t, buf.String(), "level=DEBUG msg=request path=/index.html")
+
+	_, err = New(&buf, "info", "xml")
+	assert.Error(t, err, "Expected an error for an unknown format")
+}
+
+func TestWithConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	var buf bytes.Buffer
+	logger, _ := New(&buf, "info", "json")
+	WithConn(logger, server).Info("connected")
+
+	var record map[string]any
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &record))
+	assert.Equal(t, "pipe", record["network"])
+	assert.Equal(t, "pipe", record["remote_addr"])
+	assert.NotContains(t, record, "fd", "A pipe has no file descriptor")
+}
+
+func TestWithConnFd(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var buf bytes.Buffer
+	logger, _ := New(&buf, "info", "json")
+	WithConn(logger, conn).Info("connected")
+
+	var record map[string]any
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &record))
+	assert.Equal(t, "tcp", record["network"])
+	assert.Contains(t, record, "fd")
+}
@@ -2,6 +2,7 @@ package netfunc
 
 import (
 	"errors"
+	"net/netip"
 	"slices"
 	"strconv"
 	"strings"
@@ -20,6 +21,9 @@ func IpStringToBytes(ipv4 string) ([]byte, error) {
 		if err != nil {
 			return nil, err
 		}
+		if num < 0 || num > 255 {
+			return nil, errors.New("invalid IPv4 address")
+		}
 		ipBytes[i] = byte(num)
 	}
 
@@ -137,3 +141,35 @@ func RouterForIp(routers map[string]RouterInfo, ip string) (string, error) {
 
 	return "", errors.New("no router found for IP")
 }
+
+// ParseCidr parses a CIDR block, or a bare address as a single-address
+// block, with host bits cleared.
+func ParseCidr(cidr string) (netip.Prefix, error) {
+	if !strings.Contains(cidr, "/") {
+		addr, err := netip.ParseAddr(cidr)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		addr = addr.Unmap().WithZone("")
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return prefix.Masked(), nil
+}
+
+// IpInCidr reports whether ip, IPv4 or IPv6, falls inside cidr. An IPv4
+// address written as IPv4-mapped IPv6 matches IPv4 blocks.
+func IpInCidr(ip string, cidr string) (bool, error) {
+	prefix, err := ParseCidr(cidr)
+	if err != nil {
+		return false, err
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false, err
+	}
+	return prefix.Contains(addr.Unmap().WithZone("")), nil
+}
@@ -18,6 +18,9 @@ func TestIpStringToBytes_withInvalidIp(t *testing.T) {
 
 	_, err = IpStringToBytes("a.b.c.d")
 	assert.Error(t, err, "Expected an error when converting an invalid IP address")
+
+	_, err = IpStringToBytes("192.167.23.256")
+	assert.Error(t, err, "Expected an error when an octet is out of range")
 }
 
 func TestIpBytesToInt32_withValidIpBytes(t *testing.T) {
@@ -102,3 +105,50 @@ func TestRouterForIp(t *testing.T) {
 	_, err = RouterForIp(routers, "10.35.166.170")
 	assert.Error(t, err, "Expected an error when getting the router for an IP")
 }
+
+func TestParseCidr(t *testing.T) {
+	prefix, err := ParseCidr("10.34.166.0/24")
+	assert.NoError(t, err, "Expected no error when parsing a valid CIDR")
+	assert.Equal(t, "10.34.166.0/24", prefix.String(), "Expected the correct network and subnet notation")
+
+	prefix, err = ParseCidr("10.34.166.7")
+	assert.NoError(t, err, "Expected a bare IP to be accepted as a /32")
+	assert.Equal(t, "10.34.166.7/32", prefix.String(), "Expected a bare IP to be treated as /32")
+
+	prefix, err = ParseCidr("2001:db8::1/32")
+	assert.NoError(t, err, "Expected IPv6 blocks to be accepted")
+	assert.Equal(t, "2001:db8::/32", prefix.String(), "Expected host bits to be cleared")
+
+	prefix, err = ParseCidr("::1")
+	assert.NoError(t, err, "Expected a bare IPv6 address to be accepted")
+	assert.Equal(t, 128, prefix.Bits(), "Expected a bare IPv6 address to be treated as /128")
+
+	for _, invalid := range []string{"10.34.166.0/33", "10.34.166/24", "999.1.1.1/8", "256.0.0.1", "2001:db8::/129", "nick"} {
+		_, err = ParseCidr(invalid)
+		assert.Error(t, err, "Expected an error when parsing %s", invalid)
+	}
+}
+
+func TestIpInCidr(t *testing.T) {
+	result, err := IpInCidr("192.168.1.77", "192.168.1.0/24")
+	assert.NoError(t, err, "Expected no error when matching an IP against a CIDR")
+	assert.True(t, result, "Expected the IP to be inside the CIDR")
+
+	result, _ = IpInCidr("192.168.2.77", "192.168.1.0/24")
+	assert.False(t, result, "Expected the IP to be outside the CIDR")
+
+	result, _ = IpInCidr("192.168.1.77", "192.168.1.77")
+	assert.True(t, result, "Expected a bare IP to match itself")
+
+	result, _ = IpInCidr("2001:db8:0:1::5", "2001:db8::/32")
+	assert.True(t, result, "Expected IPv6 addresses to match IPv6 blocks")
+
+	result, _ = IpInCidr("::ffff:192.168.1.77", "192.168.1.0/24")
+	assert.True(t, result, "Expected IPv4-mapped addresses to match IPv4 blocks")
+
+	result, _ = IpInCidr("2001:db8::5", "192.168.1.0/24")
+	assert.False(t, result, "Expected an IPv6 address not to match an IPv4 block")
+
+	_, err = IpInCidr("not-an-ip", "192.168.1.0/24")
+	assert.Error(t, err, "Expected an error when matching an invalid IP address")
+}
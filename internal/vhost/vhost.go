@@ -0,0 +1,303 @@
+package vhost
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/vinh0604/go-network-concepts/internal/httpproxy"
+)
+
+// Config maps Host header values to sites. In YAML:
+//
+//	hosts:
+//	  - names: [example.com, www.example.com]
+//	    root: /srv/example
+//	    error_pages:
+//	      404: errors/404.html
+//	    routes:
+//	      - prefix: /docs
+//	        root: /srv/docs
+//	      - prefix: /old
+//	        redirect: https://example.com/new
+//	      - prefix: /api
+//	        proxy: [127.0.0.1:9000, 127.0.0.1:9001]
+//	        balance: least-conn
+//	  - names: ["*"]
+//	    root: /srv/default
+type Config struct {
+	Hosts []*Host `json:"hosts" yaml:"hosts"`
+}
+
+// Host is one site. Names are matched exactly, as "*.example.com" for any
+// subdomain, or as "*" for requests no other host claims.
+type Host struct {
+	Names []string `json:"names" yaml:"names"`
+	// Root, when set, is served for paths no route matches.
+	Root   string   `json:"root" yaml:"root"`
+	Routes []*Route `json:"routes" yaml:"routes"`
+	// ErrorPages maps a status code to a file sent as the body of that
+	// error.
+	ErrorPages map[int]string `json:"error_pages" yaml:"error_pages"`
+}
+
+// Route handles the paths under Prefix in exactly one way: files from
+// Root, a redirect to Redirect, or forwarding to the Proxy upstreams.
+type Route struct {
+	Prefix string `json:"prefix" yaml:"prefix"`
+	Root   string `json:"root" yaml:"root"`
+	// Redirect is the target URL; the rest of the path after Prefix and
+	// the query are appended to it. Status defaults to 302.
+	Redirect string   `json:"redirect" yaml:"redirect"`
+	Status   int      `json:"status" yaml:"status"`
+	Proxy    []string `json:"proxy" yaml:"proxy"`
+	// StripPrefix forwards /api/x as /x instead of /api/x.
+	StripPrefix bool `json:"strip_prefix" yaml:"strip_prefix"`
+	// Balance is round-robin (the default) or least-conn.
+	Balance string `json:"balance" yaml:"balance"`
+	// PreserveHost sends the client's Host upstream rather than the
+	// upstream's address.
+	PreserveHost bool `json:"preserve_host" yaml:"preserve_host"`
+}
+
+// LoadConfig reads a JSON file (by its .json extension) or a YAML file.
+// Relative paths are taken from the config's directory.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Config{}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(cfg)
+	} else {
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		err = decoder.Decode(cfg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	dir := filepath.Dir(path)
+	for _, host := range cfg.Hosts {
+		host.Root = relativeTo(dir, host.Root)
+		for status, page := range host.ErrorPages {
+			host.ErrorPages[status] = relativeTo(dir, page)
+		}
+		for _, route := range host.Routes {
+			route.Root = relativeTo(dir, route.Root)
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+func relativeTo(dir string, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// Validate checks the config and normalises it, ordering routes longest
+// prefix first.
+func (c *Config) Validate() error {
+	if len(c.Hosts) == 0 {
+		return errors.New("no hosts configured")
+	}
+	seen := map[string]bool{}
+	for i, host := range c.Hosts {
+		if len(host.Names) == 0 {
+			return fmt.Errorf("host %d has no names", i+1)
+		}
+		for j, name := range host.Names {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			if bare := strings.TrimPrefix(name, "*."); name != "*" && (bare == "" || strings.Contains(bare, "*")) {
+				return fmt.Errorf("host %d: invalid name %q", i+1, host.Names[j])
+			}
+			if seen[name] {
+				return fmt.Errorf("host name %q is listed twice", name)
+			}
+			seen[name] = true
+			host.Names[j] = name
+		}
+		for status := range host.ErrorPages {
+			if status < 400 || status > 599 {
+				return fmt.Errorf("host %s: error page for non-error status %d", host.Names[0], status)
+			}
+		}
+
+		if host.Root != "" {
+			host.Routes = append(host.Routes, &Route{Prefix: "/", Root: host.Root})
+			host.Root = ""
+		}
+		if len(host.Routes) == 0 {
+			return fmt.Errorf("host %s has neither a root nor routes", host.Names[0])
+		}
+		for _, route := range host.Routes {
+			if err := route.validate(); err != nil {
+				return fmt.Errorf("host %s: %w", host.Names[0], err)
+			}
+		}
+		slices.SortStableFunc(host.Routes, func(a, b *Route) int {
+			return len(b.Prefix) - len(a.Prefix)
+		})
+	}
+	return nil
+}
+
+func (r *Route) validate() error {
+	if !strings.HasPrefix(r.Prefix, "/") {
+		return fmt.Errorf("route prefix %q must start with '/'", r.Prefix)
+	}
+	if r.Prefix != "/" {
+		r.Prefix = strings.TrimRight(r.Prefix, "/")
+	}
+
+	kinds := 0
+	for _, set := range []bool{r.Root != "", r.Redirect != "", len(r.Proxy) > 0} {
+		if set {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		return fmt.Errorf("route %s needs exactly one of root, redirect or proxy", r.Prefix)
+	}
+
+	if r.Redirect != "" {
+		if r.Status == 0 {
+			r.Status = 302
+		}
+		if !slices.Contains([]int{301, 302, 303, 307, 308}, r.Status) {
+			return fmt.Errorf("route %s: %d is not a redirect status", r.Prefix, r.Status)
+		}
+	} else if r.Status != 0 {
+		return fmt.Errorf("route %s: status only applies to redirects", r.Prefix)
+	}
+	if (r.StripPrefix || r.PreserveHost || r.Balance != "") && len(r.Proxy) == 0 {
+		return fmt.Errorf("route %s: strip_prefix, preserve_host and balance only apply to proxy routes", r.Prefix)
+	}
+	if _, err := httpproxy.ParseBalance(r.Balance); err != nil {
+		return fmt.Errorf("route %s: %w", r.Prefix, err)
+	}
+	for _, upstream := range r.Proxy {
+		if _, _, err := net.SplitHostPort(upstream); err != nil {
+			return fmt.Errorf("route %s: upstream %q is not host:port", r.Prefix, upstream)
+		}
+	}
+	return nil
+}
+
+// Matches reports whether the route handles urlPath. "/docs" handles
+// "/docs" and "/docs/..." but not "/docsearch".
+func (r *Route) Matches(urlPath string) bool {
+	if r.Prefix == "/" {
+		return true
+	}
+	urlPath = CleanPath(urlPath)
+	return strings.HasPrefix(urlPath, r.Prefix) && (len(urlPath) == len(r.Prefix) || urlPath[len(r.Prefix)] == '/')
+}
+
+// Location returns where a redirect route sends urlPath.
+func (r *Route) Location(urlPath string, rawQuery string) string {
+	rest := urlPath
+	if r.Prefix != "/" {
+		rest = strings.TrimPrefix(urlPath, r.Prefix)
+	}
+	location := r.Redirect
+	if rest != "" {
+		location = strings.TrimSuffix(r.Redirect, "/") + (&url.URL{Path: rest}).EscapedPath()
+	}
+	if rawQuery != "" {
+		location += "?" + rawQuery
+	}
+	return location
+}
+
+// CleanPath returns urlPath without "." and ".." segments or repeated
+// slashes, keeping a trailing slash.
+func CleanPath(urlPath string) string {
+	cleaned := path.Clean("/" + urlPath)
+	if strings.HasSuffix(urlPath, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// Route returns the route for urlPath, or nil when none matches.
+func (h *Host) Route(urlPath string) *Route {
+	for _, route := range h.Routes {
+		if route.Matches(urlPath) {
+			return route
+		}
+	}
+	return nil
+}
+
+// Router picks the host for a request's Host header.
+type Router struct {
+	exact     map[string]*Host
+	wildcards []wildcard
+	fallback  *Host
+}
+
+type wildcard struct {
+	suffix string
+	host   *Host
+}
+
+// NewRouter builds a Router from a validated config.
+func NewRouter(cfg *Config) *Router {
+	router := &Router{exact: map[string]*Host{}}
+	for _, host := range cfg.Hosts {
+		for _, name := range host.Names {
+			switch {
+			case name == "*":
+				router.fallback = host
+			case strings.HasPrefix(name, "*."):
+				router.wildcards = append(router.wildcards, wildcard{suffix: name[1:], host: host})
+			default:
+				router.exact[name] = host
+			}
+		}
+	}
+	// The most specific wildcard wins.
+	slices.SortStableFunc(router.wildcards, func(a, b wildcard) int {
+		return len(b.suffix) - len(a.suffix)
+	})
+	return router
+}
+
+// Host returns the site for a Host header value, which may carry a port,
+// or nil when no host matches and there's no "*" host.
+func (r *Router) Host(hostHeader string) *Host {
+	name := strings.ToLower(hostHeader)
+	if host, _, err := net.SplitHostPort(name); err == nil {
+		name = host
+	}
+	name = strings.TrimSuffix(strings.Trim(name, "[]"), ".")
+	if host, ok := r.exact[name]; ok {
+		return host
+	}
+	for _, w := range r.wildcards {
+		if strings.HasSuffix(name, w.suffix) {
+			return w.host
+		}
+	}
+	return r.fallback
+}
@@ -0,0 +1,174 @@
+package vhost
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const sampleYAML = `
+hosts:
+  - names: [Example.com, www.example.com]
+    root: site
+    error_pages:
+      404: errors/404.html
+    routes:
+      - prefix: /docs/
+        root: /srv/docs
+      - prefix: /old
+        redirect: https://example.com/new
+        status: 301
+      - prefix: /api
+        proxy: [127.0.0.1:9000, 127.0.0.1:9001]
+        strip_prefix: true
+        balance: least-conn
+  - names: ["*.example.com"]
+    root: /srv/sub
+  - names: ["*.api.example.com"]
+    root: /srv/api
+  - names: ["*"]
+    root: /srv/default
+`
+
+func writeConfig(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	assert := assert.New(t)
+	path := writeConfig(t, "sites.yaml", sampleYAML)
+	cfg, err := LoadConfig(path)
+	if !assert.NoError(err) {
+		return
+	}
+	dir := filepath.Dir(path)
+
+	host := cfg.Hosts[0]
+	assert.Equal([]string{"example.com", "www.example.com"}, host.Names)
+	assert.Equal(filepath.Join(dir, "errors/404.html"), host.ErrorPages[404])
+	var prefixes []string
+	for _, route := range host.Routes {
+		prefixes = append(prefixes, route.Prefix)
+	}
+	assert.Equal([]string{"/docs", "/old", "/api", "/"}, prefixes, "Longest prefix first, root last")
+	assert.Equal(filepath.Join(dir, "site"), host.Routes[3].Root)
+	assert.Equal(301, host.Routes[1].Status)
+	assert.Equal("least-conn", host.Routes[2].Balance)
+
+	jsonPath := writeConfig(t, "sites.json", `{"hosts": [{"names": ["a.test"], "routes": [{"prefix": "/", "redirect": "https://b.test"}], "error_pages": {"502": "/e.html"}}]}`)
+	cfg, err = LoadConfig(jsonPath)
+	if assert.NoError(err) {
+		assert.Equal(302, cfg.Hosts[0].Routes[0].Status, "Redirects default to 302")
+		assert.Equal("/e.html", cfg.Hosts[0].ErrorPages[502])
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := map[string]string{
+		"unknown key":      "hosts:\n  - names: [a]\n    root: /r\n    rooot: /x\n",
+		"no hosts":         "hosts: []\n",
+		"no names":         "hosts:\n  - root: /r\n",
+		"duplicate name":   "hosts:\n  - names: [a]\n    root: /r\n  - names: [A]\n    root: /s\n",
+		"bad wildcard":     "hosts:\n  - names: ['a.*.com']\n    root: /r\n",
+		"nothing to serve": "hosts:\n  - names: [a]\n",
+		"two kinds":        "hosts:\n  - names: [a]\n    routes:\n      - prefix: /x\n        root: /r\n        redirect: /y\n",
+		"relative prefix":  "hosts:\n  - names: [a]\n    routes:\n      - prefix: x\n        root: /r\n",
+		"bad status":       "hosts:\n  - names: [a]\n    routes:\n      - prefix: /x\n        redirect: /y\n        status: 200\n",
+		"bad upstream":     "hosts:\n  - names: [a]\n    routes:\n      - prefix: /x\n        proxy: [localhost]\n",
+		"strip without":    "hosts:\n  - names: [a]\n    routes:\n      - prefix: /x\n        root: /r\n        strip_prefix: true\n",
+		"bad balance":      "hosts:\n  - names: [a]\n    routes:\n      - prefix: /x\n        proxy: ['a:1']\n        balance: random\n",
+		"balance without":  "hosts:\n  - names: [a]\n    root: /r\n    routes:\n      - prefix: /x\n        root: /r\n        balance: least-conn\n",
+		"bad error page":   "hosts:\n  - names: [a]\n    root: /r\n    error_pages:\n      200: /ok.html\n",
+		"not yaml":         "hosts: [",
+	}
+	for name, content := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := LoadConfig(writeConfig(t, "sites.yaml", content))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestRouterHost(t *testing.T) {
+	cfg, err := LoadConfig(writeConfig(t, "sites.yaml", sampleYAML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := NewRouter(cfg)
+	root := func(hostHeader string) string {
+		host := router.Host(hostHeader)
+		if host == nil {
+			return ""
+		}
+		return host.Routes[len(host.Routes)-1].Root
+	}
+
+	assert := assert.New(t)
+	site := cfg.Hosts[0].Routes[3].Root
+	assert.Equal(site, root("example.com"))
+	assert.Equal(site, root("WWW.Example.COM:8080"))
+	assert.Equal(site, root("example.com."))
+	assert.Equal("/srv/sub", root("blog.example.com"))
+	assert.Equal("/srv/api", root("v1.api.example.com"), "The longer wildcard wins")
+	assert.Equal("/srv/default", root("other.test"))
+	assert.Equal("/srv/default", root(""), "HTTP/1.0 requests without Host")
+	assert.Equal("/srv/default", root("[::1]:8080"))
+
+	cfg.Hosts = cfg.Hosts[:1]
+	assert.Nil(NewRouter(cfg).Host("other.test"), "No fallback host")
+}
+
+func TestHostRoute(t *testing.T) {
+	cfg, err := LoadConfig(writeConfig(t, "sites.yaml", sampleYAML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := cfg.Hosts[0]
+	tests := map[string]string{
+		"/docs":        "/docs",
+		"/docs/a.html": "/docs",
+		"/docsearch":   "/",
+		"/api/v1":      "/api",
+		"/":            "/",
+		"/api/../old":  "/old",
+		"/docs/../api": "/api",
+		"//api":        "/api",
+	}
+	for path, prefix := range tests {
+		assert.Equal(t, prefix, host.Route(path).Prefix, path)
+	}
+
+	cfg.Hosts[0].Routes = cfg.Hosts[0].Routes[:3]
+	assert.Nil(t, host.Route("/elsewhere"))
+}
+
+func TestCleanPath(t *testing.T) {
+	tests := map[string]string{
+		"/":                   "/",
+		"":                    "/",
+		"/a/b":                "/a/b",
+		"/a/b/":               "/a/b/",
+		"/public/../internal": "/internal",
+		"/a/./b//c/":          "/a/b/c/",
+		"/../..":              "/",
+	}
+	for urlPath, want := range tests {
+		assert.Equal(t, want, CleanPath(urlPath), urlPath)
+	}
+}
+
+func TestRouteLocation(t *testing.T) {
+	route := &Route{Prefix: "/old", Redirect: "https://example.com/new/"}
+	assert.Equal(t, "https://example.com/new/", route.Location("/old", ""))
+	assert.Equal(t, "https://example.com/new/a%20b", route.Location("/old/a b", ""))
+	assert.Equal(t, "https://example.com/new/x?q=1", route.Location("/old/x", "q=1"))
+
+	everything := &Route{Prefix: "/", Redirect: "https://example.com"}
+	assert.Equal(t, "https://example.com/page", everything.Location("/page", ""))
+}
@@ -0,0 +1,355 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+)
+
+const (
+	OpContinuation = 0x0
+	OpText         = 0x1
+	OpBinary       = 0x2
+	OpClose        = 0x8
+	OpPing         = 0x9
+	OpPong         = 0xA
+)
+
+const (
+	CloseNormal        = 1000
+	CloseProtocolError = 1002
+	CloseTooBig        = 1009
+)
+
+// acceptGUID is the fixed GUID from RFC 6455 section 1.3 that is appended to
+// the client key when computing Sec-WebSocket-Accept.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const maxHandshakeSize = 8192
+
+// DefaultMaxMessageSize bounds reassembled messages so a peer can't make us
+// buffer an arbitrary amount of data.
+const DefaultMaxMessageSize = 1 << 20
+
+var (
+	ErrBadHandshake    = errors.New("websocket: bad handshake")
+	ErrMessageTooLarge = errors.New("websocket: message too large")
+	ErrProtocol        = errors.New("websocket: protocol error")
+)
+
+type Conn struct {
+	conn           net.Conn
+	reader         *bufio.Reader
+	isClient       bool
+	writeMu        sync.Mutex
+	closed         bool
+	MaxMessageSize int
+}
+
+// Accept performs the server side of the opening handshake. On failure an
+// HTTP error response is written.
+func Accept(conn net.Conn) (*Conn, error) {
+	reader := bufio.NewReader(conn)
+	requestLine, headers, err := readHeaders(reader)
+	if err != nil {
+		writeHandshakeError(conn, "400 Bad Request")
+		return nil, err
+	}
+
+	parts := strings.Fields(requestLine)
+	if len(parts) != 3 || parts[0] != "GET" || parts[2] != "HTTP/1.1" {
+		writeHandshakeError(conn, "400 Bad Request")
+		return nil, fmt.Errorf("%w: unexpected request line %q", ErrBadHandshake, requestLine)
+	}
+	if !headerContainsToken(headers["upgrade"], "websocket") || !headerContainsToken(headers["connection"], "upgrade") {
+		writeHandshakeError(conn, "400 Bad Request")
+		return nil, fmt.Errorf("%w: missing upgrade headers", ErrBadHandshake)
+	}
+	if headers["sec-websocket-version"] != "13" {
+		conn.Write([]byte("HTTP/1.1 426 Upgrade Required\r\nSec-WebSocket-Version: 13\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"))
+		return nil, fmt.Errorf("%w: unsupported version %q", ErrBadHandshake, headers["sec-websocket-version"])
+	}
+	key := headers["sec-websocket-key"]
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		writeHandshakeError(conn, "400 Bad Request")
+		return nil, fmt.Errorf("%w: invalid Sec-WebSocket-Key", ErrBadHandshake)
+	}
+
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + AcceptKey(key) + "\r\n\r\n"
+	if _, err := conn.Write([]byte(response)); err != nil {
+		return nil, err
+	}
+
+	return &Conn{conn: conn, reader: reader, MaxMessageSize: DefaultMaxMessageSize}, nil
+}
+
+// Client performs the client side of the opening handshake over an already
+// dialled connection.
+func Client(conn net.Conn, host string, path string) (*Conn, error) {
+	keyBytes := make([]byte, 16)
+	if _, err := rand.Read(keyBytes); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(keyBytes)
+
+	request := fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n", path, host, key)
+	if _, err := conn.Write([]byte(request)); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	statusLine, headers, err := readHeaders(reader)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(statusLine, "HTTP/1.1 101") {
+		return nil, fmt.Errorf("%w: unexpected status %q", ErrBadHandshake, statusLine)
+	}
+	if headers["sec-websocket-accept"] != AcceptKey(key) {
+		return nil, fmt.Errorf("%w: Sec-WebSocket-Accept mismatch", ErrBadHandshake)
+	}
+
+	return &Conn{conn: conn, reader: reader, isClient: true, MaxMessageSize: DefaultMaxMessageSize}, nil
+}
+
+func AcceptKey(key string) string {
+	hash := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+func readHeaders(reader *bufio.Reader) (string, map[string]string, error) {
+	firstLine := ""
+	headers := make(map[string]string)
+	size := 0
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return "", nil, err
+		}
+		size += len(line)
+		if size > maxHandshakeSize {
+			return "", nil, fmt.Errorf("%w: headers too large", ErrBadHandshake)
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			return firstLine, headers, nil
+		}
+		if firstLine == "" {
+			firstLine = line
+			continue
+		}
+
+		name, value, found := strings.Cut(line, ":")
+		if !found {
+			return "", nil, fmt.Errorf("%w: malformed header %q", ErrBadHandshake, line)
+		}
+		headers[strings.ToLower(strings.TrimSpace(name))] = strings.TrimSpace(value)
+	}
+}
+
+func headerContainsToken(value string, token string) bool {
+	for _, part := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(part), token) {
+			return true
+		}
+	}
+	return false
+}
+
+func writeHandshakeError(conn net.Conn, status string) {
+	conn.Write([]byte("HTTP/1.1 " + status + "\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"))
+}
+
+// ReadMessage returns the next complete data message. A close frame from
+// the peer is reported as io.EOF.
+func (c *Conn) ReadMessage() (int, []byte, error) {
+	messageOpcode := -1
+	var message []byte
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch opcode {
+		case OpPing:
+			if err := c.writeFrame(OpPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case OpPong:
+			continue
+		case OpClose:
+			code := CloseNormal
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload[:2]))
+			}
+			c.CloseWithCode(code, "")
+			return 0, nil, io.EOF
+		case OpContinuation:
+			if messageOpcode == -1 {
+				return 0, nil, c.fail(CloseProtocolError, ErrProtocol)
+			}
+		case OpText, OpBinary:
+			if messageOpcode != -1 {
+				return 0, nil, c.fail(CloseProtocolError, ErrProtocol)
+			}
+			messageOpcode = opcode
+		default:
+			return 0, nil, c.fail(CloseProtocolError, ErrProtocol)
+		}
+
+		if len(message)+len(payload) > c.MaxMessageSize {
+			return 0, nil, c.fail(CloseTooBig, ErrMessageTooLarge)
+		}
+		message = append(message, payload...)
+		if fin {
+			return messageOpcode, message, nil
+		}
+	}
+}
+
+func (c *Conn) readFrame() (bool, int, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		return false, 0, nil, err
+	}
+
+	fin := header[0]&0x80 != 0
+	opcode := int(header[0] & 0x0F)
+	masked := header[1]&0x80 != 0
+	if header[0]&0x70 != 0 || masked == c.isClient {
+		// RSV bits need a negotiated extension, and only clients mask.
+		return false, 0, nil, c.fail(CloseProtocolError, ErrProtocol)
+	}
+
+	length := uint64(header[1] & 0x7F)
+	isControl := opcode&0x8 != 0
+	if isControl && (length > 125 || !fin) {
+		return false, 0, nil, c.fail(CloseProtocolError, ErrProtocol)
+	}
+	switch length {
+	case 126:
+		extended := make([]byte, 2)
+		if _, err := io.ReadFull(c.reader, extended); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended))
+	case 127:
+		extended := make([]byte, 8)
+		if _, err := io.ReadFull(c.reader, extended); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(extended)
+	}
+	if length > uint64(c.MaxMessageSize) {
+		return false, 0, nil, c.fail(CloseTooBig, ErrMessageTooLarge)
+	}
+
+	var maskKey []byte
+	if masked {
+		maskKey = make([]byte, 4)
+		if _, err := io.ReadFull(c.reader, maskKey); err != nil {
+			return false, 0, nil, err
+		}
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		maskBytes(maskKey, payload)
+	}
+	return fin, opcode, payload, nil
+}
+
+func (c *Conn) WriteMessage(opcode int, data []byte) error {
+	return c.writeFrame(opcode, data)
+}
+
+func (c *Conn) writeFrame(opcode int, data []byte) error {
+	frame := []byte{0x80 | byte(opcode)}
+	maskBit := byte(0)
+	if c.isClient {
+		maskBit = 0x80
+	}
+
+	length := len(data)
+	switch {
+	case length <= 125:
+		frame = append(frame, maskBit|byte(length))
+	case length <= 0xFFFF:
+		frame = append(frame, maskBit|126, byte(length>>8), byte(length))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(length))
+	}
+
+	payload := data
+	if c.isClient {
+		maskKey := make([]byte, 4)
+		if _, err := rand.Read(maskKey); err != nil {
+			return err
+		}
+		frame = append(frame, maskKey...)
+		payload = append([]byte{}, data...)
+		maskBytes(maskKey, payload)
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	_, err := c.conn.Write(append(frame, payload...))
+	return err
+}
+
+func maskBytes(maskKey []byte, payload []byte) {
+	for i := range payload {
+		payload[i] ^= maskKey[i%4]
+	}
+}
+
+// CloseWithCode sends a close frame with the given status code and closes the
+// underlying connection. Calling it more than once is harmless.
+func (c *Conn) CloseWithCode(code int, reason string) error {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	payload = append(payload, reason...)
+	c.writeFrame(OpClose, payload)
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.conn.Close()
+}
+
+func (c *Conn) Close() error {
+	return c.CloseWithCode(CloseNormal, "")
+}
+
+func (c *Conn) fail(code int, err error) error {
+	c.CloseWithCode(code, err.Error())
+	return err
+}
+
+func (c *Conn) NetConn() net.Conn {
+	return c.conn
+}
@@ -0,0 +1,141 @@
+package websocket
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAcceptKey(t *testing.T) {
+	// Example from RFC 6455 section 1.3
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", AcceptKey("dGhlIHNhbXBsZSBub25jZQ=="))
+}
+
+func TestHandshakeAndEcho(t *testing.T) {
+	assert := assert.New(t)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		ws, err := Accept(server)
+		if !assert.NoError(err, "Accept failed") {
+			return
+		}
+		opcode, message, err := ws.ReadMessage()
+		if !assert.NoError(err, "Server ReadMessage failed") {
+			return
+		}
+		assert.NoError(ws.WriteMessage(opcode, message), "Server WriteMessage failed")
+	}()
+
+	ws, err := Client(client, "localhost", "/")
+	assert.NoError(err, "Client handshake failed")
+
+	go ws.WriteMessage(OpText, []byte(`{"MsgType":"hello","Nick":"alice"}`))
+	opcode, message, err := ws.ReadMessage()
+	assert.NoError(err, "Client ReadMessage failed")
+	assert.Equal(OpText, opcode)
+	assert.Equal(`{"MsgType":"hello","Nick":"alice"}`, string(message))
+}
+
+func TestReadFragmentedMessageWithPing(t *testing.T) {
+	assert := assert.New(t)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	ws := &Conn{conn: server, reader: bufio.NewReader(server), MaxMessageSize: DefaultMaxMessageSize}
+
+	go func() {
+		client.Write(maskedFrame(false, OpText, []byte("Hel")))
+		client.Write(maskedFrame(true, OpPing, []byte("hb")))
+		// Drain the pong the server writes back before sending the rest.
+		pong := make([]byte, 4)
+		io.ReadFull(client, pong)
+		assert.Equal([]byte{0x80 | OpPong, 2, 'h', 'b'}, pong, "Expected an unmasked pong echoing the ping payload")
+		client.Write(maskedFrame(true, OpContinuation, []byte("lo!")))
+	}()
+
+	opcode, message, err := ws.ReadMessage()
+	assert.NoError(err, "ReadMessage failed")
+	assert.Equal(OpText, opcode)
+	assert.Equal("Hello!", string(message))
+}
+
+func TestReadRejectsUnmaskedClientFrame(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	ws := &Conn{conn: server, reader: bufio.NewReader(server), MaxMessageSize: DefaultMaxMessageSize}
+
+	go func() {
+		client.Write([]byte{0x80 | OpText, 2, 'h', 'i'})
+		io.Copy(io.Discard, client)
+	}()
+
+	_, _, err := ws.ReadMessage()
+	assert.ErrorIs(t, err, ErrProtocol, "Expected unmasked client frames to be rejected")
+}
+
+func TestReadRejectsOversizedMessage(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	ws := &Conn{conn: server, reader: bufio.NewReader(server), MaxMessageSize: 4}
+
+	go func() {
+		client.Write(maskedFrame(true, OpText, []byte("too long")))
+		io.Copy(io.Discard, client)
+	}()
+
+	_, _, err := ws.ReadMessage()
+	assert.ErrorIs(t, err, ErrMessageTooLarge)
+}
+
+func TestReadCloseFrameReturnsEOF(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	ws := &Conn{conn: server, reader: bufio.NewReader(server), MaxMessageSize: DefaultMaxMessageSize}
+
+	go func() {
+		client.Write(maskedFrame(true, OpClose, []byte{0x03, 0xE8}))
+		io.Copy(io.Discard, client)
+	}()
+
+	_, _, err := ws.ReadMessage()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestAcceptRejectsMissingKey(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	go func() {
+		client.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+	}()
+	go func() {
+		_, err := Accept(server)
+		assert.ErrorIs(t, err, ErrBadHandshake)
+		server.Close()
+	}()
+
+	response, _ := io.ReadAll(client)
+	assert.True(t, strings.HasPrefix(string(response), "HTTP/1.1 400 Bad Request"), "Expected a 400 response")
+}
+
+func maskedFrame(fin bool, opcode int, payload []byte) []byte {
+	first := byte(opcode)
+	if fin {
+		first |= 0x80
+	}
+	maskKey := []byte{1, 2, 3, 4}
+	masked := append([]byte{}, payload...)
+	maskBytes(maskKey, masked)
+
+	frame := []byte{first, 0x80 | byte(len(payload))}
+	frame = append(frame, maskKey...)
+	return append(frame, masked...)
+}